@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/vnblr/backend/com/commute"
 	"net/http"
@@ -8,12 +9,108 @@ import (
 
 //package cmd/main is the entry point to run as a http container.
 func main() {
+	serviceAreaFile := flag.String("servicearea", "", "GeoJSON file with the polygons we serve. Empty means serve everywhere.")
+	noPickupFile := flag.String("nopickup", "", "GeoJSON file with the polygons where joins are not allowed.")
+	faresFile := flag.String("fares", "", "json file with the per km rates by vehicle type. Empty means defaults.")
+	tenantsFile := flag.String("tenants", "", "json file with the tenants, their hosts, limits and fares. Empty means a single tenant.")
+	eventLogDir := flag.String("eventlog", "", "Directory to keep the event log in. Empty means no event log.")
+	eventLogSize := flag.Int64("eventlogsize", 64, "Size in MB at which the event log moves to a new file.")
+	eventLogFiles := flag.Int("eventlogfiles", 10, "How many event log files to keep.")
+	rateLimitsFile := flag.String("ratelimits", "", "json file with the rate limits. Empty means defaults.")
+	trustedProxies := flag.String("trustedproxies", "", "Comma separated IPs/CIDRs of our proxies. X-Forwarded-For is believed only from these.")
+	rateLimitLegacy := flag.Bool("ratelimitlegacy", false, "Answer throttled requests with 200 and the error string instead of 429.")
+	verifyDrivers := flag.Bool("verifydrivers", true, "Only drivers an admin approved can drive. Turn off only to try things out.")
+	openLogin := flag.Bool("openlogin", false, "Let login create users without verifying a phone number. Anyone can log in as anyone.")
+	smsGateway := flag.String("smsgateway", "", "URL of the SMS gateway. Verification codes are posted here as phone and message.")
+	signingKeysFile := flag.String("signingkeys", "", "json file with the token signing keys. Empty means a random key, good for one instance only.")
+	emailGateway := flag.String("emailgateway", "", "URL of the email gateway. Codes to join an organisation are posted here as contact and message.")
+	shareURL := flag.String("shareurl", "", "Where /commute/share is reachable from outside, for the links sent to emergency contacts.")
+	blobDir := flag.String("blobdir", "blobs", "Directory to keep uploads, like driver documents, in.")
+	batchInterval := flag.Duration("batchmatch", 0, "How often to run the batch matcher, eg: 30s. 0 means off.")
+	flag.Parse()
+
 	fmt.Println("MapsBackend : entry point start.")
 
 	commute.Initialize()
 
+	if err := commute.LoadGeofences(*serviceAreaFile, *noPickupFile); err != nil {
+		fmt.Println("MapsBackend : could not load geofences :", err)
+		return
+	}
+	if err := commute.LoadFareRates(*faresFile); err != nil {
+		fmt.Println("MapsBackend : could not load fares :", err)
+		return
+	}
+	if err := commute.LoadTenants(*tenantsFile); err != nil {
+		fmt.Println("MapsBackend : could not load tenants :", err)
+		return
+	}
+	if err := commute.LoadRateLimits(*rateLimitsFile); err != nil {
+		fmt.Println("MapsBackend : could not load rate limits :", err)
+		return
+	}
+	if err := commute.SetTrustedProxies(*trustedProxies); err != nil {
+		fmt.Println("MapsBackend : could not set trusted proxies :", err)
+		return
+	}
+	commute.SetRateLimitLegacy(*rateLimitLegacy)
+	if !*openLogin && *smsGateway == "" {
+		fmt.Println("MapsBackend : -smsgateway is needed to verify users. Or run with -openlogin.")
+		return
+	}
+	commute.SetOpenLogin(*openLogin)
+	commute.SetDriverVerification(*verifyDrivers)
+	if *smsGateway != "" {
+		commute.SetSMSSender(commute.NewHTTPSMSSender(*smsGateway))
+	}
+	if err := commute.LoadSigningKeys(*signingKeysFile); err != nil {
+		fmt.Println("MapsBackend : could not load signing keys :", err)
+		return
+	}
+	blobs, err := commute.NewFileBlobStore(*blobDir)
+	if err != nil {
+		fmt.Println("MapsBackend : could not open blob store :", err)
+		return
+	}
+	commute.SetBlobStore(blobs)
+	commute.SetShareBaseURL(*shareURL)
+	if *emailGateway != "" {
+		commute.SetEmailNotifier(commute.NewHTTPNotifier(*emailGateway))
+	}
+	if err := commute.SetEventLog(*eventLogDir, *eventLogSize<<20, *eventLogFiles); err != nil {
+		fmt.Println("MapsBackend : could not open event log :", err)
+		return
+	}
+	commute.StartScheduler()
+	commute.StartBatchMatcher(*batchInterval)
+
+	http.HandleFunc("/commute/geofence/reload", commute.GeofenceReloadHandler)
+	http.HandleFunc("/commute/auth", commute.AuthHandler) //Does its own rate limiting, by action
+	http.HandleFunc("/commute/admin/keys/reload", commute.SigningKeysReloadHandler)
+	http.HandleFunc("/commute/trips", commute.RateLimited(commute.TripHistoryHandler))
+	http.HandleFunc("/commute/rate", commute.RateLimited(commute.RateHandler))
+	http.HandleFunc("/commute/admin/abusereports", commute.AbuseReportsHandler)
+	http.HandleFunc("/commute/wallet", commute.RateLimited(commute.WalletHandler))
+	http.HandleFunc("/commute/admin/wallet", commute.WalletAdminHandler)
+	http.HandleFunc("/commute/schedule", commute.RateLimited(commute.ScheduleHandler))
+	http.HandleFunc("/commute/demandhint", commute.RateLimited(commute.DemandHintHandler))
+	http.HandleFunc("/commute/admin/heatmap", commute.HeatmapHandler)
+	http.HandleFunc("/commute/admin/events", commute.EventExportHandler)
+	http.HandleFunc("/commute/admin/ratelimits", commute.RateLimitStatsHandler)
+	http.HandleFunc("/commute/admin/roles", commute.RolesHandler)
+	http.HandleFunc("/commute/driver/onboarding", commute.RateLimited(commute.DriverOnboardingHandler))
+	http.HandleFunc("/commute/admin/drivers", commute.DriverVerificationAdminHandler)
+	http.HandleFunc("/commute/safety", commute.RateLimited(commute.SafetyHandler))
+	http.HandleFunc("/commute/share", commute.RateLimited(commute.ShareHandler))
+	http.HandleFunc("/commute/admin/sos", commute.SOSAdminHandler)
+	http.HandleFunc("/commute/org", commute.RateLimited(commute.OrgHandler))
+	http.HandleFunc("/commute/admin/orgs", commute.OrgAdminHandler)
+	http.HandleFunc("/commute/admin/tenants", commute.TenantStatsHandler)
+	http.HandleFunc("/commute/profile", commute.RateLimited(commute.ProfileHandler))
+	http.HandleFunc("/commute/trail", commute.RateLimited(commute.TrailHandler))
+	http.HandleFunc("/commute/admin/profiles", commute.ProfileAdminHandler)
 	http.HandleFunc("/", commute.Handler)
-	http.ListenAndServe(":8080", nil)
+	http.ListenAndServe(":8080", commute.TenantRouter(http.DefaultServeMux))
 
 	fmt.Println("MapsBackend : Done launching server at 8080")
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/vnblr/backend/com/commute"
+	"os"
+	"strconv"
+	"time"
+)
+
+//package cmd/replay feeds a recorded event log or request log through the commute package on the recorded
+//clock, and shows where the responses differ from what was recorded. Run with the same config as the server.
+func main() {
+	eventsDir := flag.String("events", "", "Event log directory to replay.")
+	requestsFile := flag.String("requests", "", "Server output with the request log lines to replay.")
+	until := flag.String("until", "", "Stop at this time. RFC3339 or unix seconds. Empty means replay everything.")
+	showState := flag.Bool("state", false, "Print the state of every user at the end.")
+	verbose := flag.Bool("v", false, "Print every response, not just the ones that differ.")
+	serviceAreaFile := flag.String("servicearea", "", "GeoJSON file with the polygons we serve, as given to the server.")
+	noPickupFile := flag.String("nopickup", "", "GeoJSON file with the no pickup zones, as given to the server.")
+	faresFile := flag.String("fares", "", "json file with the fares, as given to the server.")
+	tenantsFile := flag.String("tenants", "", "json file with the tenants, as given to the server.")
+	flag.Parse()
+
+	if (*eventsDir == "") == (*requestsFile == "") {
+		fmt.Println("Replay : give one of -events or -requests")
+		os.Exit(2)
+	}
+	var stopAt time.Time
+	if *until != "" {
+		var err error
+		if stopAt, err = parseUntil(*until); err != nil {
+			fmt.Println("Replay : bad -until :", err)
+			os.Exit(2)
+		}
+	}
+
+	r := commute.NewReplayer()
+	defer r.Close()
+	if err := commute.LoadGeofences(*serviceAreaFile, *noPickupFile); err != nil {
+		fmt.Println("Replay : could not load geofences :", err)
+		os.Exit(2)
+	}
+	if err := commute.LoadFareRates(*faresFile); err != nil {
+		fmt.Println("Replay : could not load fares :", err)
+		os.Exit(2)
+	}
+	if err := commute.LoadTenants(*tenantsFile); err != nil {
+		fmt.Println("Replay : could not load tenants :", err)
+		os.Exit(2)
+	}
+
+	total, diffs := 0, 0
+	compare := func(label string, t time.Time, recordedResp string, recordedErr string, resp string, err error) {
+		total++
+		errStr := ""
+		if err != nil {
+			errStr = err.Error()
+		}
+		if resp == recordedResp && errStr == recordedErr {
+			if *verbose {
+				fmt.Printf("    %s %s\n      %s\n", t.Format(time.RFC3339Nano), label, resp)
+			}
+			return
+		}
+		diffs++
+		fmt.Printf("--- %s %s\n", t.Format(time.RFC3339Nano), label)
+		fmt.Printf("-   recorded: %s %s\n", recordedResp, recordedErr)
+		fmt.Printf("+   replayed: %s %s\n", resp, errStr)
+	}
+	stopped := func(t time.Time) bool {
+		return !stopAt.IsZero() && t.After(stopAt)
+	}
+
+	var err error
+	if *eventsDir != "" {
+		errStop := errors.New("stop")
+		err = commute.ReadEventLog(*eventsDir, func(e *commute.CommuteEvent) error {
+			t := time.Unix(0, e.Time)
+			if stopped(t) {
+				return errStop
+			}
+			resp, replayErr := r.ReplayEvent(e)
+			compare(fmt.Sprintf("#%d %s event:%d other:%s", e.Seq, e.User, e.Event, e.Other), t, e.Response, e.Error,
+				resp, replayErr)
+			return nil
+		})
+		if err == errStop {
+			err = nil
+		}
+	} else {
+		err = replayRequests(*requestsFile, r, stopped, compare)
+	}
+	if err != nil {
+		fmt.Println("Replay : ERROR :", err)
+		os.Exit(2)
+	}
+
+	if *showState {
+		fmt.Println("State at the end:")
+		commute.DumpState(os.Stdout)
+	}
+	fmt.Printf("Replay : %d requests, %d differ\n", total, diffs)
+	if diffs != 0 {
+		os.Exit(1)
+	}
+}
+
+func replayRequests(path string, r *commute.Replayer, stopped func(time.Time) bool,
+	compare func(string, time.Time, string, string, string, error)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for scanner.Scan() {
+		req, err := commute.ParseRequestLine(scanner.Text())
+		if err != nil {
+			continue //Stats and the like, also go to the same output
+		}
+		if stopped(req.Time) {
+			break
+		}
+		resp, replayErr := r.ReplayRequest(req)
+		compare(fmt.Sprintf("%s %s", req.User, req.RawQuery), req.Time, req.Response, req.Error, resp, replayErr)
+	}
+	return scanner.Err()
+}
+
+func parseUntil(s string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
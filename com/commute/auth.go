@@ -0,0 +1,316 @@
+package commute
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Accounts are tied to a phone number. A one time code goes out over SMS, and only once the code comes back
+//does the user get a token. Login then needs that token; it no longer hands one out to whoever asks.
+const OTP_DIGITS = 6
+const OTP_TTL = 5 * time.Minute
+const OTP_MAX_ATTEMPTS = 5              //Wrong codes allowed before the code is thrown away
+const OTP_RESEND_GAP = 30 * time.Second //Min gap between two codes to the same user
+
+//Store buckets used by accounts
+const bucketAccounts = "accounts" //user -> account
+const bucketPhones = "phones"     //phone -> user. One account per number in each tenant. See phoneKey
+
+//SMSSender delivers verification codes. Plug in the gateway with SetSMSSender.
+type SMSSender interface {
+	Send(phone string, message string) error
+}
+
+type account struct {
+	User     string `json:"user"`
+	Phone    string `json:"phone"`
+	Created  int64  `json:"created"`
+	Verified int64  `json:"verified"` //Last time a code was verified
+}
+
+//otpChallenge is a code sent out and not yet verified. Only the hash is kept.
+type otpChallenge struct {
+	phone    string
+	codeHash []byte
+	sent     time.Time
+	attempts int
+}
+
+var gOTPs map[string]*otpChallenge //By user
+var gSMSSender SMSSender
+var gOpenLogin bool //Old behaviour: login creates the user and hands out a token, no questions asked.
+var gAuthLock = sync.Mutex{}
+
+func resetAuth() {
+	gAuthLock.Lock()
+	defer gAuthLock.Unlock()
+	gOTPs = make(map[string]*otpChallenge)
+	gSMSSender = noSMSSender{}
+	//Open unless the server asks otherwise (see cmd), so that tests and replays can log in directly.
+	gOpenLogin = true
+}
+
+//SetSMSSender makes the package send codes through s. Returns the sender it replaces, to put back later.
+func SetSMSSender(s SMSSender) SMSSender {
+	gAuthLock.Lock()
+	defer gAuthLock.Unlock()
+	prev := gSMSSender
+	gSMSSender = s
+	return prev
+}
+
+//SetOpenLogin false makes login need the token got by verifying the phone number.
+func SetOpenLogin(open bool) {
+	gAuthLock.Lock()
+	defer gAuthLock.Unlock()
+	gOpenLogin = open
+}
+
+func isOpenLogin() bool {
+	gAuthLock.Lock()
+	defer gAuthLock.Unlock()
+	return gOpenLogin
+}
+
+//Phone numbers in E.164, eg: +919876543210. Spaces and dashes are dropped.
+func normalizePhone(phone string) (string, error) {
+	phone = strings.NewReplacer(" ", "", "-", "").Replace(phone)
+	if len(phone) < 9 || len(phone) > 16 || phone[0] != '+' || phone[1] == '0' {
+		return "", errors.New(fmt.Sprintf("Invalid phone number:%s", phone))
+	}
+	for _, c := range phone[1:] {
+		if c < '0' || c > '9' {
+			return "", errors.New(fmt.Sprintf("Invalid phone number:%s", phone))
+		}
+	}
+	return phone, nil
+}
+
+func hashCode(userName string, code string) []byte {
+	h := sha256.Sum256([]byte(userName + ":" + code))
+	return h[:]
+}
+
+//sendCode sends a fresh code to the phone. For a user who already has an account it has to be their number.
+func sendCode(userName string, phone string) error {
+	if userName == "" {
+		return errors.New("ERROR in user parameter")
+	}
+	phone, err := normalizePhone(phone)
+	if err != nil {
+		return err
+	}
+	var acct account
+	if err = storeGetJSON(bucketAccounts, userName, &acct); err == nil && acct.Phone != phone {
+		return errors.New(fmt.Sprintf("User %s is registered with another phone number", userName))
+	}
+	var owner string
+	if err = storeGetJSON(bucketPhones, phoneKey(userName, phone), &owner); err == nil && owner != userName {
+		return errors.New(fmt.Sprintf("Phone number %s is registered with another user", phone))
+	}
+
+	now := clockNow()
+	code := randCode(OTP_DIGITS)
+	ch := &otpChallenge{phone: phone, codeHash: hashCode(userName, code), sent: now}
+	gAuthLock.Lock()
+	if prev, ok := gOTPs[userName]; ok && now.Sub(prev.sent) < OTP_RESEND_GAP {
+		gAuthLock.Unlock()
+		return errors.New(fmt.Sprintf("Code already sent. Try again in %d secs",
+			int((OTP_RESEND_GAP-now.Sub(prev.sent)).Seconds())+1))
+	}
+	gOTPs[userName] = ch
+	sender := gSMSSender
+	gAuthLock.Unlock()
+
+	//Gateway can be slow, so not under the lock.
+	msg := fmt.Sprintf("%s is your verification code. It is valid for %d minutes.", code, int(OTP_TTL.Minutes()))
+	if err = sender.Send(phone, msg); err != nil {
+		gAuthLock.Lock()
+		if gOTPs[userName] == ch {
+			delete(gOTPs, userName)
+		}
+		gAuthLock.Unlock()
+		return errors.New(fmt.Sprintf("Could not send the code:%s", err.Error()))
+	}
+	return nil
+}
+
+//verifyCode checks the code sent to the user. On success the account is saved and a new access token and
+//refresh token handed out for a new session on the device. Role is the mode the app starts in, 0 if it does
+//not know yet.
+func verifyCode(userName string, code string, role int, device string, userAgent string) (string, string, error) {
+	now := clockNow()
+	gAuthLock.Lock()
+	ch, ok := gOTPs[userName]
+	if !ok {
+		gAuthLock.Unlock()
+		return "", "", errors.New("No code pending. Ask for a code first")
+	}
+	if now.Sub(ch.sent) > OTP_TTL {
+		delete(gOTPs, userName)
+		gAuthLock.Unlock()
+		return "", "", errors.New("Code expired. Ask for a new one")
+	}
+	if subtle.ConstantTimeCompare(ch.codeHash, hashCode(userName, code)) != 1 {
+		ch.attempts++
+		left := OTP_MAX_ATTEMPTS - ch.attempts
+		if left <= 0 {
+			delete(gOTPs, userName)
+			gAuthLock.Unlock()
+			return "", "", errors.New("Too many wrong codes. Ask for a new one")
+		}
+		gAuthLock.Unlock()
+		return "", "", errors.New(fmt.Sprintf("Wrong code. %d attempts left", left))
+	}
+	delete(gOTPs, userName)
+	gAuthLock.Unlock()
+
+	//Someone else may have verified the same number in the meantime.
+	var owner string
+	if err := storeGetJSON(bucketPhones, phoneKey(userName, ch.phone), &owner); err == nil && owner != userName {
+		return "", "", errors.New(fmt.Sprintf("Phone number %s is registered with another user", ch.phone))
+	}
+	acct := account{User: userName, Phone: ch.phone, Created: now.Unix()}
+	storeGetJSON(bucketAccounts, userName, &acct)
+	acct.Verified = now.Unix()
+	if err := storePutJSON(bucketAccounts, userName, acct); err != nil {
+		return "", "", err
+	}
+	if err := storePutJSON(bucketPhones, phoneKey(userName, ch.phone), userName); err != nil {
+		return "", "", err
+	}
+	s, err := startSession(userName, role, device, userAgent, REFRESH_TOKEN_TTL)
+	if err != nil {
+		return "", "", err
+	}
+	refresh, err := issueRefreshToken(s)
+	if err != nil {
+		return "", "", err
+	}
+	return sessionToken(s), refresh, nil
+}
+
+func processAuthRequest(userName string, action string, phone string, code string, mode string,
+	refresh string, device string, userAgent string) (string, error) {
+	switch action {
+	case "sendcode":
+		if err := sendCode(userName, phone); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("codesent,%d", int(OTP_TTL.Seconds())), nil
+	case "verify":
+		role, err := parseIntParam(mode, 0)
+		if err != nil || (role != 0 && role != RIDER_STATE && role != DRIVER_STATE) {
+			return "", errors.New(fmt.Sprintf("ERROR in mode parameter:%s", mode))
+		}
+		access, newRefresh, err := verifyCode(userName, code, role, device, userAgent)
+		if err != nil {
+			return "", err
+		}
+		return tokensPayload(access, newRefresh), nil
+	case "refresh":
+		access, newRefresh, err := refreshSession(refresh)
+		if err != nil {
+			return "", err
+		}
+		return tokensPayload(access, newRefresh), nil
+	}
+	return "", errors.New(fmt.Sprintf("ERROR in action parameter:%s", action))
+}
+
+//Function AuthHandler registers and verifies users. Params are user and action, one of sendcode with phone,
+//verify with code and optionally mode and device, or refresh with refresh. verify and refresh return a token pair.
+func AuthHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	user := q.Get("user")
+	action := q.Get("action")
+	if ok, rule := allowAuthRequest(user, clientIP(r), action); !ok {
+		rejectRateLimited(w)
+		fmt.Println(clockNow(), "\t", user, "\t", r.RemoteAddr, "\t", "auth", "\t", action, "\t", "throttled by "+rule)
+		return
+	}
+	retValue, err := processAuthRequest(user, action, q.Get("phone"), q.Get("code"), q.Get("mode"),
+		q.Get("refresh"), q.Get("device"), r.Header.Get("User-Agent"))
+	if err != nil {
+		fmt.Fprint(w, "ERROR! :", err)
+	} else {
+		fmt.Fprint(w, retValue)
+	}
+	//No query here. It has the code or refresh token in it.
+	fmt.Println(clockNow(), "\t", user, "\t", r.RemoteAddr, "\t", "auth", "\t", action, "\t", err)
+}
+
+//noSMSSender is there till a gateway is plugged in.
+type noSMSSender struct{}
+
+func (noSMSSender) Send(phone string, message string) error {
+	return errors.New("no SMS gateway configured")
+}
+
+//HTTPSMSSender posts phone and message as a form to an SMS gateway.
+type HTTPSMSSender struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewHTTPSMSSender(gatewayURL string) *HTTPSMSSender {
+	return &HTTPSMSSender{URL: gatewayURL, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (s *HTTPSMSSender) Send(phone string, message string) error {
+	form := url.Values{"phone": {phone}, "message": {message}}
+	resp, err := s.Client.Post(s.URL, "application/x-www-form-urlencoded", bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New(fmt.Sprintf("SMS gateway said %s", resp.Status))
+	}
+	return nil
+}
+
+//FakeSMSSender keeps messages instead of sending them. For tests and local runs.
+type FakeSMSSender struct {
+	lock     sync.Mutex
+	messages map[string][]string
+	Fail     error //Returned by Send when set
+}
+
+func NewFakeSMSSender() *FakeSMSSender {
+	return &FakeSMSSender{messages: make(map[string][]string)}
+}
+
+func (s *FakeSMSSender) Send(phone string, message string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.Fail != nil {
+		return s.Fail
+	}
+	s.messages[phone] = append(s.messages[phone], message)
+	return nil
+}
+
+//Messages sent to the phone, oldest first.
+func (s *FakeSMSSender) Messages(phone string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.messages[phone]...)
+}
+
+//LastCode is the code in the latest message to the phone. Empty if none.
+func (s *FakeSMSSender) LastCode(phone string) string {
+	msgs := s.Messages(phone)
+	if len(msgs) == 0 {
+		return ""
+	}
+	return strings.Fields(msgs[len(msgs)-1])[0]
+}
@@ -0,0 +1,186 @@
+package commute
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Sets up closed login with a fake SMS gateway and a fake clock. Call the returned func when done.
+func newTestAuth() (*FakeSMSSender, *FakeClock, func()) {
+	Initialize()
+	SetOpenLogin(false)
+	SetDriverVerification(true)
+	sms := NewFakeSMSSender()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC))
+	prevSMS := SetSMSSender(sms)
+	prevClock := SetClock(clock)
+	return sms, clock, func() {
+		SetSMSSender(prevSMS)
+		SetClock(prevClock)
+	}
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	sms, _, done := newTestAuth()
+	defer done()
+
+	//No token, no login
+	if _, err := updateState("rider1", 12.884800, 77.551600, "", RIDER_STATE, "", EVENT_LOGIN); err == nil {
+		t.Errorf("login without verifying went through")
+	}
+	if _, err := processAuthRequest("rider1", "sendcode", "+91 98765-43210", "", "", "", "", ""); err != nil {
+		t.Fatalf("sendcode failed:%s", err.Error())
+	}
+	code := sms.LastCode("+919876543210")
+	if len(code) != OTP_DIGITS {
+		t.Fatalf("no code sent:%v", sms.Messages("+919876543210"))
+	}
+	retStr, err := processAuthRequest("rider1", "verify", "", code, "", "", "", "")
+	fields := strings.Split(retStr, ",")
+	if err != nil || len(fields) != 4 || fields[0] != "tokens" {
+		t.Fatalf("verify failed. ret:%s err:%v", retStr, err)
+	}
+	token, err := updateState("rider1", 12.884800, 77.551600, fields[1], RIDER_STATE, "", EVENT_LOGIN)
+	if err != nil || token == "" {
+		t.Errorf("login with the verified token failed:%v", err)
+	}
+	if _, err = updateState("rider1", 12.884800, 77.551600, token, RIDER_STATE, "", EVENT_HEARTBEAT); err != nil {
+		t.Errorf("heartbeat failed:%s", err.Error())
+	}
+	//Code is good only once
+	if _, err = processAuthRequest("rider1", "verify", "", code, "", "", "", ""); err == nil {
+		t.Errorf("code verified twice")
+	}
+	//Logging in again does not hand out the token
+	if retStr, err = updateState("rider1", 12.884800, 77.551600, "", RIDER_STATE, "", EVENT_LOGIN); err == nil || retStr == token {
+		t.Errorf("token handed out again:%s", retStr)
+	}
+}
+
+func TestVerifyLimits(t *testing.T) {
+	sms, clock, done := newTestAuth()
+	defer done()
+	phone := "+919876543210"
+
+	//Expiry
+	sendCode("rider1", phone)
+	clock.Advance(OTP_TTL + time.Second)
+	if _, _, err := verifyCode("rider1", sms.LastCode(phone), 0, "", ""); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("expired code accepted:%v", err)
+	}
+
+	//Attempts. The right code does not help after too many wrong ones.
+	sendCode("rider1", phone)
+	for i := 1; i <= OTP_MAX_ATTEMPTS; i++ {
+		if _, _, err := verifyCode("rider1", "wrong", 0, "", ""); err == nil {
+			t.Errorf("test case #%d: wrong code accepted", i)
+		}
+	}
+	if _, _, err := verifyCode("rider1", sms.LastCode(phone), 0, "", ""); err == nil {
+		t.Errorf("code accepted after too many attempts")
+	}
+
+	//Resend gap
+	clock.Advance(OTP_RESEND_GAP)
+	if err := sendCode("rider1", phone); err != nil {
+		t.Errorf("sendcode failed:%s", err.Error())
+	}
+	if err := sendCode("rider1", phone); err == nil {
+		t.Errorf("second code sent straight away")
+	}
+	clock.Advance(OTP_RESEND_GAP)
+	if err := sendCode("rider1", phone); err != nil {
+		t.Errorf("sendcode after the gap failed:%s", err.Error())
+	}
+	//Only the latest code works
+	if _, _, err := verifyCode("rider1", sms.LastCode(phone), 0, "", ""); err != nil {
+		t.Errorf("latest code rejected:%s", err.Error())
+	}
+}
+
+func TestPhoneOwnership(t *testing.T) {
+	sms, clock, done := newTestAuth()
+	defer done()
+
+	register := func(user string, phone string) error {
+		if err := sendCode(user, phone); err != nil {
+			return err
+		}
+		_, _, err := verifyCode(user, sms.LastCode(phone), 0, "", "")
+		return err
+	}
+	cases := []struct {
+		user     string
+		phone    string
+		expected bool
+	}{
+		{"rider1", "+919876543210", true},
+		{"rider1", "+919876543210", true},  //Login on a new phone, same number
+		{"rider2", "+919876543210", false}, //Number taken
+		{"rider1", "+919876543211", false}, //Not rider1's number
+		{"rider2", "+919876543211", true},
+		{"rider3", "9876543212", false}, //Not E.164
+		{"rider3", "+91987654321a", false},
+		{"", "+919876543212", false},
+	}
+	for idx, c := range cases {
+		clock.Advance(OTP_RESEND_GAP)
+		if err := register(c.user, c.phone); (err == nil) != c.expected {
+			t.Errorf("test case #%d: err = %v", idx, err)
+		}
+	}
+
+	//Gateway down
+	sms.Fail = errors.New("gateway down")
+	clock.Advance(OTP_RESEND_GAP)
+	if err := sendCode("rider1", "+919876543210"); err == nil {
+		t.Errorf("send error not returned")
+	}
+	sms.Fail = nil
+	if err := sendCode("rider1", "+919876543210"); err != nil {
+		t.Errorf("failed send held up the next one:%s", err.Error())
+	}
+}
+
+//Old apps and tests: login hands out a token. A second login gets a new one instead of the live one.
+func TestOpenLogin(t *testing.T) {
+	Initialize()
+	token1, _ := updateState("rider1", 12.884800, 77.551600, "", RIDER_STATE, "", EVENT_LOGIN)
+	token2, _ := updateState("rider1", 12.884800, 77.551600, "", RIDER_STATE, "", EVENT_LOGIN)
+	if token1 == token2 {
+		t.Errorf("second login got the live token")
+	}
+}
+
+func TestAuthHandler(t *testing.T) {
+	sms, _, done := newTestAuth()
+	defer done()
+
+	resp := httptest.NewRecorder()
+	AuthHandler(resp, httptest.NewRequest("GET", "/commute/auth?user=rider1&action=sendcode&phone=%2B919876543210", nil))
+	if resp.Body.String() != "codesent,300" {
+		t.Errorf("sendcode got:%s", resp.Body.String())
+	}
+	resp = httptest.NewRecorder()
+	AuthHandler(resp, httptest.NewRequest("GET", "/commute/auth?user=rider1&action=verify&code="+sms.LastCode("+919876543210"), nil))
+	if !strings.HasPrefix(resp.Body.String(), "tokens,"+getToken("rider1")+",") {
+		t.Errorf("verify got:%s", resp.Body.String())
+	}
+
+	//Codes cost money. Same user, many numbers.
+	passed := 0
+	for i := 0; i < 10; i++ {
+		resp = httptest.NewRecorder()
+		AuthHandler(resp, httptest.NewRequest("GET", "/commute/auth?user=rider9&action=sendcode&phone=%2B91987654320"+string('0'+rune(i)), nil))
+		if resp.Code != http.StatusTooManyRequests {
+			passed++
+		}
+	}
+	if passed != 3 {
+		t.Errorf("%d requests let through, expected the burst of 3", passed)
+	}
+}
@@ -0,0 +1,302 @@
+package commute
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+//The batch matcher looks at every rider who is still looking and every driver with a free seat, and finds the
+//assignment that matches the most riders at the least total cost. Riders left to themselves race each other
+//to the same nearby drivers; this spreads them out.
+const BATCH_STALE_SECS = 300      //Users not heard from in this long are not matched
+const BATCH_DETOUR_METRES = 300   //Cost of each extra stop a driver makes. Spreads riders across drivers.
+const BATCH_NO_EDGE float64 = 1e9 //Cost of an assignment that is not allowed
+
+//Seats a driver can offer, by vehicle type.
+var vehicleSeats = map[int]int{VEHICLE_BIKE: 1, VEHICLE_CAR: 4, VEHICLE_SUV: 6}
+
+func seatsFor(vehicleType int) int {
+	if s, ok := vehicleSeats[vehicleType]; ok {
+		return s
+	}
+	return vehicleSeats[VEHICLE_CAR]
+}
+
+//batchProposal is one rider assigned to one driver.
+type batchProposal struct {
+	rider  string
+	driver string
+	dist   float64
+}
+
+//hungarian solves the square assignment problem on cost and returns, for every row, the column it gets.
+//The classic O(n^3) version with row and column potentials.
+func hungarian(cost [][]float64) []int {
+	n := len(cost)
+	u := make([]float64, n+1)
+	v := make([]float64, n+1)
+	p := make([]int, n+1) //p[col] is the row assigned to col. 1 based, 0 is the dummy.
+	way := make([]int, n+1)
+	for i := 1; i <= n; i++ {
+		p[0] = i
+		j0 := 0
+		minv := make([]float64, n+1)
+		used := make([]bool, n+1)
+		for j := range minv {
+			minv[j] = math.Inf(1)
+		}
+		for {
+			used[j0] = true
+			i0 := p[j0]
+			delta := math.Inf(1)
+			j1 := 0
+			for j := 1; j <= n; j++ {
+				if used[j] {
+					continue
+				}
+				cur := cost[i0-1][j-1] - u[i0] - v[j]
+				if cur < minv[j] {
+					minv[j] = cur
+					way[j] = j0
+				}
+				if minv[j] < delta {
+					delta = minv[j]
+					j1 = j
+				}
+			}
+			for j := 0; j <= n; j++ {
+				if used[j] {
+					u[p[j]] += delta
+					v[j] -= delta
+				} else {
+					minv[j] -= delta
+				}
+			}
+			j0 = j1
+			if p[j0] == 0 {
+				break
+			}
+		}
+		for j0 != 0 {
+			j1 := way[j0]
+			p[j0] = p[j1]
+			j0 = j1
+		}
+	}
+	assignment := make([]int, n)
+	for j := 1; j <= n; j++ {
+		if p[j] != 0 {
+			assignment[p[j]-1] = j - 1
+		}
+	}
+	return assignment
+}
+
+//Callers hold gStateLock. A rider is looking if not already with a driver and heard from recently.
+func isBatchRider(s *CommState, now int64) bool {
+	return s.driverOrRider == RIDER_STATE && len(s.arrConnectedWith) == 0 && now-s.lastUptTime <= BATCH_STALE_SECS
+}
+
+//Callers hold gStateLock.
+func freeSeats(s *CommState, now int64) int {
+	if s.driverOrRider != DRIVER_STATE || now-s.lastUptTime > BATCH_STALE_SECS {
+		return 0
+	}
+	return seatsFor(s.vehicleType) - len(s.arrConnectedWith)
+}
+
+//Callers hold gStateLock. Same rules as a rider requesting the driver.
+func batchEdgeAllowed(rider string, riderState *CommState, driver string, driverState *CommState) (bool, float64) {
+	dist := DistanceBetwnPts(Point{Lat: riderState.lat, Lon: riderState.lng}, Point{Lat: driverState.lat, Lon: driverState.lng})
+	if riderState.tenant != driverState.tenant || dist > maxWaitDistance(riderState.tenant) ||
+		isBlockedPair(rider, driver) || !isVerifiedDriver(driver) || !orgAllowsPair(rider, driver) ||
+		!prefsAllowPair(rider, driver) {
+		return false, 0
+	}
+	if checkPickupAllowed(rider, riderState, driver, driverState) != nil {
+		return false, 0
+	}
+	return true, dist
+}
+
+//solveRegion assigns riders to driver seats within one region. Each free seat is a column; the k'th seat of
+//a driver costs k extra stops, so an idle driver nearby wins over a busy one next door.
+func solveRegion(riders []string, drivers []string, now int64) []batchProposal {
+	type seat struct {
+		driver string
+		stop   int
+	}
+	seats := make([]seat, 0)
+	for _, d := range drivers {
+		for k := 0; k < freeSeats(gStateDS[d], now); k++ {
+			seats = append(seats, seat{d, len(gStateDS[d].arrConnectedWith) + k})
+		}
+	}
+	n := len(riders)
+	if len(seats) > n {
+		n = len(seats)
+	}
+	if n == 0 {
+		return nil
+	}
+	//Square it up. Padding rows/cols cost nothing; unmatched riders end up on them.
+	cost := make([][]float64, n)
+	dists := make([][]float64, n)
+	for i := 0; i < n; i++ {
+		cost[i] = make([]float64, n)
+		dists[i] = make([]float64, n)
+		if i >= len(riders) {
+			continue
+		}
+		for j := 0; j < n; j++ {
+			if j >= len(seats) {
+				continue
+			}
+			ok, dist := batchEdgeAllowed(riders[i], gStateDS[riders[i]], seats[j].driver, gStateDS[seats[j].driver])
+			if !ok {
+				cost[i][j] = BATCH_NO_EDGE
+				continue
+			}
+			cost[i][j] = dist + float64(seats[j].stop*BATCH_DETOUR_METRES)
+			dists[i][j] = dist
+		}
+	}
+	//Padding rows cost 0 and not allowed ones cost BATCH_NO_EDGE, so the solver first matches as many riders
+	//as it can and only then cares about distance.
+	assignment := hungarian(cost)
+	proposals := make([]batchProposal, 0)
+	for i := 0; i < len(riders); i++ {
+		j := assignment[i]
+		if j >= len(seats) || cost[i][j] >= BATCH_NO_EDGE {
+			continue
+		}
+		proposals = append(proposals, batchProposal{riders[i], seats[j].driver, dists[i][j]})
+	}
+	return proposals
+}
+
+//Callers hold gStateLock. Splits riders and drivers into regions: groups which can reach each other, directly
+//or through others. Each region is solved on its own, which keeps the matrices small.
+func batchRegions(riders []string, drivers []string) [][2][]string {
+	parent := make(map[string]string)
+	var find func(string) string
+	find = func(x string) string {
+		if parent[x] != x {
+			parent[x] = find(parent[x])
+		}
+		return parent[x]
+	}
+	for _, u := range riders {
+		parent[u] = u
+	}
+	for _, u := range drivers {
+		parent[u] = u
+	}
+	for _, r := range riders {
+		for _, d := range drivers {
+			if ok, _ := batchEdgeAllowed(r, gStateDS[r], d, gStateDS[d]); ok {
+				parent[find(r)] = find(d)
+			}
+		}
+	}
+	byRoot := make(map[string]*[2][]string)
+	roots := make([]string, 0)
+	add := func(u string, side int) {
+		root := find(u)
+		if _, ok := byRoot[root]; !ok {
+			byRoot[root] = &[2][]string{}
+			roots = append(roots, root)
+		}
+		byRoot[root][side] = append(byRoot[root][side], u)
+	}
+	for _, r := range riders {
+		add(r, 0)
+	}
+	for _, d := range drivers {
+		add(d, 1)
+	}
+	sort.Strings(roots)
+	regions := make([][2][]string, 0, len(roots))
+	for _, root := range roots {
+		regions = append(regions, *byRoot[root])
+	}
+	return regions
+}
+
+//Callers hold gStateLock. Last round's proposal is stale now. Takes back the request too if the batch matcher
+//put it there; the new round proposes it again if it still holds.
+func withdrawProposal(rider string, s *CommState) {
+	if s.batchReq {
+		if driverState, ok := gStateDS[s.proposedDriver]; ok {
+			driverState.arrReqs = removeString(driverState.arrReqs, rider)
+		}
+	}
+	s.proposedDriver, s.batchReq = "", false
+}
+
+//runBatchMatch computes the assignment and proposes it to both sides: the rider's request is registered with
+//the driver, who sees it as usual, and the driver is shown first in the rider's results. Either can still
+//ignore it; joining goes through the normal request/accept flow. Returns the proposals made.
+func runBatchMatch(now int64) []batchProposal {
+	gStateLock.Lock()
+	defer gStateLock.Unlock()
+
+	riders := make([]string, 0)
+	drivers := make([]string, 0)
+	for u, s := range gStateDS {
+		withdrawProposal(u, s)
+		if isBatchRider(s, now) {
+			riders = append(riders, u)
+		} else if freeSeats(s, now) > 0 {
+			drivers = append(drivers, u)
+		}
+	}
+	//Map order is random. Sort so that ties always break the same way.
+	sort.Strings(riders)
+	sort.Strings(drivers)
+
+	proposals := make([]batchProposal, 0)
+	for _, region := range batchRegions(riders, drivers) {
+		if len(region[0]) == 0 || len(region[1]) == 0 {
+			continue
+		}
+		for _, p := range solveRegion(region[0], region[1], now) {
+			driverState := gStateDS[p.driver]
+			if !containsString(driverState.arrReqs, p.rider) {
+				if len(driverState.arrReqs) >= maxMatchedUsers(driverState.tenant) {
+					continue //Driver cannot see any more requests
+				}
+				driverState.arrReqs = append(driverState.arrReqs, p.rider)
+				gStateDS[p.rider].batchReq = true
+			}
+			gStateDS[p.rider].proposedDriver = p.driver
+			proposals = append(proposals, p)
+		}
+	}
+	return proposals
+}
+
+func containsString(arr []string, str string) bool {
+	for _, s := range arr {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
+
+//StartBatchMatcher runs the batch matcher every interval, forever. Call once from main. Off if interval is 0.
+func StartBatchMatcher(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			proposals := runBatchMatch(clockNow().Unix())
+			fmt.Println(clockNow(), "\t", "Batch matcher proposed", len(proposals), "matches")
+		}
+	}()
+}
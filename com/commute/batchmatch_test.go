@@ -0,0 +1,177 @@
+package commute
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestHungarian(t *testing.T) {
+	cases := []struct {
+		cost     [][]float64
+		expected []int
+	}{
+		{[][]float64{{1}}, []int{0}},
+		{[][]float64{{4, 1, 3}, {2, 0, 5}, {3, 2, 2}}, []int{1, 0, 2}},
+		//Greedy would give row 0 its cheapest and leave row 1 with the expensive one.
+		{[][]float64{{1, 2}, {1, 100}}, []int{1, 0}},
+		{[][]float64{{0, 0, 0}, {BATCH_NO_EDGE, 5, BATCH_NO_EDGE}, {7, BATCH_NO_EDGE, BATCH_NO_EDGE}}, []int{2, 1, 0}},
+	}
+	for idx, c := range cases {
+		got := hungarian(c.cost)
+		for i := range c.expected {
+			if got[i] != c.expected[i] {
+				t.Errorf("test case #%d: got %v, expected %v", idx, got, c.expected)
+				break
+			}
+		}
+	}
+}
+
+//rider1 can reach both bikes, rider2 only the nearer one. Batch gives rider1 the farther bike so both ride.
+func TestBatchMatchBeatsGreedy(t *testing.T) {
+	Initialize()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+	newUser("bike1", 12.884733, 77.551541, DRIVER_STATE)
+	newUser("bike2", 12.884733, 77.555541, DRIVER_STATE)
+	newUser("rider1", 12.884733, 77.553141, RIDER_STATE) //~170m from bike1, ~260m from bike2
+	newUser("rider2", 12.884733, 77.548541, RIDER_STATE) //~325m from bike1, out of reach of bike2
+	setVehicleType("bike1", VEHICLE_BIKE)
+	setVehicleType("bike2", VEHICLE_BIKE)
+	newUser("stale", 12.884733, 77.551541, RIDER_STATE)
+	getCurrentState("stale").lastUptTime -= BATCH_STALE_SECS + 1
+
+	proposals := runBatchMatch(clock.Now().Unix())
+	got := make(map[string]string)
+	for _, p := range proposals {
+		got[p.rider] = p.driver
+	}
+	if len(got) != 2 || got["rider1"] != "bike2" || got["rider2"] != "bike1" {
+		t.Fatalf("wrong proposals:%v", proposals)
+	}
+
+	//Both sides see it
+	if !containsString(getCurrentState("bike2").arrReqs, "rider1") {
+		t.Errorf("proposal not registered with driver")
+	}
+	if retArr, _ := searchMatches("rider1", RIDER_STATE); len(retArr) != 2 || retArr[0].userName != "bike2" {
+		t.Errorf("proposed driver not first in rider's results:%v", retArr)
+	}
+
+	//Gone once they join
+	joinUsers("rider1", "bike2")
+	if getCurrentState("rider1").proposedDriver != "" {
+		t.Errorf("proposal not cleared on join")
+	}
+	if proposals = runBatchMatch(clock.Now().Unix()); len(proposals) != 1 || proposals[0].rider != "rider2" {
+		t.Errorf("joined rider or full bike proposed again:%v", proposals)
+	}
+}
+
+//A rider who moves gets a new proposal. The old driver must not keep the request the matcher put there, but
+//one the rider made themselves stays.
+func TestBatchMatchWithdraw(t *testing.T) {
+	Initialize()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+	newUser("bike1", 12.884733, 77.551541, DRIVER_STATE)
+	newUser("bike2", 12.884733, 77.555541, DRIVER_STATE)
+	newUser("rider1", 12.884733, 77.551641, RIDER_STATE)
+	newUser("rider2", 12.884733, 77.551641, RIDER_STATE)
+	setVehicleType("bike1", VEHICLE_BIKE)
+	setVehicleType("bike2", VEHICLE_BIKE)
+	registerReq("rider2", "bike2")
+
+	cases := []struct {
+		lng      float64 //Where rider1 is for the round
+		expected string  //Driver proposed to rider1
+	}{
+		{77.551641, "bike1"},
+		{77.555441, "bike2"},
+		{77.551641, "bike1"},
+	}
+	for idx, c := range cases {
+		clock.Advance(time.Minute)
+		for _, u := range []string{"bike1", "bike2", "rider1", "rider2"} {
+			getCurrentState(u).lastUptTime = clock.Now().Unix()
+		}
+		getCurrentState("rider1").lng = c.lng
+		got := make(map[string]string)
+		for _, p := range runBatchMatch(clock.Now().Unix()) {
+			got[p.rider] = p.driver
+		}
+		if got["rider1"] != c.expected {
+			t.Errorf("test case #%d: wrong proposals:%v", idx, got)
+		}
+		for _, d := range []string{"bike1", "bike2"} {
+			if containsString(getCurrentState(d).arrReqs, "rider1") != (d == c.expected) {
+				t.Errorf("test case #%d: %s requests:%v", idx, d, getCurrentState(d).arrReqs)
+			}
+		}
+		if !containsString(getCurrentState("bike2").arrReqs, "rider2") {
+			t.Errorf("test case #%d: rider2's own request withdrawn", idx)
+		}
+	}
+}
+
+//Simulates the rider-driven flow: riders in random order each see up to MAX_MATCHED_USERS drivers and take
+//the nearest one with a seat left. Returns how many got a ride.
+func simulateGreedy(r *rand.Rand, riders []string, seats map[string]int) int {
+	matched := 0
+	for _, i := range r.Perm(len(riders)) {
+		candidates, _ := searchMatches(riders[i], RIDER_STATE)
+		best := ""
+		bestDist := 0.0
+		for _, c := range candidates {
+			if seats[c.userName] > 0 && (best == "" || c.dist < bestDist) {
+				best, bestDist = c.userName, c.dist
+			}
+		}
+		if best != "" {
+			seats[best]--
+			matched++
+		}
+	}
+	return matched
+}
+
+//Random city blocks with more riders than seats. The batch matcher should never do worse than greedy, and
+//typically does a good bit better.
+func TestBatchMatchSimulation(t *testing.T) {
+	clock := NewFakeClock(time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+	totalGreedy, totalBatch, totalRiders := 0, 0, 0
+	for seed := int64(1); seed <= 5; seed++ {
+		Initialize()
+		r := rand.New(rand.NewSource(seed))
+		riders := make([]string, 0)
+		seats := make(map[string]int)
+		for i := 0; i < 60; i++ {
+			name := fmt.Sprintf("rider%d", i)
+			newUser(name, 12.97+r.Float64()*0.03, 77.59+r.Float64()*0.03, RIDER_STATE)
+			riders = append(riders, name)
+		}
+		for i := 0; i < 40; i++ {
+			name := fmt.Sprintf("driver%d", i)
+			newUser(name, 12.97+r.Float64()*0.03, 77.59+r.Float64()*0.03, DRIVER_STATE)
+			setVehicleType(name, VEHICLE_BIKE)
+			seats[name] = seatsFor(VEHICLE_BIKE)
+		}
+
+		greedy := simulateGreedy(r, riders, seats)
+		batch := len(runBatchMatch(clock.Now().Unix()))
+		if batch < greedy {
+			t.Errorf("seed %d: batch matched %d, fewer than greedy %d", seed, batch, greedy)
+		}
+		totalGreedy += greedy
+		totalBatch += batch
+		totalRiders += len(riders)
+	}
+	t.Logf("match rate greedy:%.1f%% batch:%.1f%%", 100*float64(totalGreedy)/float64(totalRiders),
+		100*float64(totalBatch)/float64(totalRiders))
+	if totalBatch <= totalGreedy {
+		t.Errorf("batch matcher did not improve on greedy. greedy:%d batch:%d", totalGreedy, totalBatch)
+	}
+}
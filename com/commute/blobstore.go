@@ -0,0 +1,168 @@
+package commute
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+//BlobStore keeps the big things, like photos, which do not belong in the Store. Keys are slash separated paths
+//which we make up, eg: drivers/<id>/1.jpg. Get returns ErrNotFound when there is no such key. The default
+//one is in memory; the server keeps them on disk with a FileBlobStore plugged in with SetBlobStore.
+type BlobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+var gBlobStore BlobStore = NewMemBlobStore()
+var gBlobStorePlugged = false
+var gBlobStoreLock = sync.RWMutex{}
+
+//SetBlobStore swaps in a different blob store. Initialize will not reset a store plugged in this way.
+func SetBlobStore(b BlobStore) {
+	gBlobStoreLock.Lock()
+	defer gBlobStoreLock.Unlock()
+	gBlobStore = b
+	gBlobStorePlugged = true
+}
+
+func resetBlobStore() {
+	gBlobStoreLock.Lock()
+	defer gBlobStoreLock.Unlock()
+	if !gBlobStorePlugged {
+		gBlobStore = NewMemBlobStore()
+	}
+}
+
+func getBlobStore() BlobStore {
+	gBlobStoreLock.RLock()
+	defer gBlobStoreLock.RUnlock()
+	return gBlobStore
+}
+
+//checkBlobKey makes sure a key cannot get out of the store's directory.
+func checkBlobKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return errors.New(fmt.Sprintf("Invalid blob key:%s", key))
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return errors.New(fmt.Sprintf("Invalid blob key:%s", key))
+		}
+	}
+	return nil
+}
+
+//FileBlobStore keeps each blob in a file under dir, at the path given by its key.
+type FileBlobStore struct {
+	dir string
+}
+
+//NewFileBlobStore makes dir if need be.
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileBlobStore{dir: dir}, nil
+}
+
+func (f *FileBlobStore) path(key string) (string, error) {
+	if err := checkBlobKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(f.dir, filepath.FromSlash(key)), nil
+}
+
+//Put writes to a temp file and renames it in, so that a Get never sees half a blob.
+func (f *FileBlobStore) Put(key string, data []byte) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func (f *FileBlobStore) Get(key string) ([]byte, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (f *FileBlobStore) Delete(key string) error {
+	path, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+//memBlobStore keeps blobs in a map. For tests.
+type memBlobStore struct {
+	lock  sync.RWMutex
+	blobs map[string][]byte
+}
+
+//NewMemBlobStore returns an empty in-memory BlobStore.
+func NewMemBlobStore() BlobStore {
+	return &memBlobStore{blobs: make(map[string][]byte)}
+}
+
+func (m *memBlobStore) Put(key string, data []byte) error {
+	if err := checkBlobKey(key); err != nil {
+		return err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.blobs[key] = append([]byte(nil), data...)
+	return nil
+}
+
+func (m *memBlobStore) Get(key string) ([]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if data, ok := m.blobs[key]; ok {
+		return append([]byte(nil), data...), nil
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memBlobStore) Delete(key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.blobs, key)
+	return nil
+}
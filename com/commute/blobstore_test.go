@@ -0,0 +1,50 @@
+package commute
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlobStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatalf("no temp dir:%s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	fileStore, err := NewFileBlobStore(filepath.Join(dir, "store"))
+	if err != nil {
+		t.Fatalf("could not make file store:%s", err.Error())
+	}
+
+	for name, b := range map[string]BlobStore{"file": fileStore, "mem": NewMemBlobStore()} {
+		if _, err := b.Get("drivers/x/1.jpg"); err != ErrNotFound {
+			t.Errorf("%s: Get of missing key did not return ErrNotFound. err:%v", name, err)
+		}
+		if err := b.Put("drivers/x/1.jpg", []byte("photo")); err != nil {
+			t.Errorf("%s: Put failed:%s", name, err.Error())
+		}
+		b.Put("drivers/x/1.jpg", []byte("newphoto"))
+		if data, err := b.Get("drivers/x/1.jpg"); err != nil || string(data) != "newphoto" {
+			t.Errorf("%s: Get returned %s err:%v", name, data, err)
+		}
+		b.Delete("drivers/x/1.jpg")
+		if _, err := b.Get("drivers/x/1.jpg"); err != ErrNotFound {
+			t.Errorf("%s: Delete did not remove. err:%v", name, err)
+		}
+		if err := b.Delete("drivers/x/1.jpg"); err != nil {
+			t.Errorf("%s: Delete of missing key failed:%s", name, err.Error())
+		}
+
+		cases := []string{"", "/etc/passwd", "../escape", "drivers/../../escape", "drivers//1.jpg", "a\\b"}
+		for idx, key := range cases {
+			if err := b.Put(key, []byte("x")); err == nil {
+				t.Errorf("%s: test case #%d: bad key %s accepted", name, idx, key)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escape")); err == nil {
+		t.Errorf("file store wrote outside its directory")
+	}
+}
@@ -0,0 +1,142 @@
+package commute
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//Store bucket for blocks. Key is blocker/blocked so that a user's list is a prefix scan.
+const bucketBlocks = "blocks"
+
+//ErrUserBlocked is returned when a request or join is attempted between two users where either has blocked the other.
+//Deliberately does not say who blocked whom.
+var ErrUserBlocked = errors.New("Not allowed: this commuter is not available to you")
+
+//blockRecord is what goes in the store. Only the key matters for now; time is for support queries.
+type blockRecord struct {
+	Blocker string `json:"blocker"`
+	Blocked string `json:"blocked"`
+	Time    int64  `json:"time"`
+}
+
+//Per user set of blocked users, loaded from the store the first time the user is looked at.
+var gBlocks map[string]map[string]bool
+var gBlocksLock = sync.RWMutex{}
+
+func resetBlocks() {
+	gBlocksLock.Lock()
+	defer gBlocksLock.Unlock()
+	gBlocks = make(map[string]map[string]bool, 1000)
+}
+
+func blockKey(blocker string, blocked string) string {
+	return blocker + "/" + blocked
+}
+
+//Callers hold gBlocksLock for writing.
+func loadBlockedSetLocked(userName string) map[string]bool {
+	if set, ok := gBlocks[userName]; ok {
+		return set
+	}
+	set := make(map[string]bool)
+	vals, _ := getStore().List(bucketBlocks, userName+"/")
+	for _, v := range vals {
+		rec := blockRecord{}
+		if err := json.Unmarshal(v, &rec); err == nil && rec.Blocker == userName {
+			set[rec.Blocked] = true
+		}
+	}
+	gBlocks[userName] = set
+	return set
+}
+
+func hasBlocked(blocker string, blocked string) bool {
+	gBlocksLock.RLock()
+	set, ok := gBlocks[blocker]
+	isBlocked := ok && set[blocked]
+	gBlocksLock.RUnlock()
+	if ok {
+		return isBlocked
+	}
+
+	gBlocksLock.Lock()
+	defer gBlocksLock.Unlock()
+	return loadBlockedSetLocked(blocker)[blocked]
+}
+
+//isBlockedPair is true if either of the two has blocked the other. Matching is symmetric.
+func isBlockedPair(user1 string, user2 string) bool {
+	return hasBlocked(user1, user2) || hasBlocked(user2, user1)
+}
+
+//getBlockedUsers returns who the user has blocked.
+func getBlockedUsers(userName string) []string {
+	gBlocksLock.Lock()
+	defer gBlocksLock.Unlock()
+
+	users := make([]string, 0)
+	for u := range loadBlockedSetLocked(userName) {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+	return users
+}
+
+//blockUser stops the two from seeing or requesting each other. Pending requests between them are dropped.
+func blockUser(userName string, other string) (string, error) {
+	if other == "" || other == userName {
+		return "", errors.New(fmt.Sprintf("Error while blocking : invalid user %s", other))
+	}
+
+	gBlocksLock.Lock()
+	set := loadBlockedSetLocked(userName)
+	err := storePutJSON(bucketBlocks, blockKey(userName, other), blockRecord{userName, other, clockNow().Unix()})
+	if err == nil {
+		set[other] = true
+	}
+	gBlocksLock.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	//Now clean up pending requests both ways.
+	gStateLock.Lock()
+	defer gStateLock.Unlock()
+	if s, ok := gStateDS[userName]; ok {
+		s.arrReqs = removeString(s.arrReqs, other)
+	}
+	if s, ok := gStateDS[other]; ok {
+		s.arrReqs = removeString(s.arrReqs, userName)
+	}
+	return fmt.Sprintf("Success! Blocked %s", other), nil
+}
+
+//unblockUser undoes blockUser. Unblocking someone not blocked is not an error.
+func unblockUser(userName string, other string) (string, error) {
+	gBlocksLock.Lock()
+	defer gBlocksLock.Unlock()
+
+	set := loadBlockedSetLocked(userName)
+	if err := getStore().Delete(bucketBlocks, blockKey(userName, other)); err != nil {
+		return "", err
+	}
+	delete(set, other)
+	return fmt.Sprintf("Success! Unblocked %s", other), nil
+}
+
+//Response for the block list event. Same comma separated style as the heartbeat.
+func blockListString(userName string) string {
+	users := getBlockedUsers(userName)
+	return fmt.Sprintf("blocklistpayload,%d%s", len(users), prefixEach(users, ","))
+}
+
+func prefixEach(arr []string, prefix string) string {
+	if len(arr) == 0 {
+		return ""
+	}
+	return prefix + strings.Join(arr, prefix)
+}
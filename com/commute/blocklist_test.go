@@ -0,0 +1,81 @@
+package commute
+
+import (
+	"testing"
+)
+
+//Blocking is symmetric: whoever blocks, neither sees nor can request/join the other.
+func TestBlockSymmetric(t *testing.T) {
+	cases := []struct {
+		blocker, blocked string
+	}{
+		{"rider1", "driver1"}, //rider blocks driver
+		{"driver1", "rider1"}, //driver blocks rider
+	}
+	for idx, c := range cases {
+		Initialize()
+		tokenDriver, _ := updateState("driver1", 12.884733, 77.551541, "", DRIVER_STATE, "", EVENT_LOGIN)
+		tokenRider, _ := updateState("rider1", 12.884800, 77.551600, "", RIDER_STATE, "", EVENT_LOGIN)
+		tokens := map[string]string{"driver1": tokenDriver, "rider1": tokenRider}
+		modes := map[string]int{"driver1": DRIVER_STATE, "rider1": RIDER_STATE}
+
+		//Pending request gets dropped on block
+		updateState("rider1", 12.884800, 77.551600, tokenRider, RIDER_STATE, "driver1", EVENT_JOINREQ)
+		_, err := updateState(c.blocker, 12.8848, 77.5516, tokens[c.blocker], modes[c.blocker], c.blocked, EVENT_BLOCK)
+		if err != nil {
+			t.Fatalf("test case #%d: block failed:%s", idx, err.Error())
+		}
+		if len(getCurrentState("driver1").arrReqs) != 0 {
+			t.Errorf("test case #%d: pending request not dropped on block", idx)
+		}
+
+		//Neither side sees the other
+		if retArr, _ := searchMatches("rider1", RIDER_STATE); len(retArr) != 0 {
+			t.Errorf("test case #%d: rider still sees blocked driver", idx)
+		}
+		getCurrentState("driver1").arrReqs = append(getCurrentState("driver1").arrReqs, "rider1")
+		if retArr, _ := searchMatches("driver1", DRIVER_STATE); len(retArr) != 0 {
+			t.Errorf("test case #%d: driver still sees blocked rider", idx)
+		}
+		getCurrentState("driver1").arrReqs = make([]string, 0)
+
+		//Neither can request or join
+		if _, err = registerReq("rider1", "driver1"); err != ErrUserBlocked {
+			t.Errorf("test case #%d: registerReq did not return ErrUserBlocked. err:%v", idx, err)
+		}
+		if _, err = joinUsers("rider1", "driver1"); err != ErrUserBlocked {
+			t.Errorf("test case #%d: joinUsers did not return ErrUserBlocked. err:%v", idx, err)
+		}
+
+		//Only the blocker can undo it
+		updateState(c.blocked, 12.8848, 77.5516, tokens[c.blocked], modes[c.blocked], c.blocker, EVENT_UNBLOCK)
+		if !isBlockedPair("rider1", "driver1") {
+			t.Errorf("test case #%d: blocked user managed to unblock", idx)
+		}
+		updateState(c.blocker, 12.8848, 77.5516, tokens[c.blocker], modes[c.blocker], c.blocked, EVENT_UNBLOCK)
+		if retArr, _ := searchMatches("rider1", RIDER_STATE); len(retArr) != 1 {
+			t.Errorf("test case #%d: rider does not see driver after unblock", idx)
+		}
+		if _, err = registerReq("rider1", "driver1"); err != nil {
+			t.Errorf("test case #%d: registerReq failed after unblock. err:%v", idx, err)
+		}
+	}
+}
+
+func TestBlockPersists(t *testing.T) {
+	Initialize()
+	token := newUser("rider1", 12.8848, 77.5516, RIDER_STATE)
+
+	if _, err := blockUser("rider1", "rider1"); err == nil {
+		t.Errorf("blocking yourself did not fail")
+	}
+	blockUser("rider1", "driver2")
+	blockUser("rider1", "driver1")
+
+	//Comes back from the store once the cache is gone
+	resetBlocks()
+	retStr, err := updateState("rider1", 12.8848, 77.5516, token, RIDER_STATE, "", EVENT_BLOCKLIST)
+	if err != nil || retStr != "blocklistpayload,2,driver1,driver2" {
+		t.Errorf("block list wrong after reload. ret:%s err:%v", retStr, err)
+	}
+}
@@ -0,0 +1,189 @@
+package commute
+
+import (
+	crand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Clock is where the package gets the time from. Tests and the replay tool swap in a FakeClock so that
+//TTLs, schedules and the like can be checked without sleeping.
+type Clock interface {
+	Now() time.Time
+}
+
+//Entropy is where the package gets randomness from: login tokens, verification codes and location jitter.
+type Entropy interface {
+	Float64() float64
+	Token() string
+	Code(digits int) string //Numeric, zero padded
+	Secret() string         //Hex. For what lets the holder in, so has to be unguessable
+}
+
+var gClock Clock = realClock{}
+var gEntropy Entropy = realEntropy{}
+
+//Swapped by tests while goroutines from earlier ones (printStat etc) may still be reading.
+var gClockLock = sync.RWMutex{}
+
+//SetClock makes the package use c for the time. Returns the clock it replaces, to put back later.
+func SetClock(c Clock) Clock {
+	gClockLock.Lock()
+	defer gClockLock.Unlock()
+	prev := gClock
+	gClock = c
+	return prev
+}
+
+//SetEntropy makes the package use e for randomness. Returns the one it replaces, to put back later.
+func SetEntropy(e Entropy) Entropy {
+	gClockLock.Lock()
+	defer gClockLock.Unlock()
+	prev := gEntropy
+	gEntropy = e
+	return prev
+}
+
+func clockNow() time.Time {
+	gClockLock.RLock()
+	c := gClock
+	gClockLock.RUnlock()
+	return c.Now()
+}
+
+func randFloat() float64 {
+	gClockLock.RLock()
+	e := gEntropy
+	gClockLock.RUnlock()
+	return e.Float64()
+}
+
+func randToken() string {
+	gClockLock.RLock()
+	e := gEntropy
+	gClockLock.RUnlock()
+	return e.Token()
+}
+
+func randSecret() string {
+	gClockLock.RLock()
+	e := gEntropy
+	gClockLock.RUnlock()
+	return e.Secret()
+}
+
+func randCode(digits int) string {
+	gClockLock.RLock()
+	e := gEntropy
+	gClockLock.RUnlock()
+	return e.Code(digits)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+//realEntropy uses uuidgen for tokens where the box has it, math/rand otherwise.
+type realEntropy struct{}
+
+func (realEntropy) Float64() float64 {
+	return rand.Float64()
+}
+
+func (realEntropy) Token() string {
+	//Leverage linux command
+	out, err := exec.Command("uuidgen").Output()
+	if err != nil {
+		return fmt.Sprintf("SomeString:%d", rand.Int63())
+	}
+	return strings.TrimSuffix(string(out), "\n") //TODO - for some reason, am getting a trail
+}
+
+//Codes go out over SMS and guard accounts, so these come from crypto/rand.
+func (realEntropy) Code(digits int) string {
+	n, err := crand.Int(crand.Reader, big.NewInt(int64(math.Pow10(digits))))
+	if err != nil {
+		return fmt.Sprintf("%0*d", digits, rand.Int63n(int64(math.Pow10(digits))))
+	}
+	return fmt.Sprintf("%0*d", digits, n.Int64())
+}
+
+//Secrets come from crypto/rand, 128 bits. With no crypto/rand there is no handing out a guessable one instead.
+func (realEntropy) Secret() string {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand failed:%s", err.Error()))
+	}
+	return hex.EncodeToString(b)
+}
+
+//FakeClock only moves when told to.
+type FakeClock struct {
+	lock sync.Mutex
+	t    time.Time
+}
+
+func NewFakeClock(t time.Time) *FakeClock {
+	return &FakeClock{t: t}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.t
+}
+
+func (c *FakeClock) Set(t time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.t = t
+}
+
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.t = c.t.Add(d)
+}
+
+//SeededEntropy gives the same sequence every time for the same seed.
+type SeededEntropy struct {
+	lock sync.Mutex
+	r    *rand.Rand
+}
+
+func NewSeededEntropy(seed int64) *SeededEntropy {
+	return &SeededEntropy{r: rand.New(rand.NewSource(seed))}
+}
+
+func (e *SeededEntropy) Float64() float64 {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.r.Float64()
+}
+
+func (e *SeededEntropy) Token() string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return fmt.Sprintf("SomeString:%d", e.r.Int63())
+}
+
+func (e *SeededEntropy) Secret() string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return fmt.Sprintf("%016x%016x", e.r.Uint64(), e.r.Uint64())
+}
+
+func (e *SeededEntropy) Code(digits int) string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return fmt.Sprintf("%0*d", digits, e.r.Int63n(int64(math.Pow10(digits))))
+}
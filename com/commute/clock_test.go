@@ -0,0 +1,82 @@
+package commute
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	defer SetClock(SetClock(clock))
+
+	cases := []struct {
+		advance  time.Duration
+		expected time.Time
+	}{
+		{0, start},
+		{time.Minute, start.Add(time.Minute)},
+		{time.Hour, start.Add(time.Hour + time.Minute)},
+	}
+	for idx, c := range cases {
+		clock.Advance(c.advance)
+		if !clockNow().Equal(c.expected) {
+			t.Errorf("test case #%d: clockNow = %s, expected %s", idx, clockNow(), c.expected)
+		}
+	}
+	clock.Set(start)
+	if !clockNow().Equal(start) {
+		t.Errorf("Set did not work:%s", clockNow())
+	}
+}
+
+//Same seed, same tokens and the same jitter.
+func TestSeededEntropy(t *testing.T) {
+	SetLocationPrivacy(PRIVACY_JITTER, 300)
+	defer resetLocationPrivacy()
+
+	run := func() (string, float64, float64) {
+		defer SetEntropy(SetEntropy(NewSeededEntropy(42)))
+		lat, lng := fuzzLocation(12.884733, 77.551541)
+		return randToken(), lat, lng
+	}
+	token1, lat1, lng1 := run()
+	token2, lat2, lng2 := run()
+	if token1 != token2 || lat1 != lat2 || lng1 != lng2 {
+		t.Errorf("not repeatable. %s,%f,%f vs %s,%f,%f", token1, lat1, lng1, token2, lat2, lng2)
+	}
+	if lat1 == 12.884733 && lng1 == 77.551541 {
+		t.Errorf("jitter did not move the point")
+	}
+}
+
+//Secrets are 128 bits, never the same twice.
+func TestRealSecret(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		s := realEntropy{}.Secret()
+		if _, err := hex.DecodeString(s); err != nil || len(s) != 32 || seen[s] {
+			t.Fatalf("bad secret:%s", s)
+		}
+		seen[s] = true
+	}
+}
+
+//Users go stale without anyone sleeping.
+func TestStaleUsersOnFakeClock(t *testing.T) {
+	Initialize()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+
+	newUser("driver1", 12.884733, 77.551541, DRIVER_STATE)
+	newUser("rider1", 12.884800, 77.551600, RIDER_STATE)
+	clock.Advance(BATCH_STALE_SECS * time.Second)
+	if proposals := runBatchMatch(clockNow().Unix()); len(proposals) != 1 {
+		t.Errorf("fresh users not matched:%v", proposals)
+	}
+	clock.Advance(time.Second)
+	if proposals := runBatchMatch(clockNow().Unix()); len(proposals) != 0 {
+		t.Errorf("stale users matched:%v", proposals)
+	}
+}
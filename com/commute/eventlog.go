@@ -0,0 +1,367 @@
+package commute
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Every accepted event goes to an append only log, one json per line, in files under a directory.
+//A file is closed once it crosses the size limit and a new one started. Only the newest few are kept.
+const EVENTLOG_DEFAULT_MAX_BYTES = 64 << 20
+const EVENTLOG_DEFAULT_MAX_FILES = 10
+const EVENTLOG_TOKEN_REDACTED = "<token>" //Logins are logged without the token handed out
+
+var eventNames = map[int]string{
+	EVENT_LOGIN:      "login",
+	EVENT_HEARTBEAT:  "heartbeat",
+	EVENT_JOINREQ:    "joinrequest",
+	EVENT_JOINACCEPT: "joinaccept",
+	EVENT_TRIPEND:    "tripend",
+	EVENT_BLOCK:      "block",
+	EVENT_UNBLOCK:    "unblock",
+	EVENT_BLOCKLIST:  "blocklist",
+	EVENT_LOGOUT:     "logout",
+	EVENT_SESSIONS:   "sessions",
+	EVENT_SWITCHMODE: "switchmode",
+	EVENT_SOS:        "sos",
+	EVENT_ORGMEMBER:  "orgmember",
+	EVENT_PROFILE:    "profile",
+}
+
+//Changes that do not come in as app events but decide who is shown to whom. They are logged with what they
+//left behind, as json in Other, and replay puts that back. See logStateChange.
+const EVENT_ORGMEMBER = 101 //Joined or left an organisation, or changed scope. Other is empty when left.
+const EVENT_PROFILE = 102   //Profile set, or gender verified
+
+//CommuteEvent is one call to updateState, with what it returned. Enough to feed it through again.
+type CommuteEvent struct {
+	Seq       int64   `json:"seq"`
+	Time      int64   `json:"time"` //Unix nanoseconds
+	User      string  `json:"user"`
+	Mode      int     `json:"mode"`
+	Event     int     `json:"event"`
+	Lat       float64 `json:"lat"`
+	Lng       float64 `json:"lng"`
+	Other     string  `json:"other,omitempty"`
+	MinRating float64 `json:"minrating,omitempty"`
+	Vehicle   int     `json:"vehicle,omitempty"`
+	HasDest   bool    `json:"hasdest,omitempty"`
+	DestLat   float64 `json:"destlat,omitempty"`
+	DestLng   float64 `json:"destlng,omitempty"`
+	NoPos     bool    `json:"nopos,omitempty"` //Sent without a location. Lat, Lng mean nothing then.
+	Device    string  `json:"device,omitempty"`
+	UserAgent string  `json:"useragent,omitempty"`
+	Response  string  `json:"response"`
+	Error     string  `json:"error,omitempty"`
+}
+
+//Options the event was sent with, back in the form updateStateWithOpts takes.
+func (e *CommuteEvent) options() requestOptions {
+	return requestOptions{minRating: e.MinRating, vehicleType: e.Vehicle, hasDest: e.HasDest,
+		destLat: e.DestLat, destLng: e.DestLng, noPosition: e.NoPos, device: e.Device, userAgent: e.UserAgent}
+}
+
+type eventLog struct {
+	dir      string
+	maxBytes int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+//Nil when not configured. Events are then not kept anywhere.
+var gEventLog *eventLog
+var gEventSeq int64
+var gEventLogLock = sync.Mutex{}
+
+func resetEventLog() {
+	gEventLogLock.Lock()
+	defer gEventLogLock.Unlock()
+	if gEventLog != nil && gEventLog.f != nil {
+		gEventLog.f.Close()
+	}
+	gEventLog = nil
+	gEventSeq = 0
+}
+
+//SetEventLog starts logging events to files in dir. Sequence numbers carry on from what is already there.
+func SetEventLog(dir string, maxBytes int64, maxFiles int) error {
+	if dir == "" {
+		return nil
+	}
+	if maxBytes <= 0 {
+		maxBytes = EVENTLOG_DEFAULT_MAX_BYTES
+	}
+	if maxFiles <= 0 {
+		maxFiles = EVENTLOG_DEFAULT_MAX_FILES
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var lastSeq int64 = 0
+	err := ReadEventLog(dir, func(e *CommuteEvent) error {
+		lastSeq = e.Seq
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	gEventLogLock.Lock()
+	defer gEventLogLock.Unlock()
+	if gEventLog != nil && gEventLog.f != nil {
+		gEventLog.f.Close()
+	}
+	gEventLog = &eventLog{dir: dir, maxBytes: maxBytes, maxFiles: maxFiles}
+	gEventSeq = lastSeq
+	return nil
+}
+
+//Files in the order they were written. Names carry the sequence number of the first event in them.
+func eventLogFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "events-*.ndjson"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+//Callers hold gEventLogLock. Starts a new file and drops the oldest ones past maxFiles.
+func (l *eventLog) rotateLocked(firstSeq int64) error {
+	if l.f != nil {
+		l.f.Close()
+		l.f = nil
+	}
+	name := filepath.Join(l.dir, fmt.Sprintf("events-%020d.ndjson", firstSeq))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.f = f
+	l.size = 0
+
+	files, err := eventLogFiles(l.dir)
+	if err != nil {
+		return err
+	}
+	for len(files) > l.maxFiles {
+		os.Remove(files[0])
+		files = files[1:]
+	}
+	return nil
+}
+
+//logEvent appends the event to the log, filling in the sequence number.
+func logEvent(e *CommuteEvent) {
+	gEventLogLock.Lock()
+	defer gEventLogLock.Unlock()
+	if gEventLog == nil {
+		return
+	}
+	gEventSeq++
+	e.Seq = gEventSeq
+	data, err := json.Marshal(e)
+	if err != nil {
+		fmt.Println("ERROR in logEvent:", err)
+		return
+	}
+	data = append(data, '\n')
+	l := gEventLog
+	if l.f == nil || (l.size > 0 && l.size+int64(len(data)) > l.maxBytes) {
+		if err = l.rotateLocked(e.Seq); err != nil {
+			fmt.Println("ERROR in logEvent: could not rotate:", err)
+			return
+		}
+	}
+	n, err := l.f.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		fmt.Println("ERROR in logEvent:", err)
+	}
+}
+
+func newCommuteEvent(userName string, lat float64, lng float64, driverorrider int, other string,
+	eventType int, opts requestOptions) *CommuteEvent {
+	return &CommuteEvent{Time: clockNow().UnixNano(), User: userName, Mode: driverorrider, Event: eventType,
+		Lat: lat, Lng: lng, Other: other, MinRating: opts.minRating, Vehicle: opts.vehicleType,
+		HasDest: opts.hasDest, DestLat: opts.destLat, DestLng: opts.destLng, NoPos: opts.noPosition,
+		Device: opts.device, UserAgent: opts.userAgent}
+}
+
+//logStateChange logs one of the changes above for the user. v is what it left, nil if nothing.
+func logStateChange(userName string, eventType int, v interface{}) {
+	other := ""
+	if v != nil {
+		data, err := json.Marshal(v)
+		if err != nil {
+			fmt.Println("ERROR in logStateChange:", err)
+			return
+		}
+		other = string(data)
+	}
+	logEvent(&CommuteEvent{Time: clockNow().UnixNano(), User: userName, Event: eventType, Other: other, NoPos: true})
+}
+
+//applyStateChange puts back what a change logged by logStateChange left.
+func applyStateChange(e *CommuteEvent) error {
+	switch e.Event {
+	case EVENT_ORGMEMBER:
+		if e.Other == "" {
+			return removeMember(e.User)
+		}
+		m := &orgMember{}
+		if err := json.Unmarshal([]byte(e.Other), m); err != nil {
+			return err
+		}
+		return saveMember(m)
+	case EVENT_PROFILE:
+		p := &commuterProfile{}
+		if err := json.Unmarshal([]byte(e.Other), p); err != nil {
+			return err
+		}
+		return saveProfile(p)
+	}
+	return errors.New(fmt.Sprintf("Not a state change:%d", e.Event))
+}
+
+func isStateChange(eventType int) bool {
+	return eventType == EVENT_ORGMEMBER || eventType == EVENT_PROFILE
+}
+
+//ReadEventLog calls fn for every event in dir, oldest first. Stops at the first error.
+func ReadEventLog(dir string, fn func(e *CommuteEvent) error) error {
+	files, err := eventLogFiles(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		if err = readEventFile(name, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readEventFile(name string, fn func(e *CommuteEvent) error) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		e := &CommuteEvent{}
+		if err = json.Unmarshal(scanner.Bytes(), e); err != nil {
+			return errors.New(fmt.Sprintf("Bad event in %s line %d : %s", name, line, err.Error()))
+		}
+		if err = fn(e); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+var eventCSVHeader = []string{"seq", "time", "user", "mode", "event", "lat", "lng", "other", "minrating", "vehicle",
+	"destlat", "destlng", "response", "error"}
+
+func (e *CommuteEvent) csvRecord() []string {
+	name, ok := eventNames[e.Event]
+	if !ok {
+		name = strconv.Itoa(e.Event)
+	}
+	dest := []string{"", ""}
+	if e.HasDest {
+		dest = []string{strconv.FormatFloat(e.DestLat, 'f', -1, 64), strconv.FormatFloat(e.DestLng, 'f', -1, 64)}
+	}
+	return []string{strconv.FormatInt(e.Seq, 10), time.Unix(0, e.Time).UTC().Format(time.RFC3339Nano), e.User,
+		strconv.Itoa(e.Mode), name, strconv.FormatFloat(e.Lat, 'f', -1, 64), strconv.FormatFloat(e.Lng, 'f', -1, 64),
+		e.Other, strconv.FormatFloat(e.MinRating, 'f', -1, 64), strconv.Itoa(e.Vehicle), dest[0], dest[1],
+		e.Response, e.Error}
+}
+
+//exportEvents writes the events between from and to (unix seconds, 0 for no limit) as ndjson or csv.
+func exportEvents(w io.Writer, dir string, format string, from int64, to int64) error {
+	inRange := func(e *CommuteEvent) bool {
+		secs := e.Time / int64(time.Second)
+		return (from == 0 || secs >= from) && (to == 0 || secs < to)
+	}
+	switch format {
+	case "", "ndjson":
+		enc := json.NewEncoder(w)
+		return ReadEventLog(dir, func(e *CommuteEvent) error {
+			if !inRange(e) {
+				return nil
+			}
+			return enc.Encode(e)
+		})
+	case "csv":
+		cw := csv.NewWriter(w)
+		if err := cw.Write(eventCSVHeader); err != nil {
+			return err
+		}
+		err := ReadEventLog(dir, func(e *CommuteEvent) error {
+			if !inRange(e) {
+				return nil
+			}
+			return cw.Write(e.csvRecord())
+		})
+		cw.Flush()
+		if err != nil {
+			return err
+		}
+		return cw.Error()
+	}
+	return errors.New(fmt.Sprintf("ERROR in format parameter:%s", format))
+}
+
+//Function EventExportHandler streams the event log. Params are format (ndjson/csv), from and to as unix seconds
+//or yyyy-mm-dd. Admins only, see isStaffRequest.
+func EventExportHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := isStaffRequest(r, ROLE_ADMIN); !ok {
+		rejectStaffRequest(w, ROLE_ADMIN)
+		return
+	}
+	q := r.URL.Query()
+	gEventLogLock.Lock()
+	dir := ""
+	if gEventLog != nil {
+		dir = gEventLog.dir
+	}
+	gEventLogLock.Unlock()
+
+	from, err := parseTimeParam(q.Get("from"))
+	var to int64
+	if err == nil {
+		to, err = parseTimeParam(q.Get("to"))
+	}
+	if err == nil && dir == "" {
+		err = errors.New("Event log is not enabled")
+	}
+	if err == nil {
+		err = exportEvents(w, dir, q.Get("format"), from, to)
+	}
+	if err != nil {
+		fmt.Fprint(w, "ERROR! :", err)
+	}
+
+	fmt.Println(clockNow(), "\t", "event export", "\t", r.RemoteAddr, "\t", r.URL.RawQuery, "\t", err)
+}
@@ -0,0 +1,147 @@
+package commute
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newTestEventLog(t *testing.T, maxBytes int64, maxFiles int) string {
+	dir, err := ioutil.TempDir("", "eventlog")
+	if err != nil {
+		t.Fatalf("could not make temp dir:%s", err.Error())
+	}
+	if err = SetEventLog(dir, maxBytes, maxFiles); err != nil {
+		t.Fatalf("could not open event log:%s", err.Error())
+	}
+	return dir
+}
+
+func readAllEvents(t *testing.T, dir string) []*CommuteEvent {
+	events := make([]*CommuteEvent, 0)
+	if err := ReadEventLog(dir, func(e *CommuteEvent) error {
+		events = append(events, e)
+		return nil
+	}); err != nil {
+		t.Fatalf("could not read event log:%s", err.Error())
+	}
+	return events
+}
+
+func TestEventLogRecordsAcceptedEvents(t *testing.T) {
+	Initialize()
+	dir := newTestEventLog(t, 0, 0)
+	defer os.RemoveAll(dir)
+
+	tokenDriver, _ := updateStateWithOpts("driver1", 12.884733, 77.551541, "", DRIVER_STATE, "", EVENT_LOGIN,
+		requestOptions{vehicleType: VEHICLE_SUV, device: "phone", userAgent: "okhttp/3.9"})
+	tokenRider, _ := updateState("rider1", 12.884800, 77.551600, "", RIDER_STATE, "", EVENT_LOGIN)
+	updateState("rider1", 12.884800, 77.551600, "badtoken", RIDER_STATE, "", EVENT_HEARTBEAT) //Not accepted
+	updateState("rider1", 12.884800, 77.551600, tokenRider, RIDER_STATE, "", EVENT_HEARTBEAT)
+	updateStateWithOpts("rider1", 12.884800, 77.551600, tokenRider, RIDER_STATE, "driver1", EVENT_JOINREQ,
+		requestOptions{hasDest: true, destLat: 12.9, destLng: 77.6})
+	updateState("driver1", 12.884733, 77.551541, tokenDriver, DRIVER_STATE, "rider9", EVENT_JOINACCEPT) //Fails
+
+	events := readAllEvents(t, dir)
+	cases := []struct {
+		user, response, err string
+		event               int
+	}{
+		{"driver1", EVENTLOG_TOKEN_REDACTED, "", EVENT_LOGIN},
+		{"rider1", EVENTLOG_TOKEN_REDACTED, "", EVENT_LOGIN},
+		{"rider1", "riderresppayload,0,1,driver1", "", EVENT_HEARTBEAT},
+		{"rider1", "Success! You are now registered with: driver1", "", EVENT_JOINREQ},
+		{"driver1", "", "has not asked", EVENT_JOINACCEPT},
+	}
+	if len(events) != len(cases) {
+		t.Fatalf("expected %d events, got %d", len(cases), len(events))
+	}
+	for idx, c := range cases {
+		e := events[idx]
+		if e.Seq != int64(idx+1) || e.User != c.user || e.Event != c.event || !strings.HasPrefix(e.Response, c.response) ||
+			!strings.Contains(e.Error, c.err) || (c.err == "" && e.Error != "") {
+			t.Errorf("test case #%d: wrong event:%+v", idx, e)
+		}
+		if idx > 0 && e.Time < events[idx-1].Time {
+			t.Errorf("test case #%d: time went backwards", idx)
+		}
+	}
+	if events[0].Vehicle != VEHICLE_SUV || events[0].options().device != "phone" || events[0].UserAgent != "okhttp/3.9" ||
+		!events[3].HasDest || events[3].options().destLng != 77.6 {
+		t.Errorf("options not kept. login:%+v joinreq:%+v", events[0], events[3])
+	}
+}
+
+//Small files so that it rotates on every couple of events. Only the newest files stay and the sequence carries on
+//across a restart.
+func TestEventLogRotation(t *testing.T) {
+	Initialize()
+	dir := newTestEventLog(t, 400, 3)
+	defer os.RemoveAll(dir)
+
+	token, _ := updateState("rider1", 12.8848, 77.5516, "", RIDER_STATE, "", EVENT_LOGIN)
+	for i := 0; i < 20; i++ {
+		updateState("rider1", 12.8848, 77.5516, token, RIDER_STATE, "", EVENT_HEARTBEAT)
+	}
+	files, _ := eventLogFiles(dir)
+	if len(files) != 3 {
+		t.Errorf("expected 3 files to be kept, got %d", len(files))
+	}
+	events := readAllEvents(t, dir)
+	if len(events) == 0 || events[len(events)-1].Seq != 21 {
+		t.Fatalf("newest event missing")
+	}
+	for idx := 1; idx < len(events); idx++ {
+		if events[idx].Seq != events[idx-1].Seq+1 {
+			t.Errorf("gap in kept events at %d", events[idx].Seq)
+		}
+	}
+
+	//Restart
+	Initialize()
+	SetEventLog(dir, 400, 3)
+	token, _ = updateState("rider1", 12.8848, 77.5516, "", RIDER_STATE, "", EVENT_LOGIN)
+	events = readAllEvents(t, dir)
+	if events[len(events)-1].Seq != 22 {
+		t.Errorf("sequence did not carry on after restart. last:%d", events[len(events)-1].Seq)
+	}
+}
+
+func TestEventExport(t *testing.T) {
+	Initialize()
+	dir := newTestEventLog(t, 0, 0)
+	defer os.RemoveAll(dir)
+	token, _ := updateState("rider1", 12.8848, 77.5516, "", RIDER_STATE, "", EVENT_LOGIN)
+	updateState("rider1", 12.8848, 77.5516, token, RIDER_STATE, "driver1", EVENT_BLOCK)
+
+	var buf bytes.Buffer
+	if err := exportEvents(&buf, dir, "ndjson", 0, 0); err != nil {
+		t.Fatalf("ndjson export failed:%s", err.Error())
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 2 || !strings.Contains(lines[1], `"other":"driver1"`) {
+		t.Errorf("wrong ndjson export:%s", buf.String())
+	}
+
+	buf.Reset()
+	if err := exportEvents(&buf, dir, "csv", 0, 0); err != nil {
+		t.Fatalf("csv export failed:%s", err.Error())
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil || len(records) != 3 || records[0][0] != "seq" || records[2][4] != "block" ||
+		records[2][12] != "Success! Blocked driver1" {
+		t.Errorf("wrong csv export:%v err:%v", records, err)
+	}
+
+	//Everything is before a time in the far future and nothing after it
+	buf.Reset()
+	exportEvents(&buf, dir, "ndjson", 4102444800, 0)
+	if buf.Len() != 0 {
+		t.Errorf("time filter not applied:%s", buf.String())
+	}
+	if err = exportEvents(&buf, dir, "xml", 0, 0); err == nil {
+		t.Errorf("bad format did not fail")
+	}
+}
@@ -0,0 +1,182 @@
+package commute
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sync"
+)
+
+//Vehicle types a driver can have. Decides the per km rate.
+const VEHICLE_BIKE = 1
+const VEHICLE_CAR = 2
+const VEHICLE_SUV = 3
+
+//All money is in paise (1/100 of a rupee) so that nothing is lost to float rounding.
+const FARE_ROUND_TO = 100 //Contributions are rounded to the nearest rupee. Driver absorbs the difference.
+
+//fareRate is the cost of running a vehicle. It is not a taxi fare; the idea is to share fuel costs.
+type fareRate struct {
+	Base  int64 `json:"base"`  //Fixed part per trip
+	PerKm int64 `json:"perkm"` //Per km of trip distance
+	Min   int64 `json:"min"`   //The whole trip never costs less than this
+}
+
+var gFareRates map[int]fareRate
+var gFareLock = sync.RWMutex{}
+
+var vehicleNames = map[string]int{"bike": VEHICLE_BIKE, "car": VEHICLE_CAR, "suv": VEHICLE_SUV}
+
+func resetFareRates() {
+	gFareLock.Lock()
+	defer gFareLock.Unlock()
+	gFareRates = map[int]fareRate{
+		VEHICLE_BIKE: {Base: 0, PerKm: 300, Min: 1000},
+		VEHICLE_CAR:  {Base: 2000, PerKm: 700, Min: 3000},
+		VEHICLE_SUV:  {Base: 3000, PerKm: 900, Min: 4000},
+	}
+}
+
+func isValidVehicleType(vehicleType int) bool {
+	return vehicleType == VEHICLE_BIKE || vehicleType == VEHICLE_CAR || vehicleType == VEHICLE_SUV
+}
+
+//SetFareRate changes the rate for a vehicle type. Amounts are in paise.
+func SetFareRate(vehicleType int, base int64, perKm int64, min int64) error {
+	if !isValidVehicleType(vehicleType) {
+		return errors.New(fmt.Sprintf("Invalid vehicle type:%d", vehicleType))
+	}
+	if base < 0 || perKm < 0 || min < 0 {
+		return errors.New(fmt.Sprintf("Fare rates cannot be negative. base:%d perkm:%d min:%d", base, perKm, min))
+	}
+	gFareLock.Lock()
+	defer gFareLock.Unlock()
+	gFareRates[vehicleType] = fareRate{Base: base, PerKm: perKm, Min: min}
+	return nil
+}
+
+//LoadFareRates reads the rate table from a json file like {"car":{"base":2000,"perkm":700,"min":3000}}.
+//Vehicle types not in the file keep their current rate.
+func LoadFareRates(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	rates := make(map[string]fareRate)
+	if err = json.Unmarshal(data, &rates); err != nil {
+		return errors.New(fmt.Sprintf("Invalid fare file %s : %s", path, err.Error()))
+	}
+	for name, r := range rates {
+		vehicleType, ok := vehicleNames[name]
+		if !ok {
+			return errors.New(fmt.Sprintf("Invalid vehicle %s in fare file %s", name, path))
+		}
+		if err = SetFareRate(vehicleType, r.Base, r.PerKm, r.Min); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//getFareRate is the tenant's own rate for the vehicle if it set one, else the default.
+func getFareRate(tenant string, vehicleType int) fareRate {
+	if r, ok := tenantFareRate(tenant, vehicleType); ok {
+		return r
+	}
+	gFareLock.RLock()
+	defer gFareLock.RUnlock()
+	if r, ok := gFareRates[vehicleType]; ok {
+		return r
+	}
+	return gFareRates[VEHICLE_CAR]
+}
+
+//tripFare is the cost of the whole trip for that distance, before it is split.
+func tripFare(tenant string, distanceMetres float64, vehicleType int) int64 {
+	r := getFareRate(tenant, vehicleType)
+	fare := r.Base + int64(math.Round(float64(r.PerKm)*distanceMetres/1000))
+	if fare < r.Min {
+		fare = r.Min
+	}
+	return fare
+}
+
+//roundHalfUp rounds num/den to the nearest multiple of unit, halves going up. All positive.
+func roundHalfUp(num int64, den int64, unit int64) int64 {
+	return (2*num + den*unit) / (2 * den * unit) * unit
+}
+
+//splitFare splits the trip cost equally between the riders and the driver, who shares the fuel cost too.
+//Each rider's share is rounded to roundTo and the driver's share is whatever is left, so that the shares always
+//add up to total exactly.
+func splitFare(total int64, riders int, roundTo int64) (int64, int64) {
+	if riders <= 0 || total <= 0 {
+		return 0, total
+	}
+	occupants := int64(riders) + 1
+	perRider := roundHalfUp(total, occupants, roundTo)
+	//Rounding up for a lot of riders on a tiny fare can overshoot. Then round down instead.
+	if perRider*int64(riders) > total {
+		perRider = total / int64(riders) / roundTo * roundTo
+	}
+	return perRider, total - perRider*int64(riders)
+}
+
+//Settlement is the fare breakdown for one rider's trip.
+type Settlement struct {
+	VehicleType    int     `json:"vehicle"`
+	DistanceMetres float64 `json:"distance"`
+	TripFare       int64   `json:"tripfare"`   //Cost of the whole trip, in paise
+	Riders         int     `json:"riders"`     //Riders sharing the car, including this one
+	RiderShare     int64   `json:"ridershare"` //What this rider pays the driver
+	DriverShare    int64   `json:"drivershare"`
+	RoundingAdjust int64   `json:"rounding"` //Extra the driver bears (+) or saves (-) over an exact split
+}
+
+func newSettlement(tenant string, distanceMetres float64, vehicleType int, riders int) *Settlement {
+	total := tripFare(tenant, distanceMetres, vehicleType)
+	perRider, driverShare := splitFare(total, riders, FARE_ROUND_TO)
+	exact := float64(total) / float64(riders+1)
+	return &Settlement{
+		VehicleType:    vehicleType,
+		DistanceMetres: distanceMetres,
+		TripFare:       total,
+		Riders:         riders,
+		RiderShare:     perRider,
+		DriverShare:    driverShare,
+		RoundingAdjust: int64(math.Round(float64(driverShare) - exact)),
+	}
+}
+
+//Paise to a "123.45" string.
+func formatMoney(paise int64) string {
+	sign := ""
+	if paise < 0 {
+		sign = "-"
+		paise = -paise
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, paise/100, paise%100)
+}
+
+func (s *Settlement) toString() string {
+	return fmt.Sprintf("fare:%s riders:%d yourshare:%s drivershare:%s", formatMoney(s.TripFare), s.Riders,
+		formatMoney(s.RiderShare), formatMoney(s.DriverShare))
+}
+
+//Estimate shown to a rider when they request a driver. Callers hold gStateLock.
+//Without a destination we can only tell them the rate.
+func fareEstimateLocked(riderState *CommState, driverState *CommState, opts requestOptions) string {
+	riders := len(driverState.arrConnectedWith) + 1 //Everyone already in, plus this one
+	if !opts.hasDest {
+		r := getFareRate(driverState.tenant, driverState.vehicleType)
+		perKm, _ := splitFare(r.PerKm, riders, 1)
+		return fmt.Sprintf("Estimated contribution:%s/km", formatMoney(perKm))
+	}
+	dist := DistanceBetwnPts(Point{Lat: riderState.lat, Lon: riderState.lng}, Point{Lat: opts.destLat, Lon: opts.destLng})
+	return fmt.Sprintf("Estimated contribution:%s", formatMoney(newSettlement(driverState.tenant, dist, driverState.vehicleType, riders).RiderShare))
+}
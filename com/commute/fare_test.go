@@ -0,0 +1,181 @@
+package commute
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTripFare(t *testing.T) {
+	Initialize()
+	cases := []struct {
+		dist        float64
+		vehicleType int
+		fare        int64
+	}{
+		{0, VEHICLE_CAR, 3000},         //min fare
+		{1000, VEHICLE_CAR, 3000},      //2000+700 is still below min
+		{10000, VEHICLE_CAR, 9000},     //2000+7000
+		{10400.4, VEHICLE_CAR, 9280},   //7280.28 rounds down
+		{10400.5, VEHICLE_CAR, 9280},   //7280.35 rounds down
+		{10400.8, VEHICLE_CAR, 9281},   //7280.56 rounds up
+		{3333, VEHICLE_BIKE, 1000},     //999.9 rounds to 1000, also the min
+		{4444, VEHICLE_BIKE, 1333},     //1333.2
+		{10000, VEHICLE_SUV, 12000},    //3000+9000
+		{10000, 42, 9000},              //unknown vehicle falls back to car
+		{1234567, VEHICLE_CAR, 866197}, //long one. 2000+864196.9
+	}
+	for idx, c := range cases {
+		if got := tripFare(DEFAULT_TENANT, c.dist, c.vehicleType); got != c.fare {
+			t.Errorf("test case #%d: tripFare(%f,%d)=%d want %d", idx, c.dist, c.vehicleType, got, c.fare)
+		}
+	}
+}
+
+func TestSplitFareCases(t *testing.T) {
+	cases := []struct {
+		total       int64
+		riders      int
+		roundTo     int64
+		perRider    int64
+		driverShare int64
+	}{
+		{9000, 1, 100, 4500, 4500},  //exact
+		{9000, 2, 100, 3000, 3000},  //exact
+		{10000, 2, 100, 3300, 3400}, //3333.33 rounds down, driver pays the extra
+		{10100, 2, 100, 3400, 3300}, //3366.67 rounds up, driver pays less
+		{9900, 3, 100, 2500, 2400},  //2475 is a half, goes up
+		{9899, 3, 100, 2500, 2399},  //2474.75 goes up
+		{9799, 3, 100, 2400, 2599},  //2449.75 goes down
+		{3000, 4, 100, 600, 600},    //exact
+		{3001, 4, 1, 600, 601},      //paise rounding
+		{3003, 4, 1, 601, 599},      //600.6 rounds up
+		{150, 4, 100, 0, 150},       //30 each rounds to 0, driver pays it all
+		{250, 4, 100, 0, 250},       //50 each would round to 100 and overshoot 250, round down instead
+		{199, 1, 100, 100, 99},      //99.5 goes up
+		{0, 2, 100, 0, 0},
+		{5000, 0, 100, 0, 5000}, //no riders
+	}
+	for idx, c := range cases {
+		perRider, driverShare := splitFare(c.total, c.riders, c.roundTo)
+		if perRider != c.perRider || driverShare != c.driverShare {
+			t.Errorf("test case #%d: splitFare(%d,%d,%d)=%d,%d want %d,%d", idx, c.total, c.riders, c.roundTo,
+				perRider, driverShare, c.perRider, c.driverShare)
+		}
+	}
+}
+
+//Every total upto Rs 200, every car size and every rounding unit we might use. Shares must always add up,
+//be multiples of the unit, never be negative and be within half a unit of the exact share unless rounding
+//up would have overshot.
+func TestSplitFareExhaustive(t *testing.T) {
+	for _, roundTo := range []int64{1, 5, 50, 100, 1000} {
+		for riders := 1; riders <= 6; riders++ {
+			for total := int64(0); total <= 20000; total++ {
+				perRider, driverShare := splitFare(total, riders, roundTo)
+				occupants := int64(riders) + 1
+				if perRider*int64(riders)+driverShare != total {
+					t.Fatalf("shares do not add up. total:%d riders:%d unit:%d got %d,%d", total, riders, roundTo, perRider, driverShare)
+				}
+				if perRider%roundTo != 0 || perRider < 0 || driverShare < 0 {
+					t.Fatalf("bad share. total:%d riders:%d unit:%d got %d,%d", total, riders, roundTo, perRider, driverShare)
+				}
+				//|perRider - total/occupants| <= roundTo/2, in integers
+				diff := perRider*occupants*2 - total*2
+				if diff < 0 {
+					diff = -diff
+				}
+				overshot := (perRider+roundTo)*int64(riders) > total
+				if diff > roundTo*occupants && !overshot {
+					t.Fatalf("share too far from exact. total:%d riders:%d unit:%d got %d", total, riders, roundTo, perRider)
+				}
+			}
+		}
+	}
+}
+
+func TestFormatMoney(t *testing.T) {
+	cases := []struct {
+		paise int64
+		want  string
+	}{
+		{0, "0.00"}, {5, "0.05"}, {50, "0.50"}, {100, "1.00"}, {12345, "123.45"}, {-1, "-0.01"}, {-12345, "-123.45"},
+	}
+	for idx, c := range cases {
+		if got := formatMoney(c.paise); got != c.want {
+			t.Errorf("test case #%d: formatMoney(%d)=%s want %s", idx, c.paise, got, c.want)
+		}
+	}
+}
+
+func TestSettlementOnTrip(t *testing.T) {
+	Initialize()
+	tokenDriver, _ := processRequest("driver1", "12.884733,77.551541", "1", "", "", "1", optionalParams{vehicle: "suv"})
+	tokenRider1, _ := updateState("rider1", 12.884800, 77.551600, "", RIDER_STATE, "", EVENT_LOGIN)
+	tokenRider2, _ := updateState("rider2", 12.884800, 77.551600, "", RIDER_STATE, "", EVENT_LOGIN)
+
+	//Without a destination, the rider gets a per km rate. Rs 9/km split with the driver.
+	retStr, err := processRequest("rider1", "12.884800,77.551600", "2", tokenRider1, "driver1", "3", optionalParams{})
+	if err != nil || !strings.Contains(retStr, "Estimated contribution:4.50/km") {
+		t.Errorf("per km estimate wrong. ret:%s err:%v", retStr, err)
+	}
+	updateState("driver1", 12.884733, 77.551541, tokenDriver, DRIVER_STATE, "rider1", EVENT_JOINACCEPT)
+
+	//Second rider, with a destination ~4.4km away. Three in the car now.
+	retStr, err = processRequest("rider2", "12.884733,77.551541", "2", tokenRider2, "driver1", "3",
+		optionalParams{dest: "12.918230,77.573472"})
+	//4418.6m by suv = 3000+3977 = 6977, a third is 2325.67 -> 2300
+	if err != nil || !strings.Contains(retStr, "Estimated contribution:23.00") {
+		t.Errorf("estimate with destination wrong. ret:%s err:%v", retStr, err)
+	}
+	updateState("driver1", 12.884733, 77.551541, tokenDriver, DRIVER_STATE, "rider2", EVENT_JOINACCEPT)
+
+	//Rider1 gets dropped with both still in the car. Shares the 6977 three ways.
+	trip, _ := getActiveTrip("rider1", "driver1")
+	retStr, err = updateState("driver1", 12.918230, 77.573472, tokenDriver, DRIVER_STATE, "rider1", EVENT_TRIPEND)
+	done, _ := getTrip(trip.TripId)
+	if err != nil || done.Fare == nil || done.Fare.TripFare != 6977 || done.Fare.Riders != 2 ||
+		done.Fare.RiderShare != 2300 || done.Fare.DriverShare != 2377 || done.Fare.VehicleType != VEHICLE_SUV {
+		t.Errorf("settlement wrong. ret:%s fare:%v err:%v", retStr, done.Fare, err)
+	}
+	if !strings.Contains(retStr, "yourshare:23.00") {
+		t.Errorf("settlement not in response. ret:%s", retStr)
+	}
+
+	//Rider2 alone for the rest. 0 distance so min fare 4000, half each.
+	trip, _ = getActiveTrip("rider2", "driver1")
+	updateState("driver1", 12.884733, 77.551541, tokenDriver, DRIVER_STATE, "rider2", EVENT_TRIPEND)
+	done, _ = getTrip(trip.TripId)
+	if done.Fare.TripFare != 4000 || done.Fare.Riders != 1 || done.Fare.RiderShare != 2000 {
+		t.Errorf("settlement for last rider wrong. fare:%v", done.Fare)
+	}
+
+	if _, err = processRequest("driver1", "12.88,77.55", "1", "", "", "1", optionalParams{vehicle: "rocket"}); err == nil {
+		t.Errorf("bad vehicle did not fail")
+	}
+}
+
+func TestLoadFareRates(t *testing.T) {
+	Initialize()
+	f, _ := ioutil.TempFile("", "fares")
+	defer os.Remove(f.Name())
+	f.WriteString(`{"car":{"base":0,"perkm":1000,"min":0},"bike":{"base":0,"perkm":100,"min":0}}`)
+	f.Close()
+
+	if err := LoadFareRates(f.Name()); err != nil {
+		t.Fatalf("LoadFareRates failed:%s", err.Error())
+	}
+	if tripFare(DEFAULT_TENANT, 5000, VEHICLE_CAR) != 5000 || tripFare(DEFAULT_TENANT, 5000, VEHICLE_BIKE) != 500 || tripFare(DEFAULT_TENANT, 10000, VEHICLE_SUV) != 12000 {
+		t.Errorf("rates not loaded. car:%d bike:%d suv:%d", tripFare(DEFAULT_TENANT, 5000, VEHICLE_CAR), tripFare(DEFAULT_TENANT, 5000, VEHICLE_BIKE),
+			tripFare(DEFAULT_TENANT, 10000, VEHICLE_SUV))
+	}
+
+	ioutil.WriteFile(f.Name(), []byte(`{"truck":{"perkm":1}}`), 0644)
+	if LoadFareRates(f.Name()) == nil {
+		t.Errorf("unknown vehicle did not fail")
+	}
+	if SetFareRate(VEHICLE_CAR, -1, 0, 0) == nil {
+		t.Errorf("negative rate did not fail")
+	}
+}
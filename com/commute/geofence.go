@@ -0,0 +1,326 @@
+package commute
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+)
+
+//Kinds of zones an operator can configure.
+const ZONE_SERVICE_AREA = 1 //Users must be inside one of these (if any are loaded) to use the app.
+const ZONE_NO_PICKUP = 2    //Joins are not allowed when either party is inside one of these. Eg: airport kerb.
+
+//geoPolygon is a single polygon with an outer ring and optional holes. The bounding box is precomputed so
+//that the common case (point far away from the zone) is a handful of comparisons. This runs on every heartbeat.
+type geoPolygon struct {
+	rings                          [][]Point //rings[0] is the outer boundary, rest are holes.
+	minLat, maxLat, minLon, maxLon float64
+}
+
+//geoZone is a named area made of one or more polygons (a GeoJSON feature).
+type geoZone struct {
+	name     string
+	kind     int
+	polygons []geoPolygon
+}
+
+//Loaded zones. Empty service areas means "serve everywhere" so that a deployment without any
+//geojson config behaves as before.
+var gServiceAreas []geoZone
+var gNoPickupZones []geoZone
+
+//Files the zones were loaded from. Kept around so that the reload endpoint can re-read them.
+var gServiceAreaFile string
+var gNoPickupFile string
+
+var gGeofenceLock = sync.RWMutex{}
+
+//Minimal subset of GeoJSON we understand: FeatureCollection, Feature, Polygon and MultiPolygon.
+type geoJSONObject struct {
+	Type        string                 `json:"type"`
+	Features    []geoJSONObject        `json:"features"`
+	Geometry    *geoJSONObject         `json:"geometry"`
+	Properties  map[string]interface{} `json:"properties"`
+	Coordinates json.RawMessage        `json:"coordinates"`
+}
+
+func newGeoPolygon(coords [][][]float64) (geoPolygon, error) {
+	p := geoPolygon{}
+	if len(coords) == 0 {
+		return p, errors.New("polygon has no rings")
+	}
+	p.rings = make([][]Point, 0, len(coords))
+	for ridx, ring := range coords {
+		if len(ring) < 3 {
+			return p, errors.New(fmt.Sprintf("polygon ring %d has only %d points", ridx, len(ring)))
+		}
+		pts := make([]Point, 0, len(ring))
+		for _, c := range ring {
+			if len(c) < 2 {
+				return p, errors.New(fmt.Sprintf("polygon ring %d has a malformed position", ridx))
+			}
+			//GeoJSON order is [lng, lat]
+			pts = append(pts, Point{Lat: c[1], Lon: c[0]})
+		}
+		p.rings = append(p.rings, pts)
+	}
+
+	//Bounding box of the outer ring is enough. Holes are always inside it.
+	p.minLat, p.maxLat = p.rings[0][0].Lat, p.rings[0][0].Lat
+	p.minLon, p.maxLon = p.rings[0][0].Lon, p.rings[0][0].Lon
+	for _, pt := range p.rings[0] {
+		if pt.Lat < p.minLat {
+			p.minLat = pt.Lat
+		}
+		if pt.Lat > p.maxLat {
+			p.maxLat = pt.Lat
+		}
+		if pt.Lon < p.minLon {
+			p.minLon = pt.Lon
+		}
+		if pt.Lon > p.maxLon {
+			p.maxLon = pt.Lon
+		}
+	}
+	return p, nil
+}
+
+//Standard even-odd ray casting on a single ring.
+func ringContains(ring []Point, lat float64, lng float64) bool {
+	inside := false
+	j := len(ring) - 1
+	for i := 0; i < len(ring); i++ {
+		pi, pj := ring[i], ring[j]
+		if (pi.Lat > lat) != (pj.Lat > lat) &&
+			lng < (pj.Lon-pi.Lon)*(lat-pi.Lat)/(pj.Lat-pi.Lat)+pi.Lon {
+			inside = !inside
+		}
+		j = i
+	}
+	return inside
+}
+
+func (p *geoPolygon) contains(lat float64, lng float64) bool {
+	if lat < p.minLat || lat > p.maxLat || lng < p.minLon || lng > p.maxLon {
+		return false
+	}
+	if !ringContains(p.rings[0], lat, lng) {
+		return false
+	}
+	for _, hole := range p.rings[1:] {
+		if ringContains(hole, lat, lng) {
+			return false
+		}
+	}
+	return true
+}
+
+func (z *geoZone) contains(lat float64, lng float64) bool {
+	for idx := range z.polygons {
+		if z.polygons[idx].contains(lat, lng) {
+			return true
+		}
+	}
+	return false
+}
+
+//Converts a geometry (Polygon/MultiPolygon) into our polygons.
+func parseGeometry(g *geoJSONObject) ([]geoPolygon, error) {
+	polys := make([]geoPolygon, 0)
+	switch g.Type {
+	case "Polygon":
+		var coords [][][]float64
+		if err := json.Unmarshal(g.Coordinates, &coords); err != nil {
+			return nil, errors.New(fmt.Sprintf("bad Polygon coordinates:%s", err.Error()))
+		}
+		p, err := newGeoPolygon(coords)
+		if err != nil {
+			return nil, err
+		}
+		polys = append(polys, p)
+	case "MultiPolygon":
+		var coords [][][][]float64
+		if err := json.Unmarshal(g.Coordinates, &coords); err != nil {
+			return nil, errors.New(fmt.Sprintf("bad MultiPolygon coordinates:%s", err.Error()))
+		}
+		for _, c := range coords {
+			p, err := newGeoPolygon(c)
+			if err != nil {
+				return nil, err
+			}
+			polys = append(polys, p)
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("unsupported geometry type:%s", g.Type))
+	}
+	return polys, nil
+}
+
+//parseGeoJSON reads a FeatureCollection, a single Feature or a bare geometry and returns one zone per feature.
+//The zone name is taken from the "name" property if present.
+func parseGeoJSON(data []byte, kind int) ([]geoZone, error) {
+	var root geoJSONObject
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid geojson:%s", err.Error()))
+	}
+
+	var features []geoJSONObject
+	switch root.Type {
+	case "FeatureCollection":
+		features = root.Features
+	case "Feature":
+		features = []geoJSONObject{root}
+	default:
+		//A bare geometry. Wrap it up as a feature.
+		features = []geoJSONObject{{Type: "Feature", Geometry: &root}}
+	}
+
+	zones := make([]geoZone, 0, len(features))
+	for idx, f := range features {
+		if f.Geometry == nil {
+			return nil, errors.New(fmt.Sprintf("feature #%d has no geometry", idx))
+		}
+		polys, err := parseGeometry(f.Geometry)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("feature #%d: %s", idx, err.Error()))
+		}
+		name := fmt.Sprintf("zone%d", idx)
+		if n, ok := f.Properties["name"].(string); ok && n != "" {
+			name = n
+		}
+		zones = append(zones, geoZone{name: name, kind: kind, polygons: polys})
+	}
+	return zones, nil
+}
+
+func loadZoneFile(path string, kind int) ([]geoZone, error) {
+	if path == "" {
+		return make([]geoZone, 0), nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseGeoJSON(data, kind)
+}
+
+//LoadGeofences reads the service-area and no-pickup-zone GeoJSON files and swaps them in atomically.
+//Either path may be empty. On error, the previously loaded zones are kept as is.
+func LoadGeofences(serviceAreaFile string, noPickupFile string) error {
+	serviceAreas, err := loadZoneFile(serviceAreaFile, ZONE_SERVICE_AREA)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error loading service areas from %s : %s", serviceAreaFile, err.Error()))
+	}
+	noPickupZones, err := loadZoneFile(noPickupFile, ZONE_NO_PICKUP)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error loading no-pickup zones from %s : %s", noPickupFile, err.Error()))
+	}
+
+	gGeofenceLock.Lock()
+	defer gGeofenceLock.Unlock()
+	gServiceAreas = serviceAreas
+	gNoPickupZones = noPickupZones
+	gServiceAreaFile = serviceAreaFile
+	gNoPickupFile = noPickupFile
+	return nil
+}
+
+//ReloadGeofences re-reads the files passed in the last LoadGeofences call.
+func ReloadGeofences() error {
+	gGeofenceLock.RLock()
+	serviceAreaFile, noPickupFile := gServiceAreaFile, gNoPickupFile
+	gGeofenceLock.RUnlock()
+
+	return LoadGeofences(serviceAreaFile, noPickupFile)
+}
+
+func resetGeofences() {
+	gGeofenceLock.Lock()
+	defer gGeofenceLock.Unlock()
+	gServiceAreas = make([]geoZone, 0)
+	gNoPickupZones = make([]geoZone, 0)
+	gServiceAreaFile = ""
+	gNoPickupFile = ""
+}
+
+//Errors out if the location is outside every configured service area.
+func checkServiceArea(lat float64, lng float64) error {
+	gGeofenceLock.RLock()
+	defer gGeofenceLock.RUnlock()
+
+	if len(gServiceAreas) == 0 {
+		return nil //Nothing configured, serve everywhere.
+	}
+	for idx := range gServiceAreas {
+		if gServiceAreas[idx].contains(lat, lng) {
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("Location %.5f,%.5f is outside our service area", lat, lng))
+}
+
+//Returns the name of the no-pickup zone the location falls in, if any.
+func noPickupZoneAt(lat float64, lng float64) (string, bool) {
+	gGeofenceLock.RLock()
+	defer gGeofenceLock.RUnlock()
+
+	for idx := range gNoPickupZones {
+		if gNoPickupZones[idx].contains(lat, lng) {
+			return gNoPickupZones[idx].name, true
+		}
+	}
+	return "", false
+}
+
+//Errors out if either of the commuters is standing in a no-pickup zone. Callers hold gStateLock.
+func checkPickupAllowed(userName string, userState *CommState, other string, otherState *CommState) error {
+	if zone, ok := noPickupZoneAt(userState.lat, userState.lng); ok {
+		return errors.New(fmt.Sprintf("Join not allowed: %s is in no-pickup zone %s", userName, zone))
+	}
+	if zone, ok := noPickupZoneAt(otherState.lat, otherState.lng); ok {
+		return errors.New(fmt.Sprintf("Join not allowed: %s is in no-pickup zone %s", other, zone))
+	}
+	return nil
+}
+
+//Only local operators get to reload. There is no admin auth yet. A proxy on the same box connects from
+//loopback too, on behalf of anyone, so nothing that came through one counts as local.
+func isLocalRequest(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsLoopback() || isTrustedProxy(ip) {
+		return false
+	}
+	for _, h := range []string{"X-Forwarded-For", "X-Real-Ip", "Forwarded"} {
+		if r.Header.Get(h) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+//Function GeofenceReloadHandler re-reads the geojson files so that operators can change zones without a restart.
+func GeofenceReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := isStaffRequest(r, ROLE_ADMIN); !ok {
+		rejectStaffRequest(w, ROLE_ADMIN)
+		return
+	}
+
+	err := ReloadGeofences()
+	if err != nil {
+		fmt.Fprint(w, "ERROR! : ", err)
+	} else {
+		gGeofenceLock.RLock()
+		fmt.Fprintf(w, "Reloaded %d service areas and %d no-pickup zones", len(gServiceAreas), len(gNoPickupZones))
+		gGeofenceLock.RUnlock()
+	}
+
+	fmt.Println(clockNow(), "\t", "geofence reload", "\t", r.RemoteAddr, "\t", err)
+}
@@ -0,0 +1,177 @@
+package commute
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//Roughly Bangalore with a hole cut out in the middle, plus a second disjoint square.
+const testServiceArea = `{"type":"FeatureCollection","features":[
+ {"type":"Feature","properties":{"name":"blr"},"geometry":{"type":"Polygon","coordinates":[
+  [[77.4,12.8],[77.8,12.8],[77.8,13.1],[77.4,13.1],[77.4,12.8]],
+  [[77.55,12.95],[77.6,12.95],[77.6,13.0],[77.55,13.0],[77.55,12.95]]]}},
+ {"type":"Feature","properties":{"name":"other"},"geometry":{"type":"MultiPolygon","coordinates":[
+  [[[10.0,10.0],[11.0,10.0],[11.0,11.0],[10.0,11.0],[10.0,10.0]]]]}}]}`
+
+//Airport kerb inside the service area.
+const testNoPickup = `{"type":"Feature","properties":{"name":"airport"},"geometry":{"type":"Polygon","coordinates":[
+  [[77.70,13.05],[77.72,13.05],[77.72,13.07],[77.70,13.07],[77.70,13.05]]]}}`
+
+func writeGeoFiles(t *testing.T) (string, string) {
+	dir, err := ioutil.TempDir("", "geofence")
+	if err != nil {
+		t.Fatalf("could not create temp dir:%s", err.Error())
+	}
+	serviceFile := filepath.Join(dir, "service.geojson")
+	noPickupFile := filepath.Join(dir, "nopickup.geojson")
+	ioutil.WriteFile(serviceFile, []byte(testServiceArea), 0644)
+	ioutil.WriteFile(noPickupFile, []byte(testNoPickup), 0644)
+	return serviceFile, noPickupFile
+}
+
+func TestPointInPolygon(t *testing.T) {
+	Initialize()
+	serviceFile, noPickupFile := writeGeoFiles(t)
+	defer os.RemoveAll(filepath.Dir(serviceFile))
+
+	if err := LoadGeofences(serviceFile, noPickupFile); err != nil {
+		t.Fatalf("LoadGeofences failed:%s", err.Error())
+	}
+
+	cases := []struct {
+		lat, lng  float64
+		inService bool
+		noPickup  bool
+	}{
+		{12.9, 77.5, true, false},        //inside blr
+		{12.97, 77.57, false, false},     //inside the hole
+		{13.06, 77.71, true, true},       //airport kerb
+		{10.5, 10.5, true, false},        //second feature
+		{150.001, 230.002, false, false}, //nowhere
+		{12.8, 77.3, false, false},       //same lat as the bottom edge, but outside
+	}
+	for idx, c := range cases {
+		got := checkServiceArea(c.lat, c.lng) == nil
+		if got != c.inService {
+			t.Errorf("test case #%d: checkServiceArea(%f,%f)=%t want %t", idx, c.lat, c.lng, got, c.inService)
+		}
+		_, gotNoPickup := noPickupZoneAt(c.lat, c.lng)
+		if gotNoPickup != c.noPickup {
+			t.Errorf("test case #%d: noPickupZoneAt(%f,%f)=%t want %t", idx, c.lat, c.lng, gotNoPickup, c.noPickup)
+		}
+	}
+}
+
+func TestGeofenceBadInput(t *testing.T) {
+	Initialize()
+	cases := []string{
+		`not json`,
+		`{"type":"Point","coordinates":[1,2]}`,
+		`{"type":"Polygon","coordinates":[[[1,2],[3,4]]]}`,
+		`{"type":"FeatureCollection","features":[{"type":"Feature"}]}`,
+	}
+	for idx, c := range cases {
+		if _, err := parseGeoJSON([]byte(c), ZONE_SERVICE_AREA); err == nil {
+			t.Errorf("test case #%d: parseGeoJSON did not return error for %s", idx, c)
+		}
+	}
+	if err := LoadGeofences("/nonexistent/file.geojson", ""); err == nil {
+		t.Errorf("LoadGeofences did not return error for missing file")
+	}
+}
+
+func TestGeofenceUpdateState(t *testing.T) {
+	Initialize()
+	serviceFile, noPickupFile := writeGeoFiles(t)
+	defer os.RemoveAll(filepath.Dir(serviceFile))
+	LoadGeofences(serviceFile, noPickupFile)
+
+	//Login outside should fail
+	_, err := updateState("faraway", 150.001, 230.002, "", RIDER_STATE, "", EVENT_LOGIN)
+	if err == nil || !strings.Contains(err.Error(), "outside our service area") {
+		t.Errorf("login outside service area was not rejected. err:%v", err)
+	}
+
+	tokenDriver, _ := updateState("driver1", 13.06, 77.71, "", DRIVER_STATE, "", EVENT_LOGIN)
+	tokenRider, _ := updateState("rider1", 13.0601, 77.7101, "", RIDER_STATE, "", EVENT_LOGIN)
+
+	//Heartbeat moving out should fail and not update the location
+	_, err = updateState("rider1", 150.001, 230.002, tokenRider, RIDER_STATE, "", EVENT_HEARTBEAT)
+	if err == nil {
+		t.Errorf("location update outside service area was not rejected")
+	}
+	if s := getCurrentState("rider1"); s.lat != 13.0601 {
+		t.Errorf("location got updated despite rejection. lat:%f", s.lat)
+	}
+
+	//Both are at the airport kerb, join request should be blocked.
+	_, err = updateState("rider1", 13.0601, 77.7101, tokenRider, RIDER_STATE, "driver1", EVENT_JOINREQ)
+	if err == nil || !strings.Contains(err.Error(), "airport") {
+		t.Errorf("join request in no-pickup zone was not rejected. err:%v", err)
+	}
+
+	//Driver moves out of the kerb. Rider is still on it.
+	updateState("driver1", 13.04, 77.71, tokenDriver, DRIVER_STATE, "", EVENT_HEARTBEAT)
+	_, err = updateState("rider1", 13.0601, 77.7101, tokenRider, RIDER_STATE, "driver1", EVENT_JOINREQ)
+	if err == nil {
+		t.Errorf("join request with rider in no-pickup zone was not rejected")
+	}
+
+	//Rider walks out too, all good now.
+	retStr, err := updateState("rider1", 13.0401, 77.7101, tokenRider, RIDER_STATE, "driver1", EVENT_JOINREQ)
+	if err != nil || !strings.Contains(retStr, "Success") {
+		t.Errorf("join request outside no-pickup zone failed. err:%v ret:%s", err, retStr)
+	}
+
+	//Driver drives into the kerb before accepting.
+	updateState("driver1", 13.06, 77.71, tokenDriver, DRIVER_STATE, "", EVENT_HEARTBEAT)
+	_, err = updateState("driver1", 13.06, 77.71, tokenDriver, DRIVER_STATE, "rider1", EVENT_JOINACCEPT)
+	if err == nil {
+		t.Errorf("join accept in no-pickup zone was not rejected")
+	}
+}
+
+func TestGeofenceReloadHandler(t *testing.T) {
+	Initialize()
+	serviceFile, noPickupFile := writeGeoFiles(t)
+	defer os.RemoveAll(filepath.Dir(serviceFile))
+	LoadGeofences(serviceFile, noPickupFile)
+
+	//Operator clears out the no-pickup zones on disk.
+	ioutil.WriteFile(noPickupFile, []byte(`{"type":"FeatureCollection","features":[]}`), 0644)
+
+	req := httptest.NewRequest("GET", "/commute/geofence/reload", nil)
+	req.RemoteAddr = "10.1.1.1:5000"
+	w := httptest.NewRecorder()
+	GeofenceReloadHandler(w, req)
+	if w.Code != 403 {
+		t.Errorf("reload from remote host was allowed. code:%d", w.Code)
+	}
+
+	//Through a proxy on the same box is not local
+	req.RemoteAddr = "127.0.0.1:5000"
+	req.Header.Set("X-Forwarded-For", "10.1.1.1")
+	w = httptest.NewRecorder()
+	GeofenceReloadHandler(w, req)
+	if w.Code != 403 {
+		t.Errorf("reload through a proxy was allowed. code:%d", w.Code)
+	}
+	req.Header.Del("X-Forwarded-For")
+	SetTrustedProxies("127.0.0.1")
+	w = httptest.NewRecorder()
+	GeofenceReloadHandler(w, req)
+	if w.Code != 403 {
+		t.Errorf("reload from a trusted proxy was allowed. code:%d", w.Code)
+	}
+	SetTrustedProxies("")
+
+	w = httptest.NewRecorder()
+	GeofenceReloadHandler(w, req)
+	if !strings.Contains(w.Body.String(), "2 service areas and 0 no-pickup zones") {
+		t.Errorf("reload did not pick up the files. body:%s", w.Body.String())
+	}
+}
@@ -4,63 +4,142 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var reqCh chan int
-var reqCnt int = 0
+var reqCnt int64 = 0
+var gStatStart time.Time
+var gStatOnce = sync.Once{}
 
 //Function printStat is a global Stat counter. It will print hygiene stats like #requests,
-// #errs, latency(?) etc. Start with count first
+//#errs, latency(?) etc. Start with count first
 func printStat() {
-	start := time.Now()
 	ticker := time.NewTicker(5 * time.Second)
-	for {
-		select {
-		case ci := <-reqCh:
-			reqCnt += ci
-			if reqCnt%10 == 0 {
-				fmt.Println(" ReqCnt : ", reqCnt, " Time taken=", time.Since(start))
+	for range ticker.C {
+		printReqCnt(atomic.LoadInt64(&reqCnt))
+		if throttled := rateLimitSummary(); throttled != "" {
+			fmt.Println(" Throttled : ", throttled)
+		}
+	}
+}
 
-			}
-		case <-ticker.C:
-			fmt.Println(" ReqCnt : ", reqCnt, " Time taken=", time.Since(start))
+func printReqCnt(cnt int64) {
+	fmt.Println(" ReqCnt : ", cnt, " Time taken=", clockNow().Sub(gStatStart))
+}
 
-		}
+//countRequest is called for every request. Every 10th one prints the count too.
+func countRequest() {
+	if cnt := atomic.AddInt64(&reqCnt, 1); cnt%10 == 0 {
+		printReqCnt(cnt)
 	}
 }
 
 //Function Initialize does all the channel etc initialization and launches threads to monitor
 func Initialize() {
-	reqCh = make(chan int, 100)
 	gStateDS = make(map[string]*CommState, 1000)
 	gLoggedInUsers = make(map[string]string, 1000)
-	//A parallel thread to dump stats
-	go printStat()
+	resetStore()
+	resetBlobStore()
+	resetGeofences()
+	resetLocationPrivacy()
+	resetTrips()
+	resetTrails()
+	resetRatings()
+	resetBlocks()
+	resetFareRates()
+	resetLedger()
+	resetSchedules()
+	resetDemand()
+	resetEventLog()
+	resetRateLimits()
+	resetAuth()
+	resetTokens()
+	resetSafety()
+	resetOrgs()
+	resetTenants()
+	resetProfiles()
+	resetOnboarding()
+	resetSessions()
+	//A parallel thread to dump stats. Just the one, however many times we are initialized.
+	gStatOnce.Do(func() {
+		gStatStart = clockNow()
+		go printStat()
+	})
 
 }
 
-//entry point calls this...directly accepts strings as given in URL and then does
-//parsing and validation. Keep it as is..easier to unit-test.
-func processRequest(userName string, latlngstr string,
-	driverorrider string, token string, other string,
-	eventtype string) (string, error) {
-	//Now lets process the params
+//optionalParams are the query params which the app may or may not send. As is from the URL, parsed
+//in processRequest.
+type optionalParams struct {
+	minrating string //Only drivers/riders rated above this are shown.
+	vehicle   string //bike/car/suv. Sent by drivers on login.
+	dest      string //"lat,lng" where the rider is headed. Sent with join requests for the fare estimate.
+	device    string //Id of the phone, sent on login. Tells the user's sessions apart.
+	userAgent string //From the header, not the query. Shown in the list of sessions.
+}
+
+//Parses "lat,lng"
+func parseLatLng(latlngstr string) (float64, float64, error) {
 	var latLongArr []string = strings.Split(latlngstr, ",")
 	if len(latLongArr) != 2 {
-		return "", errors.New(fmt.Sprintf("latlongstr wrong format:%s", latlngstr))
+		return 0, 0, errors.New(fmt.Sprintf("latlongstr wrong format:%s", latlngstr))
 	}
-	var latFlt, lngFlt float64
-	var err1, err2, err error
-	latFlt, err1 = strconv.ParseFloat(latLongArr[0], 64)
+	latFlt, err1 := strconv.ParseFloat(latLongArr[0], 64)
 	if err1 != nil {
-		return "", errors.New(fmt.Sprintf("ERROR in lat parameter:%s", err1.Error()))
+		return 0, 0, errors.New(fmt.Sprintf("ERROR in lat parameter:%s", err1.Error()))
 	}
-	lngFlt, err2 = strconv.ParseFloat(latLongArr[1], 64)
+	lngFlt, err2 := strconv.ParseFloat(latLongArr[1], 64)
 	if err2 != nil {
-		return "", errors.New(fmt.Sprintf("ERROR in lng parameter:%s", err2.Error()))
+		return 0, 0, errors.New(fmt.Sprintf("ERROR in lng parameter:%s", err2.Error()))
+	}
+	return latFlt, lngFlt, nil
+}
+
+func parseOptionalParams(optional optionalParams) (requestOptions, error) {
+	var err error
+	opts := requestOptions{}
+	if optional.minrating != "" {
+		opts.minRating, err = strconv.ParseFloat(optional.minrating, 64)
+		if err != nil || opts.minRating < 0 || opts.minRating > MAX_STARS {
+			return opts, errors.New(fmt.Sprintf("ERROR in minrating parameter:%s", optional.minrating))
+		}
+	}
+	if optional.vehicle != "" {
+		var ok bool
+		if opts.vehicleType, ok = vehicleNames[optional.vehicle]; !ok {
+			return opts, errors.New(fmt.Sprintf("ERROR in vehicle parameter:%s", optional.vehicle))
+		}
+	}
+	if optional.dest != "" {
+		opts.destLat, opts.destLng, err = parseLatLng(optional.dest)
+		if err != nil {
+			return opts, errors.New(fmt.Sprintf("ERROR in dest parameter:%s", err.Error()))
+		}
+		opts.hasDest = true
+	}
+	opts.device = optional.device
+	opts.userAgent = optional.userAgent
+	return opts, nil
+}
+
+//entry point calls this...directly accepts strings as given in URL and then does
+//parsing and validation. Keep it as is..easier to unit-test.
+func processRequest(userName string, latlngstr string,
+	driverorrider string, token string, other string,
+	eventtype string, optional optionalParams) (string, error) {
+	//Now lets process the params. No param at all is fine, the user is then where they were last seen.
+	var latFlt, lngFlt float64
+	var err error
+	if latlngstr != "" {
+		latFlt, lngFlt, err = parseLatLng(latlngstr)
+		if err != nil {
+			return "", err
+		}
 	}
 	var driverRiderMode int
 	driverRiderMode, err = strconv.Atoi(driverorrider)
@@ -69,13 +148,18 @@ func processRequest(userName string, latlngstr string,
 	}
 	var everyTypeParsed int
 	everyTypeParsed, err = strconv.Atoi(eventtype)
-	if err != nil || (everyTypeParsed != EVENT_LOGIN && everyTypeParsed != EVENT_HEARTBEAT &&
-		everyTypeParsed != EVENT_JOINREQ && everyTypeParsed != EVENT_JOINACCEPT) {
+	if err != nil || !isValidEventType(everyTypeParsed) {
 		return "", errors.New(fmt.Sprintf("ERROR in eventtype parameter:%s", eventtype))
 	}
 
+	opts, err := parseOptionalParams(optional)
+	if err != nil {
+		return "", err
+	}
+	opts.noPosition = latlngstr == ""
+
 	//Now hand the thing over to the updater
-	retValue, err := updateState(userName, latFlt, lngFlt, token, driverRiderMode, other, everyTypeParsed)
+	retValue, err := updateStateWithOpts(userName, latFlt, lngFlt, token, driverRiderMode, other, everyTypeParsed, opts)
 	return retValue, err //Return as is
 }
 
@@ -86,19 +170,64 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	reqCh <- 1
+	countRequest()
 
 	//Parse the parameters in the request
 	ip := r.RemoteAddr
 	user := r.URL.Query().Get("user")
 	ua := r.Header.Get("User-Agent")
-	token := r.URL.Query().Get("token")
+	latlngstr := r.URL.Query().Get("param")
+
+	//Throttle before doing any work. See ratelimit.go. The user's limits only with their token, and never for
+	//an SOS; raiseSOS keeps repeats from spamming. The IP ones always.
+	eventName := r.URL.Query().Get("eventtype")
+	if eventName == "" {
+		eventName = eventNames[EVENT_HEARTBEAT]
+	}
+	limitUser := rateLimitUser(user, r.URL.Query().Get("token"))
+	if eventName == eventNames[EVENT_SOS] {
+		limitUser = ""
+	}
+	if ok, rule := allowRequest(limitUser, clientIP(r), eventName); !ok {
+		rejectRateLimited(w)
+		fmt.Println(clockNow(), "\t", user, "\t", ip, "\t", latlngstr, "\t", ua,
+			"\t", r.URL.RawQuery, "\t", "", "\t", "throttled by "+rule)
+		return
+	}
+
+	retValue, err := processQuery(r.URL.Query(), ua)
+	if err != nil {
+		fmt.Fprint(w, "ERROR! :", err)
+	} else {
+		fmt.Fprint(w, retValue)
+	}
+
+	//fmt.Fprintf(w, "Request processed successfully :")
+
+	//Ideally should be using some logging system. TODO.
+	fmt.Println(clockNow(), "\t", user, "\t", ip, "\t", latlngstr, "\t", ua,
+		"\t", r.URL.RawQuery, "\t", retValue, "\t", err)
+
+}
+
+//processQuery takes the query params as the app sends them, and processes the request. Split out of Handler
+//so that recorded requests can be fed through again (see cmd/replay).
+func processQuery(q url.Values, userAgent string) (string, error) {
+	user := q.Get("user")
+	token := q.Get("token")
 
 	//The following are legacy reasons we are keep params as is. Lets chagne both app and these strings soon.
-	latlngstr := r.URL.Query().Get("param") //looks like "100.112,300.117"
-	status := r.URL.Query().Get("status")   //This actually is the "other"
-	eventtype := r.URL.Query().Get("eventtype")
-	driverorrider := r.URL.Query().Get("mode")
+	latlngstr := q.Get("param") //looks like "100.112,300.117"
+	status := q.Get("status")   //This actually is the "other"
+	eventtype := q.Get("eventtype")
+	driverorrider := q.Get("mode")
+	optional := optionalParams{
+		minrating: q.Get("minrating"),
+		vehicle:   q.Get("vehicle"),
+		dest:      q.Get("dest"),
+		device:    q.Get("device"),
+		userAgent: userAgent,
+	}
 
 	//Legacy mess. todo - change these to integers asap!
 	switch eventtype {
@@ -110,27 +239,28 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 		eventtype = "3"
 	case "joinaccept":
 		eventtype = "4"
+	case "tripend":
+		eventtype = "5"
+	case "block":
+		eventtype = "6"
+	case "unblock":
+		eventtype = "7"
+	case "blocklist":
+		eventtype = "8"
+	case "logout":
+		eventtype = "9"
+	case "sessions":
+		eventtype = "10"
+	case "switchmode":
+		eventtype = "11"
+	case "sos":
+		eventtype = "12"
 	default:
 		eventtype = "-1" //invalid
 	}
-	if latlngstr == "" {
-		latlngstr = "0.0,0.0"
-	}
 	if driverorrider == "" {
 		driverorrider = "1"
 	}
 
-	retValue, err := processRequest(user, latlngstr, driverorrider, token, status, eventtype)
-	if err != nil {
-		fmt.Fprintf(w, "ERROR! :", err)
-	} else {
-		fmt.Fprintf(w, retValue)
-	}
-
-	//fmt.Fprintf(w, "Request processed successfully :")
-
-	//Ideally should be using some logging system. TODO.
-	fmt.Println(time.Now(), "\t", user, "\t", ip, "\t", latlngstr, "\t", ua,
-		"\t", r.URL.RawQuery, "\t", retValue, "\t", err)
-
+	return processRequest(user, latlngstr, driverorrider, token, status, eventtype, optional)
 }
@@ -1,6 +1,11 @@
 package commute
 
 import (
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -16,7 +21,7 @@ func TestProcessReqs(t *testing.T) {
 		{"user1", "1.234,-3.4444", "1", "6", "", "wrongetype"},
 	}
 	for idx, c := range cases {
-		gotstr, err := processRequest(c.username, c.latlng, c.mode, "", "", c.etype)
+		gotstr, err := processRequest(c.username, c.latlng, c.mode, "", "", c.etype, optionalParams{})
 		if c.errstr == "" && err != nil {
 			t.Errorf("test case #", idx, " : processRequest returned error when there was none. ", err.Error())
 		}
@@ -25,3 +30,67 @@ func TestProcessReqs(t *testing.T) {
 		}
 	}
 }
+
+//Events sent without a location are not rejected, and do not move the user.
+func TestNoParam(t *testing.T) {
+	Initialize()
+	serviceFile, noPickupFile := writeGeoFiles(t)
+	defer os.RemoveAll(filepath.Dir(serviceFile))
+	LoadGeofences(serviceFile, noPickupFile)
+
+	query := func(params string) (string, error) {
+		q, _ := url.ParseQuery(params)
+		return processQuery(q, "okhttp")
+	}
+	if _, err := query("user=rider1&mode=2&eventtype=login"); err == nil {
+		t.Errorf("login without a location went through")
+	}
+	tokenDriver, _ := query("user=driver1&mode=1&eventtype=login&param=13.04,77.71")
+	tokenRider, _ := query("user=rider1&mode=2&eventtype=login&param=13.0401,77.7101")
+
+	cases := []struct {
+		params   string
+		expected string
+	}{
+		{"user=rider1&mode=2&eventtype=joinrequest&status=driver1&token=" + tokenRider, "Success"},
+		{"user=driver1&mode=1&eventtype=joinaccept&status=rider1&token=" + tokenDriver, "Success"},
+		{"user=rider1&mode=2&token=" + tokenRider, "riderresppayload,1,driver1"},
+		{"user=rider1&mode=2&eventtype=tripend&status=driver1&token=" + tokenRider, "Success"},
+		{"user=rider1&mode=2&eventtype=block&status=driver1&token=" + tokenRider, "Success"},
+		{"user=rider1&mode=2&eventtype=logout&token=" + tokenRider, "Success"},
+	}
+	for idx, c := range cases {
+		if got, err := query(c.params); err != nil || !strings.HasPrefix(got, c.expected) {
+			t.Errorf("test case #%d: got %s %v, expected %s", idx, got, err, c.expected)
+		}
+	}
+	if s := getCurrentState("driver1"); s.lat != 13.04 || s.lng != 77.71 {
+		t.Errorf("moved without a location:%f,%f", s.lat, s.lng)
+	}
+	//A location outside the area is turned away on any event but an SOS, else the user could be moved there
+	if _, err := query("user=driver1&mode=1&eventtype=blocklist&param=12.0,77.0&token=" + tokenDriver); err == nil {
+		t.Errorf("event from outside the service area went through")
+	}
+	if s := getCurrentState("driver1"); s.lat != 13.04 || s.lng != 77.71 {
+		t.Errorf("moved outside the service area:%f,%f", s.lat, s.lng)
+	}
+}
+
+//Responses go out as they are, a % in them included.
+func TestHandlerResponse(t *testing.T) {
+	Initialize()
+	cases := []struct {
+		rawQuery string
+		expected string
+	}{
+		{"user=rider1&mode=2&eventtype=login&param=12.88%25,77.55", `ERROR! :ERROR in lat parameter:strconv.ParseFloat: parsing "12.88%"`},
+		{"user=rider1&mode=2&eventtype=login&param=12.8848,77.5516", "ey"}, //The token
+	}
+	for idx, c := range cases {
+		resp := httptest.NewRecorder()
+		Handler(resp, httptest.NewRequest("GET", "/commute/map?"+c.rawQuery, nil))
+		if got := resp.Body.String(); !strings.HasPrefix(got, c.expected) || strings.Contains(got, "%!") {
+			t.Errorf("test case #%d: got %s, expected %s", idx, got, c.expected)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package commute
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Demand is counted per geohash cell, per minute. Precision 6 is about 1.2km x 0.6km, roughly a neighbourhood.
+const HEATMAP_PRECISION = 6
+const HEATMAP_RETENTION_MINUTES = 24 * 60 //Older counts are dropped
+const HEATMAP_DEFAULT_WINDOW = 15         //Minutes, when the caller does not say
+const HEATMAP_HINT_RADIUS = 5000          //Drivers are only pointed to demand this close, in metres
+
+//What gets counted
+const METRIC_SEARCH = 0     //A rider not yet with a driver looked for drivers
+const METRIC_UNMATCHED = 1  //...and found nobody
+const METRIC_JOINREQ = 2    //A rider asked a driver
+const METRIC_JOINACCEPT = 3 //A driver took a rider
+const numMetrics = 4
+
+type demandCounts [numMetrics]int
+
+//tenant -> cell -> minute since epoch -> counts. Tenants do not see each other's demand.
+var gDemand map[string]map[string]map[int64]*demandCounts
+var gDemandLock = sync.RWMutex{}
+var gDemandSwept int64 //Minute of the last sweepDemand
+
+func resetDemand() {
+	gDemandLock.Lock()
+	defer gDemandLock.Unlock()
+	gDemand = make(map[string]map[string]map[int64]*demandCounts)
+	gDemandSwept = 0
+}
+
+//Callers hold gDemandLock for writing. Throws away counts past retention in every cell, and cells and tenants
+//left with nothing. Cells nobody asks from any more would keep their old counts otherwise.
+func sweepDemand(minute int64) {
+	for tenant, byCell := range gDemand {
+		for cell, byMinute := range byCell {
+			for m := range byMinute {
+				if m <= minute-HEATMAP_RETENTION_MINUTES {
+					delete(byMinute, m)
+				}
+			}
+			if len(byMinute) == 0 {
+				delete(byCell, cell)
+			}
+		}
+		if len(byCell) == 0 {
+			delete(gDemand, tenant)
+		}
+	}
+	gDemandSwept = minute
+}
+
+const geohashBase32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+//geohashEncode is the standard geohash: alternate bits of longitude and latitude, 5 bits a character.
+func geohashEncode(lat float64, lng float64, precision int) string {
+	latLo, latHi := -90.0, 90.0
+	lngLo, lngHi := -180.0, 180.0
+	var sb strings.Builder
+	bit, ch, even := 0, 0, true
+	for sb.Len() < precision {
+		if even {
+			mid := (lngLo + lngHi) / 2
+			if lng >= mid {
+				ch = ch<<1 | 1
+				lngLo = mid
+			} else {
+				ch = ch << 1
+				lngHi = mid
+			}
+		} else {
+			mid := (latLo + latHi) / 2
+			if lat >= mid {
+				ch = ch<<1 | 1
+				latLo = mid
+			} else {
+				ch = ch << 1
+				latHi = mid
+			}
+		}
+		even = !even
+		if bit++; bit == 5 {
+			sb.WriteByte(geohashBase32[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return sb.String()
+}
+
+//geohashBounds returns the box a cell covers: min lat, min lng, max lat, max lng.
+func geohashBounds(hash string) (float64, float64, float64, float64, error) {
+	latLo, latHi := -90.0, 90.0
+	lngLo, lngHi := -180.0, 180.0
+	even := true
+	for _, c := range hash {
+		idx := strings.IndexRune(geohashBase32, c)
+		if idx < 0 {
+			return 0, 0, 0, 0, errors.New(fmt.Sprintf("Invalid geohash:%s", hash))
+		}
+		for b := 4; b >= 0; b-- {
+			on := idx&(1<<uint(b)) != 0
+			if even {
+				mid := (lngLo + lngHi) / 2
+				if on {
+					lngLo = mid
+				} else {
+					lngHi = mid
+				}
+			} else {
+				mid := (latLo + latHi) / 2
+				if on {
+					latLo = mid
+				} else {
+					latHi = mid
+				}
+			}
+			even = !even
+		}
+	}
+	return latLo, lngLo, latHi, lngHi, nil
+}
+
+//recordDemand counts one event of the tenant at the location. Also sweeps out anything past retention, at
+//most once a minute.
+func recordDemand(tenant string, metric int, lat float64, lng float64, now time.Time) {
+	cell := geohashEncode(lat, lng, HEATMAP_PRECISION)
+	minute := now.Unix() / 60
+
+	gDemandLock.Lock()
+	defer gDemandLock.Unlock()
+	if minute != gDemandSwept {
+		sweepDemand(minute)
+	}
+	byCell, ok := gDemand[tenant]
+	if !ok {
+		byCell = make(map[string]map[int64]*demandCounts)
+		gDemand[tenant] = byCell
+	}
+	byMinute, ok := byCell[cell]
+	if !ok {
+		byMinute = make(map[int64]*demandCounts)
+		byCell[cell] = byMinute
+	}
+	counts, ok := byMinute[minute]
+	if !ok {
+		counts = &demandCounts{}
+		byMinute[minute] = counts
+	}
+	counts[metric]++
+}
+
+//heatmapCell is what the dashboard gets for one cell over the window.
+type heatmapCell struct {
+	Cell      string  `json:"cell"`
+	Lat       float64 `json:"lat"` //Centre of the cell
+	Lng       float64 `json:"lng"`
+	Searches  int     `json:"searches"`
+	Unmatched int     `json:"unmatched"`
+	JoinReqs  int     `json:"joinreqs"`
+	Joins     int     `json:"joins"`
+	Drivers   int     `json:"drivers"` //Drivers in the cell right now, not over the window
+}
+
+//Unmet demand: riders who found nobody, less the drivers who are there now to take them.
+func (c heatmapCell) shortfall() int {
+	return c.Unmatched - c.Drivers
+}
+
+//getHeatmap adds up the tenant's last windowMinutes of counts per cell, along with the current supply of
+//their drivers. Sorted by shortfall, worst first.
+func getHeatmap(tenant string, windowMinutes int, now time.Time) []heatmapCell {
+	from := now.Unix()/60 - int64(windowMinutes) + 1
+	cells := make(map[string]*heatmapCell)
+	get := func(cell string) *heatmapCell {
+		if c, ok := cells[cell]; ok {
+			return c
+		}
+		minLat, minLng, maxLat, maxLng, _ := geohashBounds(cell)
+		c := &heatmapCell{Cell: cell, Lat: (minLat + maxLat) / 2, Lng: (minLng + maxLng) / 2}
+		cells[cell] = c
+		return c
+	}
+
+	gDemandLock.RLock()
+	for cell, byMinute := range gDemand[tenant] {
+		for m, counts := range byMinute {
+			if m < from || m > now.Unix()/60 {
+				continue
+			}
+			c := get(cell)
+			c.Searches += counts[METRIC_SEARCH]
+			c.Unmatched += counts[METRIC_UNMATCHED]
+			c.JoinReqs += counts[METRIC_JOINREQ]
+			c.Joins += counts[METRIC_JOINACCEPT]
+		}
+	}
+	gDemandLock.RUnlock()
+
+	gStateLock.RLock()
+	for _, s := range gStateDS {
+		if s.driverOrRider == DRIVER_STATE && s.tenant == tenant && now.Unix()-s.lastUptTime <= BATCH_STALE_SECS {
+			get(geohashEncode(s.lat, s.lng, HEATMAP_PRECISION)).Drivers++
+		}
+	}
+	gStateLock.RUnlock()
+
+	arr := make([]heatmapCell, 0, len(cells))
+	for _, c := range cells {
+		arr = append(arr, *c)
+	}
+	sort.Slice(arr, func(i, j int) bool {
+		if arr[i].shortfall() != arr[j].shortfall() {
+			return arr[i].shortfall() > arr[j].shortfall()
+		}
+		return arr[i].Cell < arr[j].Cell
+	})
+	return arr
+}
+
+//heatmapGeoJSON turns the cells into a FeatureCollection of boxes, counts in the properties.
+func heatmapGeoJSON(cells []heatmapCell) ([]byte, error) {
+	features := make([]map[string]interface{}, 0, len(cells))
+	for _, c := range cells {
+		minLat, minLng, maxLat, maxLng, err := geohashBounds(c.Cell)
+		if err != nil {
+			return nil, err
+		}
+		ring := [][]float64{{minLng, minLat}, {maxLng, minLat}, {maxLng, maxLat}, {minLng, maxLat}, {minLng, minLat}}
+		features = append(features, map[string]interface{}{
+			"type":       "Feature",
+			"geometry":   map[string]interface{}{"type": "Polygon", "coordinates": [][][]float64{ring}},
+			"properties": c,
+		})
+	}
+	return json.Marshal(map[string]interface{}{"type": "FeatureCollection", "features": features})
+}
+
+//demandHint points a driver to the nearest cell with unmet demand of their tenant. ok is false if there is
+//none around.
+func demandHint(tenant string, lat float64, lng float64, now time.Time) (heatmapCell, float64, bool) {
+	var best heatmapCell
+	bestDist := 0.0
+	found := false
+	for _, c := range getHeatmap(tenant, HEATMAP_DEFAULT_WINDOW, now) {
+		if c.shortfall() <= 0 {
+			continue
+		}
+		dist := DistanceBetwnPts(Point{Lat: lat, Lon: lng}, Point{Lat: c.Lat, Lon: c.Lng})
+		if dist > HEATMAP_HINT_RADIUS {
+			continue
+		}
+		if !found || dist < bestDist {
+			best, bestDist, found = c, dist, true
+		}
+	}
+	return best, bestDist, found
+}
+
+//processDemandHintRequest is for drivers. Format is demandhintpayload,0 or demandhintpayload,1,lat,lng,dist
+func processDemandHintRequest(userName string, token string) (string, error) {
+	if _, err := isUserValid(userName, token); err != nil {
+		return "", err
+	}
+	gStateLock.RLock()
+	s, ok := gStateDS[userName]
+	isDriver := ok && s.driverOrRider == DRIVER_STATE
+	lat, lng, tenant := 0.0, 0.0, ""
+	if isDriver {
+		lat, lng, tenant = s.lat, s.lng, s.tenant
+	}
+	gStateLock.RUnlock()
+	if !isDriver {
+		return "", errors.New(fmt.Sprintf("Demand hints are only for drivers:%s", userName))
+	}
+	c, dist, ok := demandHint(tenant, lat, lng, clockNow())
+	if !ok {
+		return "demandhintpayload,0", nil
+	}
+	return fmt.Sprintf("demandhintpayload,1,%.4f,%.4f,%.0f", c.Lat, c.Lng, dist), nil
+}
+
+//Function DemandHintHandler tells a driver where riders are waiting. Params are user and token.
+func DemandHintHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	user := q.Get("user")
+	retValue, err := processDemandHintRequest(user, q.Get("token"))
+	if err != nil {
+		fmt.Fprint(w, "ERROR! :", err)
+	} else {
+		fmt.Fprint(w, retValue)
+	}
+
+	fmt.Println(clockNow(), "\t", user, "\t", r.RemoteAddr, "\t", r.URL.RawQuery, "\t", err)
+}
+
+//processHeatmapRequest returns the tenant's heatmap as json or geojson.
+func processHeatmapRequest(tenant string, windowStr string, format string) (string, error) {
+	window := HEATMAP_DEFAULT_WINDOW
+	if windowStr != "" {
+		var err error
+		if window, err = strconv.Atoi(windowStr); err != nil || window <= 0 || window > HEATMAP_RETENTION_MINUTES {
+			return "", errors.New(fmt.Sprintf("ERROR in window parameter:%s", windowStr))
+		}
+	}
+	cells := getHeatmap(tenant, window, clockNow())
+	var data []byte
+	var err error
+	switch format {
+	case "", "json":
+		data, err = json.Marshal(cells)
+	case "geojson":
+		data, err = heatmapGeoJSON(cells)
+	default:
+		return "", errors.New(fmt.Sprintf("ERROR in format parameter:%s", format))
+	}
+	return string(data), err
+}
+
+//Function HeatmapHandler is for the ops dashboard. Params are tenant (the caller's own if not given), window in
+//minutes and format (json/geojson). Admins and support only, see isTenantStaffRequest.
+func HeatmapHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := isTenantStaffRequest(r, ROLE_ADMIN, ROLE_SUPPORT)
+	if !ok {
+		rejectStaffRequest(w, ROLE_ADMIN, ROLE_SUPPORT)
+		return
+	}
+	q := r.URL.Query()
+	tenant := q.Get("tenant")
+	if tenant == "" {
+		tenant = tenantOf(actor)
+	}
+	var retValue string
+	var err error
+	if !isTenant(tenant) || !canSeeTenant(actor, tenant) {
+		err = errors.New(fmt.Sprintf("No such tenant:%s", tenant))
+	} else {
+		retValue, err = processHeatmapRequest(tenant, q.Get("window"), q.Get("format"))
+	}
+	if err != nil {
+		fmt.Fprint(w, "ERROR! :", err)
+	} else {
+		fmt.Fprint(w, retValue)
+	}
+
+	fmt.Println(clockNow(), "\t", "heatmap", "\t", r.RemoteAddr, "\t", r.URL.RawQuery, "\t", err)
+}
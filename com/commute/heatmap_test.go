@@ -0,0 +1,186 @@
+package commute
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGeohash(t *testing.T) {
+	cases := []struct {
+		lat, lng  float64
+		precision int
+		expected  string
+	}{
+		{57.64911, 10.40744, 11, "u4pruydqqvj"}, //The example from the original geohash write-up
+		{0, 0, 1, "s"},
+		{-90, -180, 2, "00"},
+		{12.9716, 77.5946, 6, ""}, //Only checked for round trip
+	}
+	for idx, c := range cases {
+		hash := geohashEncode(c.lat, c.lng, c.precision)
+		if c.expected != "" && hash != c.expected {
+			t.Errorf("test case #%d: geohash = %s, expected %s", idx, hash, c.expected)
+		}
+		minLat, minLng, maxLat, maxLng, err := geohashBounds(hash)
+		if err != nil || c.lat < minLat || c.lat > maxLat || c.lng < minLng || c.lng > maxLng {
+			t.Errorf("test case #%d: %s does not contain the point. err:%v", idx, hash, err)
+		}
+	}
+	if _, _, _, _, err := geohashBounds("abc"); err == nil {
+		t.Errorf("invalid geohash did not fail")
+	}
+}
+
+//A rider waiting with nobody around shows up as unmatched, and a driver a couple of km away gets pointed there.
+func TestHeatmapAndHint(t *testing.T) {
+	Initialize()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+	tokenRider, _ := updateState("rider1", 12.884733, 77.551541, "", RIDER_STATE, "", EVENT_LOGIN)
+	tokenDriver, _ := updateState("driver1", 12.900000, 77.551541, "", DRIVER_STATE, "", EVENT_LOGIN)
+	updateState("rider1", 12.884733, 77.551541, tokenRider, RIDER_STATE, "", EVENT_HEARTBEAT)
+	updateState("rider1", 12.884733, 77.551541, tokenRider, RIDER_STATE, "", EVENT_HEARTBEAT)
+	//Old enough to be out of the default window
+	recordDemand(DEFAULT_TENANT, METRIC_UNMATCHED, 12.884733, 77.551541, clock.Now().Add(-time.Hour))
+
+	cells := getHeatmap(DEFAULT_TENANT, HEATMAP_DEFAULT_WINDOW, clock.Now())
+	if len(cells) != 2 {
+		t.Fatalf("expected the rider's and the driver's cells:%v", cells)
+	}
+	riderCell := geohashEncode(12.884733, 77.551541, HEATMAP_PRECISION)
+	if c := cells[0]; c.Cell != riderCell || c.Searches != 2 || c.Unmatched != 2 || c.Drivers != 0 {
+		t.Errorf("wrong counts for rider's cell:%v", c)
+	}
+	if c := cells[1]; c.Drivers != 1 || c.Searches != 0 {
+		t.Errorf("wrong counts for driver's cell:%v", c)
+	}
+	if cells = getHeatmap(DEFAULT_TENANT, 120, clock.Now()); cells[0].Unmatched != 3 {
+		t.Errorf("longer window did not pick up the old count:%v", cells[0])
+	}
+
+	retStr, err := processDemandHintRequest("driver1", tokenDriver)
+	if err != nil || !strings.HasPrefix(retStr, "demandhintpayload,1,12.88") {
+		t.Errorf("wrong hint:%s err:%v", retStr, err)
+	}
+	if _, err = processDemandHintRequest("rider1", tokenRider); err == nil {
+		t.Errorf("rider got a driver hint")
+	}
+
+	//Driver comes over and picks up
+	updateState("driver1", 12.884800, 77.551600, tokenDriver, DRIVER_STATE, "", EVENT_HEARTBEAT)
+	updateState("rider1", 12.884733, 77.551541, tokenRider, RIDER_STATE, "driver1", EVENT_JOINREQ)
+	updateState("driver1", 12.884800, 77.551600, tokenDriver, DRIVER_STATE, "rider1", EVENT_JOINACCEPT)
+	cells = getHeatmap(DEFAULT_TENANT, HEATMAP_DEFAULT_WINDOW, clock.Now())
+	if cells[0].JoinReqs != 1 || cells[0].Joins != 1 {
+		t.Errorf("joins not counted:%v", cells[0])
+	}
+	//Joined riders are not searching any more
+	updateState("rider1", 12.884733, 77.551541, tokenRider, RIDER_STATE, "", EVENT_HEARTBEAT)
+	if c := getHeatmap(DEFAULT_TENANT, HEATMAP_DEFAULT_WINDOW, clock.Now())[0]; c.Searches != 2 {
+		t.Errorf("joined rider counted as searching:%v", c)
+	}
+	//Two unmatched against the one driver now there is still a shortfall
+	if retStr, _ = processDemandHintRequest("driver1", tokenDriver); !strings.HasPrefix(retStr, "demandhintpayload,1,") {
+		t.Errorf("no hint with demand still unmet:%s", retStr)
+	}
+}
+
+func TestHeatmapGeoJSON(t *testing.T) {
+	Initialize()
+	recordDemand(DEFAULT_TENANT, METRIC_SEARCH, 12.884733, 77.551541, time.Now())
+	retStr, err := processHeatmapRequest(DEFAULT_TENANT, "5", "geojson")
+	if err != nil {
+		t.Fatalf("heatmap failed:%s", err.Error())
+	}
+	fc := struct {
+		Type     string `json:"type"`
+		Features []struct {
+			Geometry struct {
+				Coordinates [][][]float64 `json:"coordinates"`
+			} `json:"geometry"`
+			Properties heatmapCell `json:"properties"`
+		} `json:"features"`
+	}{}
+	if err = json.Unmarshal([]byte(retStr), &fc); err != nil || fc.Type != "FeatureCollection" || len(fc.Features) != 1 {
+		t.Fatalf("bad geojson:%s err:%v", retStr, err)
+	}
+	if f := fc.Features[0]; len(f.Geometry.Coordinates[0]) != 5 || f.Properties.Searches != 1 {
+		t.Errorf("bad feature:%v", f)
+	}
+
+	cases := []struct {
+		window, format string
+	}{
+		{"0", "json"},
+		{"abc", "json"},
+		{"5", "xml"},
+	}
+	for idx, c := range cases {
+		if _, err = processHeatmapRequest(DEFAULT_TENANT, c.window, c.format); err == nil {
+			t.Errorf("test case #%d: bad params did not fail", idx)
+		}
+	}
+}
+
+//Each tenant has its own demand, and its staff only see theirs.
+func TestTenantHeatmap(t *testing.T) {
+	newTestTenants(t)
+	token := newUser("pune/admin1", 12.884800, 77.551600, RIDER_STATE)
+	grantRole("localhost", "pune/admin1", ROLE_ADMIN)
+	tokenRider := newUser("pune/rider1", 12.884733, 77.551541, RIDER_STATE)
+	tokenDriver := newUser("goa/driver1", 12.890000, 77.551541, DRIVER_STATE)
+	updateState("pune/rider1", 12.884733, 77.551541, tokenRider, RIDER_STATE, "", EVENT_HEARTBEAT)
+
+	if cells := getHeatmap("goa", HEATMAP_DEFAULT_WINDOW, clockNow()); len(cells) != 1 || cells[0].Unmatched != 0 {
+		t.Errorf("another tenant's demand:%+v", cells)
+	}
+	if retStr, _ := processDemandHintRequest("goa/driver1", tokenDriver); retStr != "demandhintpayload,0" {
+		t.Errorf("pointed to another tenant's riders:%s", retStr)
+	}
+
+	heatmap := func(query string, remote string) string {
+		r := httptest.NewRequest("GET", "/commute/admin/heatmap?"+query, nil)
+		r.RemoteAddr = remote
+		resp := httptest.NewRecorder()
+		HeatmapHandler(resp, r)
+		return resp.Body.String()
+	}
+	cases := []struct {
+		query    string
+		remote   string
+		expected string
+	}{
+		{"token=" + token, "1.2.3.4:5555", `[{"cell":"tdr1`},
+		{"tenant=goa&token=" + token, "1.2.3.4:5555", "ERROR!"},
+		{"tenant=nosuch", "127.0.0.1:5555", "ERROR!"},
+		{"tenant=pune", "127.0.0.1:5555", `[{"cell":"tdr1`},
+		{"", "127.0.0.1:5555", "[]"},
+	}
+	for idx, c := range cases {
+		if got := heatmap(c.query, c.remote); !strings.HasPrefix(got, c.expected) {
+			t.Errorf("test case #%d: got %s, expected %s", idx, got, c.expected)
+		}
+	}
+}
+
+//Cells nobody asks from again must still lose their counts once past retention.
+func TestHeatmapRetention(t *testing.T) {
+	Initialize()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+	recordDemand(DEFAULT_TENANT, METRIC_UNMATCHED, 12.884733, 77.551541, clock.Now())
+	recordDemand("goa", METRIC_UNMATCHED, 15.496777, 73.827827, clock.Now())
+
+	clock.Advance(HEATMAP_RETENTION_MINUTES * time.Minute)
+	recordDemand(DEFAULT_TENANT, METRIC_SEARCH, 12.970000, 77.590000, clock.Now())
+
+	gDemandLock.RLock()
+	cells, goa := len(gDemand[DEFAULT_TENANT]), len(gDemand["goa"])
+	gDemandLock.RUnlock()
+	if cells != 1 || goa != 0 {
+		t.Errorf("expired counts kept. cells:%d goa cells:%d", cells, goa)
+	}
+}
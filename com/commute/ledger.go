@@ -0,0 +1,339 @@
+package commute
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+//Kinds of ledger entries
+const LEDGER_TOPUP = 1      //User adds money. Bank -> wallet.
+const LEDGER_PAYOUT = 2     //User takes money out. Wallet -> bank.
+const LEDGER_SETTLEMENT = 3 //Rider pays the driver their share of a trip. Wallet -> wallet.
+
+//The outside world. Its balance is minus whatever is sitting in wallets.
+const ACCOUNT_BANK = "system:bank"
+
+//Store buckets used by the ledger.
+const bucketLedger = "ledger"         //seq -> ledgerEntry. Append only.
+const bucketLedgerKeys = "ledgerkeys" //kind/user/idempotency key -> entry id. See ledgerKey
+
+//posting is one leg of an entry. Positive amount is a credit to the account, negative a debit. All in paise.
+type posting struct {
+	Account string `json:"account"`
+	Amount  int64  `json:"amount"`
+}
+
+//ledgerEntry is one balanced transaction. Postings always add up to zero.
+type ledgerEntry struct {
+	Id       string    `json:"id"`
+	Seq      int64     `json:"seq"`
+	Kind     int       `json:"kind"`
+	Key      string    `json:"key"` //Idempotency key, see ledgerKey. The same key is never posted twice.
+	Time     int64     `json:"time"`
+	Postings []posting `json:"postings"`
+}
+
+//Balances are derived from the journal in the store. Cached here, rebuilt by replaying on startup.
+var gBalances map[string]int64
+var gLedgerSeq int64
+var gLedgerLoaded bool
+var gLedgerLock = sync.Mutex{}
+
+func resetLedger() {
+	gLedgerLock.Lock()
+	defer gLedgerLock.Unlock()
+	gBalances = nil
+	gLedgerSeq = 0
+	gLedgerLoaded = false
+}
+
+func walletAccount(userName string) string {
+	return "wallet:" + userName
+}
+
+//Reads the whole journal and returns the balances it adds up to and the last sequence number.
+func replayLedger() (map[string]int64, int64, error) {
+	vals, err := getStore().List(bucketLedger, "")
+	if err != nil {
+		return nil, 0, err
+	}
+	balances := make(map[string]int64)
+	var seq int64 = 0
+	for _, v := range vals {
+		e := ledgerEntry{}
+		if err = json.Unmarshal(v, &e); err != nil {
+			return nil, 0, err
+		}
+		for _, p := range e.Postings {
+			balances[p.Account] += p.Amount
+		}
+		seq = e.Seq
+	}
+	return balances, seq, nil
+}
+
+//Callers hold gLedgerLock.
+func loadLedgerLocked() error {
+	if gLedgerLoaded {
+		return nil
+	}
+	balances, seq, err := replayLedger()
+	if err != nil {
+		return err
+	}
+	gBalances = balances
+	gLedgerSeq = seq
+	gLedgerLoaded = true
+	return nil
+}
+
+//ledgerKey is the idempotency key as kept. Keys come from clients, so the same one from another user, or for
+//another kind of entry, is another entry and not a retry of this one.
+func ledgerKey(kind int, userName string, key string) string {
+	return fmt.Sprintf("%d/%s/%s", kind, userName, key)
+}
+
+//postEntry records a balanced transaction. If an entry with the same key was already posted, that one is
+//returned and nothing changes, so retries are safe. A retry has to be of the same entry though, else it is an
+//error. check, if given, runs under the lock before posting and can refuse the entry (eg: not enough balance).
+func postEntry(kind int, userName string, key string, postings []posting, check func() error) (*ledgerEntry, error) {
+	if key == "" {
+		return nil, errors.New("Ledger entries need an idempotency key")
+	}
+	key = ledgerKey(kind, userName, key)
+	var sum int64 = 0
+	for _, p := range postings {
+		if p.Amount == 0 || p.Account == "" {
+			return nil, errors.New(fmt.Sprintf("Invalid posting %v", p))
+		}
+		sum += p.Amount
+	}
+	if len(postings) < 2 || sum != 0 {
+		return nil, errors.New(fmt.Sprintf("Unbalanced ledger entry. postings:%v", postings))
+	}
+
+	gLedgerLock.Lock()
+	defer gLedgerLock.Unlock()
+	if err := loadLedgerLocked(); err != nil {
+		return nil, err
+	}
+
+	//Already done?
+	if id, err := getStore().Get(bucketLedgerKeys, key); err == nil {
+		e := &ledgerEntry{}
+		if err = storeGetJSON(bucketLedger, string(id), e); err != nil {
+			return nil, err
+		}
+		if e.Kind != kind || !samePostings(e.Postings, postings) {
+			return nil, errors.New(fmt.Sprintf("Idempotency key %s was used for another entry:%s", key, e.Id))
+		}
+		return e, nil
+	}
+	if check != nil {
+		if err := check(); err != nil {
+			return nil, err
+		}
+	}
+
+	e := &ledgerEntry{
+		Id:       fmt.Sprintf("%020d", gLedgerSeq+1),
+		Seq:      gLedgerSeq + 1,
+		Kind:     kind,
+		Key:      key,
+		Time:     clockNow().Unix(),
+		Postings: postings,
+	}
+	if err := storePutJSON(bucketLedger, e.Id, e); err != nil {
+		return nil, err
+	}
+	if err := getStore().Put(bucketLedgerKeys, key, []byte(e.Id)); err != nil {
+		return nil, err
+	}
+	gLedgerSeq = e.Seq
+	for _, p := range postings {
+		gBalances[p.Account] += p.Amount
+	}
+	return e, nil
+}
+
+//getBalance is what the user has in their wallet, in paise. Can be negative if they owe.
+func getBalance(userName string) (int64, error) {
+	gLedgerLock.Lock()
+	defer gLedgerLock.Unlock()
+	if err := loadLedgerLocked(); err != nil {
+		return 0, err
+	}
+	return gBalances[walletAccount(userName)], nil
+}
+
+func samePostings(a []posting, b []posting) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func topUp(userName string, amount int64, key string) (*ledgerEntry, error) {
+	if amount <= 0 {
+		return nil, errors.New(fmt.Sprintf("Invalid top-up amount:%d", amount))
+	}
+	return postEntry(LEDGER_TOPUP, userName, key, []posting{
+		{Account: ACCOUNT_BANK, Amount: -amount},
+		{Account: walletAccount(userName), Amount: amount},
+	}, nil)
+}
+
+//payout takes money out of the wallet. Unlike settlements, this cannot take the wallet below zero.
+func payout(userName string, amount int64, key string) (*ledgerEntry, error) {
+	if amount <= 0 {
+		return nil, errors.New(fmt.Sprintf("Invalid payout amount:%d", amount))
+	}
+	//Checked under the ledger lock, after the idempotency check. So a retry of a payout that went through
+	//is not refused for want of balance, and two payouts at once cannot both spend the same money.
+	check := func() error {
+		if balance := gBalances[walletAccount(userName)]; balance < amount {
+			return errors.New(fmt.Sprintf("Insufficient balance for payout. balance:%s amount:%s",
+				formatMoney(balance), formatMoney(amount)))
+		}
+		return nil
+	}
+	return postEntry(LEDGER_PAYOUT, userName, key, []posting{
+		{Account: walletAccount(userName), Amount: -amount},
+		{Account: ACCOUNT_BANK, Amount: amount},
+	}, check)
+}
+
+//postTripSettlement moves the rider's share to the driver. Keyed on the trip, so it happens once per trip.
+func postTripSettlement(trip *Trip) (*ledgerEntry, error) {
+	if trip.Fare == nil || trip.Fare.RiderShare <= 0 {
+		return nil, nil //Nothing to settle
+	}
+	return postEntry(LEDGER_SETTLEMENT, trip.Rider, "trip:"+trip.TripId, []posting{
+		{Account: walletAccount(trip.Rider), Amount: -trip.Fare.RiderShare},
+		{Account: walletAccount(trip.Driver), Amount: trip.Fare.RiderShare},
+	}, nil)
+}
+
+//reconcileLedger replays the journal and checks it against the cached balances. Also checks that the books
+//balance overall. Returns the accounts which do not match.
+func reconcileLedger() ([]string, error) {
+	gLedgerLock.Lock()
+	defer gLedgerLock.Unlock()
+	if err := loadLedgerLocked(); err != nil {
+		return nil, err
+	}
+	replayed, _, err := replayLedger()
+	if err != nil {
+		return nil, err
+	}
+
+	mismatches := make([]string, 0)
+	var total int64 = 0
+	for acc, bal := range replayed {
+		total += bal
+		if gBalances[acc] != bal {
+			mismatches = append(mismatches, acc)
+		}
+	}
+	for acc, bal := range gBalances {
+		if _, ok := replayed[acc]; !ok && bal != 0 {
+			mismatches = append(mismatches, acc)
+		}
+	}
+	if total != 0 {
+		return mismatches, errors.New(fmt.Sprintf("Ledger does not balance. Off by %d", total))
+	}
+	return mismatches, nil
+}
+
+//processWalletRequest returns the balance of the logged in user.
+func processWalletRequest(userName string, token string) (string, error) {
+	if _, err := isUserValid(userName, token); err != nil {
+		return "", err
+	}
+	balance, err := getBalance(userName)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("walletpayload,%s", formatMoney(balance)), nil
+}
+
+//Function WalletHandler returns the wallet balance of the logged in user. Params are user and token.
+func WalletHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	user := q.Get("user")
+	retValue, err := processWalletRequest(user, q.Get("token"))
+	if err != nil {
+		fmt.Fprint(w, "ERROR! :", err)
+	} else {
+		fmt.Fprint(w, retValue)
+	}
+
+	fmt.Println(clockNow(), "\t", user, "\t", r.RemoteAddr, "\t", r.URL.RawQuery, "\t", err)
+}
+
+//processWalletAdminRequest handles top-ups, payouts and reconciliation.
+func processWalletAdminRequest(action string, userName string, amountStr string, key string) (string, error) {
+	if action == "reconcile" {
+		mismatches, err := reconcileLedger()
+		if err != nil {
+			return "", err
+		}
+		if len(mismatches) != 0 {
+			return "", errors.New(fmt.Sprintf("Ledger mismatch in accounts:%v", mismatches))
+		}
+		return "Ledger reconciled", nil
+	}
+
+	if userName == "" {
+		return "", errors.New("ERROR in user parameter")
+	}
+	amount, err := strconv.ParseInt(amountStr, 10, 64)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("ERROR in amount parameter:%s", amountStr))
+	}
+	var e *ledgerEntry
+	switch action {
+	case "topup":
+		e, err = topUp(userName, amount, key)
+	case "payout":
+		e, err = payout(userName, amount, key)
+	default:
+		return "", errors.New(fmt.Sprintf("ERROR in action parameter:%s", action))
+	}
+	if err != nil {
+		return "", err
+	}
+	balance, err := getBalance(userName)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Success! entry:%s balance:%s", e.Id, formatMoney(balance)), nil
+}
+
+//Function WalletAdminHandler is for ops to record top-ups and payouts. Params are action (topup/payout/reconcile),
+//user, amount in paise and key, which makes retries safe. Admins only, see isStaffRequest.
+func WalletAdminHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := isStaffRequest(r, ROLE_ADMIN); !ok {
+		rejectStaffRequest(w, ROLE_ADMIN)
+		return
+	}
+	q := r.URL.Query()
+	retValue, err := processWalletAdminRequest(q.Get("action"), q.Get("user"), q.Get("amount"), q.Get("key"))
+	if err != nil {
+		fmt.Fprint(w, "ERROR! :", err)
+	} else {
+		fmt.Fprint(w, retValue)
+	}
+
+	fmt.Println(clockNow(), "\t", "wallet admin", "\t", r.RemoteAddr, "\t", r.URL.RawQuery, "\t", err)
+}
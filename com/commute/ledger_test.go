@@ -0,0 +1,149 @@
+package commute
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+)
+
+//Debits must equal credits in every entry and across the whole journal.
+func checkLedgerInvariants(t *testing.T) {
+	vals, _ := getStore().List(bucketLedger, "")
+	var debits, credits int64 = 0, 0
+	for _, v := range vals {
+		e := ledgerEntry{}
+		json.Unmarshal(v, &e)
+		var entryDebits, entryCredits int64 = 0, 0
+		for _, p := range e.Postings {
+			if p.Amount < 0 {
+				entryDebits -= p.Amount
+			} else {
+				entryCredits += p.Amount
+			}
+		}
+		if entryDebits != entryCredits {
+			t.Errorf("entry %s does not balance. debits:%d credits:%d", e.Id, entryDebits, entryCredits)
+		}
+		debits += entryDebits
+		credits += entryCredits
+	}
+	if debits != credits {
+		t.Errorf("journal does not balance. debits:%d credits:%d", debits, credits)
+	}
+	if mismatches, err := reconcileLedger(); err != nil || len(mismatches) != 0 {
+		t.Errorf("ledger does not reconcile. mismatches:%v err:%v", mismatches, err)
+	}
+}
+
+func TestLedgerBasics(t *testing.T) {
+	Initialize()
+
+	cases := []struct {
+		action, user string
+		amount       int64
+		key          string
+		balance      int64
+		errstr       string
+	}{
+		{"topup", "rider1", 50000, "t1", 50000, ""},
+		{"topup", "rider1", 50000, "t1", 50000, ""}, //retry, no change
+		{"topup", "rider1", 0, "t2", 50000, "Invalid"},
+		{"topup", "rider1", 1000, "", 50000, "idempotency"},
+		{"payout", "rider1", 60000, "p1", 50000, "Insufficient"},
+		{"payout", "rider1", 20000, "p2", 30000, ""},
+		{"payout", "rider1", 20000, "p2", 30000, ""}, //retry, no change
+		{"payout", "rider1", 30000, "p3", 0, ""},
+		{"payout", "rider1", 20000, "p2", 0, ""},              //retry of an old one still returns ok
+		{"payout", "rider1", 30000, "p2", 0, "another entry"}, //not a retry, the amount differs
+		{"topup", "rider2", 7000, "t1", 7000, ""},             //another user's key
+		{"topup", "rider1", 5000, "p2", 5000, ""},             //another kind's key
+	}
+	for idx, c := range cases {
+		_, err := processWalletAdminRequest(c.action, c.user, fmt.Sprintf("%d", c.amount), c.key)
+		if c.errstr == "" && err != nil {
+			t.Errorf("test case #%d: returned error when there was none. %s", idx, err.Error())
+		}
+		if c.errstr != "" && (err == nil || !strings.Contains(err.Error(), c.errstr)) {
+			t.Errorf("test case #%d: did not return error %s. err:%v", idx, c.errstr, err)
+		}
+		if b, _ := getBalance(c.user); b != c.balance {
+			t.Errorf("test case #%d: balance %d want %d", idx, b, c.balance)
+		}
+	}
+	if _, err := postEntry(LEDGER_TOPUP, "rider1", "bad", []posting{{"a", 100}, {"b", -99}}, nil); err == nil {
+		t.Errorf("unbalanced entry got posted")
+	}
+	checkLedgerInvariants(t)
+}
+
+func TestLedgerSettlement(t *testing.T) {
+	Initialize()
+	topUp("rider1", 10000, "t1")
+	tripId := completeTestTrip(t, "rider1", "driver1")
+	trip, _ := getTrip(tripId)
+
+	riderBal, _ := getBalance("rider1")
+	driverBal, _ := getBalance("driver1")
+	if trip.Fare.RiderShare <= 0 || riderBal != 10000-trip.Fare.RiderShare || driverBal != trip.Fare.RiderShare {
+		t.Errorf("settlement not posted. share:%d rider:%d driver:%d", trip.Fare.RiderShare, riderBal, driverBal)
+	}
+
+	//Posting the same trip again does nothing
+	postTripSettlement(trip)
+	if b, _ := getBalance("driver1"); b != driverBal {
+		t.Errorf("settlement posted twice. driver:%d", b)
+	}
+
+	token := newToken("driver1", DRIVER_STATE)
+	if retStr, err := processWalletRequest("driver1", token); err != nil || retStr != "walletpayload,"+formatMoney(driverBal) {
+		t.Errorf("wallet query wrong. ret:%s err:%v", retStr, err)
+	}
+	checkLedgerInvariants(t)
+}
+
+//Lots of random activity from many goroutines. Books must still balance, no wallet goes below zero through
+//payouts, and a restart (replay from the store) gives the same balances.
+func TestLedgerInvariantsUnderLoad(t *testing.T) {
+	Initialize()
+	users := []string{"u1", "u2", "u3", "u4", "u5"}
+	var wg sync.WaitGroup
+	for g := 0; g < 10; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(int64(g)))
+			for i := 0; i < 200; i++ {
+				u := users[r.Intn(len(users))]
+				amount := int64(r.Intn(5000) + 1)
+				key := fmt.Sprintf("k%d", r.Intn(1500)) //Collisions on purpose, to exercise retries
+				switch r.Intn(3) {
+				case 0:
+					topUp(u, amount, key)
+				case 1:
+					payout(u, amount, key)
+				case 2:
+					other := users[r.Intn(len(users))]
+					if other != u {
+						postEntry(LEDGER_SETTLEMENT, u, key, []posting{{walletAccount(u), -amount}, {walletAccount(other), amount}}, nil)
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	checkLedgerInvariants(t)
+
+	before := make(map[string]int64)
+	for _, u := range users {
+		before[u], _ = getBalance(u)
+	}
+	resetLedger()
+	for _, u := range users {
+		if b, _ := getBalance(u); b != before[u] {
+			t.Errorf("balance of %s changed after replay. %d vs %d", u, b, before[u])
+		}
+	}
+}
@@ -0,0 +1,449 @@
+package commute
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Drivers send their licence, vehicle registration and photos (licence, vehicle, themselves). An admin looks
+//at them and approves or rejects. Approval gives the driver role (see roles.go) and lasts till the licence
+//expires or VERIFICATION_TTL, whichever is first. Only drivers with a live approval show up in searches.
+//A driver can send a new submission to renew. It is kept apart from the approval, which holds, documents and
+//all, till the new one is approved.
+const VERIFICATION_PENDING = "pending"
+const VERIFICATION_APPROVED = "approved"
+const VERIFICATION_REJECTED = "rejected"
+const VERIFICATION_REVOKED = "revoked"
+
+const VERIFICATION_TTL = 365 * 24 * time.Hour
+const VERIFICATION_MAX_PHOTOS = 4
+const VERIFICATION_MAX_PHOTO_BYTES = 5 << 20
+
+//Store buckets used by onboarding
+const bucketDriverVerifications = "driververifications" //user -> driverVerification, approved or revoked
+const bucketDriverSubmissions = "driversubmissions"     //user -> driverVerification, pending or rejected
+
+//Licence numbers and registrations, once spaces and dashes are dropped. eg: KA0120110012345, KA01AB1234
+var licenceRegex = regexp.MustCompile(`^[A-Z0-9]{8,20}$`)
+var registrationRegex = regexp.MustCompile(`^[A-Z0-9]{4,12}$`)
+
+var photoTypes = map[string]string{"image/jpeg": ".jpg", "image/png": ".png"}
+
+type driverVerification struct {
+	Id            string   `json:"id"`
+	User          string   `json:"user"`
+	Licence       string   `json:"licence"`
+	LicenceExpiry string   `json:"licenceexpiry"` //YYYY-MM-DD
+	Vehicle       string   `json:"vehicle"`       //Registration number
+	Photos        []string `json:"photos"`        //Blob keys
+	Status        string   `json:"status"`
+	Reason        string   `json:"reason,omitempty"` //Why it was rejected or revoked. Shown to the driver.
+	Submitted     int64    `json:"submitted"`
+	Reviewer      string   `json:"reviewer,omitempty"`
+	Reviewed      int64    `json:"reviewed,omitempty"`
+	ApprovedUntil int64    `json:"approveduntil"` //0 if not approved, and always on a submission
+}
+
+//Serializes submissions and reviews, so that a review is of the submission the admin looked at.
+var gOnboardingLock = sync.Mutex{}
+
+//Whether drivers need an approval to drive. Nothing to do with how they log in: an open login still only
+//says who they claim to be, not that they hold a licence.
+var gVerifyDrivers bool
+var gVerifyDriversLock = sync.RWMutex{}
+
+func resetOnboarding() {
+	gVerifyDriversLock.Lock()
+	defer gVerifyDriversLock.Unlock()
+	//Off unless the server asks otherwise (see cmd), so that tests and replays can drive directly.
+	gVerifyDrivers = false
+}
+
+//SetDriverVerification true makes driving need an approved verification, and the driver role with it.
+func SetDriverVerification(required bool) {
+	gVerifyDriversLock.Lock()
+	defer gVerifyDriversLock.Unlock()
+	gVerifyDrivers = required
+}
+
+func isDriverVerificationRequired() bool {
+	gVerifyDriversLock.RLock()
+	defer gVerifyDriversLock.RUnlock()
+	return gVerifyDrivers
+}
+
+//getVerification returns the driver's approval, or what is left of it once revoked.
+func getVerification(userName string) (*driverVerification, error) {
+	v := &driverVerification{}
+	if err := storeGetJSON(bucketDriverVerifications, userName, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+//getSubmission returns the driver's submission waiting for review, or the last one rejected.
+func getSubmission(userName string) (*driverVerification, error) {
+	v := &driverVerification{}
+	if err := storeGetJSON(bucketDriverSubmissions, userName, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+//getLatestVerification is what admins look at and the driver sees the status of: the submission if there is
+//one, else the approval.
+func getLatestVerification(userName string) (*driverVerification, error) {
+	if v, err := getSubmission(userName); err == nil {
+		return v, nil
+	}
+	return getVerification(userName)
+}
+
+//Drops spaces and dashes and upper cases.
+func normalizeId(s string) string {
+	return strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(s))
+}
+
+//submitVerification saves a new submission, waiting for review.
+func submitVerification(userName string, licence string, licenceExpiry string, vehicle string,
+	photos [][]byte) (*driverVerification, error) {
+	now := clockNow()
+	licence = normalizeId(licence)
+	vehicle = normalizeId(vehicle)
+	if !licenceRegex.MatchString(licence) {
+		return nil, errors.New(fmt.Sprintf("Invalid licence number:%s", licence))
+	}
+	if !registrationRegex.MatchString(vehicle) {
+		return nil, errors.New(fmt.Sprintf("Invalid vehicle registration:%s", vehicle))
+	}
+	expiry, err := time.Parse("2006-01-02", licenceExpiry)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid licence expiry, need YYYY-MM-DD:%s", licenceExpiry))
+	}
+	if !expiry.After(now) {
+		return nil, errors.New("Licence has expired")
+	}
+	if len(photos) == 0 || len(photos) > VERIFICATION_MAX_PHOTOS {
+		return nil, errors.New(fmt.Sprintf("Need 1 to %d photos, got %d", VERIFICATION_MAX_PHOTOS, len(photos)))
+	}
+	exts := make([]string, 0, len(photos))
+	for i, p := range photos {
+		if len(p) > VERIFICATION_MAX_PHOTO_BYTES {
+			return nil, errors.New(fmt.Sprintf("Photo %d is over %d MB", i+1, VERIFICATION_MAX_PHOTO_BYTES>>20))
+		}
+		ext, ok := photoTypes[http.DetectContentType(p)]
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Photo %d is not a jpeg or png", i+1))
+		}
+		exts = append(exts, ext)
+	}
+
+	gOnboardingLock.Lock()
+	defer gOnboardingLock.Unlock()
+	old, err := getSubmission(userName)
+	if err == nil && old.Status == VERIFICATION_PENDING {
+		return nil, errors.New("Already waiting for review")
+	}
+	v := &driverVerification{Id: randToken(), User: userName, Licence: licence, LicenceExpiry: licenceExpiry,
+		Vehicle: vehicle, Status: VERIFICATION_PENDING, Submitted: now.Unix()}
+	blobs := getBlobStore()
+	for i, p := range photos {
+		key := fmt.Sprintf("drivers/%s/%d%s", v.Id, i+1, exts[i])
+		if err = blobs.Put(key, p); err != nil {
+			deleteBlobs(v.Photos)
+			return nil, err
+		}
+		v.Photos = append(v.Photos, key)
+	}
+	if err = storePutJSON(bucketDriverSubmissions, userName, v); err != nil {
+		deleteBlobs(v.Photos)
+		return nil, err
+	}
+	//Only a rejected one is replaced. The approval's photos stay till the new one is approved.
+	if old != nil {
+		deleteBlobs(old.Photos)
+	}
+	audit(userName, userName, "onboarding submit", v.Id)
+	return v, nil
+}
+
+func deleteBlobs(keys []string) {
+	blobs := getBlobStore()
+	for _, k := range keys {
+		blobs.Delete(k)
+	}
+}
+
+//reviewVerification is the admin's call on a submission: approve, reject or revoke. Reject and revoke need
+//a reason, which the driver gets to see. Approve replaces the approval with the submission; reject leaves the
+//approval as it is. Revoke ends an approval that has been given.
+func reviewVerification(actor string, userName string, action string, reason string) error {
+	gOnboardingLock.Lock()
+	defer gOnboardingLock.Unlock()
+	now := clockNow()
+	var v *driverVerification
+	var err error
+	switch action {
+	case "approve", "reject":
+		if v, err = getSubmission(userName); err != nil {
+			return errors.New(fmt.Sprintf("No submission from %s", userName))
+		}
+		if v.Status != VERIFICATION_PENDING {
+			return errors.New(fmt.Sprintf("Submission from %s is %s, not pending", userName, v.Status))
+		}
+	case "revoke":
+		if v, err = getVerification(userName); err != nil || v.ApprovedUntil <= now.Unix() {
+			return errors.New(fmt.Sprintf("%s is not approved", userName))
+		}
+	default:
+		return errors.New(fmt.Sprintf("ERROR in action parameter:%s", action))
+	}
+	if action != "approve" && reason == "" {
+		return errors.New("ERROR in reason parameter")
+	}
+
+	v.Reviewer = actor
+	v.Reviewed = now.Unix()
+	switch action {
+	case "approve":
+		//The expiry date is the last day the licence is good for.
+		expiry, _ := time.Parse("2006-01-02", v.LicenceExpiry)
+		until := expiry.Add(24 * time.Hour)
+		if limit := now.Add(VERIFICATION_TTL); limit.Before(until) {
+			until = limit
+		}
+		v.Status = VERIFICATION_APPROVED
+		v.ApprovedUntil = until.Unix()
+		v.Reason = ""
+		err = saveApproval(userName, v)
+	case "reject":
+		v.Status = VERIFICATION_REJECTED
+		v.Reason = reason
+		err = storePutJSON(bucketDriverSubmissions, userName, v)
+	case "revoke":
+		v.Status = VERIFICATION_REVOKED
+		v.ApprovedUntil = 0
+		v.Reason = reason
+		err = storePutJSON(bucketDriverVerifications, userName, v)
+	}
+	if err != nil {
+		return err
+	}
+	audit(actor, userName, "onboarding "+action, v.Id)
+
+	if action == "approve" {
+		return grantRole(actor, userName, ROLE_DRIVER)
+	}
+	if action == "revoke" && hasRole(userName, ROLE_DRIVER) {
+		return revokeRole(actor, userName, ROLE_DRIVER)
+	}
+	return nil
+}
+
+//Callers hold gOnboardingLock. The approved submission takes the place of the old approval, photos and all.
+func saveApproval(userName string, v *driverVerification) error {
+	old, _ := getVerification(userName)
+	if err := storePutJSON(bucketDriverVerifications, userName, v); err != nil {
+		return err
+	}
+	if old != nil {
+		deleteBlobs(old.Photos)
+	}
+	return getStore().Delete(bucketDriverSubmissions, userName)
+}
+
+//isVerifiedDriver says if the driver may be shown to riders, or be joined.
+func isVerifiedDriver(userName string) bool {
+	if !isDriverVerificationRequired() {
+		return true
+	}
+	v, err := getVerification(userName)
+	return err == nil && clockNow().Unix() < v.ApprovedUntil
+}
+
+//listVerifications returns the submissions in the status, oldest first. Empty status for all.
+//Submissions and approvals are kept apart, so a driver renewing can be in both.
+func listVerifications(status string) ([]*driverVerification, error) {
+	out := make([]*driverVerification, 0)
+	for _, bucket := range []string{bucketDriverSubmissions, bucketDriverVerifications} {
+		vals, err := getStore().List(bucket, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, val := range vals {
+			v := &driverVerification{}
+			if err = json.Unmarshal(val, v); err != nil {
+				return nil, err
+			}
+			if status == "" || v.Status == status {
+				out = append(out, v)
+			}
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Submitted < out[j].Submitted })
+	return out, nil
+}
+
+//What the driver gets to see of their own submission.
+type verificationStatus struct {
+	Status        string `json:"status"`
+	Reason        string `json:"reason,omitempty"`
+	Submitted     int64  `json:"submitted"`
+	ApprovedUntil int64  `json:"approveduntil"`
+}
+
+func processOnboardingRequest(userName string, token string, action string, licence string, licenceExpiry string,
+	vehicle string, photos [][]byte) (string, error) {
+	if _, err := isUserValid(userName, token); err != nil {
+		return "", err
+	}
+	switch action {
+	case "submit":
+		v, err := submitVerification(userName, licence, licenceExpiry, vehicle, photos)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Success! Submitted %s for review", v.Id), nil
+	case "status", "":
+		out := verificationStatus{Status: "none"}
+		if v, err := getLatestVerification(userName); err == nil {
+			out = verificationStatus{Status: v.Status, Reason: v.Reason, Submitted: v.Submitted}
+		}
+		//A renewal under review or rejected still drives on the approval.
+		if v, err := getVerification(userName); err == nil {
+			out.ApprovedUntil = v.ApprovedUntil
+		}
+		data, err := json.Marshal(out)
+		return string(data), err
+	}
+	return "", errors.New(fmt.Sprintf("ERROR in action parameter:%s", action))
+}
+
+//Function DriverOnboardingHandler takes the driver's documents. Params are user, token and action
+//(submit/status). A submit is a multipart POST with licence, licenceexpiry (YYYY-MM-DD), vehicle (the
+//registration number) and up to VERIFICATION_MAX_PHOTOS files named photo.
+func DriverOnboardingHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	user := q.Get("user")
+	action := q.Get("action")
+	var photos [][]byte
+	var err error
+	if action == "submit" {
+		photos, err = readPhotos(w, r)
+	}
+	var retValue string
+	if err == nil {
+		retValue, err = processOnboardingRequest(user, q.Get("token"), action, r.FormValue("licence"),
+			r.FormValue("licenceexpiry"), r.FormValue("vehicle"), photos)
+	}
+	if err != nil {
+		fmt.Fprint(w, "ERROR! :", err)
+	} else {
+		fmt.Fprint(w, retValue)
+	}
+	fmt.Println(clockNow(), "\t", user, "\t", r.RemoteAddr, "\t", "onboarding", "\t", action, "\t", err)
+}
+
+func readPhotos(w http.ResponseWriter, r *http.Request) ([][]byte, error) {
+	if r.Method != "POST" {
+		return nil, errors.New("Submit with a multipart POST")
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, (VERIFICATION_MAX_PHOTOS+1)*VERIFICATION_MAX_PHOTO_BYTES)
+	if err := r.ParseMultipartForm(VERIFICATION_MAX_PHOTO_BYTES); err != nil {
+		return nil, errors.New(fmt.Sprintf("Bad upload:%s", err.Error()))
+	}
+	photos := make([][]byte, 0)
+	for _, fh := range r.MultipartForm.File["photo"] {
+		f, err := fh.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		photos = append(photos, data)
+	}
+	return photos, nil
+}
+
+//Function DriverVerificationAdminHandler is the review queue. Params are action (list/get/photo/approve/
+//reject/revoke), target (the driver), status (for list, default pending), photo (1 based, for photo) and
+//reason. Admins and support can look, only admins decide. Staff of a tenant, its drivers only. See
+//isTenantStaffRequest.
+func DriverVerificationAdminHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := isTenantStaffRequest(r, ROLE_ADMIN, ROLE_SUPPORT)
+	if !ok {
+		rejectStaffRequest(w, ROLE_ADMIN, ROLE_SUPPORT)
+		return
+	}
+	q := r.URL.Query()
+	action := q.Get("action")
+	target := q.Get("target")
+	var err error
+	if action != "list" && !canSeeTenant(actor, tenantOf(target)) {
+		action, err = "", errors.New(fmt.Sprintf("No submission from %s", target))
+	}
+	switch action {
+	case "":
+	case "list":
+		status := q.Get("status")
+		if status == "" {
+			status = VERIFICATION_PENDING
+		}
+		var list []*driverVerification
+		if list, err = listVerifications(status); err == nil {
+			visible := make([]*driverVerification, 0, len(list))
+			for _, v := range list {
+				if canSeeTenant(actor, tenantOf(v.User)) {
+					visible = append(visible, v)
+				}
+			}
+			err = json.NewEncoder(w).Encode(visible)
+		}
+	case "get":
+		var v *driverVerification
+		if v, err = getLatestVerification(target); err == nil {
+			err = json.NewEncoder(w).Encode(v)
+		}
+	case "photo":
+		var data []byte
+		if data, err = verificationPhoto(target, q.Get("photo")); err == nil {
+			w.Header().Set("Content-Type", http.DetectContentType(data))
+			w.Write(data)
+		}
+	default:
+		if actor != "localhost" && !hasRole(actor, ROLE_ADMIN) {
+			err = errors.New("Only admins can review")
+		} else if err = reviewVerification(actor, target, action, q.Get("reason")); err == nil {
+			fmt.Fprintf(w, "Success! %s %s", action, target)
+		}
+	}
+	if err != nil {
+		fmt.Fprint(w, "ERROR! :", err)
+	}
+	fmt.Println(clockNow(), "\t", actor, "\t", r.RemoteAddr, "\t", "driver verification", "\t", action, "\t",
+		target, "\t", err)
+}
+
+func verificationPhoto(userName string, n string) ([]byte, error) {
+	v, err := getLatestVerification(userName)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("No submission from %s", userName))
+	}
+	i, err := strconv.Atoi(n)
+	if err != nil || i < 1 || i > len(v.Photos) {
+		return nil, errors.New(fmt.Sprintf("ERROR in photo parameter:%s", n))
+	}
+	return getBlobStore().Get(v.Photos[i-1])
+}
@@ -0,0 +1,261 @@
+package commute
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testPNG = []byte("\x89PNG\r\n\x1a\n0000IHDR")
+var testJPEG = []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00")
+
+func reviewForTest(action string, target string, reason string) string {
+	r := httptest.NewRequest("GET", "/commute/admin/drivers?action="+action+"&target="+target+"&reason="+reason, nil)
+	r.RemoteAddr = "127.0.0.1:5555"
+	resp := httptest.NewRecorder()
+	DriverVerificationAdminHandler(resp, r)
+	return resp.Body.String()
+}
+
+//Takes the driver through verification, so that they get the driver role and show up to riders.
+func approveForTest(userName string) {
+	submitVerification(userName, "KA0120110012345", "2036-01-31", "KA01AB1234", [][]byte{testPNG})
+	reviewForTest("approve", userName, "")
+}
+
+func TestSubmitVerification(t *testing.T) {
+	_, _, done := newTestAuth()
+	defer done()
+
+	big := append(append([]byte(nil), testPNG...), make([]byte, VERIFICATION_MAX_PHOTO_BYTES)...)
+	cases := []struct {
+		licence  string
+		expiry   string
+		vehicle  string
+		photos   [][]byte
+		expected bool
+	}{
+		{"KA01 2011 0012345", "2030-01-31", "KA-01-AB-1234", [][]byte{testPNG, testJPEG}, true},
+		{"KA01", "2030-01-31", "KA01AB1234", [][]byte{testPNG}, false},                 //Licence too short
+		{"KA0120110012345", "2030-01-31", "KA01/AB", [][]byte{testPNG}, false},         //Bad registration
+		{"KA0120110012345", "31-01-2030", "KA01AB1234", [][]byte{testPNG}, false},      //Date format
+		{"KA0120110012345", "2026-10-18", "KA01AB1234", [][]byte{testPNG}, false},      //Expired
+		{"KA0120110012345", "2030-01-31", "KA01AB1234", nil, false},                    //No photos
+		{"KA0120110012345", "2030-01-31", "KA01AB1234", [][]byte{[]byte("hi")}, false}, //Not an image
+		{"KA0120110012345", "2030-01-31", "KA01AB1234", [][]byte{big}, false},
+		{"KA0120110012345", "2030-01-31", "KA01AB1234", [][]byte{testPNG, testPNG, testPNG, testPNG, testPNG}, false},
+	}
+	for idx, c := range cases {
+		user := "driver" + string(rune('a'+idx))
+		_, err := submitVerification(user, c.licence, c.expiry, c.vehicle, c.photos)
+		if (err == nil) != c.expected {
+			t.Errorf("test case #%d: err = %v", idx, err)
+		}
+	}
+
+	v, _ := getSubmission("drivera")
+	if v.Licence != "KA0120110012345" || v.Vehicle != "KA01AB1234" || v.Status != VERIFICATION_PENDING ||
+		len(v.Photos) != 2 || !strings.HasSuffix(v.Photos[1], ".jpg") {
+		t.Errorf("wrong submission:%+v", v)
+	}
+	if data, err := getBlobStore().Get(v.Photos[0]); err != nil || !bytes.Equal(data, testPNG) {
+		t.Errorf("photo not stored:%v", err)
+	}
+	if _, err := submitVerification("drivera", "KA0120110012345", "2030-01-31", "KA01AB1234", [][]byte{testPNG}); err == nil {
+		t.Errorf("second submission while pending")
+	}
+}
+
+func TestDriverApproval(t *testing.T) {
+	sms, clock, done := newTestAuth()
+	defer done()
+
+	if _, err := verifiedLogin(t, sms, "driver1", "+919876543210", DRIVER_STATE); err == nil {
+		t.Errorf("driver logged in before approval")
+	}
+	submitVerification("driver1", "KA0120110012345", "2027-01-31", "KA01AB1234", [][]byte{testPNG})
+	verifiedLogin(t, sms, "rider1", "+919876543211", RIDER_STATE)
+
+	cases := []struct {
+		action   string
+		reason   string
+		expected string
+	}{
+		{"reject", "", "ERROR!"}, //Needs a reason
+		{"revoke", "fake", "ERROR!"},
+		{"approve", "", "Success!"},
+		{"approve", "", "ERROR!"}, //Not pending any more
+	}
+	for idx, c := range cases {
+		if got := reviewForTest(c.action, "driver1", c.reason); !strings.HasPrefix(got, c.expected) {
+			t.Errorf("test case #%d: got %s, expected %s", idx, got, c.expected)
+		}
+	}
+	if !hasRole("driver1", ROLE_DRIVER) {
+		t.Errorf("approval did not give the driver role")
+	}
+	if _, err := verifiedLogin(t, sms, "driver1", "+919876543210", DRIVER_STATE); err != nil {
+		t.Fatalf("approved driver could not log in:%s", err.Error())
+	}
+	matches, _ := searchMatches("rider1", RIDER_STATE)
+	if len(matches) != 1 || matches[0].userName != "driver1" {
+		t.Errorf("approved driver not found:%+v", matches)
+	}
+
+	//Good till the licence runs out, here before a year is up
+	v, _ := getVerification("driver1")
+	if v.ApprovedUntil != time.Date(2027, 2, 1, 0, 0, 0, 0, time.UTC).Unix() {
+		t.Errorf("wrong approval expiry:%d", v.ApprovedUntil)
+	}
+	clock.Advance(time.Duration(v.ApprovedUntil-clock.Now().Unix()) * time.Second)
+	if matches, _ = searchMatches("rider1", RIDER_STATE); len(matches) != 0 {
+		t.Errorf("expired driver found:%+v", matches)
+	}
+}
+
+func TestRenewAndRevoke(t *testing.T) {
+	_, clock, done := newTestAuth()
+	defer done()
+
+	submitVerification("driver1", "KA0120110012345", "2036-01-31", "KA01AB1234", [][]byte{testPNG})
+	reviewForTest("approve", "driver1", "")
+	v, _ := getVerification("driver1")
+	if v.ApprovedUntil != clock.Now().Add(VERIFICATION_TTL).Unix() {
+		t.Errorf("approval not capped at a year:%d", v.ApprovedUntil)
+	}
+	oldPhoto := v.Photos[0]
+
+	//A renewal leaves the approval and its documents be till it is approved. Rejecting it changes nothing.
+	clock.Advance(300 * 24 * time.Hour)
+	for _, action := range []string{"reject", "approve"} {
+		renewal, err := submitVerification("driver1", "KA0120110012345", "2036-01-31", "KA01XY9999",
+			[][]byte{testJPEG})
+		if err != nil {
+			t.Fatalf("renewal failed:%s", err.Error())
+		}
+		if v, _ = getVerification("driver1"); !isVerifiedDriver("driver1") || v.Vehicle != "KA01AB1234" {
+			t.Errorf("renewal changed the approval:%+v", v)
+		}
+		if _, err = getBlobStore().Get(oldPhoto); err != nil {
+			t.Errorf("approved photos gone before review")
+		}
+		if got := reviewForTest(action, "driver1", "blurry"); !strings.HasPrefix(got, "Success!") {
+			t.Errorf("%s failed:%s", action, got)
+		}
+		v, _ = getVerification("driver1")
+		if action == "reject" && (!isVerifiedDriver("driver1") || v.Vehicle != "KA01AB1234") {
+			t.Errorf("rejected renewal changed the approval:%+v", v)
+		}
+		if action == "approve" {
+			if v.Id != renewal.Id || v.Vehicle != "KA01XY9999" || !isVerifiedDriver("driver1") {
+				t.Errorf("approved renewal not in place:%+v", v)
+			}
+			if _, err = getBlobStore().Get(oldPhoto); err != ErrNotFound {
+				t.Errorf("old photos kept")
+			}
+		} else if _, err = getBlobStore().Get(renewal.Photos[0]); err != nil {
+			t.Errorf("rejected photos gone before a new submission")
+		}
+	}
+
+	if got := reviewForTest("revoke", "driver1", "complaints"); !strings.HasPrefix(got, "Success!") {
+		t.Errorf("revoke failed:%s", got)
+	}
+	if isVerifiedDriver("driver1") || hasRole("driver1", ROLE_DRIVER) {
+		t.Errorf("revoked driver still verified")
+	}
+	v, _ = getVerification("driver1")
+	if v.Status != VERIFICATION_REVOKED || v.Reason != "complaints" || v.Reviewer != "localhost" {
+		t.Errorf("wrong record:%+v", v)
+	}
+}
+
+func TestOnboardingHandlers(t *testing.T) {
+	sms, _, done := newTestAuth()
+	defer done()
+	sendCode("driver1", "+919876543210")
+	token, _, _ := verifyCode("driver1", sms.LastCode("+919876543210"), 0, "phone", "okhttp")
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	mw.WriteField("licence", "KA0120110012345")
+	mw.WriteField("licenceexpiry", "2030-01-31")
+	mw.WriteField("vehicle", "KA01AB1234")
+	for _, p := range [][]byte{testPNG, testJPEG} {
+		fw, _ := mw.CreateFormFile("photo", "photo")
+		fw.Write(p)
+	}
+	mw.Close()
+	r := httptest.NewRequest("POST", "/commute/driver/onboarding?user=driver1&action=submit&token="+token, body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	resp := httptest.NewRecorder()
+	DriverOnboardingHandler(resp, r)
+	if !strings.HasPrefix(resp.Body.String(), "Success!") {
+		t.Fatalf("submit failed:%s", resp.Body.String())
+	}
+
+	//Review queue, then the second photo
+	r = httptest.NewRequest("GET", "/commute/admin/drivers?action=list", nil)
+	r.RemoteAddr = "127.0.0.1:5555"
+	resp = httptest.NewRecorder()
+	DriverVerificationAdminHandler(resp, r)
+	var list []driverVerification
+	if err := json.Unmarshal(resp.Body.Bytes(), &list); err != nil || len(list) != 1 || list[0].User != "driver1" {
+		t.Errorf("wrong queue:%s", resp.Body.String())
+	}
+	r = httptest.NewRequest("GET", "/commute/admin/drivers?action=photo&target=driver1&photo=2", nil)
+	r.RemoteAddr = "127.0.0.1:5555"
+	resp = httptest.NewRecorder()
+	DriverVerificationAdminHandler(resp, r)
+	if !bytes.Equal(resp.Body.Bytes(), testJPEG) || resp.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("wrong photo:%q", resp.Body.String())
+	}
+	//Not from outside without a token
+	r.RemoteAddr = "1.2.3.4:5555"
+	resp = httptest.NewRecorder()
+	DriverVerificationAdminHandler(resp, r)
+	if resp.Code != 403 {
+		t.Errorf("photo served to anyone")
+	}
+
+	reviewForTest("reject", "driver1", "blurry")
+	r = httptest.NewRequest("GET", "/commute/driver/onboarding?user=driver1&action=status&token="+token, nil)
+	resp = httptest.NewRecorder()
+	DriverOnboardingHandler(resp, r)
+	var status verificationStatus
+	if err := json.Unmarshal(resp.Body.Bytes(), &status); err != nil || status.Status != VERIFICATION_REJECTED ||
+		status.Reason != "blurry" {
+		t.Errorf("wrong status:%s", resp.Body.String())
+	}
+}
+
+//Open login says nothing about a licence. Drivers still need the approval.
+func TestVerificationWithOpenLogin(t *testing.T) {
+	Initialize()
+	SetDriverVerification(true)
+	if _, err := updateState("driver1", 12.884733, 77.551541, "", DRIVER_STATE, "", EVENT_LOGIN); err == nil {
+		t.Errorf("unverified driver logged in")
+	}
+	submitVerification("driver1", "KA0120110012345", "2036-01-31", "KA01AB1234", [][]byte{testPNG})
+	reviewForTest("approve", "driver1", "")
+	if _, err := updateState("driver1", 12.884733, 77.551541, "", DRIVER_STATE, "", EVENT_LOGIN); err != nil {
+		t.Fatalf("approved driver could not log in:%s", err.Error())
+	}
+	newUser("rider1", 12.884800, 77.551600, RIDER_STATE)
+	gStateLock.Lock()
+	gStateDS["rider1"].proposedDriver = "driver1"
+	gStateLock.Unlock()
+	if matches, _ := searchMatches("rider1", RIDER_STATE); matchNames(matches) != "driver1" {
+		t.Errorf("approved driver not found:%+v", matches)
+	}
+
+	//Not shown once revoked, even if proposed before
+	reviewForTest("revoke", "driver1", "complaints")
+	if matches, _ := searchMatches("rider1", RIDER_STATE); len(matches) != 0 {
+		t.Errorf("revoked driver found:%+v", matches)
+	}
+}
@@ -0,0 +1,642 @@
+package commute
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Organisations are companies whose people commute together. Someone joins by proving a work email (a code
+//is mailed to it) or with the organisation's invite code; one organisation per user. Members pick who they
+//match with: everyone (public), colleagues only (org), or colleagues first then everyone (orgfirst). A pair
+//matches only if both of them are fine with it, so an org only member is never shown to outsiders either.
+const ORG_SCOPE_PUBLIC = "public"
+const ORG_SCOPE_ORG = "org"
+const ORG_SCOPE_ORG_FIRST = "orgfirst"
+
+const ORG_USAGE_MAX_DAYS = 90
+
+//Store buckets used by organisations
+const bucketOrgs = "orgs"             //orgId -> organisation
+const bucketOrgDomains = "orgdomains" //email domain -> orgId
+const bucketOrgInvites = "orginvites" //invite code -> orgId
+const bucketOrgMembers = "orgmembers" //user -> orgMember
+const bucketOrgUsage = "orgusage"     //orgId/YYYY-MM-DD -> orgUsage
+
+//ErrOrgScope is returned for a request between two users whose organisation settings keep them apart.
+var ErrOrgScope = errors.New("Not allowed: this commuter rides only with their organisation")
+
+var orgIdRegex = regexp.MustCompile(`^[a-z0-9-]{2,32}$`)
+var domainRegex = regexp.MustCompile(`^[a-z0-9-]+(\.[a-z0-9-]+)+$`)
+
+type organisation struct {
+	Id         string   `json:"id"`
+	Name       string   `json:"name"`
+	Domains    []string `json:"domains"`
+	InviteCode string   `json:"invitecode"`
+	Admins     []string `json:"admins"` //Members who can see the usage
+	Created    int64    `json:"created"`
+}
+
+type orgMember struct {
+	User   string `json:"user"`
+	Org    string `json:"org"`
+	Via    string `json:"via"` //The email, or "invite"
+	Scope  string `json:"scope"`
+	Joined int64  `json:"joined"`
+}
+
+//orgUsage is one day of an organisation's activity. Org ones are with a colleague.
+type orgUsage struct {
+	Date            string `json:"date"`
+	JoinRequests    int    `json:"joinrequests"`
+	OrgJoinRequests int    `json:"orgjoinrequests"`
+	Trips           int    `json:"trips"`
+	OrgTrips        int    `json:"orgtrips"`
+}
+
+//emailChallenge is a code mailed out to join an organisation. Only the hash is kept, as for phones.
+type emailChallenge struct {
+	email    string
+	org      string
+	codeHash []byte
+	sent     time.Time
+	attempts int
+}
+
+//Memberships are looked at for every candidate in a search, so they are cached. A nil entry is a user in
+//no organisation.
+var gOrgMembers map[string]*orgMember
+var gEmailChallenges map[string]*emailChallenge //By user
+var gEmailNotifier Notifier
+var gOrgsLock = sync.RWMutex{}
+
+func resetOrgs() {
+	gOrgsLock.Lock()
+	defer gOrgsLock.Unlock()
+	gOrgMembers = make(map[string]*orgMember, 1000)
+	gEmailChallenges = make(map[string]*emailChallenge)
+	gEmailNotifier = noEmailNotifier{}
+}
+
+//SetEmailNotifier makes the package mail codes through n. Returns the one it replaces, to put back later.
+func SetEmailNotifier(n Notifier) Notifier {
+	gOrgsLock.Lock()
+	defer gOrgsLock.Unlock()
+	prev := gEmailNotifier
+	gEmailNotifier = n
+	return prev
+}
+
+//noEmailNotifier is there till a gateway is plugged in.
+type noEmailNotifier struct{}
+
+func (noEmailNotifier) Notify(contact string, message string) error {
+	return errors.New("no email gateway configured")
+}
+
+//HTTPNotifier posts contact and message as a form to a gateway.
+type HTTPNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewHTTPNotifier(gatewayURL string) *HTTPNotifier {
+	return &HTTPNotifier{URL: gatewayURL, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (n *HTTPNotifier) Notify(contact string, message string) error {
+	form := url.Values{"contact": {contact}, "message": {message}}
+	resp, err := n.Client.Post(n.URL, "application/x-www-form-urlencoded", bytes.NewBufferString(form.Encode()))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("gateway returned %d", resp.StatusCode))
+	}
+	return nil
+}
+
+func getOrg(orgId string) (*organisation, error) {
+	o := &organisation{}
+	if err := storeGetJSON(bucketOrgs, orgId, o); err != nil {
+		return nil, errors.New(fmt.Sprintf("No such organisation:%s", orgId))
+	}
+	return o, nil
+}
+
+//createOrg sets up an organisation. domains is comma separated, and each can belong to one organisation.
+func createOrg(actor string, orgId string, name string, domains string) (*organisation, error) {
+	if !orgIdRegex.MatchString(orgId) {
+		return nil, errors.New(fmt.Sprintf("Invalid organisation id, need a-z 0-9 and -:%s", orgId))
+	}
+	if name == "" {
+		return nil, errors.New("ERROR in name parameter")
+	}
+	o := &organisation{Id: orgId, Name: name, Domains: make([]string, 0), Admins: make([]string, 0),
+		InviteCode: strings.ToUpper(randSecret()), Created: clockNow().Unix()}
+	for _, d := range strings.Split(strings.ToLower(domains), ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		if !domainRegex.MatchString(d) {
+			return nil, errors.New(fmt.Sprintf("Invalid domain:%s", d))
+		}
+		var owner string
+		if err := storeGetJSON(bucketOrgDomains, d, &owner); err == nil {
+			return nil, errors.New(fmt.Sprintf("Domain %s belongs to %s", d, owner))
+		}
+		o.Domains = append(o.Domains, d)
+	}
+
+	gOrgsLock.Lock()
+	defer gOrgsLock.Unlock()
+	if _, err := getStore().Get(bucketOrgs, orgId); err == nil {
+		return nil, errors.New(fmt.Sprintf("Organisation %s exists", orgId))
+	}
+	if err := storePutJSON(bucketOrgs, orgId, o); err != nil {
+		return nil, err
+	}
+	for _, d := range o.Domains {
+		storePutJSON(bucketOrgDomains, d, orgId)
+	}
+	storePutJSON(bucketOrgInvites, o.InviteCode, orgId)
+	audit(actor, orgId, "org create", strings.Join(o.Domains, ","))
+	return o, nil
+}
+
+//rotateInvite gives the organisation a new invite code. The old one stops working; members stay.
+func rotateInvite(actor string, orgId string) (*organisation, error) {
+	gOrgsLock.Lock()
+	defer gOrgsLock.Unlock()
+	o, err := getOrg(orgId)
+	if err != nil {
+		return nil, err
+	}
+	getStore().Delete(bucketOrgInvites, o.InviteCode)
+	o.InviteCode = strings.ToUpper(randSecret())
+	if err = storePutJSON(bucketOrgs, orgId, o); err != nil {
+		return nil, err
+	}
+	storePutJSON(bucketOrgInvites, o.InviteCode, orgId)
+	audit(actor, orgId, "org rotateinvite", "")
+	return o, nil
+}
+
+//setOrgAdmin lets a member see the organisation's usage.
+func setOrgAdmin(actor string, orgId string, userName string) error {
+	if m := orgOf(userName); m == nil || m.Org != orgId {
+		return errors.New(fmt.Sprintf("%s is not in %s", userName, orgId))
+	}
+	gOrgsLock.Lock()
+	defer gOrgsLock.Unlock()
+	o, err := getOrg(orgId)
+	if err != nil {
+		return err
+	}
+	if !containsString(o.Admins, userName) {
+		o.Admins = append(o.Admins, userName)
+	}
+	if err = storePutJSON(bucketOrgs, orgId, o); err != nil {
+		return err
+	}
+	return audit(actor, userName, "org admin", orgId)
+}
+
+//orgOf returns the user's membership, nil if in no organisation.
+func orgOf(userName string) *orgMember {
+	gOrgsLock.RLock()
+	m, ok := gOrgMembers[userName]
+	gOrgsLock.RUnlock()
+	if ok {
+		return m
+	}
+	m = &orgMember{}
+	if err := storeGetJSON(bucketOrgMembers, userName, m); err != nil {
+		m = nil
+	}
+	gOrgsLock.Lock()
+	defer gOrgsLock.Unlock()
+	//A join, leave or scope change may have gone in while we were at the store. It is newer than what we read.
+	if newer, ok := gOrgMembers[userName]; ok {
+		return newer
+	}
+	gOrgMembers[userName] = m
+	return m
+}
+
+func saveMember(m *orgMember) error {
+	if err := storePutJSON(bucketOrgMembers, m.User, m); err != nil {
+		return err
+	}
+	gOrgsLock.Lock()
+	gOrgMembers[m.User] = m
+	gOrgsLock.Unlock()
+	logStateChange(m.User, EVENT_ORGMEMBER, m)
+	return nil
+}
+
+func removeMember(userName string) error {
+	if err := getStore().Delete(bucketOrgMembers, userName); err != nil {
+		return err
+	}
+	gOrgsLock.Lock()
+	gOrgMembers[userName] = nil
+	gOrgsLock.Unlock()
+	logStateChange(userName, EVENT_ORGMEMBER, nil)
+	return nil
+}
+
+func joinOrg(userName string, orgId string, via string) (string, error) {
+	if m := orgOf(userName); m != nil && m.Org != orgId {
+		return "", errors.New(fmt.Sprintf("Already in %s. Leave it first", m.Org))
+	}
+	o, err := getOrg(orgId)
+	if err != nil {
+		return "", err
+	}
+	m := &orgMember{User: userName, Org: orgId, Via: via, Scope: ORG_SCOPE_ORG_FIRST, Joined: clockNow().Unix()}
+	if err = saveMember(m); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Success! You are in %s", o.Name), nil
+}
+
+func leaveOrg(userName string) (string, error) {
+	m := orgOf(userName)
+	if m == nil {
+		return "", errors.New("Not in an organisation")
+	}
+	if err := removeMember(userName); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Success! Left %s", m.Org), nil
+}
+
+func joinOrgByInvite(userName string, code string) (string, error) {
+	var orgId string
+	if err := storeGetJSON(bucketOrgInvites, strings.ToUpper(strings.TrimSpace(code)), &orgId); err != nil {
+		return "", errors.New("Invalid invite code")
+	}
+	return joinOrg(userName, orgId, "invite")
+}
+
+//sendOrgEmailCode mails a code to the work email, if its domain belongs to an organisation.
+func sendOrgEmailCode(userName string, email string) error {
+	email = strings.ToLower(strings.TrimSpace(email))
+	at := strings.LastIndex(email, "@")
+	if at <= 0 {
+		return errors.New(fmt.Sprintf("Invalid email:%s", email))
+	}
+	var orgId string
+	if err := storeGetJSON(bucketOrgDomains, email[at+1:], &orgId); err != nil {
+		return errors.New(fmt.Sprintf("No organisation uses %s", email[at+1:]))
+	}
+
+	now := clockNow()
+	code := randCode(OTP_DIGITS)
+	ch := &emailChallenge{email: email, org: orgId, codeHash: hashCode(userName, code), sent: now}
+	gOrgsLock.Lock()
+	if prev, ok := gEmailChallenges[userName]; ok && now.Sub(prev.sent) < OTP_RESEND_GAP {
+		gOrgsLock.Unlock()
+		return errors.New(fmt.Sprintf("Code already sent. Try again in %d secs",
+			int((OTP_RESEND_GAP-now.Sub(prev.sent)).Seconds())+1))
+	}
+	gEmailChallenges[userName] = ch
+	notifier := gEmailNotifier
+	gOrgsLock.Unlock()
+
+	msg := fmt.Sprintf("%s is your code to join your organisation's carpool. It is valid for %d minutes.", code,
+		int(OTP_TTL.Minutes()))
+	if err := notifier.Notify(email, msg); err != nil {
+		gOrgsLock.Lock()
+		if gEmailChallenges[userName] == ch {
+			delete(gEmailChallenges, userName)
+		}
+		gOrgsLock.Unlock()
+		return errors.New(fmt.Sprintf("Could not send the code:%s", err.Error()))
+	}
+	return nil
+}
+
+func verifyOrgEmail(userName string, code string) (string, error) {
+	now := clockNow()
+	gOrgsLock.Lock()
+	ch, ok := gEmailChallenges[userName]
+	if !ok {
+		gOrgsLock.Unlock()
+		return "", errors.New("No code pending. Ask for a code first")
+	}
+	if now.Sub(ch.sent) > OTP_TTL {
+		delete(gEmailChallenges, userName)
+		gOrgsLock.Unlock()
+		return "", errors.New("Code expired. Ask for a new one")
+	}
+	if subtle.ConstantTimeCompare(ch.codeHash, hashCode(userName, code)) != 1 {
+		ch.attempts++
+		left := OTP_MAX_ATTEMPTS - ch.attempts
+		if left <= 0 {
+			delete(gEmailChallenges, userName)
+		}
+		gOrgsLock.Unlock()
+		if left <= 0 {
+			return "", errors.New("Too many wrong codes. Ask for a new one")
+		}
+		return "", errors.New(fmt.Sprintf("Wrong code. %d attempts left", left))
+	}
+	delete(gEmailChallenges, userName)
+	gOrgsLock.Unlock()
+	return joinOrg(userName, ch.org, ch.email)
+}
+
+func setOrgScope(userName string, scope string) (string, error) {
+	m := orgOf(userName)
+	switch scope {
+	case ORG_SCOPE_PUBLIC, ORG_SCOPE_ORG, ORG_SCOPE_ORG_FIRST:
+	default:
+		return "", errors.New(fmt.Sprintf("ERROR in scope parameter:%s", scope))
+	}
+	if m == nil {
+		return "", errors.New("Not in an organisation")
+	}
+	updated := *m
+	updated.Scope = scope
+	if err := saveMember(&updated); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Success! Matching with %s", scope), nil
+}
+
+func sameOrg(user1 string, user2 string) bool {
+	m1, m2 := orgOf(user1), orgOf(user2)
+	return m1 != nil && m2 != nil && m1.Org == m2.Org
+}
+
+//orgAllowsPair says if the two can be matched, going by what each of them asked for.
+func orgAllowsPair(user1 string, user2 string) bool {
+	m1, m2 := orgOf(user1), orgOf(user2)
+	same := m1 != nil && m2 != nil && m1.Org == m2.Org
+	if m1 != nil && m1.Scope == ORG_SCOPE_ORG && !same {
+		return false
+	}
+	if m2 != nil && m2.Scope == ORG_SCOPE_ORG && !same {
+		return false
+	}
+	return true
+}
+
+func wantsOrgFirst(userName string) bool {
+	m := orgOf(userName)
+	return m != nil && m.Scope == ORG_SCOPE_ORG_FIRST
+}
+
+//orgFirst moves colleagues to the top, keeping the order otherwise, and keeps maxMatchedUsers.
+func orgFirst(arr []matchUserDetails, userName string) []matchUserDetails {
+	sort.SliceStable(arr, func(i, j int) bool {
+		return sameOrg(userName, arr[i].userName) && !sameOrg(userName, arr[j].userName)
+	})
+	if max := maxMatchedUsers(tenantOf(userName)); len(arr) > max {
+		arr = arr[:max]
+	}
+	return arr
+}
+
+//recordOrgUsage counts a join request (trip false) or a trip between the two, for each one's organisation.
+func recordOrgUsage(rider string, driver string, trip bool) {
+	m1, m2 := orgOf(rider), orgOf(driver)
+	orgs := make([]string, 0, 2)
+	if m1 != nil {
+		orgs = append(orgs, m1.Org)
+	}
+	if m2 != nil && (m1 == nil || m2.Org != m1.Org) {
+		orgs = append(orgs, m2.Org)
+	}
+	same := m1 != nil && m2 != nil && m1.Org == m2.Org
+	date := clockNow().UTC().Format("2006-01-02")
+
+	gOrgsLock.Lock()
+	defer gOrgsLock.Unlock()
+	for _, org := range orgs {
+		u := orgUsage{Date: date}
+		storeGetJSON(bucketOrgUsage, org+"/"+date, &u)
+		if trip {
+			u.Trips++
+			if same {
+				u.OrgTrips++
+			}
+		} else {
+			u.JoinRequests++
+			if same {
+				u.OrgJoinRequests++
+			}
+		}
+		storePutJSON(bucketOrgUsage, org+"/"+date, u)
+	}
+}
+
+//orgUsageReport is what the organisation's admins see.
+type orgUsageReport struct {
+	Org     string     `json:"org"`
+	Name    string     `json:"name"`
+	Members int        `json:"members"`
+	Online  int        `json:"online"` //Members in the app right now
+	Days    []orgUsage `json:"days"`   //Most recent first. Days with nothing are left out.
+}
+
+func getOrgUsage(orgId string, days int) (*orgUsageReport, error) {
+	if days <= 0 || days > ORG_USAGE_MAX_DAYS {
+		return nil, errors.New(fmt.Sprintf("ERROR in days parameter, 1 to %d:%d", ORG_USAGE_MAX_DAYS, days))
+	}
+	o, err := getOrg(orgId)
+	if err != nil {
+		return nil, err
+	}
+	report := &orgUsageReport{Org: o.Id, Name: o.Name, Days: make([]orgUsage, 0)}
+	vals, err := getStore().List(bucketOrgMembers, "")
+	if err != nil {
+		return nil, err
+	}
+	members := make([]string, 0)
+	for _, v := range vals {
+		m := orgMember{}
+		if json.Unmarshal(v, &m) == nil && m.Org == orgId {
+			members = append(members, m.User)
+		}
+	}
+	report.Members = len(members)
+	gStateLock.RLock()
+	for _, u := range members {
+		if _, ok := gStateDS[u]; ok {
+			report.Online++
+		}
+	}
+	gStateLock.RUnlock()
+
+	now := clockNow().UTC()
+	for i := 0; i < days; i++ {
+		date := now.AddDate(0, 0, -i).Format("2006-01-02")
+		u := orgUsage{}
+		if storeGetJSON(bucketOrgUsage, orgId+"/"+date, &u) == nil {
+			report.Days = append(report.Days, u)
+		}
+	}
+	return report, nil
+}
+
+//What a member gets to see of their membership.
+type orgStatus struct {
+	Org   string `json:"org"`
+	Name  string `json:"name"`
+	Scope string `json:"scope"`
+	Admin bool   `json:"admin"`
+}
+
+func processOrgRequest(userName string, token string, action string, email string, code string, scope string,
+	days string) (string, error) {
+	if _, err := isUserValid(userName, token); err != nil {
+		return "", err
+	}
+	switch action {
+	case "joinemail":
+		if err := sendOrgEmailCode(userName, email); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("codesent,%d", int(OTP_TTL.Seconds())), nil
+	case "verifyemail":
+		return verifyOrgEmail(userName, code)
+	case "joininvite":
+		return joinOrgByInvite(userName, code)
+	case "leave":
+		return leaveOrg(userName)
+	case "scope":
+		return setOrgScope(userName, scope)
+	}
+
+	m := orgOf(userName)
+	if m == nil {
+		if action == "status" || action == "" {
+			return `{"org":"","scope":"public"}`, nil
+		}
+		return "", errors.New("Not in an organisation")
+	}
+	o, err := getOrg(m.Org)
+	if err != nil {
+		return "", err
+	}
+	var out interface{}
+	switch action {
+	case "status", "":
+		out = orgStatus{Org: o.Id, Name: o.Name, Scope: m.Scope, Admin: containsString(o.Admins, userName)}
+	case "usage":
+		if !containsString(o.Admins, userName) {
+			return "", errors.New(fmt.Sprintf("Only admins of %s can see usage", o.Id))
+		}
+		n, err := parseIntParam(days, 7)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("ERROR in days parameter:%s", days))
+		}
+		if out, err = getOrgUsage(o.Id, n); err != nil {
+			return "", err
+		}
+	default:
+		return "", errors.New(fmt.Sprintf("ERROR in action parameter:%s", action))
+	}
+	data, err := json.Marshal(out)
+	return string(data), err
+}
+
+//Function OrgHandler is a member's view of their organisation. Params are user, token and action: joinemail
+//(email), verifyemail (code), joininvite (code), leave, scope (scope=public/org/orgfirst), status, and usage
+//(days, default 7) for the organisation's admins.
+func OrgHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	user := q.Get("user")
+	retValue, err := processOrgRequest(user, q.Get("token"), q.Get("action"), q.Get("email"), q.Get("code"),
+		q.Get("scope"), q.Get("days"))
+	if err != nil {
+		fmt.Fprint(w, "ERROR! :", err)
+	} else {
+		fmt.Fprint(w, retValue)
+	}
+	//No query here. It has the code in it.
+	fmt.Println(clockNow(), "\t", user, "\t", r.RemoteAddr, "\t", "org", "\t", q.Get("action"), "\t", err)
+}
+
+//Function OrgAdminHandler sets up organisations. Params are action (create/get/list/usage/rotateinvite/
+//addadmin), org, name and domains (comma separated) for create, target (a member) for addadmin and days for
+//usage. Admins and support can look, only admins change things. See isStaffRequest.
+func OrgAdminHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := isStaffRequest(r, ROLE_ADMIN, ROLE_SUPPORT)
+	if !ok {
+		rejectStaffRequest(w, ROLE_ADMIN, ROLE_SUPPORT)
+		return
+	}
+	q := r.URL.Query()
+	action := q.Get("action")
+	isAdmin := actor == "localhost" || hasRole(actor, ROLE_ADMIN)
+	var out interface{}
+	var err error
+	switch action {
+	case "get":
+		out, err = getOrg(q.Get("org"))
+	case "list":
+		out, err = listOrgs()
+	case "usage":
+		var days int
+		if days, err = strconv.Atoi(q.Get("days")); err != nil {
+			days = 7
+		}
+		out, err = getOrgUsage(q.Get("org"), days)
+	case "create", "rotateinvite", "addadmin":
+		if !isAdmin {
+			err = errors.New("Only admins can change organisations")
+		} else if action == "create" {
+			out, err = createOrg(actor, q.Get("org"), q.Get("name"), q.Get("domains"))
+		} else if action == "rotateinvite" {
+			out, err = rotateInvite(actor, q.Get("org"))
+		} else if err = setOrgAdmin(actor, q.Get("org"), q.Get("target")); err == nil {
+			out = "Success! " + q.Get("target") + " is an admin of " + q.Get("org")
+		}
+	default:
+		err = errors.New(fmt.Sprintf("ERROR in action parameter:%s", action))
+	}
+	if err == nil {
+		if s, isString := out.(string); isString {
+			fmt.Fprint(w, s)
+		} else {
+			err = json.NewEncoder(w).Encode(out)
+		}
+	}
+	if err != nil {
+		fmt.Fprint(w, "ERROR! :", err)
+	}
+	fmt.Println(clockNow(), "\t", actor, "\t", r.RemoteAddr, "\t", "orgs", "\t", action, "\t", q.Get("org"), "\t", err)
+}
+
+func listOrgs() ([]*organisation, error) {
+	vals, err := getStore().List(bucketOrgs, "")
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*organisation, 0, len(vals))
+	for _, v := range vals {
+		o := &organisation{}
+		if err = json.Unmarshal(v, o); err != nil {
+			return nil, err
+		}
+		out = append(out, o)
+	}
+	return out, nil
+}
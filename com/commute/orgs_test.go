@@ -0,0 +1,207 @@
+package commute
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func matchNames(arr []matchUserDetails) string {
+	names := make([]string, 0, len(arr))
+	for _, m := range arr {
+		names = append(names, m.userName)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestOrgMembership(t *testing.T) {
+	Initialize()
+	mail := NewFakeNotifier()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+	defer SetEmailNotifier(SetEmailNotifier(mail))
+
+	acme, err := createOrg("localhost", "acme", "Acme Corp", "acme.com, Acme.co.in")
+	if err != nil {
+		t.Fatalf("create failed:%s", err.Error())
+	}
+	if _, err = createOrg("localhost", "other", "Other", "acme.com"); err == nil {
+		t.Errorf("domain given to two organisations")
+	}
+	token := newUser("rider1", 12.884800, 77.551600, RIDER_STATE)
+	token2 := newUser("rider2", 12.884800, 77.551600, RIDER_STATE)
+
+	//By email
+	if _, err = processOrgRequest("rider1", token, "joinemail", "me@gmail.com", "", "", ""); err == nil {
+		t.Errorf("joined with a domain nobody uses")
+	}
+	if _, err = processOrgRequest("rider1", token, "joinemail", "Me@Acme.co.in", "", "", ""); err != nil {
+		t.Fatalf("joinemail failed:%s", err.Error())
+	}
+	msgs := mail.Messages("me@acme.co.in")
+	if len(msgs) != 1 {
+		t.Fatalf("no code mailed:%v", msgs)
+	}
+	code := strings.Split(msgs[0], " ")[0]
+	if _, err = processOrgRequest("rider1", token, "verifyemail", "", "000000x", "", ""); err == nil {
+		t.Errorf("wrong code accepted")
+	}
+	if _, err = processOrgRequest("rider1", token, "verifyemail", "", code, "", ""); err != nil {
+		t.Errorf("verify failed:%s", err.Error())
+	}
+	if m := orgOf("rider1"); m == nil || m.Org != "acme" || m.Via != "me@acme.co.in" || m.Scope != ORG_SCOPE_ORG_FIRST {
+		t.Errorf("wrong membership:%+v", m)
+	}
+
+	//By invite
+	cases := []struct {
+		code     string
+		expected bool
+	}{
+		{"NOTACODE", false},
+		{strings.ToLower(acme.InviteCode), true},
+	}
+	for idx, c := range cases {
+		_, err = processOrgRequest("rider2", token2, "joininvite", "", c.code, "", "")
+		if (err == nil) != c.expected {
+			t.Errorf("test case #%d: err = %v", idx, err)
+		}
+	}
+	rotateInvite("localhost", "acme")
+	processOrgRequest("rider2", token2, "leave", "", "", "", "")
+	if _, err = joinOrgByInvite("rider2", acme.InviteCode); err == nil {
+		t.Errorf("old invite code still works")
+	}
+	if orgOf("rider2") != nil {
+		t.Errorf("still a member after leaving")
+	}
+
+	ret, _ := processOrgRequest("rider1", token, "status", "", "", "", "")
+	var status orgStatus
+	if err = json.Unmarshal([]byte(ret), &status); err != nil || status.Org != "acme" || status.Admin {
+		t.Errorf("wrong status:%s", ret)
+	}
+	if _, err = processOrgRequest("rider1", token, "scope", "", "", "everyone", ""); err == nil {
+		t.Errorf("bad scope accepted")
+	}
+}
+
+func TestOrgScopedMatching(t *testing.T) {
+	Initialize()
+	createOrg("localhost", "acme", "Acme Corp", "acme.com")
+	createOrg("localhost", "globex", "Globex", "globex.com")
+
+	tokens := make(map[string]string)
+	for _, d := range []string{"driver1", "driver2", "driver3"} {
+		tokens[d] = newUser(d, 12.884733, 77.551541, DRIVER_STATE)
+	}
+	tokens["rider1"] = newUser("rider1", 12.884800, 77.551600, RIDER_STATE)
+	joinOrg("rider1", "acme", "invite")
+	joinOrg("driver2", "acme", "invite")
+	joinOrg("driver3", "globex", "invite")
+
+	cases := []struct {
+		riderScope  string
+		driverScope string //Of driver3
+		expected    string
+	}{
+		{ORG_SCOPE_ORG, ORG_SCOPE_PUBLIC, "driver2"},
+		{ORG_SCOPE_ORG_FIRST, ORG_SCOPE_PUBLIC, "driver2,driver1,driver3"},
+		{ORG_SCOPE_PUBLIC, ORG_SCOPE_ORG, "driver1,driver2"}, //driver3 wants Globex only
+	}
+	for idx, c := range cases {
+		setOrgScope("rider1", c.riderScope)
+		setOrgScope("driver3", c.driverScope)
+		matches, _ := searchMatches("rider1", RIDER_STATE)
+		//Search goes in map order. Sort what is not put in order by the scope.
+		rest := matches
+		if c.riderScope == ORG_SCOPE_ORG_FIRST && len(matches) > 0 {
+			rest = matches[1:]
+		}
+		sort.Slice(rest, func(i, j int) bool { return rest[i].userName < rest[j].userName })
+		if got := matchNames(matches); got != c.expected {
+			t.Errorf("test case #%d: got %s, expected %s", idx, got, c.expected)
+		}
+	}
+
+	//Asking anyway does not get round it
+	setOrgScope("rider1", ORG_SCOPE_ORG)
+	if _, err := updateState("rider1", 12.884800, 77.551600, tokens["rider1"], RIDER_STATE, "driver1", EVENT_JOINREQ); err != ErrOrgScope {
+		t.Errorf("join request outside the org went through:%v", err)
+	}
+	if _, err := updateState("rider1", 12.884800, 77.551600, tokens["rider1"], RIDER_STATE, "driver2", EVENT_JOINREQ); err != nil {
+		t.Errorf("join request in the org failed:%s", err.Error())
+	}
+}
+
+func TestOrgUsage(t *testing.T) {
+	Initialize()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+	createOrg("localhost", "acme", "Acme Corp", "acme.com")
+	riderToken := newUser("rider1", 12.884800, 77.551600, RIDER_STATE)
+	driverToken := newUser("driver1", 12.884733, 77.551541, DRIVER_STATE)
+	outsiderToken := newUser("driver2", 12.884733, 77.551541, DRIVER_STATE)
+	joinOrg("rider1", "acme", "invite")
+	joinOrg("driver1", "acme", "invite")
+
+	updateState("rider1", 12.884800, 77.551600, riderToken, RIDER_STATE, "driver2", EVENT_JOINREQ)
+	updateState("rider1", 12.884800, 77.551600, riderToken, RIDER_STATE, "driver1", EVENT_JOINREQ)
+	updateState("driver1", 12.884733, 77.551541, driverToken, DRIVER_STATE, "rider1", EVENT_JOINACCEPT)
+	clock.Advance(23 * time.Hour) //Next day, tokens still good
+	updateState("driver1", 12.884733, 77.551541, driverToken, DRIVER_STATE, "rider1", EVENT_TRIPEND)
+	updateState("rider1", 12.884800, 77.551600, riderToken, RIDER_STATE, "driver2", EVENT_JOINREQ)
+	updateState("driver2", 12.884733, 77.551541, outsiderToken, DRIVER_STATE, "rider1", EVENT_JOINACCEPT)
+
+	//Members only see it once made admins
+	if _, err := processOrgRequest("driver1", driverToken, "usage", "", "", "", ""); err == nil {
+		t.Errorf("non admin saw usage")
+	}
+	setOrgAdmin("localhost", "acme", "driver1")
+	ret, err := processOrgRequest("driver1", driverToken, "usage", "", "", "", "7")
+	if err != nil {
+		t.Fatalf("usage failed:%s", err.Error())
+	}
+	var report orgUsageReport
+	json.Unmarshal([]byte(ret), &report)
+	expected := []orgUsage{{"2026-10-20", 1, 0, 1, 0}, {"2026-10-19", 2, 1, 1, 1}}
+	if report.Members != 2 || report.Online != 2 || len(report.Days) != 2 || report.Days[0] != expected[0] ||
+		report.Days[1] != expected[1] {
+		t.Errorf("wrong usage:%s", ret)
+	}
+	if setOrgAdmin("localhost", "acme", "driver2") == nil {
+		t.Errorf("outsider made an admin")
+	}
+
+	//Ops see it from the admin endpoint
+	r := httptest.NewRequest("GET", "/commute/admin/orgs?action=usage&org=acme&days=1", nil)
+	r.RemoteAddr = "127.0.0.1:5555"
+	resp := httptest.NewRecorder()
+	OrgAdminHandler(resp, r)
+	if err = json.Unmarshal(resp.Body.Bytes(), &report); err != nil || len(report.Days) != 1 {
+		t.Errorf("wrong admin usage:%s", resp.Body.String())
+	}
+	r = httptest.NewRequest("GET", "/commute/admin/orgs?action=create&org=x&name=X", nil)
+	r.RemoteAddr = "1.2.3.4:5555"
+	resp = httptest.NewRecorder()
+	OrgAdminHandler(resp, r)
+	if resp.Code != 403 {
+		t.Errorf("outsider created an org")
+	}
+}
+
+//A search loading a membership while the user joins must not put the old one back in the cache.
+func TestOrgMemberRace(t *testing.T) {
+	Initialize()
+	createOrg("localhost", "acme", "Acme Corp", "acme.com")
+	defer SetStore(getStore())
+	SetStore(&racingStore{getStore(), bucketOrgMembers, func() { joinOrg("rider1", "acme", "invite") }})
+
+	orgOf("rider1")
+	if m := orgOf("rider1"); m == nil || m.Org != "acme" {
+		t.Errorf("membership lost from the cache:%v", m)
+	}
+}
@@ -0,0 +1,350 @@
+package commute
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+//Commuter profiles say what a commuter is like (smokes, plays music, travels with pets) and what they want
+//from the other side. A hard preference (require/refuse) keeps a candidate out of the results altogether, in
+//either direction. A soft one (prefer/avoid) only moves them up or down: each met one is worth
+//PREF_SOFT_METRES less distance, each missed one that much more. Women only is hard too, and needs the
+//other side's gender checked by staff, not just declared.
+const PREF_SMOKING = "smoking"
+const PREF_MUSIC = "music"
+const PREF_PETS = "pets"
+
+var prefAttributes = []string{PREF_SMOKING, PREF_MUSIC, PREF_PETS}
+
+//Preference levels
+const PREF_REQUIRE = "require" //Hard. Candidate has to have it
+const PREF_PREFER = "prefer"   //Soft
+const PREF_AVOID = "avoid"     //Soft
+const PREF_REFUSE = "refuse"   //Hard. Candidate must not have it
+
+var prefLevels = map[string]bool{PREF_REQUIRE: true, PREF_PREFER: true, PREF_AVOID: true, PREF_REFUSE: true}
+
+const GENDER_FEMALE = "female"
+const GENDER_MALE = "male"
+const GENDER_OTHER = "other"
+
+var validGenders = map[string]bool{GENDER_FEMALE: true, GENDER_MALE: true, GENDER_OTHER: true}
+
+const PREF_SOFT_METRES = 200 //What one soft preference is worth in distance, when ranking
+
+const bucketProfiles = "profiles" //user -> commuterProfile
+
+//ErrPreferences is returned when a request is between commuters whose hard preferences rule each other out.
+var ErrPreferences = errors.New("Not allowed: your preferences or theirs rule this commuter out")
+
+type commuterProfile struct {
+	User           string            `json:"user"`
+	Gender         string            `json:"gender,omitempty"` //As the commuter says
+	GenderVerified bool              `json:"genderverified"`   //Checked by staff. Cleared when the gender changes.
+	Attrs          []string          `json:"attrs"`            //Which of prefAttributes apply to the commuter
+	Prefs          map[string]string `json:"prefs"`            //Attribute -> level
+	WomenOnly      bool              `json:"womenonly"`
+}
+
+//Profiles are looked at for every candidate in a search, so they are cached. A nil entry is a user without
+//a profile.
+var gProfiles map[string]*commuterProfile
+var gProfilesLock = sync.RWMutex{}
+
+//Held across the read-modify-write of a profile, else a commuter's edit and a staff check at the same time
+//lose one of the two.
+var gProfileEditLock = sync.Mutex{}
+
+func resetProfiles() {
+	gProfilesLock.Lock()
+	defer gProfilesLock.Unlock()
+	gProfiles = make(map[string]*commuterProfile, 1000)
+}
+
+func getProfile(userName string) *commuterProfile {
+	gProfilesLock.RLock()
+	p, ok := gProfiles[userName]
+	gProfilesLock.RUnlock()
+	if ok {
+		return p
+	}
+	p = &commuterProfile{}
+	if err := storeGetJSON(bucketProfiles, userName, p); err != nil {
+		p = nil
+	}
+	gProfilesLock.Lock()
+	defer gProfilesLock.Unlock()
+	//A save may have gone in while we were at the store. Its profile is newer than what we read.
+	if newer, ok := gProfiles[userName]; ok {
+		return newer
+	}
+	gProfiles[userName] = p
+	return p
+}
+
+func saveProfile(p *commuterProfile) error {
+	if err := storePutJSON(bucketProfiles, p.User, p); err != nil {
+		return err
+	}
+	gProfilesLock.Lock()
+	gProfiles[p.User] = p
+	gProfilesLock.Unlock()
+	logStateChange(p.User, EVENT_PROFILE, p)
+	return nil
+}
+
+func (p *commuterProfile) has(attr string) bool {
+	return p != nil && containsString(p.Attrs, attr)
+}
+
+func (p *commuterProfile) isVerifiedWoman() bool {
+	return p != nil && p.Gender == GENDER_FEMALE && p.GenderVerified
+}
+
+//Parses "smoking:refuse,music:prefer". Empty clears them.
+func parsePrefs(str string) (map[string]string, error) {
+	prefs := make(map[string]string)
+	for _, p := range strings.Split(str, ",") {
+		if strings.TrimSpace(p) == "" {
+			continue
+		}
+		kv := strings.Split(strings.TrimSpace(p), ":")
+		if len(kv) != 2 || !containsString(prefAttributes, kv[0]) || !prefLevels[kv[1]] {
+			return nil, errors.New(fmt.Sprintf("ERROR in prefs parameter:%s", p))
+		}
+		prefs[kv[0]] = kv[1]
+	}
+	return prefs, nil
+}
+
+//setProfile saves what the commuter says about themselves. Empty params leave that part as is; "none" clears
+//attrs and prefs. Changing the gender needs it checked again, and women only needs it checked.
+func setProfile(userName string, gender string, attrs string, prefs string, womenOnly string) (string, error) {
+	gProfileEditLock.Lock()
+	defer gProfileEditLock.Unlock()
+	p := &commuterProfile{User: userName, Attrs: make([]string, 0), Prefs: make(map[string]string)}
+	if old := getProfile(userName); old != nil {
+		*p = *old
+	}
+	if gender != "" && gender != p.Gender {
+		if !validGenders[gender] {
+			return "", errors.New(fmt.Sprintf("ERROR in gender parameter:%s", gender))
+		}
+		p.Gender, p.GenderVerified = gender, false
+	}
+	if attrs == "none" {
+		p.Attrs = make([]string, 0)
+	} else if attrs != "" {
+		list := make([]string, 0)
+		for _, a := range strings.Split(attrs, ",") {
+			a = strings.TrimSpace(a)
+			if !containsString(prefAttributes, a) {
+				return "", errors.New(fmt.Sprintf("ERROR in attrs parameter:%s", a))
+			}
+			if !containsString(list, a) {
+				list = append(list, a)
+			}
+		}
+		p.Attrs = list
+	}
+	if prefs == "none" {
+		p.Prefs = make(map[string]string)
+	} else if prefs != "" {
+		parsed, err := parsePrefs(prefs)
+		if err != nil {
+			return "", err
+		}
+		p.Prefs = parsed
+	}
+	switch womenOnly {
+	case "":
+	case "1":
+		p.WomenOnly = true
+	case "0":
+		p.WomenOnly = false
+	default:
+		return "", errors.New(fmt.Sprintf("ERROR in womenonly parameter:%s", womenOnly))
+	}
+	if p.WomenOnly && !p.isVerifiedWoman() {
+		return "", errors.New("Women only needs your gender verified as female")
+	}
+	if err := saveProfile(p); err != nil {
+		return "", err
+	}
+	return "Success! Profile saved", nil
+}
+
+//verifyGender is staff confirming the commuter's gender, from an ID seen at onboarding or support. Audited.
+func verifyGender(actor string, userName string, gender string) error {
+	if !validGenders[gender] {
+		return errors.New(fmt.Sprintf("ERROR in gender parameter:%s", gender))
+	}
+	gProfileEditLock.Lock()
+	defer gProfileEditLock.Unlock()
+	p := &commuterProfile{User: userName, Attrs: make([]string, 0), Prefs: make(map[string]string)}
+	if old := getProfile(userName); old != nil {
+		*p = *old
+	}
+	p.Gender, p.GenderVerified = gender, true
+	if gender != GENDER_FEMALE {
+		p.WomenOnly = false
+	}
+	if err := saveProfile(p); err != nil {
+		return err
+	}
+	return audit(actor, userName, "verify gender", gender)
+}
+
+//Whether b gets past a's hard preferences.
+func passesHardPrefs(a *commuterProfile, b *commuterProfile) bool {
+	if a == nil {
+		return true
+	}
+	if a.WomenOnly && !b.isVerifiedWoman() {
+		return false
+	}
+	for attr, level := range a.Prefs {
+		if (level == PREF_REQUIRE && !b.has(attr)) || (level == PREF_REFUSE && b.has(attr)) {
+			return false
+		}
+	}
+	return true
+}
+
+//prefsAllowPair says if the two can ride together as far as either one's hard preferences go.
+func prefsAllowPair(a string, b string) bool {
+	pa, pb := getProfile(a), getProfile(b)
+	return passesHardPrefs(pa, pb) && passesHardPrefs(pb, pa)
+}
+
+//explainMatch scores candidate against the user's soft preferences and says why: "+music" for a preference
+//met, "-smoking" for one missed, separated by "|". In the order of prefAttributes.
+func explainMatch(user *commuterProfile, candidate string) (int, string) {
+	if user == nil {
+		return 0, ""
+	}
+	other := getProfile(candidate)
+	score, reasons := 0, make([]string, 0)
+	if user.WomenOnly {
+		reasons = append(reasons, "+womenonly")
+	}
+	for _, attr := range prefAttributes {
+		level := user.Prefs[attr]
+		if level != PREF_PREFER && level != PREF_AVOID {
+			continue
+		}
+		if (level == PREF_PREFER) == other.has(attr) {
+			score++
+			reasons = append(reasons, "+"+attr)
+		} else {
+			score--
+			reasons = append(reasons, "-"+attr)
+		}
+	}
+	return score, strings.Join(reasons, "|")
+}
+
+//rankByPrefs orders the candidates by their weight (see motionWeight) less what the user's soft preferences
+//are worth, and fills in why each is where it is. Nearest first among equals.
+func rankByPrefs(arr []matchUserDetails, userName string) []matchUserDetails {
+	p := getProfile(userName)
+	if p == nil {
+		return rankByWeight(arr)
+	}
+	for i := range arr {
+		var score int
+		score, arr[i].why = explainMatch(p, arr[i].userName)
+		arr[i].weight -= float64(score * PREF_SOFT_METRES)
+	}
+	return rankByWeight(arr)
+}
+
+//explainsMatches says if the user's search results are ranked and come with the reasons. Only for users with
+//preferences, so that nothing changes for the apps which do not know about them.
+func explainsMatches(userName string) bool {
+	p := getProfile(userName)
+	return p != nil && (len(p.Prefs) > 0 || p.WomenOnly)
+}
+
+func processProfileRequest(userName string, token string, action string, gender string, attrs string,
+	prefs string, womenOnly string) (string, error) {
+	if _, err := isUserValid(userName, token); err != nil {
+		return "", err
+	}
+	switch action {
+	case "get":
+		p := getProfile(userName)
+		if p == nil {
+			p = &commuterProfile{User: userName, Attrs: make([]string, 0), Prefs: make(map[string]string)}
+		}
+		data, err := json.Marshal(p)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	case "set":
+		return setProfile(userName, gender, attrs, prefs, womenOnly)
+	}
+	return "", errors.New(fmt.Sprintf("ERROR in action parameter:%s", action))
+}
+
+//Function ProfileHandler shows and changes the commuter's profile. Params are user, token and action: get
+//(json back) or set with any of gender (female/male/other), attrs (comma separated from smoking, music and
+//pets, "none" to clear), prefs (attr:level, comma separated, levels require/prefer/avoid/refuse, "none" to
+//clear) and womenonly (1/0).
+func ProfileHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	user := q.Get("user")
+	retValue, err := processProfileRequest(user, q.Get("token"), q.Get("action"), q.Get("gender"), q.Get("attrs"),
+		q.Get("prefs"), q.Get("womenonly"))
+	if err != nil {
+		fmt.Fprint(w, "ERROR! :", err)
+	} else {
+		fmt.Fprint(w, retValue)
+	}
+	//No query here. It has the gender in it.
+	fmt.Println(clockNow(), "\t", user, "\t", r.RemoteAddr, "\t", "profile", "\t", q.Get("action"), "\t", err)
+}
+
+//Function ProfileAdminHandler lets staff verify a commuter's gender, which women only matching relies on.
+//Params are action (get/verifygender), target and gender. Admins only for verifying; staff of a tenant, its
+//commuters only. See isTenantStaffRequest.
+func ProfileAdminHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := isTenantStaffRequest(r, ROLE_ADMIN, ROLE_SUPPORT)
+	if !ok {
+		rejectStaffRequest(w, ROLE_ADMIN, ROLE_SUPPORT)
+		return
+	}
+	q := r.URL.Query()
+	action, target := q.Get("action"), q.Get("target")
+	var err error
+	if target == "" || !canSeeTenant(actor, tenantOf(target)) {
+		err = errors.New(fmt.Sprintf("ERROR in target parameter:%s", target))
+	} else {
+		switch action {
+		case "get":
+			p := getProfile(target)
+			if p == nil {
+				err = errors.New(fmt.Sprintf("No profile for %s", target))
+			} else {
+				err = json.NewEncoder(w).Encode(p)
+			}
+		case "verifygender":
+			if actor != "localhost" && !hasRole(actor, ROLE_ADMIN) {
+				err = errors.New("Only admins can verify a gender")
+			} else if err = verifyGender(actor, target, q.Get("gender")); err == nil {
+				fmt.Fprint(w, "Success! Gender verified for ", target)
+			}
+		default:
+			err = errors.New(fmt.Sprintf("ERROR in action parameter:%s", action))
+		}
+	}
+	if err != nil {
+		fmt.Fprint(w, "ERROR! :", err)
+	}
+	fmt.Println(clockNow(), "\t", actor, "\t", r.RemoteAddr, "\t", "profiles", "\t", action, "\t", target, "\t", err)
+}
@@ -0,0 +1,217 @@
+package commute
+
+import (
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSetProfile(t *testing.T) {
+	Initialize()
+	token := newUser("rider1", 12.884800, 77.551600, RIDER_STATE)
+	cases := []struct {
+		gender    string
+		attrs     string
+		prefs     string
+		womenOnly string
+		expected  bool
+	}{
+		{"female", "music,pets", "smoking:refuse,music:prefer", "", true},
+		{"woman", "", "", "", false},
+		{"", "cats", "", "", false},
+		{"", "", "smoking:never", "", false},
+		{"", "", "dogs:prefer", "", false},
+		{"", "", "", "1", false}, //Not verified yet
+		{"", "", "", "yes", false},
+		{"", "none", "none", "0", true},
+	}
+	for idx, c := range cases {
+		_, err := processProfileRequest("rider1", token, "set", c.gender, c.attrs, c.prefs, c.womenOnly)
+		if (err == nil) != c.expected {
+			t.Errorf("test case #%d: err = %v", idx, err)
+		}
+	}
+	if p := getProfile("rider1"); p == nil || p.Gender != GENDER_FEMALE || len(p.Attrs) != 0 || len(p.Prefs) != 0 {
+		t.Errorf("wrong profile:%+v", p)
+	}
+
+	//Once checked women only can be set, and changing the gender needs it checked again
+	verifyGender("localhost", "rider1", GENDER_FEMALE)
+	if _, err := setProfile("rider1", "", "", "", "1"); err != nil {
+		t.Errorf("women only failed:%s", err.Error())
+	}
+	if _, err := setProfile("rider1", GENDER_OTHER, "", "", ""); err == nil {
+		t.Errorf("gender changed with women only on")
+	}
+	if _, err := processProfileRequest("rider1", "badtoken", "get", "", "", "", ""); err == nil {
+		t.Errorf("profile without a valid token")
+	}
+}
+
+func TestHardPreferences(t *testing.T) {
+	Initialize()
+	token := newUser("rider1", 12.884800, 77.551600, RIDER_STATE)
+	for _, d := range []string{"driver1", "driver2", "driver3"} {
+		newUser(d, 12.884733, 77.551541, DRIVER_STATE)
+	}
+	setProfile("driver1", GENDER_MALE, "smoking", "", "")
+	setProfile("driver2", GENDER_FEMALE, "pets", "", "")
+	setProfile("driver3", GENDER_FEMALE, "music", "smoking:refuse,pets:refuse", "")
+	verifyGender("localhost", "driver2", GENDER_FEMALE)
+	verifyGender("localhost", "rider1", GENDER_FEMALE)
+
+	cases := []struct {
+		prefs     string
+		attrs     string
+		womenOnly string
+		expected  string
+	}{
+		{"none", "none", "0", "driver1,driver2,driver3"},
+		{"smoking:refuse", "none", "0", "driver2,driver3"},
+		{"music:require", "none", "0", "driver3"},
+		{"none", "pets", "0", "driver1,driver2"}, //driver3 does not take pets
+		{"none", "none", "1", "driver2"},         //driver3 only says so
+	}
+	for idx, c := range cases {
+		if _, err := setProfile("rider1", "", c.attrs, c.prefs, c.womenOnly); err != nil {
+			t.Fatalf("test case #%d: %s", idx, err.Error())
+		}
+		matches, _ := searchMatches("rider1", RIDER_STATE)
+		sort.Slice(matches, func(i, j int) bool { return matches[i].userName < matches[j].userName })
+		if got := matchNames(matches); got != c.expected {
+			t.Errorf("test case #%d: got %s, expected %s", idx, got, c.expected)
+		}
+	}
+
+	//Asking anyway does not get round it
+	if _, err := updateState("rider1", 12.884800, 77.551600, token, RIDER_STATE, "driver1", EVENT_JOINREQ); err != ErrPreferences {
+		t.Errorf("join request against preferences went through:%v", err)
+	}
+	if _, err := updateState("rider1", 12.884800, 77.551600, token, RIDER_STATE, "driver2", EVENT_JOINREQ); err != nil {
+		t.Errorf("join request failed:%s", err.Error())
+	}
+}
+
+func TestPreferenceRanking(t *testing.T) {
+	Initialize()
+	token := newUser("rider1", 12.884800, 77.551600, RIDER_STATE)
+	newUser("driver1", 12.884800, 77.551700, DRIVER_STATE) //About 10m
+	newUser("driver2", 12.884800, 77.553000, DRIVER_STATE) //About 150m
+	newUser("driver3", 12.884800, 77.555000, DRIVER_STATE) //About 370m
+	setProfile("driver1", "", "smoking", "", "")
+	setProfile("driver2", "", "music", "", "")
+	setProfile("driver3", "", "music,pets", "", "")
+
+	//Nothing changes without preferences
+	ret, _ := updateState("rider1", 12.884800, 77.551600, token, RIDER_STATE, "", EVENT_HEARTBEAT)
+	if strings.Contains(ret, "|") || strings.Count(ret, ",") != 14 {
+		t.Errorf("response changed without preferences:%s", ret)
+	}
+
+	cases := []struct {
+		prefs    string
+		expected string
+	}{
+		{"music:prefer", "driver2,driver3,driver1"},
+		{"smoking:avoid,music:prefer,pets:prefer", "driver3,driver2,driver1"},
+		{"smoking:prefer", "driver1,driver2,driver3"},
+	}
+	for idx, c := range cases {
+		setProfile("rider1", "", "", c.prefs, "")
+		matches, _ := searchMatches("rider1", RIDER_STATE)
+		if got := matchNames(matches); got != c.expected {
+			t.Errorf("test case #%d: got %s, expected %s", idx, got, c.expected)
+		}
+	}
+
+	//The response says why
+	setProfile("rider1", "", "", "smoking:avoid,music:prefer", "")
+	ret, _ = updateState("rider1", 12.884800, 77.551600, token, RIDER_STATE, "", EVENT_HEARTBEAT)
+	if !strings.HasSuffix(ret, ",+smoking|+music,+smoking|+music,-smoking|-music") {
+		t.Errorf("wrong reasons:%s", ret)
+	}
+}
+
+func TestProfileAdmin(t *testing.T) {
+	Initialize()
+	newUser("rider1", 12.884800, 77.551600, RIDER_STATE)
+	admin := func(query string, remote string) string {
+		r := httptest.NewRequest("GET", "/commute/admin/profiles?"+query, nil)
+		r.RemoteAddr = remote
+		resp := httptest.NewRecorder()
+		ProfileAdminHandler(resp, r)
+		return resp.Body.String()
+	}
+	cases := []struct {
+		query    string
+		remote   string
+		expected string
+	}{
+		{"action=verifygender&target=rider1&gender=female", "1.2.3.4:5555", "ERROR!"},
+		{"action=get&target=rider1", "127.0.0.1:5555", "ERROR!"},
+		{"action=verifygender&target=rider1&gender=woman", "127.0.0.1:5555", "ERROR!"},
+		{"action=verifygender&target=rider1&gender=female", "127.0.0.1:5555", "Success!"},
+		{"action=get&target=rider1", "127.0.0.1:5555", `{"user":"rider1","gender":"female","genderverified":true`},
+	}
+	for idx, c := range cases {
+		if got := admin(c.query, c.remote); !strings.HasPrefix(got, c.expected) {
+			t.Errorf("test case #%d: got %s, expected %s", idx, got, c.expected)
+		}
+	}
+	if recs, _ := getAudit("rider1"); len(recs) != 1 || recs[0].Action != "verify gender" {
+		t.Errorf("not audited:%+v", recs)
+	}
+}
+
+//A search loading a profile while it is saved must not put the old one back in the cache.
+func TestProfileRace(t *testing.T) {
+	Initialize()
+	defer SetStore(getStore())
+	SetStore(&racingStore{getStore(), bucketProfiles, func() { setProfile("rider1", GENDER_FEMALE, "music", "", "") }})
+
+	getProfile("rider1")
+	if p := getProfile("rider1"); p == nil || p.Gender != GENDER_FEMALE {
+		t.Errorf("profile lost from the cache:%+v", p)
+	}
+}
+
+//racingPutStore is racingStore for the first Put to the bucket.
+type racingPutStore struct {
+	Store
+	bucket string
+	during func()
+}
+
+func (s *racingPutStore) Put(bucket string, key string, value []byte) error {
+	err := s.Store.Put(bucket, key, value)
+	if bucket == s.bucket && s.during != nil {
+		during := s.during
+		s.during = nil
+		during()
+	}
+	return err
+}
+
+//Staff checking the gender while the commuter edits the profile must not lose either change.
+func TestProfileEditRace(t *testing.T) {
+	Initialize()
+	var wg sync.WaitGroup
+	defer SetStore(getStore())
+	SetStore(&racingPutStore{getStore(), bucketProfiles, func() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			verifyGender("localhost", "rider1", GENDER_FEMALE)
+		}()
+		time.Sleep(50 * time.Millisecond)
+	}})
+
+	setProfile("rider1", "", "music", "", "")
+	wg.Wait()
+	if p := getProfile("rider1"); p == nil || !p.isVerifiedWoman() || !p.has("music") {
+		t.Errorf("profile edit lost:%+v", p)
+	}
+}
@@ -0,0 +1,84 @@
+package commute
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+)
+
+//How the positions of co-commuters we are not yet connected with are blurred.
+const PRIVACY_EXACT = 0  //No blurring. Only for debugging.
+const PRIVACY_GRID = 1   //Snap to the centre of a grid cell of gPrivacyMetres.
+const PRIVACY_JITTER = 2 //Random offset within a circle of gPrivacyMetres.
+
+const metresPerDegreeLat float64 = 111320
+
+//Default is a grid. Jitter on its own can be averaged out by a stranger polling often, a grid cannot.
+var gPrivacyMode = PRIVACY_GRID
+var gPrivacyMetres float64 = 300
+var gPrivacyLock = sync.RWMutex{}
+
+//SetLocationPrivacy configures how unconnected candidates' locations are blurred before being sent out.
+func SetLocationPrivacy(mode int, metres float64) error {
+	if mode != PRIVACY_EXACT && mode != PRIVACY_GRID && mode != PRIVACY_JITTER {
+		return errors.New(fmt.Sprintf("Invalid privacy mode:%d", mode))
+	}
+	if mode != PRIVACY_EXACT && metres <= 0 {
+		return errors.New(fmt.Sprintf("Invalid privacy radius:%f", metres))
+	}
+	gPrivacyLock.Lock()
+	defer gPrivacyLock.Unlock()
+	gPrivacyMode = mode
+	gPrivacyMetres = metres
+	return nil
+}
+
+func resetLocationPrivacy() {
+	SetLocationPrivacy(PRIVACY_GRID, 300)
+}
+
+//Degrees of longitude making up the given metres at this latitude. Clamped near the poles.
+func metresToLngDegrees(metres float64, lat float64) float64 {
+	cosLat := math.Cos(lat * math.Pi / 180)
+	if cosLat < 0.01 {
+		cosLat = 0.01
+	}
+	return metres / (metresPerDegreeLat * cosLat)
+}
+
+//Snaps to the centre of the grid cell. The cell height is fixed in degrees so that the latitude row
+//(and hence the longitude cell width) does not depend on where inside the cell the user is.
+func snapToGrid(lat float64, lng float64, metres float64) (float64, float64) {
+	latStep := metres / metresPerDegreeLat
+	snappedLat := (math.Floor(lat/latStep) + 0.5) * latStep
+
+	lngStep := metresToLngDegrees(metres, snappedLat)
+	snappedLng := (math.Floor(lng/lngStep) + 0.5) * lngStep
+	return snappedLat, snappedLng
+}
+
+//Moves the point in a random direction by a random distance of upto metres. sqrt keeps it uniform over the disc.
+func jitter(lat float64, lng float64, metres float64) (float64, float64) {
+	dist := metres * math.Sqrt(randFloat())
+	angle := 2 * math.Pi * randFloat()
+
+	newLat := lat + dist*math.Cos(angle)/metresPerDegreeLat
+	newLng := lng + dist*math.Sin(angle)/(metresPerDegreeLat*math.Max(math.Cos(lat*math.Pi/180), 0.01))
+	return newLat, newLng
+}
+
+//fuzzLocation returns the blurred location as per the current privacy settings.
+func fuzzLocation(lat float64, lng float64) (float64, float64) {
+	gPrivacyLock.RLock()
+	mode, metres := gPrivacyMode, gPrivacyMetres
+	gPrivacyLock.RUnlock()
+
+	switch mode {
+	case PRIVACY_GRID:
+		return snapToGrid(lat, lng, metres)
+	case PRIVACY_JITTER:
+		return jitter(lat, lng, metres)
+	}
+	return lat, lng
+}
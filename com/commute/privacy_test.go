@@ -0,0 +1,91 @@
+package commute
+
+import (
+	"testing"
+)
+
+func TestFuzzLocation(t *testing.T) {
+	Initialize()
+	cases := []struct {
+		mode     int
+		metres   float64
+		lat, lng float64
+	}{
+		{PRIVACY_GRID, 300, 12.884733, 77.551541},
+		{PRIVACY_GRID, 1000, -33.8688, 151.2093},
+		{PRIVACY_JITTER, 300, 12.884733, 77.551541},
+		{PRIVACY_JITTER, 50, 60.1699, 24.9384},
+	}
+	for idx, c := range cases {
+		SetLocationPrivacy(c.mode, c.metres)
+		for i := 0; i < 100; i++ {
+			lat, lng := fuzzLocation(c.lat, c.lng)
+			if lat == c.lat || lng == c.lng {
+				t.Errorf("test case #%d: exact coordinate leaked. got %f,%f", idx, lat, lng)
+			}
+			//Grid centre is at most half a diagonal away, jitter at most the radius.
+			dist := DistanceBetwnPts(Point{Lat: c.lat, Lon: c.lng}, Point{Lat: lat, Lon: lng})
+			if dist > c.metres+1 {
+				t.Errorf("test case #%d: fuzzed too far. dist:%f", idx, dist)
+			}
+		}
+	}
+
+	//Two users in the same cell should be indistinguishable.
+	SetLocationPrivacy(PRIVACY_GRID, 300)
+	lat1, lng1 := fuzzLocation(12.884733, 77.551541)
+	lat2, lng2 := fuzzLocation(12.884800, 77.551600)
+	if lat1 != lat2 || lng1 != lng2 {
+		t.Errorf("same cell gave different locations. %f,%f vs %f,%f", lat1, lng1, lat2, lng2)
+	}
+
+	if SetLocationPrivacy(7, 100) == nil || SetLocationPrivacy(PRIVACY_GRID, 0) == nil {
+		t.Errorf("SetLocationPrivacy accepted invalid settings")
+	}
+}
+
+//Nobody should see the exact location of someone they are not joined with.
+func TestNoExactLocationForUnconnected(t *testing.T) {
+	Initialize()
+	drivers := []struct {
+		user     string
+		lat, lng float64
+	}{
+		{"driver1", 12.884733, 77.551541},
+		{"driver2", 12.885733, 77.552541},
+		{"driver3", 12.883733, 77.550541},
+	}
+	tokens := make(map[string]string)
+	for _, d := range drivers {
+		tokens[d.user], _ = updateState(d.user, d.lat, d.lng, "", DRIVER_STATE, "", EVENT_LOGIN)
+	}
+	tokenRider, _ := updateState("rider1", 12.884, 77.551, "", RIDER_STATE, "", EVENT_LOGIN)
+
+	checkResp := func(viewer string, mode int, exactFor string) {
+		respObj, err := buildSearchResponse(viewer, mode, requestOptions{})
+		if err != nil {
+			t.Fatalf("buildSearchResponse failed for %s:%s", viewer, err.Error())
+		}
+		for _, n := range respObj.arrNearbyCommuters {
+			s := getCurrentState(n.userName)
+			exact := n.lat == s.lat && n.lng == s.lng
+			if n.userName == exactFor && !exact {
+				t.Errorf("%s is connected to %s but did not get exact location", viewer, n.userName)
+			}
+			if n.userName != exactFor && exact {
+				t.Errorf("%s got exact location of unconnected %s", viewer, n.userName)
+			}
+		}
+	}
+
+	//Rider sees all drivers, none exact.
+	checkResp("rider1", RIDER_STATE, "")
+
+	//Rider requests driver1. Driver sees the rider, but still not exact.
+	updateState("rider1", 12.884, 77.551, tokenRider, RIDER_STATE, "driver1", EVENT_JOINREQ)
+	checkResp("driver1", DRIVER_STATE, "")
+
+	//Once accepted, the rider gets driver1's exact location. Others stay blurred.
+	updateState("driver1", 12.884733, 77.551541, tokens["driver1"], DRIVER_STATE, "rider1", EVENT_JOINACCEPT)
+	checkResp("rider1", RIDER_STATE, "driver1")
+}
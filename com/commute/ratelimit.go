@@ -0,0 +1,368 @@
+package commute
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Token bucket limits, per user and per client IP, optionally per event type. A request has to get past every
+//rule that applies to it.
+const RATELIMIT_SCOPE_USER = "user"
+const RATELIMIT_SCOPE_IP = "ip"
+const RATELIMIT_SWEEP_SECS = 60 //How often idle buckets are thrown away
+
+//ErrRateLimited is what throttled callers get. Same "ERROR! :" form as every other error for older apps.
+var ErrRateLimited = errors.New("Too many requests. Please slow down")
+
+//rateLimit lets Burst requests through at once and then Rate a second. Rate 0 turns the rule off.
+type rateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst float64 `json:"burst"`
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+//Rules by "scope" or "scope:event", eg: "ip" or "ip:login". Buckets by rule and then user/ip.
+var gRateLimits map[string]rateLimit
+var gBuckets map[string]*tokenBucket
+var gRateLimitRejected map[string]int64
+var gRateLimitAllowed int64
+var gRateLimitLastSweep time.Time
+var gTrustedProxies []*net.IPNet
+var gRateLimitLegacy bool //Throttled requests get 200 and the error string, for apps that choke on a 429
+var gRateLimitLock = sync.Mutex{}
+
+func resetRateLimits() {
+	gRateLimitLock.Lock()
+	defer gRateLimitLock.Unlock()
+	//Heartbeats come every 30secs or so. Logins should be rare, and random usernames from one IP rarer still.
+	gRateLimits = map[string]rateLimit{
+		RATELIMIT_SCOPE_USER:            {Rate: 2, Burst: 10},
+		RATELIMIT_SCOPE_IP:              {Rate: 20, Burst: 100},
+		RATELIMIT_SCOPE_USER + ":login": {Rate: 1.0 / 60, Burst: 5},
+		RATELIMIT_SCOPE_IP + ":login":   {Rate: 0.2, Burst: 20},
+		//Every code is an SMS we pay for, and guessing codes is what the verify limits are against.
+		RATELIMIT_SCOPE_USER + ":sendcode": {Rate: 1.0 / 60, Burst: 3},
+		RATELIMIT_SCOPE_IP + ":sendcode":   {Rate: 0.1, Burst: 10},
+		RATELIMIT_SCOPE_USER + ":verify":   {Rate: 0.2, Burst: 10},
+		RATELIMIT_SCOPE_IP + ":verify":     {Rate: 1, Burst: 30},
+		//Nobody needs more than one SOS a second, even a whole office behind one address.
+		RATELIMIT_SCOPE_IP + ":sos": {Rate: 1, Burst: 20},
+	}
+	gBuckets = make(map[string]*tokenBucket)
+	gRateLimitRejected = make(map[string]int64)
+	gRateLimitAllowed = 0
+	gRateLimitLastSweep = time.Time{}
+	gTrustedProxies = nil
+	gRateLimitLegacy = false
+}
+
+func rateLimitRule(scope string, event string) string {
+	if event == "" {
+		return scope
+	}
+	return scope + ":" + event
+}
+
+//SetRateLimit sets the rule for the scope (user/ip) and event type, eg: "login". Empty event means every request.
+func SetRateLimit(scope string, event string, rate float64, burst float64) error {
+	if scope != RATELIMIT_SCOPE_USER && scope != RATELIMIT_SCOPE_IP {
+		return errors.New(fmt.Sprintf("Invalid rate limit scope:%s", scope))
+	}
+	if rate < 0 || burst < 0 || (rate > 0 && burst < 1) {
+		return errors.New(fmt.Sprintf("Invalid rate limit. rate:%f burst:%f", rate, burst))
+	}
+	gRateLimitLock.Lock()
+	defer gRateLimitLock.Unlock()
+	gRateLimits[rateLimitRule(scope, event)] = rateLimit{Rate: rate, Burst: burst}
+	return nil
+}
+
+//LoadRateLimits reads rules from a json file like {"ip:login":{"rate":0.1,"burst":10},"user":{"rate":1,"burst":5}}.
+//Rules not in the file keep their current value.
+func LoadRateLimits(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	rules := make(map[string]rateLimit)
+	if err = json.Unmarshal(data, &rules); err != nil {
+		return errors.New(fmt.Sprintf("Invalid rate limit file %s : %s", path, err.Error()))
+	}
+	for rule, l := range rules {
+		scope, event := rule, ""
+		if idx := strings.Index(rule, ":"); idx >= 0 {
+			scope, event = rule[:idx], rule[idx+1:]
+		}
+		if err = SetRateLimit(scope, event, l.Rate, l.Burst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//SetTrustedProxies takes comma separated CIDRs or IPs of our own load balancers. X-Forwarded-For is only
+//believed when the request comes from one of them.
+func SetTrustedProxies(list string) error {
+	nets := make([]*net.IPNet, 0)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Invalid trusted proxy:%s", s))
+		}
+		nets = append(nets, n)
+	}
+	gRateLimitLock.Lock()
+	defer gRateLimitLock.Unlock()
+	gTrustedProxies = nets
+	return nil
+}
+
+//SetRateLimitLegacy makes throttled requests get a 200 with the error string instead of a 429.
+func SetRateLimitLegacy(legacy bool) {
+	gRateLimitLock.Lock()
+	defer gRateLimitLock.Unlock()
+	gRateLimitLegacy = legacy
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	gRateLimitLock.Lock()
+	defer gRateLimitLock.Unlock()
+	for _, n := range gTrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//clientIP is the address the request came from. Behind our proxies, the last address in X-Forwarded-For
+//which is not one of them; anything before that could have been made up by the client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip) {
+		return host
+	}
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		host = hop.String()
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return host
+}
+
+//Callers hold gRateLimitLock. Refills the bucket up to now.
+func refillLocked(key string, l rateLimit, now time.Time) *tokenBucket {
+	b, ok := gBuckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.Burst, last: now}
+		gBuckets[key] = b
+		return b
+	}
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * l.Rate
+		if b.tokens > l.Burst {
+			b.tokens = l.Burst
+		}
+		b.last = now
+	}
+	return b
+}
+
+//Callers hold gRateLimitLock. Buckets which have filled back up are no different from new ones, so drop them.
+//Keeps random usernames from growing the map forever.
+func sweepBucketsLocked(now time.Time) {
+	if now.Sub(gRateLimitLastSweep) < RATELIMIT_SWEEP_SECS*time.Second {
+		return
+	}
+	gRateLimitLastSweep = now
+	for key, b := range gBuckets {
+		rule := key[:strings.Index(key, "|")]
+		l := gRateLimits[rule]
+		if l.Rate <= 0 || b.tokens+now.Sub(b.last).Seconds()*l.Rate >= l.Burst {
+			delete(gBuckets, key)
+		}
+	}
+}
+
+//rateLimitCheck is a rule and whose bucket under it, a user or an ip.
+type rateLimitCheck struct {
+	rule string
+	who  string
+}
+
+//allowRequest takes a token from every bucket that applies, or none at all if any of them is empty.
+//Returns the rule which turned it away.
+func allowRequest(userName string, ip string, event string) (bool, string) {
+	checks := []rateLimitCheck{{RATELIMIT_SCOPE_IP, ip}}
+	if event != "" {
+		checks = append(checks, rateLimitCheck{rateLimitRule(RATELIMIT_SCOPE_IP, event), ip})
+	}
+	if userName != "" {
+		checks = append(checks, rateLimitCheck{RATELIMIT_SCOPE_USER, userName})
+		if event != "" {
+			checks = append(checks, rateLimitCheck{rateLimitRule(RATELIMIT_SCOPE_USER, event), userName})
+		}
+	}
+	return allowChecks(checks)
+}
+
+//allowAuthRequest is allowRequest for the auth actions. Nobody has shown who they are yet, so only the user's
+//rule for the action applies, and not the user rule every other request of theirs has to get past.
+func allowAuthRequest(userName string, ip string, action string) (bool, string) {
+	checks := []rateLimitCheck{{RATELIMIT_SCOPE_IP, ip}, {rateLimitRule(RATELIMIT_SCOPE_IP, action), ip}}
+	if userName != "" {
+		checks = append(checks, rateLimitCheck{rateLimitRule(RATELIMIT_SCOPE_USER, action), userName})
+	}
+	return allowChecks(checks)
+}
+
+func allowChecks(checks []rateLimitCheck) (bool, string) {
+	now := clockNow()
+	gRateLimitLock.Lock()
+	defer gRateLimitLock.Unlock()
+	sweepBucketsLocked(now)
+
+	buckets := make([]*tokenBucket, 0, len(checks))
+	for _, c := range checks {
+		l, ok := gRateLimits[c.rule]
+		if !ok || l.Rate <= 0 {
+			continue
+		}
+		b := refillLocked(c.rule+"|"+c.who, l, now)
+		if b.tokens < 1 {
+			gRateLimitRejected[c.rule]++
+			return false, c.rule
+		}
+		buckets = append(buckets, b)
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	gRateLimitAllowed++
+	return true, ""
+}
+
+//rateLimitUser is who the per user limits of a commute request go to: the user, if the token is theirs.
+//Nobody otherwise, so that requests sent in someone's name can not use up their limits.
+func rateLimitUser(userName string, token string) string {
+	claims, err := parseAccessToken(token)
+	if err != nil || claims.Sub != userName || checkSession(claims.Sid) != nil {
+		return ""
+	}
+	return userName
+}
+
+//rejectRateLimited writes the response for a throttled request.
+func rejectRateLimited(w http.ResponseWriter) {
+	gRateLimitLock.Lock()
+	legacy := gRateLimitLegacy
+	gRateLimitLock.Unlock()
+	if !legacy {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}
+	fmt.Fprint(w, "ERROR! :", ErrRateLimited)
+}
+
+//RateLimited puts the per user and per IP limits in front of a handler. Handler does its own, per event type.
+//The user's only with their token, as in Handler.
+func RateLimited(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		limitUser := rateLimitUser(r.URL.Query().Get("user"), r.URL.Query().Get("token"))
+		if ok, rule := allowRequest(limitUser, ip, ""); !ok {
+			rejectRateLimited(w)
+			fmt.Println(clockNow(), "\t", r.URL.Query().Get("user"), "\t", ip, "\t", r.URL.Path, "\t", "throttled by", rule)
+			return
+		}
+		h(w, r)
+	}
+}
+
+//rateLimitStats is the json for the ops endpoint.
+type rateLimitStats struct {
+	Allowed  int64                `json:"allowed"`
+	Rejected map[string]int64     `json:"rejected"` //By rule
+	Buckets  int                  `json:"buckets"`
+	Rules    map[string]rateLimit `json:"rules"`
+}
+
+func getRateLimitStats() rateLimitStats {
+	gRateLimitLock.Lock()
+	defer gRateLimitLock.Unlock()
+	s := rateLimitStats{Allowed: gRateLimitAllowed, Rejected: make(map[string]int64), Buckets: len(gBuckets),
+		Rules: make(map[string]rateLimit)}
+	for k, v := range gRateLimitRejected {
+		s.Rejected[k] = v
+	}
+	for k, v := range gRateLimits {
+		s.Rules[k] = v
+	}
+	return s
+}
+
+//Function RateLimitStatsHandler shows what has been throttled. Admins and support only.
+func RateLimitStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := isStaffRequest(r, ROLE_ADMIN, ROLE_SUPPORT); !ok {
+		rejectStaffRequest(w, ROLE_ADMIN, ROLE_SUPPORT)
+		return
+	}
+	data, err := json.Marshal(getRateLimitStats())
+	if err != nil {
+		fmt.Fprint(w, "ERROR! :", err)
+	} else {
+		fmt.Fprint(w, string(data))
+	}
+	fmt.Println(clockNow(), "\t", "ratelimit stats", "\t", r.RemoteAddr, "\t", err)
+}
+
+//Rules which turned traffic away, busiest first. For printStat.
+func rateLimitSummary() string {
+	s := getRateLimitStats()
+	rules := make([]string, 0, len(s.Rejected))
+	for r := range s.Rejected {
+		rules = append(rules, r)
+	}
+	sort.Slice(rules, func(i, j int) bool { return s.Rejected[rules[i]] > s.Rejected[rules[j]] })
+	parts := make([]string, 0, len(rules))
+	for _, r := range rules {
+		parts = append(parts, fmt.Sprintf("%s=%d", r, s.Rejected[r]))
+	}
+	return strings.Join(parts, " ")
+}
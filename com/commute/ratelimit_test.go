@@ -0,0 +1,301 @@
+package commute
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	Initialize()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+	SetRateLimit(RATELIMIT_SCOPE_USER, "", 1, 3)
+
+	cases := []struct {
+		advance  time.Duration
+		expected bool
+	}{
+		{0, true},
+		{0, true},
+		{0, true},
+		{0, false}, //Burst used up
+		{500 * time.Millisecond, false},
+		{500 * time.Millisecond, true}, //One more after a second
+		{0, false},
+		{time.Hour, true}, //Never more than the burst though
+		{0, true},
+		{0, true},
+		{0, false},
+	}
+	for idx, c := range cases {
+		clock.Advance(c.advance)
+		if ok, _ := allowRequest("rider1", "10.0.0.1", ""); ok != c.expected {
+			t.Errorf("test case #%d: allowRequest = %t, expected %t", idx, ok, c.expected)
+		}
+	}
+	//Someone else has a bucket of their own
+	if ok, _ := allowRequest("rider2", "10.0.0.1", ""); !ok {
+		t.Errorf("other user throttled")
+	}
+}
+
+//Random usernames from one address still run into the per IP login limit.
+func TestLoginLimitPerIP(t *testing.T) {
+	Initialize()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+	defer SetEntropy(SetEntropy(NewSeededEntropy(7)))
+	SetRateLimit(RATELIMIT_SCOPE_IP, "login", 0.2, 20)
+
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		if ok, rule := allowRequest(randToken(), "10.0.0.1", "login"); ok {
+			allowed++
+		} else if rule != "ip:login" {
+			t.Errorf("throttled by %s, expected ip:login", rule)
+		}
+	}
+	if allowed != 20 {
+		t.Errorf("allowed %d logins, expected 20", allowed)
+	}
+	//Heartbeats from the same address are fine, and so are logins from elsewhere
+	if ok, _ := allowRequest("rider1", "10.0.0.1", "heartbeat"); !ok {
+		t.Errorf("heartbeat throttled")
+	}
+	if ok, _ := allowRequest("rider1", "10.0.0.2", "login"); !ok {
+		t.Errorf("login from another address throttled")
+	}
+	if s := getRateLimitStats(); s.Rejected["ip:login"] != 80 {
+		t.Errorf("rejected = %v, expected 80 for ip:login", s.Rejected)
+	}
+}
+
+//A request turned away by one rule does not use up tokens from the others.
+func TestRateLimitAllOrNothing(t *testing.T) {
+	Initialize()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+	SetRateLimit(RATELIMIT_SCOPE_IP, "", 1, 5)
+	SetRateLimit(RATELIMIT_SCOPE_USER, "login", 1, 1)
+
+	allowRequest("rider1", "10.0.0.1", "login")
+	for i := 0; i < 10; i++ {
+		if ok, rule := allowRequest("rider1", "10.0.0.1", "login"); ok || rule != "user:login" {
+			t.Errorf("test case #%d: allowed:%t rule:%s", i, ok, rule)
+		}
+	}
+	//Four left for the address
+	for i := 0; i < 4; i++ {
+		if ok, _ := allowRequest("rider2", "10.0.0.1", ""); !ok {
+			t.Errorf("test case #%d: ip tokens were used up by throttled requests", i)
+		}
+	}
+	if ok, rule := allowRequest("rider2", "10.0.0.1", ""); ok || rule != "ip" {
+		t.Errorf("expected ip limit. allowed:%t rule:%s", ok, rule)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	Initialize()
+	if err := SetTrustedProxies("10.1.0.0/16, 192.168.1.1"); err != nil {
+		t.Fatalf("SetTrustedProxies failed:%s", err.Error())
+	}
+	cases := []struct {
+		remote   string
+		xff      string
+		expected string
+	}{
+		{"1.2.3.4:5555", "", "1.2.3.4"},
+		{"1.2.3.4:5555", "9.9.9.9", "1.2.3.4"},                        //Not from our proxy, header ignored
+		{"10.1.2.3:5555", "5.6.7.8", "5.6.7.8"},                       //Our proxy
+		{"10.1.2.3:5555", "9.9.9.9, 5.6.7.8", "5.6.7.8"},              //Client made up the first hop
+		{"10.1.2.3:5555", "9.9.9.9, 5.6.7.8, 192.168.1.1", "5.6.7.8"}, //Two of our proxies
+		{"10.1.2.3:5555", "junk", "10.1.2.3"},
+		{"10.1.2.3:5555", "", "10.1.2.3"},
+	}
+	for idx, c := range cases {
+		r := httptest.NewRequest("GET", "/commute", nil)
+		r.RemoteAddr = c.remote
+		if c.xff != "" {
+			r.Header.Set("X-Forwarded-For", c.xff)
+		}
+		if ip := clientIP(r); ip != c.expected {
+			t.Errorf("test case #%d: clientIP = %s, expected %s", idx, ip, c.expected)
+		}
+	}
+	if err := SetTrustedProxies("10.1.0.0/99"); err == nil {
+		t.Errorf("bad CIDR accepted")
+	}
+}
+
+//Buckets which have filled back up go away.
+func TestSweepBuckets(t *testing.T) {
+	Initialize()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		allowRequest("", ip, "")
+	}
+	if s := getRateLimitStats(); s.Buckets != 3 {
+		t.Errorf("buckets = %d, expected 3", s.Buckets)
+	}
+	clock.Advance(RATELIMIT_SWEEP_SECS * time.Second)
+	allowRequest("", "10.0.0.4", "")
+	if s := getRateLimitStats(); s.Buckets != 1 {
+		t.Errorf("buckets = %d after sweep, expected 1", s.Buckets)
+	}
+}
+
+func TestRateLimitedResponse(t *testing.T) {
+	cases := []struct {
+		legacy     bool
+		expectCode int
+	}{
+		{false, http.StatusTooManyRequests},
+		{true, http.StatusOK},
+	}
+	for idx, c := range cases {
+		Initialize()
+		SetRateLimit(RATELIMIT_SCOPE_IP, "", 1, 1)
+		SetRateLimitLegacy(c.legacy)
+		clock := NewFakeClock(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC))
+		prev := SetClock(clock)
+
+		var resp *httptest.ResponseRecorder
+		for i := 0; i < 2; i++ {
+			resp = httptest.NewRecorder()
+			Handler(resp, httptest.NewRequest("GET", "/commute/map?user=rider1&param=12.884800,77.551600&mode=2&eventtype=login", nil))
+		}
+		if resp.Code != c.expectCode || !strings.HasPrefix(resp.Body.String(), "ERROR! :"+ErrRateLimited.Error()) {
+			t.Errorf("test case #%d: got %d %s", idx, resp.Code, resp.Body.String())
+		}
+		if !c.legacy && resp.Header().Get("Retry-After") == "" {
+			t.Errorf("test case #%d: no Retry-After", idx)
+		}
+
+		//Wrapped handlers too
+		h := RateLimited(func(w http.ResponseWriter, r *http.Request) {})
+		resp = httptest.NewRecorder()
+		h(resp, httptest.NewRequest("GET", "/trips?user=rider1", nil))
+		if resp.Code != c.expectCode {
+			t.Errorf("test case #%d: wrapped handler got %d", idx, resp.Code)
+		}
+		SetClock(prev)
+	}
+}
+
+//Requests in someone's name without their token do not use up their limits. An SOS has the IP limits only.
+func TestRateLimitNeedsToken(t *testing.T) {
+	Initialize()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+	token := newUser("rider1", 12.884800, 77.551600, RIDER_STATE)
+	SetRateLimit(RATELIMIT_SCOPE_USER, "", 1, 1)
+	SetRateLimit(RATELIMIT_SCOPE_IP, "sos", 1, 1)
+
+	send := func(query string, remote string) int {
+		r := httptest.NewRequest("GET", "/commute/map?user=rider1&param=12.884800,77.551600&mode=2&"+query, nil)
+		r.RemoteAddr = remote
+		resp := httptest.NewRecorder()
+		Handler(resp, r)
+		return resp.Code
+	}
+	cases := []struct {
+		query    string
+		remote   string
+		expected int
+	}{
+		{"token=forged", "10.0.0.1:5000", http.StatusOK},
+		{"token=forged", "10.0.0.1:5000", http.StatusOK},
+		{"token=" + token, "10.0.0.2:5000", http.StatusOK},
+		{"token=" + token, "10.0.0.2:5000", http.StatusTooManyRequests},
+		{"eventtype=sos&token=" + token, "10.0.0.2:5000", http.StatusOK}, //Over the user limit, still goes
+		{"eventtype=sos&token=" + token, "10.0.0.2:5000", http.StatusTooManyRequests},
+		{"eventtype=sos&token=" + token, "10.0.0.3:5000", http.StatusOK},
+	}
+	for idx, c := range cases {
+		if got := send(c.query, c.remote); got != c.expected {
+			t.Errorf("test case #%d: got %d, expected %d", idx, got, c.expected)
+		}
+	}
+}
+
+//Requests elsewhere in someone's name, on the other endpoints and auth, do not use up their limits either.
+func TestRateLimitCrossIPDrain(t *testing.T) {
+	Initialize()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+	token := newUser("victim", 12.884800, 77.551600, RIDER_STATE)
+
+	send := func(h http.HandlerFunc, url string, remote string) int {
+		r := httptest.NewRequest("GET", url, nil)
+		r.RemoteAddr = remote
+		resp := httptest.NewRecorder()
+		h(resp, r)
+		return resp.Code
+	}
+	trips := RateLimited(func(w http.ResponseWriter, r *http.Request) {})
+	for i := 0; i < 20; i++ {
+		send(trips, "/commute/trips?user=victim", "10.0.0.1:5000")
+		send(AuthHandler, "/commute/auth?user=victim&action=verify&code=000000", "10.0.0.1:5000")
+	}
+	if got := send(Handler, "/commute/map?user=victim&param=12.884800,77.551600&mode=2&token="+token, "10.0.0.2:5000"); got != http.StatusOK {
+		t.Errorf("heartbeat throttled:%d", got)
+	}
+	if got := send(trips, "/commute/trips?user=victim&token="+token, "10.0.0.2:5000"); got != http.StatusOK {
+		t.Errorf("trips throttled:%d", got)
+	}
+	//Their own requests still count
+	for i := 0; i < 20; i++ {
+		send(trips, "/commute/trips?user=victim&token="+token, "10.0.0.2:5000")
+	}
+	if got := send(trips, "/commute/trips?user=victim&token="+token, "10.0.0.3:5000"); got != http.StatusTooManyRequests {
+		t.Errorf("user limit not applied:%d", got)
+	}
+}
+
+func TestLoadRateLimits(t *testing.T) {
+	Initialize()
+	cases := []struct {
+		content  string
+		expected bool
+	}{
+		{`{"ip:login":{"rate":0.1,"burst":10},"user":{"rate":1,"burst":5}}`, true},
+		{`{"user:tripend":{"rate":0,"burst":0}}`, true}, //Turned off
+		{`{"device":{"rate":1,"burst":5}}`, false},
+		{`{"user":{"rate":1,"burst":0}}`, false},
+		{`{"user":{"rate":-1,"burst":5}}`, false},
+		{`not json`, false},
+	}
+	for idx, c := range cases {
+		f, _ := ioutil.TempFile("", "ratelimits")
+		f.WriteString(c.content)
+		f.Close()
+		err := LoadRateLimits(f.Name())
+		os.Remove(f.Name())
+		if (err == nil) != c.expected {
+			t.Errorf("test case #%d: err = %v", idx, err)
+		}
+	}
+	rules := getRateLimitStats().Rules
+	if rules["ip:login"].Rate != 0.1 || rules["user"].Burst != 5 || rules["ip"].Burst != 100 {
+		t.Errorf("rules not loaded:%v", rules)
+	}
+
+	//Ops endpoint
+	resp := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/admin/ratelimits", nil)
+	r.RemoteAddr = "127.0.0.1:5555"
+	RateLimitStatsHandler(resp, r)
+	var s rateLimitStats
+	if err := json.Unmarshal(resp.Body.Bytes(), &s); err != nil || s.Rules["user"].Rate != 1 {
+		t.Errorf("bad stats:%s", resp.Body.String())
+	}
+}
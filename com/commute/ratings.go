@@ -0,0 +1,213 @@
+package commute
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const MIN_STARS = 1
+const MAX_STARS = 5
+const MAX_COMMENT_LEN = 500
+
+//Store buckets used by ratings.
+const bucketRatings = "ratings"           //tripId/from -> Rating
+const bucketRatingSummary = "ratingsumm"  //user -> ratingSummary
+const bucketAbuseReports = "abusereports" //time/tripId/from -> Rating. For admins to go through.
+
+//Rating is what one side of a trip thinks of the other. One per trip per side.
+type Rating struct {
+	TripId  string `json:"tripid"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Stars   int    `json:"stars"`
+	Comment string `json:"comment"`
+	Abuse   bool   `json:"abuse"`
+	Time    int64  `json:"time"`
+}
+
+//ratingSummary is the running aggregate for a user.
+type ratingSummary struct {
+	Sum          int `json:"sum"`
+	Count        int `json:"count"`
+	AbuseReports int `json:"abusereports"`
+}
+
+func (s ratingSummary) average() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return float64(s.Sum) / float64(s.Count)
+}
+
+//Search looks up the rating of every candidate on every heartbeat. Keep them in memory, backed by the store.
+var gRatingSummaries map[string]ratingSummary
+var gRatingsLock = sync.RWMutex{}
+
+func resetRatings() {
+	gRatingsLock.Lock()
+	defer gRatingsLock.Unlock()
+	gRatingSummaries = make(map[string]ratingSummary, 1000)
+}
+
+//Returns the aggregate for the user, loading it from the store the first time.
+func getRatingSummary(userName string) ratingSummary {
+	gRatingsLock.RLock()
+	summ, ok := gRatingSummaries[userName]
+	gRatingsLock.RUnlock()
+	if ok {
+		return summ
+	}
+
+	//Not rated yet is also fine, it stays at zero.
+	storeGetJSON(bucketRatingSummary, userName, &summ)
+
+	gRatingsLock.Lock()
+	defer gRatingsLock.Unlock()
+	//A rating may have gone in while we were at the store. Its summary is newer than what we read.
+	if newer, ok := gRatingSummaries[userName]; ok {
+		return newer
+	}
+	gRatingSummaries[userName] = summ
+	return summ
+}
+
+//Average stars of the user. 0 means nobody has rated them yet.
+func getAverageRating(userName string) float64 {
+	return getRatingSummary(userName).average()
+}
+
+//rateTrip records the rating from one side of the trip for the other.
+func rateTrip(tripId string, from string, stars int, comment string, abuse bool) (string, error) {
+	if stars < MIN_STARS || stars > MAX_STARS {
+		return "", errors.New(fmt.Sprintf("Invalid rating:%d. Should be between %d and %d", stars, MIN_STARS, MAX_STARS))
+	}
+	if len(comment) > MAX_COMMENT_LEN {
+		return "", errors.New(fmt.Sprintf("Comment too long. Max is %d characters", MAX_COMMENT_LEN))
+	}
+
+	trip, err := getTrip(tripId)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Error while rating : trip %s does not exist!", tripId))
+	}
+	to := ""
+	switch from {
+	case trip.Rider:
+		to = trip.Driver
+	case trip.Driver:
+		to = trip.Rider
+	default:
+		return "", errors.New(fmt.Sprintf("Error while rating : %s was not on trip %s", from, tripId))
+	}
+
+	//Whole read-check-write under the lock, else two quick taps can both get through.
+	gRatingsLock.Lock()
+	defer gRatingsLock.Unlock()
+
+	key := tripId + "/" + from
+	if _, err = getStore().Get(bucketRatings, key); err == nil {
+		return "", errors.New(fmt.Sprintf("Error while rating : you have already rated trip %s", tripId))
+	}
+
+	rating := Rating{TripId: tripId, From: from, To: to, Stars: stars, Comment: comment, Abuse: abuse,
+		Time: clockNow().Unix()}
+	if err = storePutJSON(bucketRatings, key, rating); err != nil {
+		return "", err
+	}
+
+	summ, ok := gRatingSummaries[to]
+	if !ok {
+		storeGetJSON(bucketRatingSummary, to, &summ)
+	}
+	summ.Sum += stars
+	summ.Count++
+	if abuse {
+		summ.AbuseReports++
+		if err = storePutJSON(bucketAbuseReports, fmt.Sprintf("%020d/%s", rating.Time, key), rating); err != nil {
+			return "", err
+		}
+	}
+	if err = storePutJSON(bucketRatingSummary, to, summ); err != nil {
+		return "", err
+	}
+	gRatingSummaries[to] = summ
+
+	return fmt.Sprintf("Success! Rated %s for trip %s", to, tripId), nil
+}
+
+//getAbuseReports returns all abuse reports, oldest first.
+func getAbuseReports() ([]Rating, error) {
+	vals, err := getStore().List(bucketAbuseReports, "")
+	if err != nil {
+		return nil, err
+	}
+	reports := make([]Rating, 0, len(vals))
+	for _, v := range vals {
+		r := Rating{}
+		if err = json.Unmarshal(v, &r); err != nil {
+			return nil, err
+		}
+		reports = append(reports, r)
+	}
+	return reports, nil
+}
+
+//processRateRequest parses the params given in the URL and records the rating.
+func processRateRequest(userName string, token string, tripId string, starsStr string, comment string,
+	abuseStr string) (string, error) {
+	if _, err := isUserValid(userName, token); err != nil {
+		return "", err
+	}
+	stars, err := strconv.Atoi(starsStr)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("ERROR in stars parameter:%s", starsStr))
+	}
+	abuse := abuseStr == "1" || abuseStr == "true"
+	return rateTrip(tripId, userName, stars, comment, abuse)
+}
+
+//Function RateHandler lets either side of a trip rate the other. Params are user, token, trip, stars,
+//comment (optional) and abuse=1 to report abuse.
+func RateHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	user := q.Get("user")
+	retValue, err := processRateRequest(user, q.Get("token"), q.Get("trip"), q.Get("stars"), q.Get("comment"),
+		q.Get("abuse"))
+	if err != nil {
+		fmt.Fprint(w, "ERROR! :", err)
+	} else {
+		fmt.Fprint(w, retValue)
+	}
+
+	fmt.Println(clockNow(), "\t", user, "\t", r.RemoteAddr, "\t", r.URL.RawQuery, "\t", err)
+}
+
+//Function AbuseReportsHandler dumps all abuse reports as json for the ops team. Admins and support only,
+//and staff of a tenant see the reports against its users.
+func AbuseReportsHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := isTenantStaffRequest(r, ROLE_ADMIN, ROLE_SUPPORT)
+	if !ok {
+		rejectStaffRequest(w, ROLE_ADMIN, ROLE_SUPPORT)
+		return
+	}
+	all, err := getAbuseReports()
+	reports := make([]Rating, 0, len(all))
+	for _, rep := range all {
+		if canSeeTenant(actor, tenantOf(rep.To)) {
+			reports = append(reports, rep)
+		}
+	}
+	if err == nil {
+		var out []byte
+		out, err = json.Marshal(reports)
+		if err == nil {
+			w.Write(out)
+		}
+	}
+	if err != nil {
+		fmt.Fprint(w, "ERROR! :", err)
+	}
+}
@@ -0,0 +1,156 @@
+package commute
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//Logs in a driver and a rider next to each other and takes them through a full trip. Returns the trip id.
+func completeTestTrip(t *testing.T, rider string, driver string) string {
+	tokenDriver := newUser(driver, 12.884733, 77.551541, DRIVER_STATE)
+	tokenRider := newUser(rider, 12.884800, 77.551600, RIDER_STATE)
+	updateState(rider, 12.884800, 77.551600, tokenRider, RIDER_STATE, driver, EVENT_JOINREQ)
+	if _, err := updateState(driver, 12.884733, 77.551541, tokenDriver, DRIVER_STATE, rider, EVENT_JOINACCEPT); err != nil {
+		t.Fatalf("join accept failed for %s/%s:%s", rider, driver, err.Error())
+	}
+	trip, _ := getActiveTrip(rider, driver)
+	updateState(driver, 12.918230, 77.573472, tokenDriver, DRIVER_STATE, rider, EVENT_TRIPEND)
+	return trip.TripId
+}
+
+func TestRateTrip(t *testing.T) {
+	Initialize()
+	SetStore(NewMemStore())
+	tripId := completeTestTrip(t, "rider1", "driver1")
+
+	cases := []struct {
+		from    string
+		tripId  string
+		stars   int
+		comment string
+		abuse   bool
+		errstr  string
+	}{
+		{"rider1", tripId, 0, "", false, "Invalid rating"},
+		{"rider1", tripId, 6, "", false, "Invalid rating"},
+		{"rider1", "notatrip", 4, "", false, "does not exist"},
+		{"stranger", tripId, 1, "", false, "was not on trip"},
+		{"rider1", tripId, 4, strings.Repeat("x", MAX_COMMENT_LEN+1), false, "too long"},
+		{"rider1", tripId, 4, "smooth ride", false, ""},
+		{"rider1", tripId, 5, "", false, "already rated"}, //one per trip
+		{"driver1", tripId, 1, "was rude", true, ""},      //other side can still rate
+	}
+	for idx, c := range cases {
+		_, err := rateTrip(c.tripId, c.from, c.stars, c.comment, c.abuse)
+		if c.errstr == "" && err != nil {
+			t.Errorf("test case #%d: rateTrip returned error when there was none. %s", idx, err.Error())
+		}
+		if c.errstr != "" && (err == nil || !strings.Contains(err.Error(), c.errstr)) {
+			t.Errorf("test case #%d: rateTrip did not return error %s. err:%v", idx, c.errstr, err)
+		}
+	}
+
+	if r := getAverageRating("driver1"); r != 4 {
+		t.Errorf("driver rating wrong:%f", r)
+	}
+	if s := getRatingSummary("rider1"); s.Count != 1 || s.AbuseReports != 1 {
+		t.Errorf("rider summary wrong:%v", s)
+	}
+	reports, _ := getAbuseReports()
+	if len(reports) != 1 || reports[0].To != "rider1" || reports[0].Comment != "was rude" {
+		t.Errorf("abuse report not recorded:%v", reports)
+	}
+	req := httptest.NewRequest("GET", "/commute/admin/abusereports", nil)
+	req.RemoteAddr = "127.0.0.1:5000"
+	w := httptest.NewRecorder()
+	AbuseReportsHandler(w, req)
+	if !strings.Contains(w.Body.String(), "was rude") {
+		t.Errorf("abuse report endpoint did not return the report. body:%s", w.Body.String())
+	}
+
+	//Summaries survive a restart since they are in the store.
+	resetRatings()
+	if r := getAverageRating("driver1"); r != 4 {
+		t.Errorf("driver rating not reloaded from store:%f", r)
+	}
+}
+
+func TestMinRatingFilter(t *testing.T) {
+	Initialize()
+	SetStore(NewMemStore())
+
+	//driver1 gets 5 stars, driver2 gets 2 stars, driver3 is new.
+	rateTrip(completeTestTrip(t, "rider1", "driver1"), "rider1", 5, "", false)
+	rateTrip(completeTestTrip(t, "rider2", "driver2"), "rider2", 2, "", false)
+	newUser("driver3", 12.884733, 77.551541, DRIVER_STATE)
+	//Trips ended away at the drop-off, bring them back.
+	updateStateAttrs("driver1", 12.884733, 77.551541, DRIVER_STATE)
+	updateStateAttrs("driver2", 12.884733, 77.551541, DRIVER_STATE)
+	token := newUser("searcher", 12.884800, 77.551600, RIDER_STATE)
+
+	cases := []struct {
+		minRating float64
+		want      []string
+	}{
+		{0, []string{"driver1", "driver2", "driver3"}},
+		{3, []string{"driver1", "driver3"}},
+		{5, []string{"driver1", "driver3"}},
+	}
+	for idx, c := range cases {
+		retArr, err := searchMatchesWithOpts("searcher", RIDER_STATE, requestOptions{minRating: c.minRating})
+		got := make(map[string]float64)
+		for _, m := range retArr {
+			got[m.userName] = m.rating
+		}
+		if err != nil || len(got) != len(c.want) {
+			t.Errorf("test case #%d: got %v want %v err:%v", idx, got, c.want, err)
+			continue
+		}
+		for _, w := range c.want {
+			if _, ok := got[w]; !ok {
+				t.Errorf("test case #%d: %s missing in %v", idx, w, got)
+			}
+		}
+	}
+
+	//Ratings go out with the heartbeat response, after the candidates.
+	retStr, err := processRequest("searcher", "12.884800,77.551600", "2", token, "", "2", optionalParams{minrating: "3"})
+	if err != nil || !strings.HasSuffix(retStr, ",5.0,0.0") && !strings.HasSuffix(retStr, ",0.0,5.0") {
+		t.Errorf("heartbeat response does not have ratings. ret:%s err:%v", retStr, err)
+	}
+	if _, err = processRequest("searcher", "12.884800,77.551600", "2", token, "", "2", optionalParams{minrating: "six"}); err == nil {
+		t.Errorf("bad minrating did not fail")
+	}
+}
+
+//Runs during once, in the middle of the first read from bucket.
+type racingStore struct {
+	Store
+	bucket string
+	during func()
+}
+
+func (s *racingStore) Get(bucket string, key string) ([]byte, error) {
+	val, err := s.Store.Get(bucket, key)
+	if bucket == s.bucket && s.during != nil {
+		during := s.during
+		s.during = nil
+		during()
+	}
+	return val, err
+}
+
+//A search loading a summary while a rating goes in must not put the old one back in the cache.
+func TestRatingSummaryRace(t *testing.T) {
+	Initialize()
+	tripId := completeTestTrip(t, "rider1", "driver1")
+	resetRatings()
+	defer SetStore(getStore())
+	SetStore(&racingStore{getStore(), bucketRatingSummary, func() { rateTrip(tripId, "rider1", 4, "", false) }})
+
+	getRatingSummary("driver1")
+	if s := getRatingSummary("driver1"); s.Count != 1 || s.Sum != 4 {
+		t.Errorf("rating lost from the cache:%v", s)
+	}
+}
@@ -0,0 +1,123 @@
+package commute
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+//Replayer feeds recorded traffic back through the package on the recorded clock. Tokens handed out on
+//replay are not the ones handed out originally, so it keeps track of them.
+type Replayer struct {
+	clock      *FakeClock
+	prevClock  Clock
+	userTokens map[string]string //user -> token of the replayed login. The event log has no tokens.
+	tokens     map[string]string //recorded token -> replayed token. Request logs have the recorded ones.
+}
+
+//NewReplayer starts from an empty state and takes over the package clock until Close.
+func NewReplayer() *Replayer {
+	Initialize()
+	r := &Replayer{clock: NewFakeClock(time.Unix(0, 0)), userTokens: make(map[string]string), tokens: make(map[string]string)}
+	r.prevClock = SetClock(r.clock)
+	return r
+}
+
+//Close gives the clock back.
+func (r *Replayer) Close() {
+	SetClock(r.prevClock)
+}
+
+//ReplayEvent runs one event from the event log. Returns the response in the form it is logged in, so it can
+//be compared with the recorded one.
+func (r *Replayer) ReplayEvent(e *CommuteEvent) (string, error) {
+	r.clock.Set(time.Unix(0, e.Time))
+	if isStateChange(e.Event) {
+		return "", applyStateChange(e)
+	}
+	resp, err := updateStateWithOpts(e.User, e.Lat, e.Lng, r.userTokens[e.User], e.Mode, e.Other, e.Event, e.options())
+	if handsOutToken(e.Event) && err == nil {
+		r.userTokens[e.User] = resp
+		resp = EVENTLOG_TOKEN_REDACTED
+	}
+	return resp, err
+}
+
+//RecordedRequest is one line of what Handler prints for every request.
+type RecordedRequest struct {
+	Time      time.Time
+	User      string
+	UserAgent string
+	RawQuery  string
+	Response  string
+	Error     string //Empty if there was none
+}
+
+const requestLogSep = " \t " //Handler prints with Println, so the tabs get a space either side
+const requestLogFields = 8   //time, user, ip, latlng, user agent, query, response, error
+
+//ParseRequestLine reads back a Handler log line. Other lines in the same output give an error.
+func ParseRequestLine(line string) (*RecordedRequest, error) {
+	fields := strings.Split(strings.TrimRight(line, "\r\n"), requestLogSep)
+	if len(fields) != requestLogFields {
+		return nil, errors.New("Not a request log line")
+	}
+	//time.Time prints the monotonic clock reading at the end, which is of no use here.
+	timeStr := fields[0]
+	if idx := strings.Index(timeStr, " m="); idx >= 0 {
+		timeStr = timeStr[:idx]
+	}
+	t, err := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", timeStr)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Bad time in request log line:%s", fields[0]))
+	}
+	req := &RecordedRequest{Time: t, User: fields[1], UserAgent: fields[4], RawQuery: fields[5], Response: fields[6],
+		Error: fields[7]}
+	if req.Error == "<nil>" {
+		req.Error = ""
+	}
+	if strings.HasPrefix(req.Error, "throttled by ") {
+		return nil, errors.New("Throttled request. Never got processed")
+	}
+	return req, nil
+}
+
+//ReplayRequest runs one request from the request log. For logins the recorded token is returned, so that the
+//response can be compared, and later requests with that token are given the replayed one.
+func (r *Replayer) ReplayRequest(req *RecordedRequest) (string, error) {
+	r.clock.Set(req.Time)
+	q, err := url.ParseQuery(req.RawQuery)
+	if err != nil {
+		return "", err
+	}
+	if t, ok := r.tokens[q.Get("token")]; ok {
+		q.Set("token", t)
+	}
+	resp, err := processQuery(q, req.UserAgent)
+	if (q.Get("eventtype") == "login" || q.Get("eventtype") == "switchmode") && err == nil {
+		r.tokens[req.Response] = resp
+		resp = req.Response
+	}
+	return resp, err
+}
+
+//DumpState writes out the state of every user, sorted by name. For comparing runs by eye.
+func DumpState(w io.Writer) {
+	gStateLock.RLock()
+	defer gStateLock.RUnlock()
+
+	users := make([]string, 0, len(gStateDS))
+	for u := range gStateDS {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+	for _, u := range users {
+		s := gStateDS[u]
+		fmt.Fprintf(w, "%s mode:%d lat:%f lng:%f updated:%d vehicle:%d connected:%v requests:%v\n", u,
+			s.driverOrRider, s.lat, s.lng, s.lastUptTime, s.vehicleType, s.arrConnectedWith, s.arrReqs)
+	}
+}
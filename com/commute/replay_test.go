@@ -0,0 +1,153 @@
+package commute
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+//A day in the life: logins, search, join, trip end and a block. Replaying the log gives the same responses
+//and the same state.
+func TestReplayEventLog(t *testing.T) {
+	Initialize()
+	dir := newTestEventLog(t, 0, 0)
+	defer os.RemoveAll(dir)
+
+	tokenDriver, _ := updateState("driver1", 12.884733, 77.551541, "", DRIVER_STATE, "", EVENT_LOGIN)
+	tokenRider, _ := updateState("rider1", 12.884800, 77.551600, "", RIDER_STATE, "", EVENT_LOGIN)
+	updateState("rider1", 12.884800, 77.551600, tokenRider, RIDER_STATE, "", EVENT_HEARTBEAT)
+	updateState("rider1", 12.884800, 77.551600, tokenRider, RIDER_STATE, "driver1", EVENT_JOINREQ)
+	updateState("driver1", 12.884733, 77.551541, tokenDriver, DRIVER_STATE, "", EVENT_HEARTBEAT)
+	updateState("driver1", 12.884733, 77.551541, tokenDriver, DRIVER_STATE, "rider1", EVENT_JOINACCEPT)
+	updateState("driver1", 12.884733, 77.551541, tokenDriver, DRIVER_STATE, "rider1", EVENT_JOINACCEPT) //Fails
+	updateState("rider1", 12.918230, 77.573472, tokenRider, RIDER_STATE, "driver1", EVENT_TRIPEND)
+	updateState("rider1", 12.918230, 77.573472, tokenRider, RIDER_STATE, "driver1", EVENT_BLOCK)
+	updateState("rider1", 12.918230, 77.573472, tokenRider, RIDER_STATE, "", EVENT_HEARTBEAT)
+
+	var before bytes.Buffer
+	DumpState(&before)
+	events := readAllEvents(t, dir)
+	if len(events) != 10 {
+		t.Fatalf("expected 10 events, got %d", len(events))
+	}
+
+	r := NewReplayer()
+	defer r.Close()
+	for idx, e := range events {
+		resp, err := r.ReplayEvent(e)
+		errStr := ""
+		if err != nil {
+			errStr = err.Error()
+		}
+		if resp != e.Response || errStr != e.Error {
+			t.Errorf("test case #%d: replay differs. recorded:%s %s replayed:%s %s", idx, e.Response, e.Error, resp, errStr)
+		}
+	}
+	var after bytes.Buffer
+	DumpState(&after)
+	if before.String() != after.String() {
+		t.Errorf("state differs after replay.\nrecorded:\n%s\nreplayed:\n%s", before.String(), after.String())
+	}
+
+	//Times are the recorded ones, not now
+	trips, _, _ := getTripHistory("rider1", 0, 0, 0, TRIP_PAGE_SIZE)
+	if len(trips) != 1 || trips[0].EndTime != events[7].Time/int64(time.Second) {
+		t.Errorf("trip not on the recorded clock:%v", trips)
+	}
+}
+
+//Organisations and profiles change who shows up in a search. They go in the log, so searches after them
+//replay the same.
+func TestReplayMatchingSettings(t *testing.T) {
+	Initialize()
+	dir := newTestEventLog(t, 0, 0)
+	defer os.RemoveAll(dir)
+
+	updateState("driver1", 12.884733, 77.551541, "", DRIVER_STATE, "", EVENT_LOGIN)
+	updateState("driver2", 12.885733, 77.551541, "", DRIVER_STATE, "", EVENT_LOGIN)
+	tokenRider, _ := updateState("rider1", 12.884800, 77.551600, "", RIDER_STATE, "", EVENT_LOGIN)
+	createOrg("localhost", "acme", "Acme Corp", "acme.com")
+	joinOrg("rider1", "acme", "invite")
+	joinOrg("driver1", "acme", "invite")
+	setOrgScope("rider1", ORG_SCOPE_ORG)
+	orgOnly, _ := updateState("rider1", 12.884800, 77.551600, tokenRider, RIDER_STATE, "", EVENT_HEARTBEAT)
+	leaveOrg("rider1")
+	verifyGender("localhost", "rider1", GENDER_FEMALE)
+	verifyGender("localhost", "driver2", GENDER_FEMALE)
+	setProfile("rider1", "", "", "", "1")
+	womenOnly, _ := updateState("rider1", 12.884800, 77.551600, tokenRider, RIDER_STATE, "", EVENT_HEARTBEAT)
+	if orgOnly == womenOnly {
+		t.Fatalf("same search either way:%s", orgOnly)
+	}
+
+	events := readAllEvents(t, dir)
+	if len(events) != 12 {
+		t.Fatalf("expected 12 events, got %d", len(events))
+	}
+	r := NewReplayer()
+	defer r.Close()
+	for idx, e := range events {
+		resp, err := r.ReplayEvent(e)
+		if resp != e.Response || err != nil {
+			t.Errorf("test case #%d: replay differs. recorded:%s replayed:%s %v", idx, e.Response, resp, err)
+		}
+	}
+	if orgOf("rider1") != nil || orgOf("driver1") == nil || !getProfile("rider1").WomenOnly {
+		t.Errorf("settings not replayed")
+	}
+}
+
+//Lines as Handler prints them.
+func requestLogLine(when time.Time, rawQuery string, resp string, err error) string {
+	q, _ := url.ParseQuery(rawQuery)
+	return fmt.Sprintln(when, "\t", q.Get("user"), "\t", "127.0.0.1:5555", "\t", q.Get("param"), "\t", "okhttp",
+		"\t", rawQuery, "\t", resp, "\t", err)
+}
+
+func TestReplayRequestLog(t *testing.T) {
+	Initialize()
+	start := time.Now()
+	lines := make([]string, 0)
+	record := func(offset time.Duration, rawQuery string) {
+		q, _ := url.ParseQuery(rawQuery)
+		resp, err := processQuery(q, "okhttp")
+		lines = append(lines, requestLogLine(start.Add(offset), rawQuery, resp, err))
+	}
+	record(0, "user=driver1&param=12.884733,77.551541&mode=1&eventtype=login")
+	record(time.Second, "user=rider1&param=12.884800,77.551600&mode=2&eventtype=login")
+	tokenDriver, tokenRider := getToken("driver1"), getToken("rider1")
+	record(2*time.Second, "user=rider1&param=12.884800,77.551600&mode=2&token="+tokenRider)
+	record(3*time.Second, "user=rider1&param=12.884800,77.551600&mode=2&eventtype=joinrequest&status=driver1&token="+tokenRider)
+	record(4*time.Second, "user=driver1&param=12.884733,77.551541&mode=1&eventtype=joinaccept&status=rider1&token="+tokenDriver)
+	record(5*time.Second, "user=rider1&param=12.884800,77.551600&mode=2&token=stale")
+
+	r := NewReplayer()
+	defer r.Close()
+	if _, err := ParseRequestLine(" ReqCnt :  10  Time taken= 1s\n"); err == nil {
+		t.Errorf("stats line parsed as a request")
+	}
+	for idx, line := range lines {
+		req, err := ParseRequestLine(line)
+		if err != nil {
+			t.Fatalf("test case #%d: could not parse:%s err:%s", idx, line, err.Error())
+		}
+		if !req.Time.Equal(start.Add(time.Duration(idx) * time.Second).Round(0)) {
+			t.Errorf("test case #%d: wrong time %s", idx, req.Time)
+		}
+		resp, err := r.ReplayRequest(req)
+		errStr := ""
+		if err != nil {
+			errStr = err.Error()
+		}
+		if resp != req.Response || errStr != req.Error {
+			t.Errorf("test case #%d: replay differs. recorded:%s %s replayed:%s %s", idx, req.Response, req.Error, resp, errStr)
+		}
+	}
+	//Rider was last heard from at the join request. The stale token one is turned away.
+	if s := getCurrentState("rider1"); len(s.arrConnectedWith) != 1 || s.lastUptTime != start.Add(3*time.Second).Unix() {
+		t.Errorf("wrong state after replay:%+v", s)
+	}
+}
@@ -9,6 +9,8 @@ type nearbyUserDetails struct {
 	lat      float64
 	lng      float64
 	dist     float64 //Already computed, might as well reuse in app
+	rating   float64 //Average stars. 0 if not rated yet.
+	why      string  //Why it is ranked where it is, when explained. See rankByPrefs
 }
 
 //ResponseDetails captures the content of what gets returned by the API.
@@ -20,6 +22,9 @@ type ResponseDetails struct {
 
 	//Potential connects
 	arrNearbyCommuters []nearbyUserDetails
+
+	//Add why each potential connect is ranked where it is. Only for users with preferences.
+	explain bool
 }
 
 func newResponseDetails() *ResponseDetails {
@@ -35,6 +40,9 @@ func newResponseDetails() *ResponseDetails {
 func (r *ResponseDetails) toString(state int) string {
 	//Format is driverresppayload,numberofJoinedRiders,rider1,rider2..,numberofrequestedriders,rider1,lat1,lng1,rider2,lat2,lng2..
 	//Format is riderresppayload,numberofJoinedDrivers,driver1,driver2..,numberofnearbydrivers,driver1,lat1,lng1,driver2,lat2,lng2..
+	//Both are followed by rating1,rating2.. one per nearby commuter. Kept at the end so older apps which
+	//only read the triples continue to work.
+	//For users with preferences, the ratings are followed by why1,why2.. eg: "+music|-smoking". See rankByPrefs
 
 	retStr := ""
 	switch state {
@@ -51,6 +59,14 @@ func (r *ResponseDetails) toString(state int) string {
 	for _, n := range r.arrNearbyCommuters {
 		retStr = fmt.Sprintf("%s,%s,%.2f,%.2f", retStr, n.userName, n.lat, n.lng)
 	}
+	for _, n := range r.arrNearbyCommuters {
+		retStr = fmt.Sprintf("%s,%.1f", retStr, n.rating)
+	}
+	if r.explain {
+		for _, n := range r.arrNearbyCommuters {
+			retStr = fmt.Sprintf("%s,%s", retStr, n.why)
+		}
+	}
 
 	return retStr
 
@@ -61,5 +77,25 @@ func (r *ResponseDetails) addJoinedUser(userName string) {
 }
 
 func (r *ResponseDetails) addPotentialUser(userName string, lat float64, lng float64, dist float64) {
-	r.arrNearbyCommuters = append(r.arrNearbyCommuters, nearbyUserDetails{userName, lat, lng, dist})
+	r.arrNearbyCommuters = append(r.arrNearbyCommuters, nearbyUserDetails{userName, lat, lng, dist, 0, ""})
+}
+
+func (r *ResponseDetails) isJoined(userName string) bool {
+	for _, c := range r.arrConnectedUsers {
+		if c == userName {
+			return true
+		}
+	}
+	return false
+}
+
+//addCandidate is what the search results should go through. Exact positions are only handed out for
+//co-commuters we are already connected with. Everyone else gets a blurred location (see privacy.go).
+//Joined users have to be filled in before this is called.
+func (r *ResponseDetails) addCandidate(userName string, lat float64, lng float64, dist float64, rating float64,
+	why string) {
+	if !r.isJoined(userName) {
+		lat, lng = fuzzLocation(lat, lng)
+	}
+	r.arrNearbyCommuters = append(r.arrNearbyCommuters, nearbyUserDetails{userName, lat, lng, dist, rating, why})
 }
@@ -15,10 +15,10 @@ func TestRespOutput(t *testing.T) {
 	}{
 		{joinedusers: []string{"juser1", "juser2"}, users: []string{"cuser1", "cuser2"}, mode: 1,
 			lats: []float64{1.1, 2.2}, lngs: []float64{3.1, 4.2}, dists: []float64{100.1, 120.1},
-			finalStr: "driverresppayload,2,juser1,juser2,2,cuser1,1.10,3.10,cuser2,2.20,4.20"},
+			finalStr: "driverresppayload,2,juser1,juser2,2,cuser1,1.10,3.10,cuser2,2.20,4.20,0.0,0.0"},
 		{joinedusers: []string{"x"}, users: []string{"driver1", "driver2"}, mode: 2,
 			lats: []float64{1.1, 2.2}, lngs: []float64{3.1, 4.2}, dists: []float64{100.1, 120.1},
-			finalStr: "riderresppayload,1,x,2,driver1,1.10,3.10,driver2,2.20,4.20"},
+			finalStr: "riderresppayload,1,x,2,driver1,1.10,3.10,driver2,2.20,4.20,0.0,0.0"},
 	}
 
 	for idx, c := range cases {
@@ -0,0 +1,310 @@
+package commute
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+//Roles belong to the account, not to whatever the app sends. Everyone can ride; driving needs the driver role,
+//given once the driver is verified. Admin and support are for ops. The mode a session is in is in its token,
+//and the mode param has to agree with it. Switching goes through EVENT_SWITCHMODE, which is audited.
+const ROLE_RIDER = "rider"
+const ROLE_DRIVER = "driver" //Verified driver
+const ROLE_ADMIN = "admin"
+const ROLE_SUPPORT = "support"
+
+//Store buckets used by roles
+const bucketRoles = "roles" //user -> roleRecord
+const bucketAudit = "audit" //time/user -> auditRecord
+
+var validRoles = map[string]bool{ROLE_RIDER: true, ROLE_DRIVER: true, ROLE_ADMIN: true, ROLE_SUPPORT: true}
+
+//eventModes says which modes may send each event. Events not here are allowed in either mode.
+var eventModes = map[int][]int{
+	EVENT_JOINREQ:    {RIDER_STATE},
+	EVENT_JOINACCEPT: {DRIVER_STATE},
+}
+
+type roleRecord struct {
+	Roles []string `json:"roles"` //Rider is implied, not stored
+}
+
+//auditRecord is one change to who can do what.
+type auditRecord struct {
+	Time   int64  `json:"time"`
+	Actor  string `json:"actor"` //Who did it. The user themselves for mode switches, "localhost" for ops on the box.
+	User   string `json:"user"`
+	Action string `json:"action"`
+	Detail string `json:"detail"`
+}
+
+var gRolesLock = sync.Mutex{}
+var gAuditSeq int64 //Keeps records made in the same instant apart, in order
+
+func getRoles(userName string) []string {
+	var rec roleRecord
+	storeGetJSON(bucketRoles, userName, &rec)
+	return append([]string{ROLE_RIDER}, rec.Roles...)
+}
+
+func hasRole(userName string, roles ...string) bool {
+	for _, r := range getRoles(userName) {
+		if containsString(roles, r) {
+			return true
+		}
+	}
+	return false
+}
+
+//canUseMode says if the user may be in the mode. Driving needs the driver role, when drivers are verified.
+func canUseMode(userName string, mode int) bool {
+	if mode == DRIVER_STATE {
+		return !isDriverVerificationRequired() || hasRole(userName, ROLE_DRIVER)
+	}
+	return mode == RIDER_STATE
+}
+
+func audit(actor string, userName string, action string, detail string) error {
+	now := clockNow()
+	rec := auditRecord{Time: now.Unix(), Actor: actor, User: userName, Action: action, Detail: detail}
+	seq := atomic.AddInt64(&gAuditSeq, 1)
+	return storePutJSON(bucketAudit, fmt.Sprintf("%020d/%010d/%s", now.UnixNano(), seq, userName), rec)
+}
+
+func getAudit(userName string) ([]auditRecord, error) {
+	vals, err := getStore().List(bucketAudit, "")
+	if err != nil {
+		return nil, err
+	}
+	out := make([]auditRecord, 0)
+	for _, v := range vals {
+		var rec auditRecord
+		if err = json.Unmarshal(v, &rec); err != nil {
+			return nil, err
+		}
+		if userName == "" || rec.User == userName {
+			out = append(out, rec)
+		}
+	}
+	return out, nil
+}
+
+//grantRole gives the user a role. Audited.
+func grantRole(actor string, userName string, role string) error {
+	if !validRoles[role] || role == ROLE_RIDER {
+		return errors.New(fmt.Sprintf("Invalid role:%s", role))
+	}
+	gRolesLock.Lock()
+	defer gRolesLock.Unlock()
+	var rec roleRecord
+	storeGetJSON(bucketRoles, userName, &rec)
+	if containsString(rec.Roles, role) {
+		return nil
+	}
+	rec.Roles = append(rec.Roles, role)
+	if err := storePutJSON(bucketRoles, userName, rec); err != nil {
+		return err
+	}
+	return audit(actor, userName, "grant", role)
+}
+
+//revokeRole takes a role away. Audited. Sessions in driver mode end with the driver role, so that the
+//tokens they have stop working now rather than when they expire.
+func revokeRole(actor string, userName string, role string) error {
+	gRolesLock.Lock()
+	var rec roleRecord
+	storeGetJSON(bucketRoles, userName, &rec)
+	if !containsString(rec.Roles, role) {
+		gRolesLock.Unlock()
+		return errors.New(fmt.Sprintf("%s does not have the role %s", userName, role))
+	}
+	rec.Roles = removeString(rec.Roles, role)
+	err := storePutJSON(bucketRoles, userName, rec)
+	gRolesLock.Unlock()
+	if err != nil {
+		return err
+	}
+	if err = audit(actor, userName, "revoke", role); err != nil {
+		return err
+	}
+	if role != ROLE_DRIVER {
+		return nil
+	}
+	gSessionsLock.Lock()
+	defer gSessionsLock.Unlock()
+	sessions, err := listSessionsLocked(userName, clockNow())
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		if s.Role == DRIVER_STATE {
+			endSessionLocked(s)
+		}
+	}
+	return nil
+}
+
+//checkEventAllowed is the policy for updateState: the mode param has to be the mode of the session, and
+//the event has to be one that mode can send.
+func checkEventAllowed(claims *accessClaims, driverorrider int, eventType int) error {
+	if claims.Role != driverorrider {
+		return errors.New(fmt.Sprintf("You are logged in as %s. Switch mode first", modeName(claims.Role)))
+	}
+	if modes, ok := eventModes[eventType]; ok && !containsInt(modes, driverorrider) {
+		return errors.New(fmt.Sprintf("Not allowed for a %s:%s", modeName(driverorrider), eventNames[eventType]))
+	}
+	return nil
+}
+
+func modeName(mode int) string {
+	switch mode {
+	case DRIVER_STATE:
+		return ROLE_DRIVER
+	case RIDER_STATE:
+		return ROLE_RIDER
+	}
+	return "nobody"
+}
+
+func containsInt(arr []int, v int) bool {
+	for _, a := range arr {
+		if a == v {
+			return true
+		}
+	}
+	return false
+}
+
+//switchMode moves the session to the other mode and returns a new token for it. Not in the middle of a trip.
+func switchMode(userName string, sessionId string, mode int) (string, error) {
+	if !canUseMode(userName, mode) {
+		return "", errors.New(fmt.Sprintf("%s is not allowed to be a %s", userName, modeName(mode)))
+	}
+	gStateLock.Lock()
+	currState, ok := gStateDS[userName]
+	if ok && len(currState.arrConnectedWith) > 0 {
+		gStateLock.Unlock()
+		return "", errors.New("Cannot switch mode during a trip")
+	}
+	gStateLock.Unlock()
+
+	gSessionsLock.Lock()
+	defer gSessionsLock.Unlock()
+	s, err := getSession(userName, sessionId)
+	if err != nil {
+		return "", err
+	}
+	from := s.Role
+	s.Role = mode
+	if err = saveSession(s); err != nil {
+		return "", err
+	}
+	if err = audit(userName, userName, "switchmode", fmt.Sprintf("%s->%s", modeName(from), modeName(mode))); err != nil {
+		return "", err
+	}
+	return sessionToken(s), nil
+}
+
+//isStaffRequest lets through ops on the box, and users of the default tenant with one of the roles. Their
+//token comes in the Authorization header as "Bearer <token>", or the token param; the user is whoever the
+//token is for, since some admin endpoints use the user param for someone else. Returns who is asking, for
+//the audit log. For endpoints that show or change things across tenants.
+func isStaffRequest(r *http.Request, roles ...string) (string, bool) {
+	actor, ok := isTenantStaffRequest(r, roles...)
+	if !ok || (actor != "localhost" && tenantOf(actor) != DEFAULT_TENANT) {
+		return "", false
+	}
+	return actor, true
+}
+
+//isTenantStaffRequest is isStaffRequest letting in staff of any tenant. For endpoints which keep to the
+//tenant's users, see canSeeTenant.
+func isTenantStaffRequest(r *http.Request, roles ...string) (string, bool) {
+	if isLocalRequest(r) {
+		return "localhost", true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	claims, err := parseAccessToken(token)
+	if err != nil {
+		return "", false
+	}
+	if _, err = validateToken(claims.Sub, token); err != nil || !hasRole(claims.Sub, roles...) {
+		return "", false
+	}
+	return claims.Sub, true
+}
+
+func rejectStaffRequest(w http.ResponseWriter, roles ...string) {
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprint(w, "ERROR! : allowed only from localhost or for ", strings.Join(roles, "/"))
+}
+
+func processRolesRequest(actor string, isAdmin bool, action string, userName string, role string) (string, error) {
+	switch action {
+	case "list":
+		return fmt.Sprintf("rolespayload,%s", strings.Join(getRoles(userName), ",")), nil
+	case "audit":
+		recs, err := getAudit(userName)
+		if err != nil {
+			return "", err
+		}
+		data, err := json.Marshal(recs)
+		return string(data), err
+	case "grant", "revoke":
+	default:
+		return "", errors.New(fmt.Sprintf("ERROR in action parameter:%s", action))
+	}
+	if !isAdmin {
+		return "", errors.New("Only admins can change roles")
+	}
+	if userName == "" {
+		return "", errors.New("ERROR in target parameter")
+	}
+	var err error
+	if action == "grant" {
+		err = grantRole(actor, userName, role)
+	} else {
+		err = revokeRole(actor, userName, role)
+	}
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Success! %s %s %s", action, role, userName), nil
+}
+
+//Function RolesHandler shows and changes roles. Params are action (list/audit/grant/revoke), target (the user)
+//and role. Admins and support can look, only admins can change. Staff of a tenant, its users only. See
+//isTenantStaffRequest.
+func RolesHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := isTenantStaffRequest(r, ROLE_ADMIN, ROLE_SUPPORT)
+	if !ok {
+		rejectStaffRequest(w, ROLE_ADMIN, ROLE_SUPPORT)
+		return
+	}
+	q := r.URL.Query()
+	isAdmin := actor == "localhost" || hasRole(actor, ROLE_ADMIN)
+	var retValue string
+	var err error
+	if q.Get("target") == "" && actor != "localhost" && tenantOf(actor) != DEFAULT_TENANT {
+		err = errors.New("ERROR in target parameter")
+	} else if !canSeeTenant(actor, tenantOf(q.Get("target"))) {
+		err = errors.New(fmt.Sprintf("No such user:%s", q.Get("target")))
+	} else {
+		retValue, err = processRolesRequest(actor, isAdmin, q.Get("action"), q.Get("target"), q.Get("role"))
+	}
+	if err != nil {
+		fmt.Fprint(w, "ERROR! :", err)
+	} else {
+		fmt.Fprint(w, retValue)
+	}
+	fmt.Println(clockNow(), "\t", actor, "\t", r.RemoteAddr, "\t", "roles", "\t", q.Get("action"), "\t",
+		q.Get("target"), "\t", q.Get("role"), "\t", err)
+}
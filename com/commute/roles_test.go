@@ -0,0 +1,174 @@
+package commute
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//Verifies the phone and logs in. Returns the token, or the error from login.
+func verifiedLogin(t *testing.T, sms *FakeSMSSender, userName string, phone string, mode int) (string, error) {
+	if err := sendCode(userName, phone); err != nil {
+		t.Fatalf("sendcode failed:%s", err.Error())
+	}
+	token, _, err := verifyCode(userName, sms.LastCode(phone), 0, "phone", "okhttp")
+	if err != nil {
+		t.Fatalf("verify failed:%s", err.Error())
+	}
+	return updateState(userName, 12.884733, 77.551541, token, mode, "", EVENT_LOGIN)
+}
+
+func TestDriverRole(t *testing.T) {
+	sms, _, done := newTestAuth()
+	defer done()
+
+	if _, err := verifiedLogin(t, sms, "driver1", "+919876543210", DRIVER_STATE); err == nil {
+		t.Errorf("unverified driver logged in as a driver")
+	}
+	approveForTest("driver1")
+	driverToken, err := verifiedLogin(t, sms, "driver1", "+919876543210", DRIVER_STATE)
+	if err != nil {
+		t.Fatalf("verified driver could not log in:%s", err.Error())
+	}
+	riderToken, _ := verifiedLogin(t, sms, "rider1", "+919876543211", RIDER_STATE)
+
+	cases := []struct {
+		user     string
+		token    string
+		mode     int
+		other    string
+		event    int
+		expected bool
+	}{
+		{"driver1", driverToken, DRIVER_STATE, "", EVENT_HEARTBEAT, true},
+		{"driver1", driverToken, RIDER_STATE, "", EVENT_HEARTBEAT, false}, //Mode flip on a heartbeat
+		{"rider1", riderToken, DRIVER_STATE, "", EVENT_HEARTBEAT, false},
+		{"rider1", riderToken, RIDER_STATE, "rider1", EVENT_JOINACCEPT, false}, //Riders do not accept
+		{"driver1", driverToken, DRIVER_STATE, "driver1", EVENT_JOINREQ, false},
+		{"rider1", riderToken, RIDER_STATE, "driver1", EVENT_JOINREQ, true},
+		{"driver1", driverToken, DRIVER_STATE, "rider1", EVENT_JOINACCEPT, true},
+	}
+	for idx, c := range cases {
+		_, err := updateState(c.user, 12.884733, 77.551541, c.token, c.mode, c.other, c.event)
+		if (err == nil) != c.expected {
+			t.Errorf("test case #%d: err = %v", idx, err)
+		}
+	}
+	if s := getCurrentState("driver1"); s.driverOrRider != DRIVER_STATE {
+		t.Errorf("mode changed by a rejected heartbeat:%d", s.driverOrRider)
+	}
+
+	//Taking the role away logs out the driver sessions
+	if err = revokeRole("localhost", "driver1", ROLE_DRIVER); err != nil {
+		t.Errorf("revoke failed:%s", err.Error())
+	}
+	if _, err = isUserValid("driver1", driverToken); err == nil {
+		t.Errorf("driver session still live after revoke")
+	}
+}
+
+func TestSwitchMode(t *testing.T) {
+	sms, _, done := newTestAuth()
+	defer done()
+
+	token, _ := verifiedLogin(t, sms, "user1", "+919876543210", RIDER_STATE)
+	if _, err := updateState("user1", 12.884733, 77.551541, token, DRIVER_STATE, "", EVENT_SWITCHMODE); err == nil {
+		t.Errorf("switched to driver without the role")
+	}
+	approveForTest("user1")
+	newToken, err := updateState("user1", 12.884733, 77.551541, token, DRIVER_STATE, "", EVENT_SWITCHMODE)
+	if err != nil {
+		t.Fatalf("switch failed:%s", err.Error())
+	}
+	if claims, _ := parseAccessToken(newToken); claims.Role != DRIVER_STATE {
+		t.Errorf("new token not for driver mode:%+v", claims)
+	}
+	if _, err = updateState("user1", 12.884733, 77.551541, newToken, DRIVER_STATE, "", EVENT_HEARTBEAT); err != nil {
+		t.Errorf("heartbeat as driver failed:%s", err.Error())
+	}
+	if s := getCurrentState("user1"); s.driverOrRider != DRIVER_STATE {
+		t.Errorf("state not switched:%d", s.driverOrRider)
+	}
+
+	//Not mid trip
+	riderToken, _ := verifiedLogin(t, sms, "rider1", "+919876543211", RIDER_STATE)
+	updateState("rider1", 12.884733, 77.551541, riderToken, RIDER_STATE, "user1", EVENT_JOINREQ)
+	updateState("user1", 12.884733, 77.551541, newToken, DRIVER_STATE, "rider1", EVENT_JOINACCEPT)
+	if _, err = updateState("user1", 12.884733, 77.551541, newToken, RIDER_STATE, "", EVENT_SWITCHMODE); err == nil {
+		t.Errorf("switched mode during a trip")
+	}
+
+	recs, _ := getAudit("user1")
+	actions := make([]string, 0)
+	for _, r := range recs {
+		actions = append(actions, r.Actor+":"+r.Action+":"+r.Detail)
+	}
+	if !strings.HasSuffix(strings.Join(actions, " "), "localhost:grant:driver user1:switchmode:rider->driver") {
+		t.Errorf("wrong audit trail:%v", actions)
+	}
+}
+
+func TestStaffEndpoints(t *testing.T) {
+	sms, _, done := newTestAuth()
+	defer done()
+
+	grantRole("localhost", "admin1", ROLE_ADMIN)
+	grantRole("localhost", "support1", ROLE_SUPPORT)
+	adminToken, _ := verifiedLogin(t, sms, "admin1", "+919876543210", RIDER_STATE)
+	supportToken, _ := verifiedLogin(t, sms, "support1", "+919876543211", RIDER_STATE)
+	riderToken, _ := verifiedLogin(t, sms, "rider1", "+919876543212", RIDER_STATE)
+
+	cases := []struct {
+		remote   string
+		token    string
+		query    string
+		expected string
+	}{
+		{"127.0.0.1:5555", "", "action=grant&target=driver1&role=driver", "Success!"},
+		{"1.2.3.4:5555", "", "action=list&target=driver1", "ERROR!"},
+		{"1.2.3.4:5555", riderToken, "action=list&target=driver1", "ERROR!"},
+		{"1.2.3.4:5555", supportToken, "action=list&target=driver1", "rolespayload,rider,driver"},
+		{"1.2.3.4:5555", supportToken, "action=revoke&target=driver1&role=driver", "ERROR!"},
+		{"1.2.3.4:5555", adminToken, "action=revoke&target=driver1&role=driver", "Success!"},
+		{"1.2.3.4:5555", adminToken, "action=grant&target=driver1&role=superuser", "ERROR!"},
+	}
+	for idx, c := range cases {
+		r := httptest.NewRequest("GET", "/commute/admin/roles?"+c.query, nil)
+		r.RemoteAddr = c.remote
+		if c.token != "" {
+			r.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		resp := httptest.NewRecorder()
+		RolesHandler(resp, r)
+		if !strings.HasPrefix(resp.Body.String(), c.expected) {
+			t.Errorf("test case #%d: got %s, expected %s", idx, resp.Body.String(), c.expected)
+		}
+	}
+
+	//Who did what
+	r := httptest.NewRequest("GET", "/commute/admin/roles?action=audit&target=driver1", nil)
+	r.RemoteAddr = "127.0.0.1:5555"
+	resp := httptest.NewRecorder()
+	RolesHandler(resp, r)
+	var recs []auditRecord
+	if err := json.Unmarshal(resp.Body.Bytes(), &recs); err != nil || len(recs) != 2 || recs[1].Actor != "admin1" {
+		t.Errorf("wrong audit:%s", resp.Body.String())
+	}
+
+	//Other admin endpoints take the token too, and the wallet one keeps its user param for the target
+	r = httptest.NewRequest("GET", "/commute/admin/wallet?action=topup&user=rider1&amount=5000&key=t1", nil)
+	r.RemoteAddr = "1.2.3.4:5555"
+	r.Header.Set("Authorization", "Bearer "+adminToken)
+	resp = httptest.NewRecorder()
+	WalletAdminHandler(resp, r)
+	if !strings.HasPrefix(resp.Body.String(), "Success!") {
+		t.Errorf("admin topup failed:%s", resp.Body.String())
+	}
+	r.Header.Set("Authorization", "Bearer "+supportToken)
+	resp = httptest.NewRecorder()
+	WalletAdminHandler(resp, r)
+	if resp.Code != 403 {
+		t.Errorf("support could top up:%s", resp.Body.String())
+	}
+}
@@ -0,0 +1,469 @@
+package commute
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Safety: users keep a few emergency contacts. The SOS event takes down where the user and everyone they are
+//riding with are, tells the contacts with a live share link, and flags the trips for the ops team. Share
+//links can also be made by hand, eg: to let family follow a ride. They show where the user is, read only,
+//to whoever has the link, till they expire.
+const SOS_MAX_CONTACTS = 5
+const SHARE_LINK_TTL = 2 * time.Hour //Default, and what the SOS link gets
+const SHARE_LINK_MAX_TTL = 12 * time.Hour
+const SOS_REPEAT_GAP = time.Minute //A second SOS within this gives back the open alert. Contacts are told once.
+
+//Store buckets used by safety
+const bucketEmergencyContacts = "emergencycontacts" //user -> []string of phones
+const bucketSOSAlerts = "sosalerts"                 //alertId -> sosAlert
+const bucketShareLinks = "sharelinks"               //linkId -> shareLink
+
+//Notifier gets the word out to emergency contacts. The default sends an SMS through the SMS sender (see
+//auth.go). Plug in another with SetNotifier.
+type Notifier interface {
+	Notify(contact string, message string) error
+}
+
+var gNotifier Notifier
+var gShareBaseURL string
+var gSafetyLock = sync.Mutex{}
+
+func resetSafety() {
+	gSafetyLock.Lock()
+	defer gSafetyLock.Unlock()
+	gNotifier = smsNotifier{}
+	gShareBaseURL = "/commute/share"
+}
+
+//SetNotifier makes the package notify through n. Returns the notifier it replaces, to put back later.
+func SetNotifier(n Notifier) Notifier {
+	gSafetyLock.Lock()
+	defer gSafetyLock.Unlock()
+	prev := gNotifier
+	gNotifier = n
+	return prev
+}
+
+//SetShareBaseURL is where ShareHandler is reachable from outside, eg: https://example.com/commute/share.
+//Links sent to contacts are this with the link id.
+func SetShareBaseURL(baseURL string) {
+	gSafetyLock.Lock()
+	defer gSafetyLock.Unlock()
+	if baseURL != "" {
+		gShareBaseURL = baseURL
+	}
+}
+
+func shareURL(id string) string {
+	gSafetyLock.Lock()
+	defer gSafetyLock.Unlock()
+	return gShareBaseURL + "?id=" + id
+}
+
+func getNotifier() Notifier {
+	gSafetyLock.Lock()
+	defer gSafetyLock.Unlock()
+	return gNotifier
+}
+
+//smsNotifier sends through whatever SMS sender is plugged in at the time.
+type smsNotifier struct{}
+
+func (smsNotifier) Notify(contact string, message string) error {
+	gAuthLock.Lock()
+	sender := gSMSSender
+	gAuthLock.Unlock()
+	return sender.Send(contact, message)
+}
+
+//FakeNotifier keeps messages instead of sending them. For tests and local runs.
+type FakeNotifier struct {
+	lock     sync.Mutex
+	messages map[string][]string
+	Fail     bool //Notify errors out when set
+}
+
+func NewFakeNotifier() *FakeNotifier {
+	return &FakeNotifier{messages: make(map[string][]string)}
+}
+
+func (n *FakeNotifier) Notify(contact string, message string) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.Fail {
+		return errors.New("notifier down")
+	}
+	n.messages[contact] = append(n.messages[contact], message)
+	return nil
+}
+
+//Messages returns what has been sent to the contact, oldest first.
+func (n *FakeNotifier) Messages(contact string) []string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return append([]string(nil), n.messages[contact]...)
+}
+
+func getEmergencyContacts(userName string) []string {
+	contacts := make([]string, 0)
+	storeGetJSON(bucketEmergencyContacts, userName, &contacts)
+	return contacts
+}
+
+//setEmergencyContacts replaces the user's contacts with the comma separated phone numbers. Empty clears them.
+func setEmergencyContacts(userName string, list string) (string, error) {
+	contacts := make([]string, 0)
+	for _, c := range strings.Split(list, ",") {
+		if strings.TrimSpace(c) == "" {
+			continue
+		}
+		phone, err := normalizePhone(c)
+		if err != nil {
+			return "", err
+		}
+		if !containsString(contacts, phone) {
+			contacts = append(contacts, phone)
+		}
+	}
+	if len(contacts) > SOS_MAX_CONTACTS {
+		return "", errors.New(fmt.Sprintf("At most %d emergency contacts", SOS_MAX_CONTACTS))
+	}
+	if err := storePutJSON(bucketEmergencyContacts, userName, contacts); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Success! %d emergency contacts", len(contacts)), nil
+}
+
+//sosPosition is where someone was when the SOS went off.
+type sosPosition struct {
+	User       string  `json:"user"`
+	Lat        float64 `json:"lat"`
+	Lng        float64 `json:"lng"`
+	LastUpdate int64   `json:"lastupdate"` //When we last heard from them. Older than the alert if their app went quiet.
+}
+
+type sosAlert struct {
+	Id       string        `json:"id"`
+	User     string        `json:"user"`
+	Time     int64         `json:"time"`
+	Where    sosPosition   `json:"where"`
+	With     []sosPosition `json:"with"` //Everyone the user was connected with
+	Trips    []string      `json:"trips"`
+	Share    string        `json:"share"`    //Share link id
+	Notified []string      `json:"notified"` //Contacts who were told
+	Failed   []string      `json:"failed"`   //Contacts we could not reach
+	Resolved int64         `json:"resolved,omitempty"`
+	Resolver string        `json:"resolver,omitempty"`
+}
+
+//Callers hold gStateLock.
+func positionOf(userName string) (sosPosition, bool) {
+	s, ok := gStateDS[userName]
+	if !ok {
+		return sosPosition{User: userName}, false
+	}
+	return sosPosition{User: userName, Lat: s.lat, Lng: s.lng, LastUpdate: s.lastUptTime}, true
+}
+
+//raiseSOS is the SOS event. The alert is saved and the trips flagged before anyone is told, so that ops
+//see it even if the notifier is down.
+func raiseSOS(userName string) (string, error) {
+	now := clockNow()
+	if open, err := getSOSAlerts(false); err == nil {
+		for _, a := range open {
+			if a.User == userName && now.Unix()-a.Time < int64(SOS_REPEAT_GAP.Seconds()) {
+				return fmt.Sprintf("sos,%s,%d,%s", a.Id, len(a.Notified), shareURL(a.Share)), nil
+			}
+		}
+	}
+	alert := &sosAlert{Id: fmt.Sprintf("S%d-%s", now.Unix(), randSecret()), User: userName, Time: now.Unix(),
+		With: make([]sosPosition, 0), Trips: make([]string, 0), Notified: make([]string, 0), Failed: make([]string, 0)}
+
+	gStateLock.RLock()
+	where, ok := positionOf(userName)
+	if !ok {
+		gStateLock.RUnlock()
+		return "", errors.New(fmt.Sprintf("Error while raising SOS :%s does not exist!", userName))
+	}
+	alert.Where = where
+	isDriver := gStateDS[userName].driverOrRider == DRIVER_STATE
+	for _, o := range gStateDS[userName].arrConnectedWith {
+		pos, _ := positionOf(o)
+		alert.With = append(alert.With, pos)
+	}
+	gStateLock.RUnlock()
+
+	for _, o := range alert.With {
+		rider, driver := userName, o.User
+		if isDriver {
+			rider, driver = o.User, userName
+		}
+		if trip, err := flagTrip(rider, driver, alert.Id); err == nil {
+			alert.Trips = append(alert.Trips, trip.TripId)
+		}
+	}
+	link, err := createShareLink(userName, SHARE_LINK_TTL)
+	if err != nil {
+		return "", err
+	}
+	alert.Share = link.Id
+	if err = storePutJSON(bucketSOSAlerts, alert.Id, alert); err != nil {
+		return "", err
+	}
+
+	msg := fmt.Sprintf("SOS from %s at %s. Last seen at %.6f,%.6f", userName, now.UTC().Format(time.RFC3339),
+		where.Lat, where.Lng)
+	if len(alert.With) > 0 {
+		names := make([]string, 0, len(alert.With))
+		for _, o := range alert.With {
+			names = append(names, o.User)
+		}
+		msg += fmt.Sprintf(", with %s", strings.Join(names, ", "))
+	}
+	msg += fmt.Sprintf(". Live location: %s", shareURL(link.Id))
+	notifier := getNotifier()
+	for _, c := range getEmergencyContacts(userName) {
+		if err := notifier.Notify(c, msg); err != nil {
+			fmt.Println("ERROR in raiseSOS: could not notify contact of:", userName, " alert:", alert.Id, " err:", err)
+			alert.Failed = append(alert.Failed, c)
+		} else {
+			alert.Notified = append(alert.Notified, c)
+		}
+	}
+	if err = storePutJSON(bucketSOSAlerts, alert.Id, alert); err != nil {
+		return "", err
+	}
+	fmt.Println(clockNow(), "\t", "SOS", "\t", userName, "\t", alert.Id)
+	return fmt.Sprintf("sos,%s,%d,%s", alert.Id, len(alert.Notified), shareURL(link.Id)), nil
+}
+
+//flagTrip marks the active trip between the two with the SOS alert, for the ops team.
+func flagTrip(rider string, driver string, alertId string) (*Trip, error) {
+	gActiveTripsLock.Lock()
+	defer gActiveTripsLock.Unlock()
+	tripId, ok := gActiveTrips[tripPairKey(rider, driver)]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("No active trip between %s and %s", rider, driver))
+	}
+	trip, err := getTrip(tripId)
+	if err != nil {
+		return nil, err
+	}
+	trip.SOS = append(trip.SOS, alertId)
+	if err = saveTrip(trip); err != nil {
+		return nil, err
+	}
+	return trip, nil
+}
+
+//getSOSAlerts returns the alerts, newest first. Resolved ones only if asked for.
+func getSOSAlerts(withResolved bool) ([]*sosAlert, error) {
+	vals, err := getStore().List(bucketSOSAlerts, "")
+	if err != nil {
+		return nil, err
+	}
+	out := make([]*sosAlert, 0)
+	for _, v := range vals {
+		a := &sosAlert{}
+		if err = json.Unmarshal(v, a); err != nil {
+			return nil, err
+		}
+		if withResolved || a.Resolved == 0 {
+			out = append(out, a)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time > out[j].Time })
+	return out, nil
+}
+
+func resolveSOS(actor string, alertId string) error {
+	gSafetyLock.Lock()
+	defer gSafetyLock.Unlock()
+	a := &sosAlert{}
+	if err := storeGetJSON(bucketSOSAlerts, alertId, a); err != nil || !canSeeTenant(actor, tenantOf(a.User)) {
+		return errors.New(fmt.Sprintf("No such alert:%s", alertId))
+	}
+	if a.Resolved != 0 {
+		return errors.New(fmt.Sprintf("Already resolved by %s", a.Resolver))
+	}
+	a.Resolved = clockNow().Unix()
+	a.Resolver = actor
+	return storePutJSON(bucketSOSAlerts, alertId, a)
+}
+
+type shareLink struct {
+	Id      string `json:"id"` //Anyone with the link sees where the user is, so a secret. See randSecret
+	User    string `json:"user"`
+	Created int64  `json:"created"`
+	Expires int64  `json:"expires"`
+}
+
+func createShareLink(userName string, ttl time.Duration) (*shareLink, error) {
+	if ttl <= 0 || ttl > SHARE_LINK_MAX_TTL {
+		return nil, errors.New(fmt.Sprintf("Share links last up to %d minutes", int(SHARE_LINK_MAX_TTL.Minutes())))
+	}
+	now := clockNow()
+	link := &shareLink{Id: randSecret(), User: userName, Created: now.Unix(), Expires: now.Add(ttl).Unix()}
+	if err := storePutJSON(bucketShareLinks, link.Id, link); err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+//revokeShareLink ends a link early. Only the one who made it can.
+func revokeShareLink(userName string, id string) (string, error) {
+	link := &shareLink{}
+	if err := storeGetJSON(bucketShareLinks, id, link); err != nil || link.User != userName {
+		return "", errors.New(fmt.Sprintf("No such share link:%s", id))
+	}
+	if err := getStore().Delete(bucketShareLinks, id); err != nil {
+		return "", err
+	}
+	return "Success! Share link revoked", nil
+}
+
+//sharedPosition is what a share link shows. Exact, unlike what other users see (see privacy.go), since the
+//user chose to share it.
+type sharedPosition struct {
+	User       string  `json:"user"`
+	Lat        float64 `json:"lat"`
+	Lng        float64 `json:"lng"`
+	LastUpdate int64   `json:"lastupdate"`
+	Trip       *Trip   `json:"trip,omitempty"` //The active trip, if on one
+	Expires    int64   `json:"expires"`
+}
+
+func getSharedPosition(id string) (*sharedPosition, error) {
+	link := &shareLink{}
+	if err := storeGetJSON(bucketShareLinks, id, link); err != nil || clockNow().Unix() >= link.Expires {
+		return nil, errors.New("This link has expired")
+	}
+	gStateLock.RLock()
+	pos, ok := positionOf(link.User)
+	var connected []string
+	isDriver := false
+	if ok {
+		connected = append(connected, gStateDS[link.User].arrConnectedWith...)
+		isDriver = gStateDS[link.User].driverOrRider == DRIVER_STATE
+	}
+	gStateLock.RUnlock()
+	if !ok {
+		return nil, errors.New("Location not available")
+	}
+	out := &sharedPosition{User: link.User, Lat: pos.Lat, Lng: pos.Lng, LastUpdate: pos.LastUpdate, Expires: link.Expires}
+	//A rider has one driver. A driver with several riders shares the trip with the first.
+	if len(connected) > 0 {
+		rider, driver := link.User, connected[0]
+		if isDriver {
+			rider, driver = connected[0], link.User
+		}
+		out.Trip, _ = getActiveTrip(rider, driver)
+	}
+	return out, nil
+}
+
+func processSafetyRequest(userName string, token string, action string, contacts string, minutes string,
+	id string) (string, error) {
+	if _, err := isUserValid(userName, token); err != nil {
+		return "", err
+	}
+	switch action {
+	case "contacts":
+		return setEmergencyContacts(userName, contacts)
+	case "getcontacts":
+		return fmt.Sprintf("contacts,%s", strings.Join(getEmergencyContacts(userName), ",")), nil
+	case "share":
+		ttl := SHARE_LINK_TTL
+		if minutes != "" {
+			m, err := strconv.Atoi(minutes)
+			if err != nil {
+				return "", errors.New(fmt.Sprintf("ERROR in minutes parameter:%s", minutes))
+			}
+			ttl = time.Duration(m) * time.Minute
+		}
+		link, err := createShareLink(userName, ttl)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("share,%s,%s,%d", link.Id, shareURL(link.Id), link.Expires), nil
+	case "unshare":
+		return revokeShareLink(userName, id)
+	}
+	return "", errors.New(fmt.Sprintf("ERROR in action parameter:%s", action))
+}
+
+//Function SafetyHandler manages emergency contacts and share links. Params are user, token and action:
+//contacts (contacts=comma separated phones, empty to clear), getcontacts, share (minutes, optional) and
+//unshare (id). The SOS itself is an event, see updateState.
+func SafetyHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	user := q.Get("user")
+	retValue, err := processSafetyRequest(user, q.Get("token"), q.Get("action"), q.Get("contacts"),
+		q.Get("minutes"), q.Get("id"))
+	if err != nil {
+		fmt.Fprint(w, "ERROR! :", err)
+	} else {
+		fmt.Fprint(w, retValue)
+	}
+	//No query here. It has the phone numbers in it.
+	fmt.Println(clockNow(), "\t", user, "\t", r.RemoteAddr, "\t", "safety", "\t", q.Get("action"), "\t", err)
+}
+
+//Function ShareHandler shows the position behind a share link as json. Param is id. No login, the link is
+//the key.
+func ShareHandler(w http.ResponseWriter, r *http.Request) {
+	pos, err := getSharedPosition(r.URL.Query().Get("id"))
+	if err == nil {
+		var data []byte
+		if data, err = json.Marshal(pos); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(data)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprint(w, "ERROR! :", err)
+}
+
+//Function SOSAdminHandler lists SOS alerts, newest first, and resolves them. Params are action (list/resolve),
+//all=1 to list resolved ones too and id. Admins and support only; staff of a tenant see its users' alerts.
+func SOSAdminHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := isTenantStaffRequest(r, ROLE_ADMIN, ROLE_SUPPORT)
+	if !ok {
+		rejectStaffRequest(w, ROLE_ADMIN, ROLE_SUPPORT)
+		return
+	}
+	q := r.URL.Query()
+	var err error
+	switch q.Get("action") {
+	case "list", "":
+		var alerts []*sosAlert
+		if alerts, err = getSOSAlerts(q.Get("all") == "1"); err == nil {
+			visible := make([]*sosAlert, 0, len(alerts))
+			for _, a := range alerts {
+				if canSeeTenant(actor, tenantOf(a.User)) {
+					visible = append(visible, a)
+				}
+			}
+			err = json.NewEncoder(w).Encode(visible)
+		}
+	case "resolve":
+		if err = resolveSOS(actor, q.Get("id")); err == nil {
+			fmt.Fprint(w, "Success! Resolved ", q.Get("id"))
+		}
+	default:
+		err = errors.New(fmt.Sprintf("ERROR in action parameter:%s", q.Get("action")))
+	}
+	if err != nil {
+		fmt.Fprint(w, "ERROR! :", err)
+	}
+	fmt.Println(clockNow(), "\t", actor, "\t", r.RemoteAddr, "\t", "sos", "\t", q.Get("action"), "\t", q.Get("id"), "\t", err)
+}
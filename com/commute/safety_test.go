@@ -0,0 +1,251 @@
+package commute
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSafety() (*FakeNotifier, *FakeClock, func()) {
+	Initialize()
+	notifier := NewFakeNotifier()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC))
+	prevNotifier := SetNotifier(notifier)
+	prevClock := SetClock(clock)
+	SetShareBaseURL("https://example.com/commute/share")
+	return notifier, clock, func() {
+		SetNotifier(prevNotifier)
+		SetClock(prevClock)
+	}
+}
+
+func TestEmergencyContacts(t *testing.T) {
+	_, _, done := newTestSafety()
+	defer done()
+	token := newUser("rider1", 12.884800, 77.551600, RIDER_STATE)
+
+	cases := []struct {
+		contacts string
+		expected string
+	}{
+		{"+91 98765-43210,+919876543211", "+919876543210,+919876543211"},
+		{"+919876543210,+919876543210", "+919876543210"}, //Once each
+		{"12345", "+919876543210"},                       //Bad number leaves the old ones
+		{"+911111111111,+912222222222,+913333333333,+914444444444,+915555555555,+916666666666", "+919876543210"},
+		{"", ""},
+	}
+	for idx, c := range cases {
+		processSafetyRequest("rider1", token, "contacts", c.contacts, "", "")
+		got, _ := processSafetyRequest("rider1", token, "getcontacts", "", "", "")
+		if got != "contacts,"+c.expected {
+			t.Errorf("test case #%d: got %s, expected %s", idx, got, c.expected)
+		}
+	}
+	if _, err := processSafetyRequest("rider1", "badtoken", "getcontacts", "", "", ""); err == nil {
+		t.Errorf("contacts without a valid token")
+	}
+}
+
+func TestSOS(t *testing.T) {
+	notifier, clock, done := newTestSafety()
+	defer done()
+	riderToken := newUser("rider1", 12.884800, 77.551600, RIDER_STATE)
+	driverToken := newUser("driver1", 12.884733, 77.551541, DRIVER_STATE)
+	setEmergencyContacts("rider1", "+919876543210,+919876543211")
+	updateState("rider1", 12.884800, 77.551600, riderToken, RIDER_STATE, "driver1", EVENT_JOINREQ)
+	updateState("driver1", 12.884733, 77.551541, driverToken, DRIVER_STATE, "rider1", EVENT_JOINACCEPT)
+	updateState("driver1", 12.890000, 77.560000, driverToken, DRIVER_STATE, "", EVENT_HEARTBEAT)
+
+	ret, err := updateState("rider1", 12.891000, 77.561000, riderToken, RIDER_STATE, "", EVENT_SOS)
+	if err != nil {
+		t.Fatalf("sos failed:%s", err.Error())
+	}
+	parts := strings.Split(ret, ",")
+	if len(parts) != 4 || parts[0] != "sos" || parts[2] != "2" {
+		t.Fatalf("wrong sos response:%s", ret)
+	}
+	msgs := notifier.Messages("+919876543211")
+	if len(msgs) != 1 || !strings.Contains(msgs[0], "12.891000,77.561000") || !strings.Contains(msgs[0], "driver1") ||
+		!strings.Contains(msgs[0], parts[3]) || !strings.HasPrefix(parts[3], "https://example.com/commute/share?id=") {
+		t.Errorf("wrong message:%v", msgs)
+	}
+
+	alerts, _ := getSOSAlerts(false)
+	if len(alerts) != 1 || alerts[0].Id != parts[1] || len(alerts[0].With) != 1 ||
+		alerts[0].With[0].Lat != 12.890000 || len(alerts[0].Trips) != 1 {
+		t.Fatalf("wrong alert:%+v", alerts)
+	}
+	trip, _ := getActiveTrip("rider1", "driver1")
+	if len(trip.SOS) != 1 || trip.SOS[0] != parts[1] {
+		t.Errorf("trip not flagged:%+v", trip)
+	}
+
+	//Pressing again straight away does not tell them again
+	clock.Advance(10 * time.Second)
+	again, _ := updateState("rider1", 12.891000, 77.561000, riderToken, RIDER_STATE, "", EVENT_SOS)
+	if again != ret || len(notifier.Messages("+919876543211")) != 1 {
+		t.Errorf("repeat sos notified again:%s", again)
+	}
+
+	//A down notifier still gets the alert to ops
+	clock.Advance(SOS_REPEAT_GAP)
+	notifier.Fail = true
+	ret, err = updateState("rider1", 12.891000, 77.561000, riderToken, RIDER_STATE, "", EVENT_SOS)
+	if err != nil || !strings.HasPrefix(ret, "sos,") {
+		t.Errorf("sos with notifier down failed:%s %v", ret, err)
+	}
+	alerts, _ = getSOSAlerts(false)
+	if len(alerts) != 2 || len(alerts[0].Failed) != 2 || len(alerts[0].Notified) != 0 {
+		t.Errorf("wrong alerts:%+v", alerts)
+	}
+}
+
+func TestSOSAdmin(t *testing.T) {
+	_, _, done := newTestSafety()
+	defer done()
+	token := newUser("rider1", 12.884800, 77.551600, RIDER_STATE)
+	ret, _ := updateState("rider1", 12.884800, 77.551600, token, RIDER_STATE, "", EVENT_SOS)
+	id := strings.Split(ret, ",")[1]
+
+	admin := func(query string, remote string) string {
+		r := httptest.NewRequest("GET", "/commute/admin/sos?"+query, nil)
+		r.RemoteAddr = remote
+		resp := httptest.NewRecorder()
+		SOSAdminHandler(resp, r)
+		return resp.Body.String()
+	}
+	cases := []struct {
+		query    string
+		remote   string
+		expected string
+	}{
+		{"action=list", "1.2.3.4:5555", "ERROR!"},
+		{"action=list", "127.0.0.1:5555", `[{"id":"` + id},
+		{"action=resolve&id=" + id, "127.0.0.1:5555", "Success!"},
+		{"action=resolve&id=" + id, "127.0.0.1:5555", "ERROR!"},
+		{"action=list", "127.0.0.1:5555", "[]"},
+		{"action=list&all=1", "127.0.0.1:5555", `[{"id":"` + id},
+	}
+	for idx, c := range cases {
+		if got := admin(c.query, c.remote); !strings.HasPrefix(got, c.expected) {
+			t.Errorf("test case #%d: got %s, expected %s", idx, got, c.expected)
+		}
+	}
+}
+
+func TestShareLink(t *testing.T) {
+	_, clock, done := newTestSafety()
+	defer done()
+	riderToken := newUser("rider1", 12.884800, 77.551600, RIDER_STATE)
+	driverToken := newUser("driver1", 12.884733, 77.551541, DRIVER_STATE)
+
+	cases := []struct {
+		minutes  string
+		expected bool
+	}{
+		{"", true},
+		{"30", true},
+		{"0", false},
+		{"721", false},
+		{"soon", false},
+	}
+	for idx, c := range cases {
+		_, err := processSafetyRequest("rider1", riderToken, "share", "", c.minutes, "")
+		if (err == nil) != c.expected {
+			t.Errorf("test case #%d: err = %v", idx, err)
+		}
+	}
+
+	ret, _ := processSafetyRequest("rider1", riderToken, "share", "", "30", "")
+	id := strings.Split(ret, ",")[1]
+	if len(id) != 32 {
+		t.Errorf("guessable share link:%s", id)
+	}
+	get := func() (int, *sharedPosition) {
+		r := httptest.NewRequest("GET", "/commute/share?id="+id, nil)
+		resp := httptest.NewRecorder()
+		ShareHandler(resp, r)
+		pos := &sharedPosition{}
+		json.Unmarshal(resp.Body.Bytes(), pos)
+		return resp.Code, pos
+	}
+
+	updateState("rider1", 12.884800, 77.551600, riderToken, RIDER_STATE, "driver1", EVENT_JOINREQ)
+	updateState("driver1", 12.884733, 77.551541, driverToken, DRIVER_STATE, "rider1", EVENT_JOINACCEPT)
+	updateState("rider1", 12.886000, 77.553000, riderToken, RIDER_STATE, "", EVENT_HEARTBEAT)
+	if code, pos := get(); code != 200 || pos.Lat != 12.886000 || pos.Trip == nil || pos.Trip.Driver != "driver1" {
+		t.Errorf("wrong shared position:%d %+v", code, pos)
+	}
+
+	//Someone else cannot take it down, the owner can
+	if _, err := processSafetyRequest("driver1", driverToken, "unshare", "", "", id); err == nil {
+		t.Errorf("someone else revoked the link")
+	}
+	clock.Advance(31 * time.Minute)
+	if code, _ := get(); code != 404 {
+		t.Errorf("expired link works:%d", code)
+	}
+	ret, _ = processSafetyRequest("rider1", riderToken, "share", "", "", "")
+	id = strings.Split(ret, ",")[1]
+	processSafetyRequest("rider1", riderToken, "unshare", "", "", id)
+	if code, _ := get(); code != 404 {
+		t.Errorf("revoked link works:%d", code)
+	}
+}
+
+//Wherever they are, and whatever they send, an SOS goes through.
+func TestSOSAnywhere(t *testing.T) {
+	notifier, clock, done := newTestSafety()
+	defer done()
+	serviceFile, noPickupFile := writeGeoFiles(t)
+	defer os.RemoveAll(filepath.Dir(serviceFile))
+	LoadGeofences(serviceFile, noPickupFile)
+	riderToken := newUser("rider1", 12.884800, 77.551600, RIDER_STATE)
+	rider2Token := newUser("rider2", 12.884800, 77.551600, RIDER_STATE)
+	setEmergencyContacts("rider1", "+919876543210")
+	setEmergencyContacts("rider2", "+919876543211")
+
+	//Driven out of the service area
+	ret, err := updateState("rider1", 14.500000, 78.500000, riderToken, RIDER_STATE, "", EVENT_SOS)
+	if err != nil || !strings.HasPrefix(ret, "sos,") {
+		t.Fatalf("sos from outside the service area failed:%s %v", ret, err)
+	}
+	if msgs := notifier.Messages("+919876543210"); len(msgs) != 1 || !strings.Contains(msgs[0], "14.500000,78.500000") {
+		t.Errorf("wrong message:%v", msgs)
+	}
+	//Heartbeats from there are still turned away
+	if _, err = updateState("rider1", 14.500000, 78.500000, riderToken, RIDER_STATE, "", EVENT_HEARTBEAT); err == nil {
+		t.Errorf("heartbeat from outside the service area went through")
+	}
+
+	//No location at all, from the app
+	clock.Advance(SOS_REPEAT_GAP)
+	q, _ := url.ParseQuery("user=rider2&mode=2&eventtype=sos&token=" + rider2Token)
+	ret, err = processQuery(q, "okhttp")
+	if err != nil || !strings.HasPrefix(ret, "sos,") {
+		t.Fatalf("sos without a location failed:%s %v", ret, err)
+	}
+	if msgs := notifier.Messages("+919876543211"); len(msgs) != 1 || !strings.Contains(msgs[0], "12.884800,77.551600") {
+		t.Errorf("not the last known location:%v", msgs)
+	}
+}
+
+//Two people in trouble in the same second get an alert each.
+func TestSOSSameTime(t *testing.T) {
+	_, _, done := newTestSafety()
+	defer done()
+	token1 := newUser("rider1", 12.884800, 77.551600, RIDER_STATE)
+	token2 := newUser("rider2", 12.891000, 77.561000, RIDER_STATE)
+	updateState("rider1", 12.884800, 77.551600, token1, RIDER_STATE, "", EVENT_SOS)
+	updateState("rider2", 12.891000, 77.561000, token2, RIDER_STATE, "", EVENT_SOS)
+
+	alerts, _ := getSOSAlerts(false)
+	if len(alerts) != 2 || alerts[0].Id == alerts[1].Id || alerts[0].User == alerts[1].User {
+		t.Errorf("alerts lost:%+v", alerts)
+	}
+}
@@ -0,0 +1,491 @@
+package commute
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Plans are recurring commutes published ahead of time. Drivers offer seats, riders ask for them.
+const PLAN_MAX_WALK_METRES = 1000 //Max distance of rider's start/end from the driver's route
+const PLAN_MAX_FLEX_MINUTES = 60
+const PLAN_MAX_SEATS = 6
+const PLAN_REMINDER_LEAD = 15 * time.Minute //Reminder goes out this long before departure
+const PLAN_JOIN_GRACE = 15 * time.Minute    //Keep trying to link the two this long after departure
+
+//Status of a match between a driver plan and a rider plan on a date
+const MATCH_PENDING = 1   //Matched, departure not yet here
+const MATCH_CONFIRMED = 2 //Departure came and the two were joined
+const MATCH_MISSED = 3    //Departure came and went, but they could not be joined (not logged in etc)
+
+//Store buckets used by schedules
+const bucketPlans = "plans"             //planId -> commutePlan
+const bucketPlanMatches = "planmatches" //date/driverPlanId/riderPlanId -> planMatch
+
+//commutePlan is a recurring offer (driver) or request (rider).
+type commutePlan struct {
+	Id      string  `json:"id"`
+	User    string  `json:"user"`
+	Role    int     `json:"role"`   //DRIVER_STATE or RIDER_STATE
+	Days    int     `json:"days"`   //Bitmask, bit 0 is Sunday as in time.Weekday
+	Minute  int     `json:"minute"` //Departure, minutes since midnight
+	Flex    int     `json:"flex"`   //Minutes either side the user is ok with
+	FromLat float64 `json:"fromlat"`
+	FromLng float64 `json:"fromlng"`
+	ToLat   float64 `json:"tolat"`
+	ToLng   float64 `json:"tolng"`
+	Seats   int     `json:"seats"`   //Drivers only
+	Created int64   `json:"created"` //Nanoseconds, so that plans in the same second still have an order
+}
+
+//planMatch pairs a driver plan with a rider plan for one date.
+type planMatch struct {
+	Date         string `json:"date"` //yyyy-mm-dd in gScheduleLocation
+	DriverPlanId string `json:"driverplan"`
+	RiderPlanId  string `json:"riderplan"`
+	Driver       string `json:"driver"`
+	Rider        string `json:"rider"`
+	Depart       int64  `json:"depart"` //Unix time of the driver's departure
+	Status       int    `json:"status"`
+	Reminded     bool   `json:"reminded"`
+}
+
+//Times in plans are local times. Defaults to the box's timezone.
+var gScheduleLocation = time.Local
+var gScheduleLock = sync.Mutex{}
+var gPlanCounter int64 = 0
+
+//Reminders waiting to be picked up by the user.
+var gReminders map[string][]string
+
+func resetSchedules() {
+	gScheduleLock.Lock()
+	defer gScheduleLock.Unlock()
+	gReminders = make(map[string][]string)
+}
+
+//SetScheduleLocation sets the timezone plan times are in.
+func SetScheduleLocation(loc *time.Location) {
+	gScheduleLock.Lock()
+	defer gScheduleLock.Unlock()
+	gScheduleLocation = loc
+}
+
+var dayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+//Parses "mon,wed,fri", "weekdays", "weekends" or "daily" into a bitmask.
+func parseDays(s string) (int, error) {
+	switch s {
+	case "weekdays":
+		return 0x3e, nil
+	case "weekends":
+		return 0x41, nil
+	case "daily":
+		return 0x7f, nil
+	}
+	days := 0
+	for _, d := range strings.Split(s, ",") {
+		found := false
+		for idx, name := range dayNames {
+			if strings.ToLower(strings.TrimSpace(d)) == name {
+				days |= 1 << uint(idx)
+				found = true
+			}
+		}
+		if !found {
+			return 0, errors.New(fmt.Sprintf("ERROR in days parameter:%s", s))
+		}
+	}
+	return days, nil
+}
+
+//Parses "08:45" into minutes since midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("ERROR in time parameter:%s", s))
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (p *commutePlan) runsOn(day time.Weekday) bool {
+	return p.Days&(1<<uint(day)) != 0
+}
+
+//addPlan validates and saves a plan.
+func addPlan(p *commutePlan) (*commutePlan, error) {
+	if p.Role != DRIVER_STATE && p.Role != RIDER_STATE {
+		return nil, errors.New(fmt.Sprintf("Invalid role:%d", p.Role))
+	}
+	if p.Days <= 0 || p.Days > 0x7f {
+		return nil, errors.New("A plan needs at least one day")
+	}
+	if p.Minute < 0 || p.Minute >= 24*60 || p.Flex < 0 || p.Flex > PLAN_MAX_FLEX_MINUTES {
+		return nil, errors.New(fmt.Sprintf("Invalid time:%d or flex:%d", p.Minute, p.Flex))
+	}
+	if p.Role == DRIVER_STATE && (p.Seats <= 0 || p.Seats > PLAN_MAX_SEATS) {
+		return nil, errors.New(fmt.Sprintf("Invalid seats:%d", p.Seats))
+	}
+	if p.Role == RIDER_STATE {
+		p.Seats = 0
+	}
+	p.Id = fmt.Sprintf("P%d-%d", clockNow().Unix(), atomic.AddInt64(&gPlanCounter, 1))
+	p.Created = clockNow().UnixNano()
+	if err := storePutJSON(bucketPlans, p.Id, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func getPlans() ([]*commutePlan, error) {
+	vals, err := getStore().List(bucketPlans, "")
+	if err != nil {
+		return nil, err
+	}
+	plans := make([]*commutePlan, 0, len(vals))
+	for _, v := range vals {
+		p := &commutePlan{}
+		if err = json.Unmarshal(v, p); err != nil {
+			return nil, err
+		}
+		plans = append(plans, p)
+	}
+	return plans, nil
+}
+
+func getMatches(datePrefix string) ([]*planMatch, error) {
+	vals, err := getStore().List(bucketPlanMatches, datePrefix)
+	if err != nil {
+		return nil, err
+	}
+	matches := make([]*planMatch, 0, len(vals))
+	for _, v := range vals {
+		m := &planMatch{}
+		if err = json.Unmarshal(v, m); err != nil {
+			return nil, err
+		}
+		matches = append(matches, m)
+	}
+	return matches, nil
+}
+
+func matchKey(m *planMatch) string {
+	return m.Date + "/" + m.DriverPlanId + "/" + m.RiderPlanId
+}
+
+//cancelPlan removes the user's plan and any pending matches it has.
+func cancelPlan(userName string, planId string) (string, error) {
+	gScheduleLock.Lock()
+	defer gScheduleLock.Unlock()
+
+	p := &commutePlan{}
+	if err := storeGetJSON(bucketPlans, planId, p); err != nil || p.User != userName {
+		return "", errors.New(fmt.Sprintf("Error while cancelling : plan %s does not exist!", planId))
+	}
+	matches, err := getMatches("")
+	if err != nil {
+		return "", err
+	}
+	for _, m := range matches {
+		if m.Status == MATCH_PENDING && (m.DriverPlanId == planId || m.RiderPlanId == planId) {
+			getStore().Delete(bucketPlanMatches, matchKey(m))
+		}
+	}
+	if err = getStore().Delete(bucketPlans, planId); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Success! Cancelled plan %s", planId), nil
+}
+
+//Local flat projection around origin, in metres. Good enough over the length of a commute.
+func toLocalXY(origin Point, p Point) (float64, float64) {
+	x := (p.Lon - origin.Lon) * metresPerDegreeLat * math.Cos(origin.Lat*math.Pi/180)
+	y := (p.Lat - origin.Lat) * metresPerDegreeLat
+	return x, y
+}
+
+//Distance of p from the segment a-b, and how far along the segment (0 to 1) the closest point is.
+func distanceToSegment(a Point, b Point, p Point) (float64, float64) {
+	bx, by := toLocalXY(a, b)
+	px, py := toLocalXY(a, p)
+	lenSq := bx*bx + by*by
+	t := 0.0
+	if lenSq > 0 {
+		t = math.Max(0, math.Min(1, (px*bx+py*by)/lenSq))
+	}
+	dx, dy := px-t*bx, py-t*by
+	return math.Sqrt(dx*dx + dy*dy), t
+}
+
+//routeCompatible is true if the rider's start and end are both near the driver's route, in the same direction.
+//Returns how far off the route the rider is, to rank drivers.
+func routeCompatible(driver *commutePlan, rider *commutePlan) (bool, float64) {
+	a := Point{Lat: driver.FromLat, Lon: driver.FromLng}
+	b := Point{Lat: driver.ToLat, Lon: driver.ToLng}
+	pickupDist, pickupT := distanceToSegment(a, b, Point{Lat: rider.FromLat, Lon: rider.FromLng})
+	dropDist, dropT := distanceToSegment(a, b, Point{Lat: rider.ToLat, Lon: rider.ToLng})
+	if pickupDist > PLAN_MAX_WALK_METRES || dropDist > PLAN_MAX_WALK_METRES || pickupT > dropT {
+		return false, 0
+	}
+	return true, pickupDist + dropDist
+}
+
+//timeCompatible is true if the departure windows overlap. Returns the gap in minutes.
+func timeCompatible(driver *commutePlan, rider *commutePlan) (bool, int) {
+	gap := driver.Minute - rider.Minute
+	if gap < 0 {
+		gap = -gap
+	}
+	return gap <= driver.Flex+rider.Flex, gap
+}
+
+//matchPlansForDate pairs every unmatched rider plan running on that date with the best driver plan that still
+//has seats. Best is the smallest time gap, then the least walking. Callers hold gScheduleLock.
+func matchPlansForDate(date time.Time) ([]*planMatch, error) {
+	dateStr := date.Format("2006-01-02")
+	plans, err := getPlans()
+	if err != nil {
+		return nil, err
+	}
+	existing, err := getMatches(dateStr + "/")
+	if err != nil {
+		return nil, err
+	}
+	seatsTaken := make(map[string]int)
+	riderMatched := make(map[string]bool)
+	for _, m := range existing {
+		seatsTaken[m.DriverPlanId]++
+		riderMatched[m.RiderPlanId] = true
+	}
+
+	drivers := make([]*commutePlan, 0)
+	riders := make([]*commutePlan, 0)
+	for _, p := range plans {
+		if !p.runsOn(date.Weekday()) {
+			continue
+		}
+		if p.Role == DRIVER_STATE {
+			drivers = append(drivers, p)
+		} else if !riderMatched[p.Id] {
+			riders = append(riders, p)
+		}
+	}
+	//First come first served, by when the plan was published.
+	sort.SliceStable(riders, func(i, j int) bool { return riders[i].Created < riders[j].Created })
+
+	newMatches := make([]*planMatch, 0)
+	for _, r := range riders {
+		var best *commutePlan
+		bestGap, bestWalk := 0, 0.0
+		for _, d := range drivers {
+			if d.User == r.User || seatsTaken[d.Id] >= d.Seats || tenantOf(d.User) != tenantOf(r.User) ||
+				isBlockedPair(d.User, r.User) || !orgAllowsPair(d.User, r.User) || !prefsAllowPair(d.User, r.User) {
+				continue
+			}
+			okTime, gap := timeCompatible(d, r)
+			okRoute, walk := routeCompatible(d, r)
+			if !okTime || !okRoute {
+				continue
+			}
+			if best == nil || gap < bestGap || (gap == bestGap && walk < bestWalk) {
+				best, bestGap, bestWalk = d, gap, walk
+			}
+		}
+		if best == nil {
+			continue
+		}
+		depart := time.Date(date.Year(), date.Month(), date.Day(), best.Minute/60, best.Minute%60, 0, 0, date.Location())
+		m := &planMatch{Date: dateStr, DriverPlanId: best.Id, RiderPlanId: r.Id, Driver: best.User, Rider: r.User,
+			Depart: depart.Unix(), Status: MATCH_PENDING}
+		if err = storePutJSON(bucketPlanMatches, matchKey(m), m); err != nil {
+			return nil, err
+		}
+		seatsTaken[best.Id]++
+		newMatches = append(newMatches, m)
+	}
+	return newMatches, nil
+}
+
+//Callers hold gScheduleLock.
+func addReminder(userName string, msg string) {
+	gReminders[userName] = append(gReminders[userName], msg)
+}
+
+//runScheduler matches plans for today and tomorrow, sends reminders for rides coming up and links the two
+//users up when the ride is due. Called every minute by the scheduler loop; now is passed in for tests.
+func runScheduler(now time.Time) error {
+	gScheduleLock.Lock()
+	defer gScheduleLock.Unlock()
+
+	now = now.In(gScheduleLocation)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, gScheduleLocation)
+	for _, d := range []time.Time{today, today.AddDate(0, 0, 1)} {
+		if _, err := matchPlansForDate(d); err != nil {
+			return err
+		}
+	}
+
+	matches, err := getMatches("")
+	if err != nil {
+		return err
+	}
+	for _, m := range matches {
+		if m.Status != MATCH_PENDING {
+			continue
+		}
+		depart := time.Unix(m.Depart, 0)
+		changed := false
+		if !m.Reminded && !now.Before(depart.Add(-PLAN_REMINDER_LEAD)) {
+			when := depart.In(gScheduleLocation).Format("15:04")
+			addReminder(m.Rider, fmt.Sprintf("Your ride with %s is at %s", m.Driver, when))
+			addReminder(m.Driver, fmt.Sprintf("You are picking up %s at %s", m.Rider, when))
+			m.Reminded = true
+			changed = true
+		}
+		if !now.Before(depart) {
+			//Same path as a driver accepting, so geofences, blocks and trip records all apply.
+			if _, err := joinUsers(m.Rider, m.Driver); err == nil {
+				m.Status = MATCH_CONFIRMED
+				changed = true
+			} else if now.After(depart.Add(PLAN_JOIN_GRACE)) {
+				fmt.Println("Scheduler: could not link", m.Rider, m.Driver, "for", m.Date, ":", err)
+				m.Status = MATCH_MISSED
+				changed = true
+			}
+		}
+		if changed {
+			if err = storePutJSON(bucketPlanMatches, matchKey(m), m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//StartScheduler runs the plan matcher every minute, forever. Call once from main.
+func StartScheduler() {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		for range ticker.C {
+			if err := runScheduler(clockNow()); err != nil {
+				fmt.Println("Scheduler: ERROR", err)
+			}
+		}
+	}()
+}
+
+//takeReminders returns and clears the user's pending reminders.
+func takeReminders(userName string) []string {
+	gScheduleLock.Lock()
+	defer gScheduleLock.Unlock()
+	r := gReminders[userName]
+	delete(gReminders, userName)
+	return r
+}
+
+//Plans and matches of the user, as json.
+func listPlans(userName string) (string, error) {
+	gScheduleLock.Lock()
+	defer gScheduleLock.Unlock()
+
+	plans, err := getPlans()
+	if err != nil {
+		return "", err
+	}
+	matches, err := getMatches("")
+	if err != nil {
+		return "", err
+	}
+	out := struct {
+		Plans   []*commutePlan `json:"plans"`
+		Matches []*planMatch   `json:"matches"`
+	}{make([]*commutePlan, 0), make([]*planMatch, 0)}
+	for _, p := range plans {
+		if p.User == userName {
+			out.Plans = append(out.Plans, p)
+		}
+	}
+	for _, m := range matches {
+		if m.Driver == userName || m.Rider == userName {
+			out.Matches = append(out.Matches, m)
+		}
+	}
+	data, err := json.Marshal(out)
+	return string(data), err
+}
+
+//processScheduleRequest parses the params given in the URL and routes to the action.
+func processScheduleRequest(userName string, token string, action string, days string, clock string,
+	flex string, from string, to string, seats string, planId string) (string, error) {
+	if _, err := isUserValid(userName, token); err != nil {
+		return "", err
+	}
+
+	switch action {
+	case "list":
+		return listPlans(userName)
+	case "cancel":
+		return cancelPlan(userName, planId)
+	case "reminders":
+		r := takeReminders(userName)
+		return fmt.Sprintf("reminderspayload,%d%s", len(r), prefixEach(r, ",")), nil
+	case "offer", "request":
+	default:
+		return "", errors.New(fmt.Sprintf("ERROR in action parameter:%s", action))
+	}
+
+	p := &commutePlan{User: userName, Role: RIDER_STATE}
+	if action == "offer" {
+		p.Role = DRIVER_STATE
+	}
+	if !canUseMode(userName, p.Role) {
+		return "", errors.New(fmt.Sprintf("%s is not allowed to be a %s", userName, modeName(p.Role)))
+	}
+	var err error
+	if p.Days, err = parseDays(days); err != nil {
+		return "", err
+	}
+	if p.Minute, err = parseClock(clock); err != nil {
+		return "", err
+	}
+	if p.Flex, err = parseIntParam(flex, 10); err != nil {
+		return "", errors.New(fmt.Sprintf("ERROR in flex parameter:%s", flex))
+	}
+	if p.FromLat, p.FromLng, err = parseLatLng(from); err != nil {
+		return "", errors.New(fmt.Sprintf("ERROR in from parameter:%s", err.Error()))
+	}
+	if p.ToLat, p.ToLng, err = parseLatLng(to); err != nil {
+		return "", errors.New(fmt.Sprintf("ERROR in to parameter:%s", err.Error()))
+	}
+	if p.Seats, err = strconv.Atoi(seats); err != nil && p.Role == DRIVER_STATE {
+		return "", errors.New(fmt.Sprintf("ERROR in seats parameter:%s", seats))
+	}
+	if _, err = addPlan(p); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Success! Plan %s saved", p.Id), nil
+}
+
+//Function ScheduleHandler manages recurring commutes. Params are user, token and action, one of
+//offer (driver) / request (rider) with days, time, flex, from, to and seats; list; cancel with plan; reminders.
+func ScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	user := q.Get("user")
+	retValue, err := processScheduleRequest(user, q.Get("token"), q.Get("action"), q.Get("days"), q.Get("time"),
+		q.Get("flex"), q.Get("from"), q.Get("to"), q.Get("seats"), q.Get("plan"))
+	if err != nil {
+		fmt.Fprint(w, "ERROR! :", err)
+	} else {
+		fmt.Fprint(w, retValue)
+	}
+
+	fmt.Println(clockNow(), "\t", user, "\t", r.RemoteAddr, "\t", r.URL.RawQuery, "\t", err)
+}
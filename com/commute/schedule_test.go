@@ -0,0 +1,190 @@
+package commute
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDays(t *testing.T) {
+	cases := []struct {
+		in      string
+		days    int
+		wantErr bool
+	}{
+		{"weekdays", 0x3e, false},
+		{"weekends", 0x41, false},
+		{"daily", 0x7f, false},
+		{"mon,wed, FRI", 0x2a, false},
+		{"sun", 0x01, false},
+		{"mon,funday", 0, true},
+		{"", 0, true},
+	}
+	for idx, c := range cases {
+		days, err := parseDays(c.in)
+		if (err != nil) != c.wantErr || days != c.days {
+			t.Errorf("test case #%d: parseDays(%s) = %x, %v", idx, c.in, days, err)
+		}
+	}
+}
+
+//HSR Layout to Whitefield, roughly along the outer ring road.
+var planHSR = Point{Lat: 12.9116, Lon: 77.6389}
+var planWhitefield = Point{Lat: 12.9698, Lon: 77.7500}
+
+func TestRouteCompatible(t *testing.T) {
+	driver := &commutePlan{FromLat: planHSR.Lat, FromLng: planHSR.Lon, ToLat: planWhitefield.Lat, ToLng: planWhitefield.Lon}
+	cases := []struct {
+		from, to Point
+		ok       bool
+	}{
+		{planHSR, planWhitefield, true},                                              //Same trip
+		{Point{Lat: 12.9400, Lon: 77.6930}, planWhitefield, true},                    //Gets on half way
+		{Point{Lat: 12.9420, Lon: 77.6930}, Point{Lat: 12.9600, Lon: 77.7300}, true}, //A bit off the road, both ends
+		{planWhitefield, planHSR, false},                                             //Wrong way
+		{Point{Lat: 12.9716, Lon: 77.5946}, planWhitefield, false},                   //From MG Road, too far
+		{planHSR, Point{Lat: 13.0500, Lon: 77.7500}, false},                          //Ends way past
+	}
+	for idx, c := range cases {
+		rider := &commutePlan{FromLat: c.from.Lat, FromLng: c.from.Lon, ToLat: c.to.Lat, ToLng: c.to.Lon}
+		if ok, _ := routeCompatible(driver, rider); ok != c.ok {
+			t.Errorf("test case #%d: routeCompatible = %v, expected %v", idx, ok, c.ok)
+		}
+	}
+}
+
+func TestTimeCompatible(t *testing.T) {
+	cases := []struct {
+		driverMinute, driverFlex, riderMinute, riderFlex int
+		ok                                               bool
+	}{
+		{525, 10, 525, 0, true},
+		{525, 10, 540, 5, true},
+		{525, 10, 541, 5, false},
+		{525, 0, 520, 0, false},
+	}
+	for idx, c := range cases {
+		d := &commutePlan{Minute: c.driverMinute, Flex: c.driverFlex}
+		r := &commutePlan{Minute: c.riderMinute, Flex: c.riderFlex}
+		if ok, _ := timeCompatible(d, r); ok != c.ok {
+			t.Errorf("test case #%d: timeCompatible = %v, expected %v", idx, ok, c.ok)
+		}
+	}
+}
+
+//Driver offers one seat on weekdays, two riders want it. First to ask gets it, gets reminded and gets linked up.
+func TestScheduleMatchAndJoin(t *testing.T) {
+	Initialize()
+	tokenDriver, _ := updateState("driver1", planHSR.Lat, planHSR.Lon, "", DRIVER_STATE, "", EVENT_LOGIN)
+	tokenRider1, _ := updateState("rider1", planHSR.Lat, planHSR.Lon, "", RIDER_STATE, "", EVENT_LOGIN)
+	tokenRider2, _ := updateState("rider2", planHSR.Lat, planHSR.Lon, "", RIDER_STATE, "", EVENT_LOGIN)
+
+	from := "12.9116,77.6389"
+	to := "12.9698,77.7500"
+	if _, err := processScheduleRequest("driver1", tokenDriver, "offer", "weekdays", "08:45", "10", from, to, "1", ""); err != nil {
+		t.Fatalf("offer failed:%s", err.Error())
+	}
+	if _, err := processScheduleRequest("rider1", tokenRider1, "request", "mon,tue", "08:40", "10", from, to, "", ""); err != nil {
+		t.Fatalf("request failed:%s", err.Error())
+	}
+	if _, err := processScheduleRequest("rider2", tokenRider2, "request", "mon", "08:50", "10", from, to, "", ""); err != nil {
+		t.Fatalf("request failed:%s", err.Error())
+	}
+	if _, err := processScheduleRequest("rider2", tokenRider2, "request", "mon", "8.50", "10", from, to, "", ""); err == nil {
+		t.Errorf("bad time did not fail")
+	}
+
+	monday := time.Date(2026, 10, 19, 0, 0, 0, 0, gScheduleLocation)
+	if monday.Weekday() != time.Monday {
+		t.Fatalf("test date is not a monday:%s", monday.Weekday())
+	}
+	at := func(hh int, mm int) time.Time {
+		return monday.Add(time.Duration(hh)*time.Hour + time.Duration(mm)*time.Minute)
+	}
+
+	//Matched early, but nothing sent yet
+	if err := runScheduler(at(7, 0)); err != nil {
+		t.Fatalf("scheduler failed:%s", err.Error())
+	}
+	matches, _ := getMatches(monday.Format("2006-01-02") + "/")
+	if len(matches) != 1 || matches[0].Rider != "rider1" || matches[0].Driver != "driver1" {
+		t.Fatalf("wrong matches:%v", matches)
+	}
+	if r := takeReminders("rider1"); len(r) != 0 {
+		t.Errorf("reminder sent too early:%v", r)
+	}
+
+	//Reminder goes out once
+	runScheduler(at(8, 31))
+	runScheduler(at(8, 32))
+	retStr, _ := processScheduleRequest("rider1", tokenRider1, "reminders", "", "", "", "", "", "", "")
+	if retStr != "reminderspayload,1,Your ride with driver1 is at 08:45" {
+		t.Errorf("wrong rider reminders:%s", retStr)
+	}
+	if r := takeReminders("driver1"); len(r) != 1 || !strings.Contains(r[0], "rider1") {
+		t.Errorf("wrong driver reminders:%v", r)
+	}
+	if r := takeReminders("rider2"); len(r) != 0 {
+		t.Errorf("unmatched rider got a reminder:%v", r)
+	}
+
+	//Linked up when it is time
+	runScheduler(at(8, 45))
+	if s := getCurrentState("rider1"); len(s.arrConnectedWith) != 1 || s.arrConnectedWith[0] != "driver1" {
+		t.Errorf("rider not connected to driver:%v", s.arrConnectedWith)
+	}
+	if _, err := getActiveTrip("rider1", "driver1"); err != nil {
+		t.Errorf("no trip started for scheduled ride:%s", err.Error())
+	}
+	matches, _ = getMatches(monday.Format("2006-01-02") + "/")
+	if matches[0].Status != MATCH_CONFIRMED {
+		t.Errorf("match not confirmed. status:%d", matches[0].Status)
+	}
+
+	//Tuesday: rider1 gets matched again, rider2 does not travel then
+	tuesday := monday.AddDate(0, 0, 1)
+	matches, _ = getMatches(tuesday.Format("2006-01-02") + "/")
+	if len(matches) != 1 || matches[0].Rider != "rider1" {
+		t.Errorf("wrong tuesday matches:%v", matches)
+	}
+}
+
+//If the rider never shows up, the match is given up on after the grace period.
+func TestScheduleMissedAndCancel(t *testing.T) {
+	Initialize()
+	driver, _ := addPlan(&commutePlan{User: "driver1", Role: DRIVER_STATE, Days: 0x7f, Minute: 9 * 60, Flex: 0, Seats: 2,
+		FromLat: planHSR.Lat, FromLng: planHSR.Lon, ToLat: planWhitefield.Lat, ToLng: planWhitefield.Lon})
+	rider, _ := addPlan(&commutePlan{User: "rider1", Role: RIDER_STATE, Days: 0x7f, Minute: 9 * 60, Flex: 0,
+		FromLat: planHSR.Lat, FromLng: planHSR.Lon, ToLat: planWhitefield.Lat, ToLng: planWhitefield.Lon})
+	if driver == nil || rider == nil {
+		t.Fatalf("could not add plans")
+	}
+	if _, err := addPlan(&commutePlan{User: "driver2", Role: DRIVER_STATE, Days: 0x7f, Minute: 9 * 60, Seats: 0}); err == nil {
+		t.Errorf("driver plan without seats did not fail")
+	}
+
+	day := time.Date(2026, 10, 19, 0, 0, 0, 0, gScheduleLocation)
+	dateKey := day.Format("2006-01-02") + "/"
+	runScheduler(day.Add(9 * time.Hour))
+	if matches, _ := getMatches(dateKey); len(matches) != 1 || matches[0].Status != MATCH_PENDING {
+		t.Fatalf("expected one pending match:%v", matches)
+	}
+	runScheduler(day.Add(9*time.Hour + PLAN_JOIN_GRACE + time.Minute))
+	if matches, _ := getMatches(dateKey); len(matches) != 1 || matches[0].Status != MATCH_MISSED {
+		t.Errorf("expected a missed match:%v", matches)
+	}
+
+	//Cancelling drops pending matches but keeps history
+	if _, err := cancelPlan("rider1", driver.Id); err == nil {
+		t.Errorf("cancelled someone else's plan")
+	}
+	if _, err := cancelPlan("rider1", rider.Id); err != nil {
+		t.Errorf("cancel failed:%s", err.Error())
+	}
+	if matches, _ := getMatches(dateKey); len(matches) != 1 {
+		t.Errorf("cancel removed a past match:%v", matches)
+	}
+	if matches, _ := getMatches(day.AddDate(0, 0, 1).Format("2006-01-02") + "/"); len(matches) != 0 {
+		t.Errorf("cancel left a pending match:%v", matches)
+	}
+}
@@ -0,0 +1,283 @@
+package commute
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+//A user can be logged in on several devices, each one a session. Every access token names its session. A
+//logout puts the session in a revocation set, which tokens are checked against in memory so that the logout
+//takes effect straight away rather than when the token runs out. The set is kept in the store as well, and
+//every instance picks up the others' logouts within SESSION_REVOKE_SYNC.
+const SESSION_REVOKE_SYNC = 5 * time.Second
+const LOGOUT_ALL = "all" //other param of the logout event, to log out of every device
+
+//Store buckets used by sessions
+const bucketSessions = "sessions"               //user/sessionId -> session
+const bucketRevokedSessions = "revokedsessions" //sessionId -> revokedSession
+
+type session struct {
+	Id        string `json:"id"`
+	User      string `json:"user"`
+	Device    string `json:"device"` //Sent by the app. Empty for old apps, which then count as one device.
+	UserAgent string `json:"useragent"`
+	Role      int    `json:"role"`
+	Created   int64  `json:"created"`
+	LastSeen  int64  `json:"lastseen"`
+	Expires   int64  `json:"expires"` //Pushed out on every refresh
+	Refresh   string `json:"refresh"` //Key of the live refresh token, if any. See tokens.go
+}
+
+//Serializes changes to the sessions of a user, so that two logins from the same device leave one session.
+var gSessionsLock = sync.Mutex{}
+
+type revokedSession struct {
+	Id    string `json:"id"`
+	Until int64  `json:"until"` //No token for the session is live past this, so it can be let go of
+}
+
+var gRevoked map[string]int64     //sessionId -> until
+var gRevokedSynced time.Time      //Last read from the store
+var gSessionSeen map[string]int64 //sessionId -> last seen, newer than what the store has
+var gRevokedLock = sync.Mutex{}
+
+func resetSessions() {
+	gRevokedLock.Lock()
+	defer gRevokedLock.Unlock()
+	gRevoked = make(map[string]int64)
+	gRevokedSynced = time.Time{}
+	gSessionSeen = make(map[string]int64)
+}
+
+//revokeSession makes the tokens for the session no good, here straight away and on the other instances at
+//their next sync.
+func revokeSession(id string) error {
+	rec := revokedSession{Id: id, Until: clockNow().Add(OPEN_LOGIN_TOKEN_TTL).Unix()} //No token lives longer
+	gRevokedLock.Lock()
+	gRevoked[id] = rec.Until
+	delete(gSessionSeen, id)
+	gRevokedLock.Unlock()
+	return storePutJSON(bucketRevokedSessions, id, rec)
+}
+
+//Callers hold gRevokedLock. Picks up the logouts on other instances, and lets go of the ones past caring.
+func syncRevokedLocked(now time.Time) {
+	vals, err := getStore().List(bucketRevokedSessions, "")
+	if err != nil {
+		fmt.Println("ERROR in syncRevokedLocked:", err)
+		return
+	}
+	for _, v := range vals {
+		rec := revokedSession{}
+		if json.Unmarshal(v, &rec) != nil {
+			continue
+		}
+		if now.Unix() >= rec.Until {
+			getStore().Delete(bucketRevokedSessions, rec.Id)
+			delete(gRevoked, rec.Id)
+			continue
+		}
+		gRevoked[rec.Id] = rec.Until
+	}
+	gRevokedSynced = now
+}
+
+func sessionKey(userName string, id string) string {
+	return userName + "/" + id
+}
+
+func getSession(userName string, id string) (*session, error) {
+	s := &session{}
+	if err := storeGetJSON(bucketSessions, sessionKey(userName, id), s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func saveSession(s *session) error {
+	s.LastSeen = lastSeen(s)
+	return storePutJSON(bucketSessions, sessionKey(s.User, s.Id), s)
+}
+
+//Callers hold gSessionsLock.
+func endSessionLocked(s *session) error {
+	if s.Refresh != "" {
+		getStore().Delete(bucketRefreshTokens, s.Refresh)
+	}
+	if err := revokeSession(s.Id); err != nil {
+		return err
+	}
+	return getStore().Delete(bucketSessions, sessionKey(s.User, s.Id))
+}
+
+//Callers hold gSessionsLock. Expired ones are cleaned up on the way.
+func listSessionsLocked(userName string, now time.Time) ([]*session, error) {
+	vals, err := getStore().List(bucketSessions, userName+"/")
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]*session, 0, len(vals))
+	for _, v := range vals {
+		s := &session{}
+		if err = json.Unmarshal(v, s); err != nil {
+			return nil, err
+		}
+		if s.User != userName { //Someone else whose name starts with ours and a slash
+			continue
+		}
+		if now.Unix() >= s.Expires {
+			endSessionLocked(s)
+			continue
+		}
+		s.LastSeen = lastSeen(s)
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+//startSession logs the user in on the device. An older session from the same device is ended.
+func startSession(userName string, role int, device string, userAgent string, ttl time.Duration) (*session, error) {
+	now := clockNow()
+	gSessionsLock.Lock()
+	defer gSessionsLock.Unlock()
+
+	existing, err := listSessionsLocked(userName, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range existing {
+		if s.Device == device {
+			endSessionLocked(s)
+		}
+	}
+	s := &session{Id: randSecret(), User: userName, Device: device, UserAgent: userAgent, Role: role,
+		Created: now.Unix(), LastSeen: now.Unix(), Expires: now.Add(ttl).Unix()}
+	if err = saveSession(s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//checkSession errors out if the session has been logged out. Notes that it was seen. No store on the way,
+//this is on every request. A session that expired has no token left that has not.
+func checkSession(id string) error {
+	now := clockNow()
+	gRevokedLock.Lock()
+	defer gRevokedLock.Unlock()
+	if now.Sub(gRevokedSynced) >= SESSION_REVOKE_SYNC || now.Before(gRevokedSynced) {
+		syncRevokedLocked(now)
+	}
+	if _, ok := gRevoked[id]; ok {
+		return errors.New("logged out")
+	}
+	gSessionSeen[id] = now.Unix()
+	return nil
+}
+
+//lastSeen is when the session was last used, on this instance if since it was saved.
+func lastSeen(s *session) int64 {
+	gRevokedLock.Lock()
+	defer gRevokedLock.Unlock()
+	if seen := gSessionSeen[s.Id]; seen > s.LastSeen {
+		return seen
+	}
+	return s.LastSeen
+}
+
+//logout ends the session named by which: empty for the current one, LOGOUT_ALL for all, else a session id.
+func logout(userName string, currentId string, which string) (string, error) {
+	gSessionsLock.Lock()
+	defer gSessionsLock.Unlock()
+
+	sessions, err := listSessionsLocked(userName, clockNow())
+	if err != nil {
+		return "", err
+	}
+	if which == "" {
+		which = currentId
+	}
+	ended := 0
+	for _, s := range sessions {
+		if which == LOGOUT_ALL || s.Id == which {
+			if err = endSessionLocked(s); err != nil {
+				return "", err
+			}
+			ended++
+		}
+	}
+	if ended == 0 {
+		return "", errors.New(fmt.Sprintf("No such session:%s", which))
+	}
+	return fmt.Sprintf("Success! Logged out of %d devices", ended), nil
+}
+
+//sessionInfo is what the user gets to see of a session.
+type sessionInfo struct {
+	Id        string `json:"id"`
+	Device    string `json:"device"`
+	UserAgent string `json:"useragent"`
+	Created   int64  `json:"created"`
+	LastSeen  int64  `json:"lastseen"`
+	Current   bool   `json:"current"` //The one asking
+}
+
+//Response for the sessions event. Most recently seen first, then newest.
+func sessionsString(userName string, currentId string) (string, error) {
+	gSessionsLock.Lock()
+	sessions, err := listSessionsLocked(userName, clockNow())
+	gSessionsLock.Unlock()
+	if err != nil {
+		return "", err
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].LastSeen != sessions[j].LastSeen {
+			return sessions[i].LastSeen > sessions[j].LastSeen
+		}
+		return sessions[i].Created > sessions[j].Created
+	})
+	out := struct {
+		Sessions []sessionInfo `json:"sessions"`
+	}{make([]sessionInfo, 0, len(sessions))}
+	for _, s := range sessions {
+		out.Sessions = append(out.Sessions, sessionInfo{Id: s.Id, Device: s.Device, UserAgent: s.UserAgent,
+			Created: s.Created, LastSeen: s.LastSeen, Current: s.Id == currentId})
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+//resumeSession is a login by someone who already has a token, from verifying their phone number. Same
+//session, with a new token for the mode they are starting in.
+func resumeSession(userName string, token string, role int, opts requestOptions) (string, error) {
+	claims, err := validateToken(userName, token)
+	if err != nil {
+		return "", err
+	}
+	gSessionsLock.Lock()
+	defer gSessionsLock.Unlock()
+	s, err := getSession(userName, claims.Sid)
+	if err != nil {
+		return "", err
+	}
+	if s.Role != 0 && s.Role != role {
+		audit(userName, userName, "switchmode", fmt.Sprintf("%s->%s on login", modeName(s.Role), modeName(role)))
+	}
+	s.Role = role
+	if opts.device != "" {
+		s.Device = opts.device
+	}
+	if opts.userAgent != "" {
+		s.UserAgent = opts.userAgent
+	}
+	if err = saveSession(s); err != nil {
+		return "", err
+	}
+	return sessionToken(s), nil
+}
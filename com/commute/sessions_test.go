@@ -0,0 +1,186 @@
+package commute
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type sessionsPayload struct {
+	Sessions []sessionInfo `json:"sessions"`
+}
+
+func listSessionsForTest(t *testing.T, userName string, token string) []sessionInfo {
+	retStr, err := updateState(userName, 12.884800, 77.551600, token, RIDER_STATE, "", EVENT_SESSIONS)
+	if err != nil {
+		t.Fatalf("sessions failed:%s", err.Error())
+	}
+	var out sessionsPayload
+	if err = json.Unmarshal([]byte(retStr), &out); err != nil {
+		t.Fatalf("bad sessions payload:%s", retStr)
+	}
+	return out.Sessions
+}
+
+func TestMultiDeviceSessions(t *testing.T) {
+	Initialize()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+
+	login := func(device string, ua string) string {
+		q := url.Values{"user": {"rider1"}, "param": {"12.884800,77.551600"}, "mode": {"2"}, "eventtype": {"login"},
+			"device": {device}}
+		token, err := processQuery(q, ua)
+		if err != nil {
+			t.Fatalf("login from %s failed:%s", device, err.Error())
+		}
+		return token
+	}
+	phone := login("phone", "okhttp/3.9")
+	clock.Advance(time.Hour)
+	tablet := login("tablet", "okhttp/4.0")
+	clock.Advance(time.Hour)
+	oldPhone := phone
+	phone = login("phone", "okhttp/3.9") //Same device again replaces its session
+
+	if _, err := isUserValid("rider1", oldPhone); err == nil {
+		t.Errorf("replaced session still works")
+	}
+	sessions := listSessionsForTest(t, "rider1", tablet)
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %v", sessions)
+	}
+	//Most recently seen first
+	if sessions[0].Device != "phone" || sessions[0].UserAgent != "okhttp/3.9" || sessions[0].Current ||
+		sessions[1].Device != "tablet" || !sessions[1].Current {
+		t.Errorf("wrong sessions:%+v", sessions)
+	}
+
+	//Last seen moves with use, without writing to the store every heartbeat
+	saved, _ := getSession("rider1", sessions[1].Id)
+	clock.Advance(time.Minute)
+	updateState("rider1", 12.884800, 77.551600, tablet, RIDER_STATE, "", EVENT_HEARTBEAT)
+	if s, _ := getSession("rider1", sessions[1].Id); s.LastSeen != saved.LastSeen {
+		t.Errorf("last seen written on a heartbeat")
+	}
+	clock.Advance(time.Minute)
+	if sessions = listSessionsForTest(t, "rider1", tablet); sessions[0].Device != "tablet" ||
+		sessions[0].LastSeen != clock.Now().Unix() {
+		t.Errorf("last seen not updated:%+v", sessions)
+	}
+
+	//Log out of the phone from the tablet
+	if _, err := updateState("rider1", 12.884800, 77.551600, tablet, RIDER_STATE, sessions[1].Id, EVENT_LOGOUT); err != nil {
+		t.Errorf("logout of the phone failed:%s", err.Error())
+	}
+	if _, err := isUserValid("rider1", phone); err == nil {
+		t.Errorf("phone still logged in")
+	}
+	if _, err := isUserValid("rider1", tablet); err != nil {
+		t.Errorf("tablet logged out too")
+	}
+	//Log out of this one
+	if _, err := updateState("rider1", 12.884800, 77.551600, tablet, RIDER_STATE, "", EVENT_LOGOUT); err != nil {
+		t.Errorf("logout failed:%s", err.Error())
+	}
+	if _, err := isUserValid("rider1", tablet); err == nil {
+		t.Errorf("tablet still logged in")
+	}
+}
+
+func TestLogoutAll(t *testing.T) {
+	Initialize()
+	tokens := make([]string, 0)
+	for _, device := range []string{"phone1", "phone2", "phone3"} {
+		token, _ := newDeviceToken("driver1", DRIVER_STATE, device, "")
+		tokens = append(tokens, token)
+	}
+	other := newToken("driver2", DRIVER_STATE)
+	initUserState("driver1", 12.884733, 77.551541, DRIVER_STATE)
+
+	cases := []struct {
+		which    string
+		expected bool
+	}{
+		{"nosuchsession", false},
+		{LOGOUT_ALL, true},
+	}
+	for idx, c := range cases {
+		_, err := updateState("driver1", 12.884733, 77.551541, tokens[0], DRIVER_STATE, c.which, EVENT_LOGOUT)
+		if (err == nil) != c.expected {
+			t.Errorf("test case #%d: err = %v", idx, err)
+		}
+	}
+	for idx, token := range tokens {
+		if _, err := isUserValid("driver1", token); err == nil {
+			t.Errorf("test case #%d: still logged in", idx)
+		}
+	}
+	if _, err := isUserValid("driver2", other); err != nil {
+		t.Errorf("someone else got logged out")
+	}
+}
+
+//A logout on another instance shows up here at the next sync.
+func TestRevocationSync(t *testing.T) {
+	Initialize()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+	token := newToken("rider1", RIDER_STATE)
+	claims, _ := parseAccessToken(token)
+	isUserValid("rider1", token)
+
+	//What the other instance leaves in the store
+	storePutJSON(bucketRevokedSessions, claims.Sid, revokedSession{claims.Sid, clock.Now().Add(time.Hour).Unix()})
+	if _, err := isUserValid("rider1", token); err != nil {
+		t.Errorf("store read on every request")
+	}
+	clock.Advance(SESSION_REVOKE_SYNC)
+	if _, err := isUserValid("rider1", token); err == nil {
+		t.Errorf("logout elsewhere not picked up")
+	}
+	//Let go of once no token can be live
+	clock.Advance(time.Hour)
+	isUserValid("rider1", token)
+	if vals, _ := getStore().List(bucketRevokedSessions, ""); len(vals) != 0 {
+		t.Errorf("revocations kept:%d", len(vals))
+	}
+}
+
+//Refresh tokens die with their session.
+func TestLogoutRevokesRefresh(t *testing.T) {
+	sms, _, done := newTestAuth()
+	defer done()
+
+	sendCode("rider1", "+919876543210")
+	access, refresh, err := verifyCode("rider1", sms.LastCode("+919876543210"), RIDER_STATE, "phone", "okhttp")
+	if err != nil {
+		t.Fatalf("verify failed:%s", err.Error())
+	}
+	if _, err = logout("rider1", "", LOGOUT_ALL); err != nil {
+		t.Errorf("logout failed:%s", err.Error())
+	}
+	if _, err = isUserValid("rider1", access); err == nil {
+		t.Errorf("access token works after logout")
+	}
+	if _, _, err = refreshSession(refresh); err == nil {
+		t.Errorf("refresh token works after logout")
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	Initialize()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+
+	newDeviceToken("rider1", RIDER_STATE, "phone", "")
+	clock.Advance(OPEN_LOGIN_TOKEN_TTL / 2)
+	token, _ := newDeviceToken("rider1", RIDER_STATE, "tablet", "")
+	initUserState("rider1", 12.884800, 77.551600, RIDER_STATE)
+	clock.Advance(OPEN_LOGIN_TOKEN_TTL / 2)
+	sessions := listSessionsForTest(t, "rider1", token)
+	if len(sessions) != 1 || sessions[0].Device != "tablet" {
+		t.Errorf("expired session listed:%+v", sessions)
+	}
+}
@@ -3,11 +3,7 @@ package commute
 import (
 	"errors"
 	"fmt"
-	"math/rand"
-	"os/exec"
-	"strings"
 	"sync"
-	"time"
 )
 
 const DRIVER_STATE = 1
@@ -15,10 +11,18 @@ const RIDER_STATE = 2
 const MAX_WAIT_DISTANCE = 500 //max distance in meters which can be between a driver and commuter.
 const MAX_MATCHED_USERS = 5   //Max users that can be shown for a match.
 //These are the various eventTypes honoured
-const EVENT_LOGIN = 1      //When you start the app
-const EVENT_HEARTBEAT = 2  //Every periodic interval like 30secs based on app settings.
-const EVENT_JOINREQ = 3    //When a rider issues a join req looking at drivers
-const EVENT_JOINACCEPT = 4 //Driver accepts the pending req and connects.
+const EVENT_LOGIN = 1       //When you start the app
+const EVENT_HEARTBEAT = 2   //Every periodic interval like 30secs based on app settings.
+const EVENT_JOINREQ = 3     //When a rider issues a join req looking at drivers
+const EVENT_JOINACCEPT = 4  //Driver accepts the pending req and connects.
+const EVENT_TRIPEND = 5     //Either side ends the trip at drop-off. Disconnects the two.
+const EVENT_BLOCK = 6       //Never show me "other" again, and vice versa.
+const EVENT_UNBLOCK = 7     //Undo a block.
+const EVENT_BLOCKLIST = 8   //Who have I blocked.
+const EVENT_LOGOUT = 9      //Log out of this device, another one ("other" is its session id) or "all".
+const EVENT_SESSIONS = 10   //Where am I logged in.
+const EVENT_SWITCHMODE = 11 //Rider to driver or back. mode is the one to switch to. See roles.go
+const EVENT_SOS = 12        //Help! Tells the emergency contacts and the ops team. See safety.go
 //What state the current commuter is in
 const STATE_LOOKING = 1
 const STATE_NOT_LOOKING = 2
@@ -27,7 +31,7 @@ const STATE_NOT_LOOKING = 2
 //it may be needed to put TTL and other constraints on auth later. Right now, we are using a simple global map.
 //For optimization sake, we may have to have multiple DS's indexed by location.
 var gStateDS map[string]*CommState
-var gLoggedInUsers map[string]string
+var gLoggedInUsers map[string]string //Last token handed out per user. Auth does not look here, see tokens.go
 
 //locks for the above DS. Maybe we should explore sync.map
 var gStateLock = sync.RWMutex{}
@@ -40,7 +44,18 @@ type CommState struct {
 	lng           float64
 	curr_state    int
 	lastUptTime   int64
-	driverOrRider int //Mode of the user.
+	driverOrRider int    //Mode of the user.
+	vehicleType   int    //Only matters for drivers. Decides the fare.
+	tenant        string //From the user name. See tenants.go
+
+	//track is the last few positions, oldest first. See trajectory.go
+	track []trackPoint
+
+	//proposedDriver is the driver the batch matcher picked for this rider, if any. Shown first in search.
+	proposedDriver string
+	//batchReq is set when the batch matcher put the rider's request with proposedDriver, not the rider.
+	//Withdrawn again when the next round proposes someone else.
+	batchReq bool
 
 	//arrReqs is a the pending requests from co-commuters since the last time state was refreshed
 	arrReqs []string
@@ -49,28 +64,38 @@ type CommState struct {
 }
 
 //puts a new user into the token data structures and returns the token for auth
-func newToken(userName string) string {
-	//Sync mess since this can be called from many threads.
-	gLoggedInUsersLock.Lock()
-	defer gLoggedInUsersLock.Unlock()
+func newToken(userName string, role int) string {
+	token, _ := newDeviceToken(userName, role, "", "")
+	return token
+}
 
-	//If user already exists, return as is.
-	if val, ok := gLoggedInUsers[userName]; ok {
-		return val
+//Logs the user in on the device and returns the token for auth. See sessions.go
+func newDeviceToken(userName string, role int, device string, userAgent string) (string, error) {
+	//Always a fresh one. Handing back the existing token would give away the session of whoever has it.
+	ttl := REFRESH_TOKEN_TTL
+	if isOpenLogin() {
+		ttl = OPEN_LOGIN_TOKEN_TTL
 	}
-	//Leverage linux command
-	newToken := ""
-	out, err := exec.Command("uuidgen").Output()
+	s, err := startSession(userName, role, device, userAgent, ttl)
 	if err != nil {
-		r := rand.New(rand.NewSource(time.Now().UnixNano()))
-		newToken = fmt.Sprintf("SomeString:%d", r.Int63())
-	} else {
-		newToken = string(out)
+		fmt.Println("ERROR! Could not start session. User:", userName, " err:", err)
+		return "", err
 	}
+	return sessionToken(s), nil
+}
 
-	newToken = strings.TrimSuffix(newToken, "\n") //TODO - for some reason, am getting a trail
+//Signs an access token for the session. See tokens.go
+func sessionToken(s *session) string {
+	ttl := ACCESS_TOKEN_TTL
+	if isOpenLogin() {
+		ttl = OPEN_LOGIN_TOKEN_TTL
+	}
+	newToken := signAccessToken(s.User, s.Role, s.Id, ttl)
 
-	gLoggedInUsers[userName] = newToken
+	//Sync mess since this can be called from many threads.
+	gLoggedInUsersLock.Lock()
+	defer gLoggedInUsersLock.Unlock()
+	gLoggedInUsers[s.User] = newToken
 	return newToken
 
 }
@@ -97,14 +122,34 @@ func countStateUsers() int {
 	return len(gStateDS)
 }
 
+//Events whose response is a new token.
+func handsOutToken(eventType int) bool {
+	return eventType == EVENT_LOGIN || eventType == EVENT_SWITCHMODE
+}
+
+func isValidEventType(eventType int) bool {
+	switch eventType {
+	case EVENT_LOGIN, EVENT_HEARTBEAT, EVENT_JOINREQ, EVENT_JOINACCEPT, EVENT_TRIPEND,
+		EVENT_BLOCK, EVENT_UNBLOCK, EVENT_BLOCKLIST, EVENT_LOGOUT, EVENT_SESSIONS, EVENT_SWITCHMODE,
+		EVENT_SOS:
+		return true
+	}
+	return false
+}
+
 //Takes care of all authentication/logging in etc. First time a user is created
 func newUser(userName string, lat float64, lng float64, driverorrider int) string {
+	token := newToken(userName, driverorrider)
+	initUserState(userName, lat, lng, driverorrider)
+	return token
+}
+
+//Sets up the state of a user who just logged in.
+func initUserState(userName string, lat float64, lng float64, driverorrider int) {
 	//Lock down the dbs.
 	gStateLock.Lock()
 	defer gStateLock.Unlock()
 
-	token := newToken(userName)
-
 	//If state does not exist, create one. No issues here since we already have the user logged in.
 	var currState *CommState
 	if currState2, ok := gStateDS[userName]; ok == false {
@@ -112,38 +157,50 @@ func newUser(userName string, lat float64, lng float64, driverorrider int) strin
 		currState.arrReqs = make([]string, 0)
 		currState.arrConnectedWith = make([]string, 0)
 		currState.driverOrRider = driverorrider
+		currState.vehicleType = VEHICLE_CAR
+		currState.tenant = tenantOf(userName)
 		gStateDS[userName] = currState
 	} else {
 		currState = currState2
 	}
 
 	//Initialize the state.
-	currState.lastUptTime = time.Now().Unix()
+	currState.lastUptTime = clockNow().Unix()
 	currState.lat = lat
 	currState.lng = lng
 	currState.driverOrRider = driverorrider
+	recordPosition(currState, lat, lng)
+}
 
-	return token
-
+func setVehicleType(userName string, vehicleType int) {
+	gStateLock.Lock()
+	defer gStateLock.Unlock()
+	if currState, ok := gStateDS[userName]; ok {
+		currState.vehicleType = vehicleType
+	}
 }
 
-//If a wrong token is sent, error out
+//If a wrong token is sent, error out.
 func isUserValid(userName string, token string) (bool, error) {
-	//Read locks
-	gLoggedInUsersLock.RLock()
-	defer gLoggedInUsersLock.RUnlock()
+	_, err := validateToken(userName, token)
+	return err == nil, err
+}
 
-	currToken := "" //Of the user logged in
-	if val, ok := gLoggedInUsers[userName]; ok {
-		currToken = string(val)
+//Checks the signature and that the session is still logged in. Returns what the token says.
+func validateToken(userName string, token string) (*accessClaims, error) {
+	claims, err := parseAccessToken(token)
+	if err == nil && claims.Sub != userName {
+		err = errors.New(fmt.Sprintf("token is for %s", claims.Sub))
 	}
-
-	if currToken != token {
-		fmt.Println("ERROR! Token mismatch. User:", userName, " currToken:", currToken, " token:", token)
-		return false, errors.New(fmt.Sprintf("Authentication error! you are not logged in"))
+	if err == nil {
+		err = checkSession(claims.Sid)
+	}
+	if err != nil {
+		fmt.Println("ERROR! Token rejected. User:", userName, " reason:", err)
+		return nil, errors.New(fmt.Sprintf("Authentication error! you are not logged in"))
 	}
 
-	return true, nil
+	return claims, nil
 
 }
 
@@ -162,13 +219,38 @@ func updateStateAttrs(userName string, lat float64, lng float64, driverorrider i
 	}
 
 	//Initialize the state.
-	currState.lastUptTime = time.Now().Unix()
+	currState.lastUptTime = clockNow().Unix()
 	currState.lat = lat
 	currState.lng = lng
 	currState.driverOrRider = driverorrider
+	recordPosition(currState, lat, lng)
+	recordTrailPoint(userName, currState, lat, lng)
 	return nil //All good.
 }
 
+//touchState is updateStateAttrs for an event sent without a location. The user stays where they were last
+//seen, which is returned.
+func touchState(userName string, driverorrider int) (float64, float64, error) {
+	gStateLock.Lock()
+	defer gStateLock.Unlock()
+	currState, ok := gStateDS[userName]
+	if !ok {
+		return 0, 0, errors.New(fmt.Sprintf("Error while updating profile : %s does not exist!", userName))
+	}
+	currState.lastUptTime = clockNow().Unix()
+	currState.driverOrRider = driverorrider
+	return currState.lat, currState.lng, nil
+}
+
+//updatePosition takes the location the event came with, if it came with one. Returns where the user is now.
+func updatePosition(userName string, lat float64, lng float64, driverorrider int,
+	opts requestOptions) (float64, float64, error) {
+	if opts.noPosition {
+		return touchState(userName, driverorrider)
+	}
+	return lat, lng, updateStateAttrs(userName, lat, lng, driverorrider)
+}
+
 //This is a bit annoying since each of the access needs to be read-locked and we cant do it at a higher level
 //Lets see if there is a simpler way out later.
 func fillAlreadyJoinedAttr(r *ResponseDetails, userName string) error {
@@ -206,15 +288,36 @@ func registerReq(userName string, other string) (string, error) {
 	} else {
 		currState = currState2
 	}
+	if tenantOf(userName) != currState.tenant {
+		return "", ErrOtherTenant
+	}
+	if isBlockedPair(userName, other) {
+		return "", ErrUserBlocked
+	}
+	if !orgAllowsPair(userName, other) {
+		return "", ErrOrgScope
+	}
+	if !prefsAllowPair(userName, other) {
+		return "", ErrPreferences
+	}
+	if userState, ok := gStateDS[userName]; ok {
+		if err := checkPickupAllowed(userName, userState, other, currState); err != nil {
+			return "", err
+		}
+	}
 
 	//Now lets register request in this state, if possible.
-	if len(currState.arrReqs) >= MAX_MATCHED_USERS {
+	if len(currState.arrReqs) >= maxMatchedUsers(currState.tenant) {
 		return "", errors.New(fmt.Sprintf("Error while registering req :%s is already overloaded!", other))
 	}
 
 	//See if is already registered
 	for _, d := range currState.arrReqs {
 		if d == userName {
+			//The rider asked for the proposed driver too. Not the batch matcher's to withdraw any more.
+			if userState, ok := gStateDS[userName]; ok && userState.proposedDriver == other {
+				userState.batchReq = false
+			}
 			return "You are already registerd with this driver. Please wait!", nil
 		}
 	}
@@ -223,12 +326,29 @@ func registerReq(userName string, other string) (string, error) {
 	return fmt.Sprintf("Success! You are now registered with: %s", other), nil
 }
 
+//acceptJoin is the driver taking on a rider who asked, see registerReq. Nobody else.
+func acceptJoin(rider string, driver string) (string, error) {
+	//Write locks
+	gStateLock.Lock()
+	defer gStateLock.Unlock()
+
+	if driverState, ok := gStateDS[driver]; !ok || !containsString(driverState.arrReqs, rider) {
+		return "", errors.New(fmt.Sprintf("Error while joining user : %s has not asked to join %s", rider, driver))
+	}
+	return joinUsersLocked(rider, driver)
+}
+
 //Mark the two as "connected". Used in display and analytics subsequently
 func joinUsers(rider string, driver string) (string, error) {
 	//Write locks
 	gStateLock.Lock()
 	defer gStateLock.Unlock()
+	return joinUsersLocked(rider, driver)
+}
 
+//joinUsersLocked checks again everything that allowed the two to find each other, since any of it may have
+//changed since. Callers hold gStateLock.
+func joinUsersLocked(rider string, driver string) (string, error) {
 	var riderState *CommState
 	if tempState, ok := gStateDS[rider]; ok == false {
 		fmt.Sprintf("ERROR in joinUsers: user does not exist :%s len:%d", rider, len(gStateDS))
@@ -243,9 +363,35 @@ func joinUsers(rider string, driver string) (string, error) {
 	} else {
 		driverState = tempState2
 	}
+	if riderState.tenant != driverState.tenant {
+		return "", ErrOtherTenant
+	}
+	if isBlockedPair(rider, driver) {
+		return "", ErrUserBlocked
+	}
+	if !orgAllowsPair(rider, driver) {
+		return "", ErrOrgScope
+	}
+	if !prefsAllowPair(rider, driver) {
+		return "", ErrPreferences
+	}
+	if !isVerifiedDriver(driver) {
+		return "", errors.New(fmt.Sprintf("Error while joining user : %s is not a verified driver", driver))
+	}
+	if err := checkPickupAllowed(rider, riderState, driver, driverState); err != nil {
+		return "", err
+	}
+	if _, err := getActiveTrip(rider, driver); err == nil {
+		return "", errors.New(fmt.Sprintf("Error while joining user : %s is already on a trip with %s", rider, driver))
+	}
+	//Record the trip first. Nothing to undo if that fails.
+	if _, err := startTrip(rider, driver, driverState.lat, driverState.lng); err != nil {
+		return "", errors.New(fmt.Sprintf("Error while joining user : could not record trip %s", err.Error()))
+	}
 
 	//Now that we have both states, lets update them.
 	riderState.arrConnectedWith = append(riderState.arrConnectedWith, driver)
+	riderState.proposedDriver, riderState.batchReq = "", false
 	driverState.arrConnectedWith = append(driverState.arrConnectedWith, rider)
 
 	//Remove request registered. Is there a better way in golang?
@@ -262,38 +408,175 @@ func joinUsers(rider string, driver string) (string, error) {
 
 }
 
+func removeString(arr []string, str string) []string {
+	for idx, a := range arr {
+		if a == str {
+			arr[idx] = arr[len(arr)-1]
+			return arr[:len(arr)-1]
+		}
+	}
+	return arr
+}
+
+//Fare estimate for the rider joining the driver. Has to be called without gStateLock held.
+func fareEstimate(rider string, driver string, opts requestOptions) string {
+	gStateLock.RLock()
+	defer gStateLock.RUnlock()
+
+	riderState, ok1 := gStateDS[rider]
+	driverState, ok2 := gStateDS[driver]
+	if !ok1 || !ok2 {
+		return ""
+	}
+	return fareEstimateLocked(riderState, driverState, opts)
+}
+
+//Trip is over. Record the drop-off and disconnect the two. Either the rider or the driver can end it.
+func endTrip(userName string, other string, lat float64, lng float64) (string, error) {
+	//Write locks
+	gStateLock.Lock()
+	defer gStateLock.Unlock()
+
+	userState, ok := gStateDS[userName]
+	if !ok {
+		return "", errors.New(fmt.Sprintf("Error while ending trip :%s does not exist!", userName))
+	}
+	otherState, ok := gStateDS[other]
+	if !ok {
+		return "", errors.New(fmt.Sprintf("Error while ending trip :%s does not exist!", other))
+	}
+
+	rider, driver, driverState := userName, other, otherState
+	if userState.driverOrRider == DRIVER_STATE {
+		rider, driver, driverState = other, userName, userState
+	}
+	//Everyone still in the car shares the cost, this rider included.
+	trip, err := completeTrip(rider, driver, lat, lng, driverState.vehicleType, len(driverState.arrConnectedWith))
+	if err != nil {
+		return "", err
+	}
+
+	//The trip is done either way. A failed posting can be retried later, it is keyed on the trip.
+	if _, err = postTripSettlement(trip); err != nil {
+		fmt.Println("ERROR in endTrip: could not post settlement for trip:", trip.TripId, " err:", err)
+	}
+
+	userState.arrConnectedWith = removeString(userState.arrConnectedWith, other)
+	otherState.arrConnectedWith = removeString(otherState.arrConnectedWith, userName)
+	return fmt.Sprintf("Success! Trip %s ended. Distance:%.0f %s", trip.TripId, trip.DistanceMetres,
+		trip.Fare.toString()), nil
+}
+
+//requestOptions are the optional params that can come along with an event. Zero value means none were sent.
+type requestOptions struct {
+	minRating   float64 //Skip rated candidates below this. Unrated ones still show up, everyone starts somewhere.
+	vehicleType int     //Sent by drivers on login. Decides the fare rate.
+	hasDest     bool    //Rider told us where they are going. Used for the fare estimate on join requests.
+	destLat     float64
+	destLng     float64
+	device      string //Sent by the app on login, to tell the user's devices apart. See sessions.go
+	userAgent   string
+	noPosition  bool //No param was sent. lat/lng are zeros then, not where the user is.
+}
+
 //updateState is invoked every time an event is received from a commuter, be it a heardbeat event or a
 //a specific request like "connect ot his driver". This is the main router and calls internal methods
 //to process request.
 func updateState(userName string, lat float64, lng float64, token string, driverorrider int,
 	other string, eventType int) (string, error) {
+	return updateStateWithOpts(userName, lat, lng, token, driverorrider, other, eventType, requestOptions{})
+}
+
+//updateStateWithOpts is updateState with the optional params. See requestOptions.
+func updateStateWithOpts(userName string, lat float64, lng float64, token string, driverorrider int,
+	other string, eventType int, opts requestOptions) (retStr string, err error) {
 	//A general note. Do not take a mutex at this high a level. Better to do it at granular functions which are
 	//eventually routed to. Else will run into issues as in https://stackoverflow.com/questions/14670979/recursive-locking-in-go
 
 	//Ensure eventtype sanity
-	if eventType != EVENT_HEARTBEAT && eventType != EVENT_JOINREQ &&
-		eventType != EVENT_JOINACCEPT && eventType != EVENT_LOGIN {
+	if !isValidEventType(eventType) {
 		return "", errors.New(fmt.Sprintf("Invalid eventtype:%d", eventType))
 	}
-	var err error
-	var retStr string
+
+	//Nothing to do for users outside the area we serve. Every location sent moves the user, so every one is
+	//checked. Events sent without one keep the user where they were, and go through. An SOS always does.
+	if eventType == EVENT_LOGIN && opts.noPosition {
+		return "", errors.New("ERROR in param parameter: login needs the location")
+	}
+	if eventType != EVENT_SOS && !opts.noPosition {
+		err = checkServiceArea(lat, lng)
+		if err != nil {
+			return "", err
+		}
+	}
 
 	//Step #1: if this is a login event, create a new user
 	if eventType == EVENT_LOGIN {
-		currToken := newUser(userName, lat, lng, driverorrider)
+		var currToken string
+		if !canUseMode(userName, driverorrider) {
+			return "", errors.New(fmt.Sprintf("%s is not allowed to be a %s", userName, modeName(driverorrider)))
+		}
+		if isOpenLogin() {
+			if currToken, err = newDeviceToken(userName, driverorrider, opts.device, opts.userAgent); err != nil {
+				return "", err
+			}
+		} else {
+			//The token comes from verifying the phone number. See auth.go. A new one goes back, for this mode.
+			if currToken, err = resumeSession(userName, token, driverorrider, opts); err != nil {
+				return "", err
+			}
+		}
+		initUserState(userName, lat, lng, driverorrider)
+		if opts.vehicleType != 0 {
+			setVehicleType(userName, opts.vehicleType)
+		}
+		e := newCommuteEvent(userName, lat, lng, driverorrider, other, eventType, opts)
+		e.Response = EVENTLOG_TOKEN_REDACTED
+		logEvent(e)
+		countTenantEvent(userName, eventType)
 		//Nothing else to do for now. Just return the newly created token which will be passed back.
 		return currToken, nil
 	}
 
-	_, err = isUserValid(userName, token)
+	claims, err := validateToken(userName, token)
 	if err != nil {
 		return "", err
 	}
+	if eventType != EVENT_SWITCHMODE {
+		if err = checkEventAllowed(claims, driverorrider, eventType); err != nil {
+			return "", err
+		}
+	}
+
+	//Accepted. From here on whatever happens goes in the event log, errors included, since the state
+	//may have changed before the error.
+	e := newCommuteEvent(userName, lat, lng, driverorrider, other, eventType, opts)
+	defer func() {
+		e.Response = retStr
+		if err != nil {
+			e.Error = err.Error()
+		} else if handsOutToken(eventType) {
+			e.Response = EVENTLOG_TOKEN_REDACTED
+		}
+		logEvent(e)
+		countTenantEvent(userName, eventType)
+	}()
+
+	//Before the location update, which would set the new mode.
+	if eventType == EVENT_SWITCHMODE {
+		if retStr, err = switchMode(userName, claims.Sid, driverorrider); err != nil {
+			return "", err
+		}
+		if lat, lng, err = updatePosition(userName, lat, lng, driverorrider, opts); err != nil {
+			return "", err
+		}
+		return retStr, nil
+	}
 
 	//Now lets handle the events.
 
 	//Whatever be the event, lets update the location etc first.
-	err = updateStateAttrs(userName, lat, lng, driverorrider)
+	lat, lng, err = updatePosition(userName, lat, lng, driverorrider, opts)
 	if err != nil {
 		return "", err
 	}
@@ -301,20 +584,17 @@ func updateState(userName string, lat float64, lng float64, token string, driver
 	switch eventType {
 	case EVENT_HEARTBEAT: //This comes at prefined periodicity from app-side. Maybe once in 30 secs if user is moving
 		//Lets find out the nearby commuters and return back.
-		var arrMatchUsers []matchUserDetails
-		arrMatchUsers, err = searchMatches(userName, driverorrider)
-		if err != nil {
-			return "", err
-		}
-		//Instantiate a response details object
-		var respObj *ResponseDetails = newResponseDetails()
-		err = fillAlreadyJoinedAttr(respObj, userName)
+		var respObj *ResponseDetails
+		respObj, err = buildSearchResponse(userName, driverorrider, opts)
 		if err != nil {
 			return "", err
 		}
-		//Now fill the details of matched users
-		for _, m := range arrMatchUsers {
-			respObj.addPotentialUser(m.userName, m.lat, m.lng, m.dist)
+		//Riders still looking for a driver count towards demand. See heatmap.go
+		if driverorrider == RIDER_STATE && len(respObj.arrConnectedUsers) == 0 {
+			recordDemand(tenantOf(userName), METRIC_SEARCH, lat, lng, clockNow())
+			if len(respObj.arrNearbyCommuters) == 0 {
+				recordDemand(tenantOf(userName), METRIC_UNMATCHED, lat, lng, clockNow())
+			}
 		}
 		//Return the response
 		return respObj.toString(driverorrider), nil
@@ -324,21 +604,70 @@ func updateState(userName string, lat float64, lng float64, token string, driver
 		if err != nil {
 			return "", err
 		}
-		return retStr, nil //ALl good. Request is registered with the "other" driver.
+		recordDemand(tenantOf(userName), METRIC_JOINREQ, lat, lng, clockNow())
+		recordOrgUsage(userName, other, false)
+		return fmt.Sprintf("%s. %s", retStr, fareEstimate(userName, other, opts)), nil //ALl good. Request is registered with the "other" driver.
 
 	case EVENT_JOINACCEPT: //This comes when a driver accepts a request from a nearby rider.
-		retStr, err = joinUsers(other, userName) //Note that other=rider in this signal
+		retStr, err = acceptJoin(other, userName) //Note that other=rider in this signal
 		if err != nil {
 			return "", err
 		}
+		recordDemand(tenantOf(userName), METRIC_JOINACCEPT, lat, lng, clockNow())
+		recordOrgUsage(other, userName, true)
 		return retStr, nil //ALl good. Request is registered with the "other" driver.
 
+	case EVENT_TRIPEND: //Either side reached the drop-off.
+		retStr, err = endTrip(userName, other, lat, lng)
+		if err != nil {
+			return "", err
+		}
+		return retStr, nil
+
+	case EVENT_BLOCK:
+		return blockUser(userName, other)
+
+	case EVENT_UNBLOCK:
+		return unblockUser(userName, other)
+
+	case EVENT_BLOCKLIST:
+		return blockListString(userName), nil
+
+	case EVENT_LOGOUT:
+		return logout(userName, claims.Sid, other)
+
+	case EVENT_SESSIONS:
+		return sessionsString(userName, claims.Sid)
+
+	case EVENT_SOS:
+		return raiseSOS(userName)
+
 	}
 
 	return "Update Success!", nil
 
 }
 
+//Finds the nearby commuters and puts them, along with the already joined ones, in a response object.
+func buildSearchResponse(userName string, driverorrider int, opts requestOptions) (*ResponseDetails, error) {
+	arrMatchUsers, err := searchMatchesWithOpts(userName, driverorrider, opts)
+	if err != nil {
+		return nil, err
+	}
+	//Instantiate a response details object
+	var respObj *ResponseDetails = newResponseDetails()
+	err = fillAlreadyJoinedAttr(respObj, userName)
+	if err != nil {
+		return nil, err
+	}
+	//Now fill the details of matched users. Joined ones have to be in before this so they get exact locations.
+	respObj.explain = explainsMatches(userName)
+	for _, m := range arrMatchUsers {
+		respObj.addCandidate(m.userName, m.lat, m.lng, m.dist, m.rating, m.why)
+	}
+	return respObj, nil
+}
+
 //Get the current value as is stored. TODO - clone and send. Otherwise the caller may mutate
 func getCurrentState(userName string) *CommState {
 	gStateLock.RLock()
@@ -353,11 +682,24 @@ type matchUserDetails struct {
 	lat      float64
 	lng      float64
 	dist     float64
+	rating   float64
+	why      string  //Why it is ranked where it is. See rankByPrefs
+	weight   float64 //What it is ranked by. Less is better. See motionWeight
 }
 
 //Main function which figures out the nearby commuters. In this POC, we are doing a whole scan. Imagine a
 //cluster of machines based on location and users indexed as per a 1x1 grid and we can only relevant maps.
 func searchMatches(userName string, mode int) ([]matchUserDetails, error) {
+	return searchMatchesWithOpts(userName, mode, requestOptions{})
+}
+
+//Returns true if the candidate passes the filters the searching user asked for.
+func (opts requestOptions) allows(rating float64) bool {
+	return opts.minRating <= 0 || rating == 0 || rating >= opts.minRating
+}
+
+//searchMatchesWithOpts is searchMatches with the user's filters applied.
+func searchMatchesWithOpts(userName string, mode int, opts requestOptions) ([]matchUserDetails, error) {
 	//readlock
 	gStateLock.RLock()
 	defer gStateLock.RUnlock()
@@ -372,31 +714,54 @@ func searchMatches(userName string, mode int) ([]matchUserDetails, error) {
 		return nil, errors.New(fmt.Sprintf("Invalid mode:%d", mode))
 	}
 
-	currPoint := Point{Lat: currState.lat, Lon: currState.lng}
+	//Everyone is where they were going, not where they last told us. See trajectory.go
+	nowMs := clockNow().UnixNano() / 1e6
+	currPoint := projectedPosition(currState, nowMs)
+	maxDist, maxUsers := maxWaitDistance(currState.tenant), maxMatchedUsers(currState.tenant)
+
+	//Ranking by preference needs all the candidates too.
+	ranked := explainsMatches(userName)
 
-	//A rider is typically looking all drivers nearby.
+	//A rider is typically looking all drivers nearby. They are ranked by distance and by where they are
+	//headed, so it means looking at all of them.
 	if mode == RIDER_STATE {
+		colleaguesFirst := wantsOrgFirst(userName)
 		for u, uState := range gStateDS {
-			if uState.driverOrRider == DRIVER_STATE { //can match a rider only to a driver
+			if uState.driverOrRider == DRIVER_STATE && uState.tenant == currState.tenant { //can match a rider only to a driver
+				if isBlockedPair(userName, u) || !isVerifiedDriver(u) || !orgAllowsPair(userName, u) ||
+					!prefsAllowPair(userName, u) {
+					continue
+				}
 				//They match only if they are at reasonable distance.
-				newPoint := Point{Lat: uState.lat, Lon: uState.lng}
+				newPoint := projectedPosition(uState, nowMs)
 				dist := DistanceBetwnPts(currPoint, newPoint)
 
-				if dist > MAX_WAIT_DISTANCE {
+				if dist > maxDist {
+					continue
+				}
+				rating := getAverageRating(u)
+				if !opts.allows(rating) {
 					continue
 				}
 
 				//Now this is an eligible user. Lets add.
-				newUserDetails := matchUserDetails{u, uState.lat, uState.lng, dist}
+				weight := motionWeight(uState, dist, currPoint)
+				newUserDetails := matchUserDetails{u, uState.lat, uState.lng, dist, rating, "", weight}
 				arrMatchedUsers = append(arrMatchedUsers, newUserDetails)
-
-				if len(arrMatchedUsers) >= MAX_MATCHED_USERS {
-					break //Come out now. Found enough
-				}
-
 			}
 		}
-		return arrMatchedUsers, nil //Normal return
+		if ranked {
+			arrMatchedUsers = rankByPrefs(arrMatchedUsers, userName)
+		} else {
+			arrMatchedUsers = rankByWeight(arrMatchedUsers)
+		}
+		if len(arrMatchedUsers) > maxUsers && !colleaguesFirst {
+			arrMatchedUsers = arrMatchedUsers[:maxUsers]
+		}
+		if colleaguesFirst {
+			arrMatchedUsers = orgFirst(arrMatchedUsers, userName)
+		}
+		return promoteProposal(arrMatchedUsers, userName, currState, opts), nil //Normal return
 	}
 	//Now the user has to be driver. Here, you just go by riders' requests. Scan through, update latest
 	//distance and just return
@@ -404,26 +769,67 @@ func searchMatches(userName string, mode int) ([]matchUserDetails, error) {
 
 		//For now, if the requested user is not found, we just move on. Ideally we should error out and handle.
 		if reqUserState, ok := gStateDS[reqUser]; ok {
-			if reqUserState.driverOrRider == RIDER_STATE { //Again, lets ignore if the state is wrong
-				newPoint := Point{Lat: reqUserState.lat, Lon: reqUserState.lng}
+			if reqUserState.driverOrRider == RIDER_STATE && reqUserState.tenant == currState.tenant { //Again, lets ignore if the state is wrong
+				if isBlockedPair(userName, reqUser) || !orgAllowsPair(userName, reqUser) || !prefsAllowPair(userName, reqUser) {
+					continue
+				}
+				newPoint := projectedPosition(reqUserState, nowMs)
 				dist := DistanceBetwnPts(currPoint, newPoint)
 
-				if dist > MAX_WAIT_DISTANCE {
+				if dist > maxDist {
+					continue
+				}
+				rating := getAverageRating(reqUser)
+				if !opts.allows(rating) {
 					continue
 				}
 
 				//Now this is an eligible user. Lets add.
-				newUserDetails := matchUserDetails{reqUser, reqUserState.lat, reqUserState.lng, dist}
+				newUserDetails := matchUserDetails{reqUser, reqUserState.lat, reqUserState.lng, dist, rating, "", dist}
 				arrMatchedUsers = append(arrMatchedUsers, newUserDetails)
 
-				if len(arrMatchedUsers) >= MAX_MATCHED_USERS {
+				if len(arrMatchedUsers) >= maxUsers && !ranked {
 					break //Come out now. Found enough
 				}
 
 			}
 		}
 	}
+	if ranked {
+		arrMatchedUsers = rankByPrefs(arrMatchedUsers, userName)
+		if len(arrMatchedUsers) > maxUsers {
+			arrMatchedUsers = arrMatchedUsers[:maxUsers]
+		}
+	}
 
 	return arrMatchedUsers, nil
 
 }
+
+//promoteProposal puts the driver the batch matcher proposed at the top of a rider's results. It may not have
+//been in them at all, since search stops at maxMatchedUsers. Callers hold gStateLock.
+func promoteProposal(arr []matchUserDetails, rider string, riderState *CommState, opts requestOptions) []matchUserDetails {
+	driver := riderState.proposedDriver
+	if driver == "" {
+		return arr
+	}
+	driverState, ok := gStateDS[driver]
+	if !ok || driverState.driverOrRider != DRIVER_STATE || driverState.tenant != riderState.tenant {
+		return arr
+	}
+	nowMs := clockNow().UnixNano() / 1e6
+	dist := DistanceBetwnPts(projectedPosition(riderState, nowMs), projectedPosition(driverState, nowMs))
+	rating := getAverageRating(driver)
+	if dist > maxWaitDistance(riderState.tenant) || !opts.allows(rating) || isBlockedPair(rider, driver) || !orgAllowsPair(rider, driver) ||
+		!prefsAllowPair(rider, driver) || !isVerifiedDriver(driver) {
+		return arr
+	}
+	_, why := explainMatch(getProfile(rider), driver)
+	promoted := []matchUserDetails{{driver, driverState.lat, driverState.lng, dist, rating, why, dist}}
+	for _, m := range arr {
+		if m.userName != driver && len(promoted) < maxMatchedUsers(riderState.tenant) {
+			promoted = append(promoted, m)
+		}
+	}
+	return promoted
+}
@@ -14,15 +14,15 @@ var wg sync.WaitGroup
 func TestUserCreation(t *testing.T) {
 	Initialize()
 
-	//Repeat users
-	token1 := newToken("newuser1")
-	token2 := newToken("newuser1")
+	//Repeat users get a new token
+	token1 := newToken("newuser1", RIDER_STATE)
+	token2 := newToken("newuser1", RIDER_STATE)
 
-	if token1 != token2 || countLoggedInUsers() != 1 {
+	if token1 == token2 || countLoggedInUsers() != 1 {
 		t.Errorf("newuser for same user failed. token1:", token1, " token2:", token2, " size:", countLoggedInUsers())
 	}
 
-	token3 := newToken("newuser3")
+	token3 := newToken("newuser3", RIDER_STATE)
 	if token1 == token3 || countLoggedInUsers() != 2 {
 		t.Errorf("newuser for same user failed. token1:", token1, " token3:", token3, " size:", countLoggedInUsers())
 	}
@@ -33,7 +33,7 @@ func TestUpdateAuthError(t *testing.T) {
 	Initialize()
 
 	//Not logged in user
-	token1 := newToken("newuser1")
+	token1 := newToken("newuser1", RIDER_STATE)
 	_, err := updateState("token3", 7.1, 10.2, token1, RIDER_STATE, "", EVENT_HEARTBEAT)        //wrong user
 	_, err2 := updateState("token1", 7.1, 10.2, "wrongtoken", RIDER_STATE, "", EVENT_HEARTBEAT) //wrong token
 
@@ -45,17 +45,25 @@ func TestUpdateAuthError(t *testing.T) {
 
 func TestUpdateExample(t *testing.T) {
 	Initialize()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+	defer SetEntropy(SetEntropy(NewSeededEntropy(1)))
 
 	//Lets simulate a login event first.
 	token1, _ := updateState("newuser1", 7.1, 10.2, "", RIDER_STATE, "", EVENT_LOGIN)
 	if countLoggedInUsers() != 1 || countStateUsers() != 1 { //fixme
 		t.Errorf("Count mismatch in DS1. LoggedIn:", countLoggedInUsers(), " in DS:", countStateUsers())
 	}
+	if claims, err := parseAccessToken(token1); err != nil || claims.Sid != NewSeededEntropy(1).Secret() {
+		t.Errorf("Token not from the seeded entropy:%s", token1)
+	}
+	clock.Advance(30 * time.Second)
 	r1, _ := updateState("newuser1", 7.1, 10.2, token1, RIDER_STATE, "", EVENT_HEARTBEAT)
 	if countLoggedInUsers() != 1 || countStateUsers() != 1 {
 		t.Errorf("Count mismatch in DS2. LoggedIn:", countLoggedInUsers(), " in DS:", countStateUsers(), " ret:", r1)
 	}
 	//Another update
+	clock.Advance(30 * time.Second)
 	r2, _ := updateState("newuser1", 7.2, 10.3, token1, RIDER_STATE, "", EVENT_HEARTBEAT)
 	if countLoggedInUsers() != 1 || countStateUsers() != 1 {
 		t.Errorf("Count mismatch in DS3. LoggedIn:", countLoggedInUsers(), " in DS:", countStateUsers(), " ret:", r2)
@@ -66,6 +74,9 @@ func TestUpdateExample(t *testing.T) {
 	if obj1.lat != 7.2 || obj1.lng != 10.3 {
 		t.Errorf("Normal update did not work. Users:", countLoggedInUsers(), " lat:", obj1.lat, " lng:", obj1.lng)
 	}
+	if obj1.lastUptTime != clock.Now().Unix() {
+		t.Errorf("Update time not from the clock. lastUptTime:%d expected:%d", obj1.lastUptTime, clock.Now().Unix())
+	}
 
 	//Nonexistent user
 	obj2 := getCurrentState("nonuser")
@@ -302,3 +313,29 @@ func TestMuiltiSearchJoinAccept(t *testing.T) {
 	}
 
 }
+
+//Drivers take on only the riders who asked, and only if the two may still ride together.
+func TestAcceptJoin(t *testing.T) {
+	Initialize()
+	tokenDriver := newUser("driver1", 12.884733, 77.551541, DRIVER_STATE)
+	tokenRider := newUser("rider1", 12.884800, 77.551600, RIDER_STATE)
+	newUser("rider2", 12.884800, 77.551600, RIDER_STATE)
+	setProfile("driver1", "", "smoking", "", "")
+	updateState("rider1", 12.884800, 77.551600, tokenRider, RIDER_STATE, "driver1", EVENT_JOINREQ)
+
+	if _, err := updateState("driver1", 12.884733, 77.551541, tokenDriver, DRIVER_STATE, "rider2", EVENT_JOINACCEPT); err == nil {
+		t.Errorf("joined a rider who did not ask")
+	}
+	//Changed their mind since asking
+	setProfile("rider1", "", "", "smoking:refuse", "")
+	if _, err := updateState("driver1", 12.884733, 77.551541, tokenDriver, DRIVER_STATE, "rider1", EVENT_JOINACCEPT); err != ErrPreferences {
+		t.Errorf("joined against preferences:%v", err)
+	}
+	if _, err := joinUsers("rider1", "driver1"); err != ErrPreferences {
+		t.Errorf("scheduled join against preferences:%v", err)
+	}
+	setProfile("rider1", "", "", "none", "")
+	if _, err := updateState("driver1", 12.884733, 77.551541, tokenDriver, DRIVER_STATE, "rider1", EVENT_JOINACCEPT); err != nil {
+		t.Errorf("join failed:%s", err.Error())
+	}
+}
@@ -0,0 +1,147 @@
+package commute
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//Store is the pluggable persistence layer. Records are opaque blobs grouped in buckets (think tables) and
+//keyed by strings. List returns the records whose key starts with prefix, sorted by key, so callers can encode
+//ordering (eg: timestamps) into the keys. The default one is in memory; plug in a db backed one with SetStore.
+type Store interface {
+	Put(bucket string, key string, value []byte) error
+	Get(bucket string, key string) ([]byte, error)
+	Delete(bucket string, key string) error
+	List(bucket string, prefix string) ([][]byte, error)
+}
+
+//ErrNotFound is returned by Store.Get when there is no such key.
+var ErrNotFound = errors.New("not found")
+
+var gStore Store = NewMemStore()
+var gStoreLock = sync.RWMutex{}
+
+//SetStore swaps in a different persistence layer. Call before Initialize so that nothing is lost.
+func SetStore(s Store) {
+	gStoreLock.Lock()
+	defer gStoreLock.Unlock()
+	gStore = s
+}
+
+//An in-memory store is part of the process state, so Initialize starts it afresh. Others are left alone.
+func resetStore() {
+	gStoreLock.Lock()
+	defer gStoreLock.Unlock()
+	if _, ok := gStore.(*memStore); ok {
+		gStore = NewMemStore()
+	}
+}
+
+func getStore() Store {
+	gStoreLock.RLock()
+	defer gStoreLock.RUnlock()
+	return gStore
+}
+
+//Helpers to keep json marshalling out of every caller.
+func storePutJSON(bucket string, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return getStore().Put(bucket, key, data)
+}
+
+func storeGetJSON(bucket string, key string, v interface{}) error {
+	data, err := getStore().Get(bucket, key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+//Store bucket for nextSequence
+const bucketSequences = "sequences" //name -> last number handed out
+
+var gSequenceLock = sync.Mutex{}
+
+//nextSequence hands out the next number for name, starting at 1. The last one is kept in the store, so
+//numbers carry on after a restart.
+func nextSequence(name string) (int64, error) {
+	gSequenceLock.Lock()
+	defer gSequenceLock.Unlock()
+	var last int64 = 0
+	if err := storeGetJSON(bucketSequences, name, &last); err != nil && err != ErrNotFound {
+		return 0, err
+	}
+	last++
+	if err := storePutJSON(bucketSequences, name, last); err != nil {
+		return 0, err
+	}
+	return last, nil
+}
+
+//memStore keeps everything in maps. Good for tests and a single box POC.
+type memStore struct {
+	lock    sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+//NewMemStore returns an empty in-memory Store.
+func NewMemStore() Store {
+	return &memStore{buckets: make(map[string]map[string][]byte)}
+}
+
+func (m *memStore) Put(bucket string, key string, value []byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	b, ok := m.buckets[bucket]
+	if !ok {
+		b = make(map[string][]byte)
+		m.buckets[bucket] = b
+	}
+	//Copy, so that the caller reusing its buffer does not change what is stored.
+	b[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (m *memStore) Get(bucket string, key string) ([]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	if val, ok := m.buckets[bucket][key]; ok {
+		return append([]byte(nil), val...), nil
+	}
+	return nil, ErrNotFound
+}
+
+func (m *memStore) Delete(bucket string, key string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.buckets[bucket], key)
+	return nil
+}
+
+func (m *memStore) List(bucket string, prefix string) ([][]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	keys := make([]string, 0)
+	for k := range m.buckets[bucket] {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	vals := make([][]byte, 0, len(keys))
+	for _, k := range keys {
+		vals = append(vals, append([]byte(nil), m.buckets[bucket][k]...))
+	}
+	return vals, nil
+}
@@ -0,0 +1,39 @@
+package commute
+
+import (
+	"testing"
+)
+
+func TestMemStore(t *testing.T) {
+	s := NewMemStore()
+
+	if _, err := s.Get("b", "missing"); err != ErrNotFound {
+		t.Errorf("Get of missing key did not return ErrNotFound. err:%v", err)
+	}
+
+	buf := []byte("one")
+	s.Put("b", "k1", buf)
+	buf[0] = 'X' //Must not change the stored copy
+	s.Put("b", "k3", []byte("three"))
+	s.Put("b", "k2", []byte("two"))
+	s.Put("other", "k1", []byte("notme"))
+
+	if v, err := s.Get("b", "k1"); err != nil || string(v) != "one" {
+		t.Errorf("Get returned %s err:%v", v, err)
+	}
+
+	vals, _ := s.List("b", "k")
+	if len(vals) != 3 || string(vals[0]) != "one" || string(vals[1]) != "two" || string(vals[2]) != "three" {
+		t.Errorf("List not sorted by key or wrong. len:%d", len(vals))
+	}
+
+	s.Delete("b", "k2")
+	vals, _ = s.List("b", "")
+	if len(vals) != 2 {
+		t.Errorf("Delete did not remove. len:%d", len(vals))
+	}
+	vals, _ = s.List("nobucket", "")
+	if len(vals) != 0 {
+		t.Errorf("List of missing bucket returned %d", len(vals))
+	}
+}
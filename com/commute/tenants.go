@@ -0,0 +1,336 @@
+package commute
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//Tenants let one deployment run several cities or brands that never see each other. Each user belongs to
+//one tenant, and inside the package their name carries it: "pune/rider1". Names are qualified at the edge
+//(see TenantRouter), so the rest of the code keys everything (state, sessions, store records) on names that
+//cannot clash across tenants. Searches, joins and the matchers also check the tenants agree, so a request
+//made up inside the package cannot cross over either. The default tenant has bare names, as before tenants.
+const DEFAULT_TENANT = ""
+const TENANT_SEP = "/"
+
+//ErrOtherTenant is returned when a request names a user of another tenant.
+var ErrOtherTenant = errors.New("Not allowed: this commuter is in another tenant")
+
+var tenantIdRegex = regexp.MustCompile(`^[a-z0-9-]{2,32}$`)
+
+//TenantConfig is one tenant in the tenants file. Zero values fall back to the package defaults.
+//eg: {"tenants":[{"id":"pune","hosts":["pune.example.com"],"maxwaitdistance":800,"fares":{"car":{...}}}]}
+type TenantConfig struct {
+	Id              string              `json:"id"`
+	Hosts           []string            `json:"hosts"`           //Requests to these hosts are for the tenant. The path prefix /<id>/ always is.
+	MaxWaitDistance float64             `json:"maxwaitdistance"` //Metres. MAX_WAIT_DISTANCE if not set
+	MaxMatchedUsers int                 `json:"maxmatchedusers"` //MAX_MATCHED_USERS if not set
+	Fares           map[string]fareRate `json:"fares"`           //As in the fares file. Vehicles not here pay the default rate.
+}
+
+type tenantsFile struct {
+	Tenants []TenantConfig `json:"tenants"`
+}
+
+var gTenants map[string]*TenantConfig
+var gTenantHosts map[string]string
+var gTenantEvents map[string]map[string]int64 //tenant -> event name -> count
+var gTenantLock = sync.RWMutex{}
+
+func resetTenants() {
+	gTenantLock.Lock()
+	defer gTenantLock.Unlock()
+	gTenants = map[string]*TenantConfig{DEFAULT_TENANT: {}}
+	gTenantHosts = make(map[string]string)
+	gTenantEvents = make(map[string]map[string]int64)
+}
+
+//LoadTenants reads the tenants file and swaps the tenants in. Empty path means just the default tenant.
+func LoadTenants(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var f tenantsFile
+	if err = json.Unmarshal(data, &f); err != nil {
+		return errors.New(fmt.Sprintf("Invalid tenants file %s : %s", path, err.Error()))
+	}
+	return SetTenants(f.Tenants)
+}
+
+//SetTenants swaps in the tenants. The default tenant is always there.
+func SetTenants(tenants []TenantConfig) error {
+	cfgs := map[string]*TenantConfig{DEFAULT_TENANT: {}}
+	hosts := make(map[string]string)
+	for i := range tenants {
+		t := tenants[i]
+		if !tenantIdRegex.MatchString(t.Id) {
+			return errors.New(fmt.Sprintf("Invalid tenant id, need a-z 0-9 and -:%s", t.Id))
+		}
+		if _, ok := cfgs[t.Id]; ok {
+			return errors.New(fmt.Sprintf("Tenant %s given twice", t.Id))
+		}
+		if t.MaxWaitDistance < 0 || t.MaxMatchedUsers < 0 {
+			return errors.New(fmt.Sprintf("Tenant %s : limits cannot be negative", t.Id))
+		}
+		for name, r := range t.Fares {
+			if _, ok := vehicleNames[name]; !ok {
+				return errors.New(fmt.Sprintf("Tenant %s : invalid vehicle %s", t.Id, name))
+			}
+			if r.Base < 0 || r.PerKm < 0 || r.Min < 0 {
+				return errors.New(fmt.Sprintf("Tenant %s : fare rates cannot be negative", t.Id))
+			}
+		}
+		for _, h := range t.Hosts {
+			h = strings.ToLower(h)
+			if other, ok := hosts[h]; ok {
+				return errors.New(fmt.Sprintf("Host %s is for both %s and %s", h, other, t.Id))
+			}
+			hosts[h] = t.Id
+		}
+		cfgs[t.Id] = &t
+	}
+	gTenantLock.Lock()
+	defer gTenantLock.Unlock()
+	gTenants = cfgs
+	gTenantHosts = hosts
+	return nil
+}
+
+func isTenant(tenant string) bool {
+	gTenantLock.RLock()
+	defer gTenantLock.RUnlock()
+	_, ok := gTenants[tenant]
+	return ok
+}
+
+func tenantConfig(tenant string) TenantConfig {
+	gTenantLock.RLock()
+	defer gTenantLock.RUnlock()
+	if t, ok := gTenants[tenant]; ok {
+		return *t
+	}
+	return TenantConfig{}
+}
+
+//tenantOf is the tenant in the (qualified) user name.
+func tenantOf(userName string) string {
+	if idx := strings.Index(userName, TENANT_SEP); idx > 0 {
+		return userName[:idx]
+	}
+	return DEFAULT_TENANT
+}
+
+//qualifyUser turns the name the app sent into the name inside the package. The app may send it back as we
+//gave it out, qualified, but only for the same tenant.
+func qualifyUser(tenant string, name string) (string, error) {
+	if name == "" {
+		return "", nil
+	}
+	if !strings.Contains(name, TENANT_SEP) {
+		//A default tenant user named after a tenant would be a prefix of everyone in it.
+		if tenant == DEFAULT_TENANT && name != DEFAULT_TENANT && isTenant(name) {
+			return "", errors.New(fmt.Sprintf("Invalid user name:%s", name))
+		}
+		if tenant == DEFAULT_TENANT {
+			return name, nil
+		}
+		return tenant + TENANT_SEP + name, nil
+	}
+	if tenant != DEFAULT_TENANT && strings.HasPrefix(name, tenant+TENANT_SEP) &&
+		!strings.Contains(name[len(tenant)+1:], TENANT_SEP) {
+		return name, nil
+	}
+	return "", errors.New(fmt.Sprintf("Invalid user name:%s", name))
+}
+
+//phoneKey is where the owner of the phone is kept. The same number can sign up once in each tenant.
+func phoneKey(userName string, phone string) string {
+	if tenant := tenantOf(userName); tenant != DEFAULT_TENANT {
+		return tenant + TENANT_SEP + phone
+	}
+	return phone
+}
+
+func maxWaitDistance(tenant string) float64 {
+	if d := tenantConfig(tenant).MaxWaitDistance; d > 0 {
+		return d
+	}
+	return MAX_WAIT_DISTANCE
+}
+
+func maxMatchedUsers(tenant string) int {
+	if n := tenantConfig(tenant).MaxMatchedUsers; n > 0 {
+		return n
+	}
+	return MAX_MATCHED_USERS
+}
+
+//tenantFareRate is the tenant's own rate for the vehicle, if it has one.
+func tenantFareRate(tenant string, vehicleType int) (fareRate, bool) {
+	cfg := tenantConfig(tenant)
+	for name, vt := range vehicleNames {
+		if vt == vehicleType {
+			r, ok := cfg.Fares[name]
+			return r, ok
+		}
+	}
+	return fareRate{}, false
+}
+
+//resolveTenant works out who the request is for: the path prefix /<id>/ or the host, and the token. If both
+//say, they have to agree. Returns the path without the prefix.
+func resolveTenant(r *http.Request) (string, string, error) {
+	tenant, found := DEFAULT_TENANT, false
+	path := r.URL.Path
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	if len(parts) == 2 && parts[0] != "commute" && isTenant(parts[0]) {
+		tenant, found = parts[0], true
+		path = "/" + parts[1]
+	} else {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		gTenantLock.RLock()
+		tenant, found = gTenantHosts[strings.ToLower(host)]
+		gTenantLock.RUnlock()
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if claims, err := parseAccessToken(token); err == nil {
+		if found && tenantOf(claims.Sub) != tenant {
+			return "", "", errors.New("Token is for another tenant")
+		}
+		tenant = tenantOf(claims.Sub)
+	}
+	return tenant, path, nil
+}
+
+//Params which are user names.
+var tenantUserParams = []string{"user", "target"}
+
+//Map events whose status is the other user. For the rest it is something else, eg: a session id for logout,
+//and other handlers use it for what they like.
+var tenantStatusUserEvents = map[string]bool{eventNames[EVENT_JOINREQ]: true, eventNames[EVENT_JOINACCEPT]: true,
+	eventNames[EVENT_TRIPEND]: true, eventNames[EVENT_BLOCK]: true, eventNames[EVENT_UNBLOCK]: true}
+
+//Function TenantRouter puts the tenant into the request before h sees it: the path loses the tenant prefix
+//and the user name params are qualified. Wrap the whole mux with it.
+func TenantRouter(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, path, err := resolveTenant(r)
+		q := r.URL.Query()
+		params := tenantUserParams
+		if strings.Contains(path, "commute/map") && tenantStatusUserEvents[q.Get("eventtype")] {
+			params = []string{"user", "target", "status"}
+		}
+		for _, p := range params {
+			if err != nil || q.Get(p) == "" {
+				continue
+			}
+			var name string
+			if name, err = qualifyUser(tenant, q.Get(p)); err == nil {
+				q.Set(p, name)
+			}
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, "ERROR! :", err)
+			fmt.Println(clockNow(), "\t", r.RemoteAddr, "\t", r.Host, "\t", r.URL.Path, "\t", err)
+			return
+		}
+		r.URL.Path = path
+		r.URL.RawQuery = q.Encode()
+		h.ServeHTTP(w, r)
+	})
+}
+
+//countTenantEvent counts what the tenant's users do. The package's own metrics are for all tenants.
+func countTenantEvent(userName string, eventType int) {
+	tenant := tenantOf(userName)
+	gTenantLock.Lock()
+	defer gTenantLock.Unlock()
+	counts, ok := gTenantEvents[tenant]
+	if !ok {
+		counts = make(map[string]int64)
+		gTenantEvents[tenant] = counts
+	}
+	counts[eventNames[eventType]]++
+}
+
+//tenantStats is what the tenant's staff get to see.
+type tenantStats struct {
+	Tenant  string           `json:"tenant"`
+	Online  int              `json:"online"` //Users with state right now
+	Drivers int              `json:"drivers"`
+	Events  map[string]int64 `json:"events"` //Since the process started
+}
+
+func getTenantStats(tenant string) tenantStats {
+	out := tenantStats{Tenant: tenant, Events: make(map[string]int64)}
+	gStateLock.RLock()
+	for _, s := range gStateDS {
+		if s.tenant == tenant {
+			out.Online++
+			if s.driverOrRider == DRIVER_STATE {
+				out.Drivers++
+			}
+		}
+	}
+	gStateLock.RUnlock()
+	gTenantLock.RLock()
+	for name, n := range gTenantEvents[tenant] {
+		out.Events[name] = n
+	}
+	gTenantLock.RUnlock()
+	return out
+}
+
+//canSeeTenant says if the staff member can look at the tenant's users. Ops on the box and staff of the
+//default tenant can see all; everyone else just their own.
+func canSeeTenant(actor string, tenant string) bool {
+	return actor == "localhost" || tenantOf(actor) == DEFAULT_TENANT || tenantOf(actor) == tenant
+}
+
+//Function TenantStatsHandler shows the stats of each tenant the caller can see, as json. Staff of a tenant
+//see their own. See isTenantStaffRequest.
+func TenantStatsHandler(w http.ResponseWriter, r *http.Request) {
+	actor, ok := isTenantStaffRequest(r, ROLE_ADMIN, ROLE_SUPPORT)
+	if !ok {
+		rejectStaffRequest(w, ROLE_ADMIN, ROLE_SUPPORT)
+		return
+	}
+	gTenantLock.RLock()
+	ids := make([]string, 0, len(gTenants))
+	for id := range gTenants {
+		if canSeeTenant(actor, id) {
+			ids = append(ids, id)
+		}
+	}
+	gTenantLock.RUnlock()
+	sort.Strings(ids)
+	out := make([]tenantStats, 0, len(ids))
+	for _, id := range ids {
+		out = append(out, getTenantStats(id))
+	}
+	err := json.NewEncoder(w).Encode(out)
+	if err != nil {
+		fmt.Fprint(w, "ERROR! :", err)
+	}
+	fmt.Println(clockNow(), "\t", actor, "\t", r.RemoteAddr, "\t", "tenant stats", "\t", err)
+}
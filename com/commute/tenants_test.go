@@ -0,0 +1,239 @@
+package commute
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestTenants(t *testing.T) {
+	Initialize()
+	err := SetTenants([]TenantConfig{
+		{Id: "pune", Hosts: []string{"Pune.example.com"}, MaxWaitDistance: 2000, MaxMatchedUsers: 2,
+			Fares: map[string]fareRate{"car": {Base: 1000, PerKm: 2000, Min: 0}}},
+		{Id: "goa"},
+	})
+	if err != nil {
+		t.Fatalf("tenants not set:%s", err.Error())
+	}
+}
+
+func TestSetTenants(t *testing.T) {
+	Initialize()
+	cases := []struct {
+		tenants  []TenantConfig
+		expected bool
+	}{
+		{[]TenantConfig{{Id: "pune"}}, true},
+		{[]TenantConfig{{Id: "Pune"}}, false},
+		{[]TenantConfig{{Id: "commute/x"}}, false},
+		{[]TenantConfig{{Id: "pune"}, {Id: "pune"}}, false},
+		{[]TenantConfig{{Id: "pune", Hosts: []string{"a.com"}}, {Id: "goa", Hosts: []string{"A.com"}}}, false},
+		{[]TenantConfig{{Id: "pune", MaxWaitDistance: -1}}, false},
+		{[]TenantConfig{{Id: "pune", Fares: map[string]fareRate{"boat": {}}}}, false},
+	}
+	for idx, c := range cases {
+		if err := SetTenants(c.tenants); (err == nil) != c.expected {
+			t.Errorf("test case #%d: err = %v", idx, err)
+		}
+	}
+}
+
+func TestQualifyUser(t *testing.T) {
+	newTestTenants(t)
+	cases := []struct {
+		tenant   string
+		name     string
+		expected string //Empty for an error
+	}{
+		{DEFAULT_TENANT, "rider1", "rider1"},
+		{"pune", "rider1", "pune/rider1"},
+		{"pune", "pune/rider1", "pune/rider1"},
+		{"pune", "goa/rider1", ""},
+		{"pune", "pune/a/b", ""},
+		{DEFAULT_TENANT, "pune/rider1", ""},
+		{DEFAULT_TENANT, "pune", ""}, //Would own the whole tenant's names
+		{"pune", "goa", "pune/goa"},
+	}
+	for idx, c := range cases {
+		got, err := qualifyUser(c.tenant, c.name)
+		if got != c.expected || (err == nil) != (c.expected != "") {
+			t.Errorf("test case #%d: got %s %v, expected %s", idx, got, err, c.expected)
+		}
+	}
+}
+
+func TestTenantRouter(t *testing.T) {
+	newTestTenants(t)
+	puneToken := newUser("pune/rider1", 12.884800, 77.551600, RIDER_STATE)
+
+	var seen *http.Request
+	router := TenantRouter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { seen = r }))
+	cases := []struct {
+		url    string
+		host   string
+		path   string //Empty for a rejected request
+		user   string
+		status string
+	}{
+		{"/commute/map?user=rider1&eventtype=joinrequest&status=driver1", "example.com", "/commute/map", "rider1", "driver1"},
+		{"/pune/commute/map?user=rider1&eventtype=joinrequest&status=driver1", "example.com", "/commute/map", "pune/rider1", "pune/driver1"},
+		{"/pune/commute/map?user=rider1&eventtype=heartbeat&status=driver1", "example.com", "/commute/map", "pune/rider1", "driver1"},
+		{"/pune/commute/admin/drivers?status=approved", "example.com", "/commute/admin/drivers", "", "approved"},
+		{"/commute/map?user=rider1", "pune.example.com:8080", "/commute/map", "pune/rider1", ""},
+		{"/commute/map?user=rider1&eventtype=logout&status=all", "pune.example.com", "/commute/map", "pune/rider1", "all"},
+		{"/goa/commute/map?user=goa/rider1", "example.com", "/commute/map", "goa/rider1", ""},
+		{"/goa/commute/map?user=pune/rider1", "example.com", "", "", ""},
+		{"/nowhere/commute/map?user=rider1", "example.com", "/nowhere/commute/map", "rider1", ""},
+		//The token says which tenant, and cannot be used for another
+		{"/commute/map?user=rider1&token=" + puneToken, "example.com", "/commute/map", "pune/rider1", ""},
+		{"/goa/commute/map?user=rider1&token=" + puneToken, "example.com", "", "", ""},
+	}
+	for idx, c := range cases {
+		seen = nil
+		r := httptest.NewRequest("GET", c.url, nil)
+		r.Host = c.host
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, r)
+		if c.path == "" {
+			if seen != nil || resp.Code != http.StatusBadRequest {
+				t.Errorf("test case #%d: not rejected, code %d", idx, resp.Code)
+			}
+			continue
+		}
+		if seen == nil {
+			t.Errorf("test case #%d: rejected:%s", idx, resp.Body.String())
+			continue
+		}
+		q := seen.URL.Query()
+		if seen.URL.Path != c.path || q.Get("user") != c.user || q.Get("status") != c.status {
+			t.Errorf("test case #%d: got %s %s %s", idx, seen.URL.Path, q.Get("user"), q.Get("status"))
+		}
+	}
+}
+
+//Other handlers get their status as sent.
+func TestTenantAdminList(t *testing.T) {
+	newTestTenants(t)
+	token := newUser("pune/admin1", 12.884800, 77.551600, RIDER_STATE)
+	grantRole("localhost", "pune/admin1", ROLE_ADMIN)
+	approveForTest("pune/driver1")
+	approveForTest("goa/driver1")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/commute/admin/drivers", DriverVerificationAdminHandler)
+	r := httptest.NewRequest("GET", "/pune/commute/admin/drivers?action=list&status=approved&token="+token, nil)
+	r.RemoteAddr = "1.2.3.4:5555"
+	resp := httptest.NewRecorder()
+	TenantRouter(mux).ServeHTTP(resp, r)
+	var list []driverVerification
+	if err := json.Unmarshal(resp.Body.Bytes(), &list); err != nil || len(list) != 1 || list[0].User != "pune/driver1" {
+		t.Errorf("wrong list:%s", resp.Body.String())
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	newTestTenants(t)
+	tokens := make(map[string]string)
+	for _, u := range []string{"rider1", "pune/rider1", "goa/rider1"} {
+		tokens[u] = newUser(u, 12.884800, 77.551600, RIDER_STATE)
+	}
+	for _, u := range []string{"driver1", "pune/driver1", "goa/driver1"} {
+		tokens[u] = newUser(u, 12.884733, 77.551541, DRIVER_STATE)
+	}
+
+	//Same name, separate users
+	for _, u := range []string{"rider1", "pune/rider1", "goa/rider1"} {
+		matches, _ := searchMatches(u, RIDER_STATE)
+		expected := strings.Replace(u, "rider1", "driver1", 1)
+		if got := matchNames(matches); got != expected {
+			t.Errorf("%s found %s, expected %s", u, got, expected)
+		}
+	}
+	if _, err := validateToken("rider1", tokens["pune/rider1"]); err == nil {
+		t.Errorf("token of pune/rider1 works for rider1")
+	}
+
+	//Asking anyway does not get round it
+	if _, err := updateState("pune/rider1", 12.884800, 77.551600, tokens["pune/rider1"], RIDER_STATE, "goa/driver1", EVENT_JOINREQ); err != ErrOtherTenant {
+		t.Errorf("join request to another tenant:%v", err)
+	}
+	if _, err := joinUsers("goa/rider1", "pune/driver1"); err != ErrOtherTenant {
+		t.Errorf("joined across tenants:%v", err)
+	}
+	if _, err := updateState("pune/rider1", 12.884800, 77.551600, tokens["pune/rider1"], RIDER_STATE, "pune/driver1", EVENT_JOINREQ); err != nil {
+		t.Errorf("join request in the tenant failed:%s", err.Error())
+	}
+}
+
+func TestTenantConfig(t *testing.T) {
+	newTestTenants(t)
+	//About 1.1km apart. Within the radius of pune only.
+	for _, tenant := range []string{"pune/", "goa/"} {
+		newUser(tenant+"rider1", 12.884800, 77.551600, RIDER_STATE)
+		for _, d := range []string{"driver1", "driver2", "driver3"} {
+			newUser(tenant+d, 12.894800, 77.551600, DRIVER_STATE)
+		}
+	}
+	cases := []struct {
+		user     string
+		expected int
+	}{
+		{"pune/rider1", 2}, //Only shows 2
+		{"goa/rider1", 0},
+	}
+	for idx, c := range cases {
+		if matches, _ := searchMatches(c.user, RIDER_STATE); len(matches) != c.expected {
+			t.Errorf("test case #%d: got %d matches, expected %d", idx, len(matches), c.expected)
+		}
+	}
+
+	if got, want := tripFare("pune", 5000, VEHICLE_CAR), int64(11000); got != want {
+		t.Errorf("pune fare %d, expected %d", got, want)
+	}
+	if tripFare("pune", 5000, VEHICLE_BIKE) != tripFare(DEFAULT_TENANT, 5000, VEHICLE_BIKE) ||
+		tripFare("goa", 5000, VEHICLE_CAR) != tripFare(DEFAULT_TENANT, 5000, VEHICLE_CAR) {
+		t.Errorf("rates not set by the tenant changed")
+	}
+}
+
+func TestTenantStats(t *testing.T) {
+	newTestTenants(t)
+	token := newUser("pune/admin1", 12.884800, 77.551600, RIDER_STATE)
+	grantRole("localhost", "pune/admin1", ROLE_ADMIN)
+	newUser("pune/driver1", 12.884733, 77.551541, DRIVER_STATE)
+	newUser("goa/rider1", 12.884800, 77.551600, RIDER_STATE)
+	updateState("pune/admin1", 12.884800, 77.551600, token, RIDER_STATE, "", EVENT_HEARTBEAT)
+
+	stats := func(remote string, token string) []tenantStats {
+		r := httptest.NewRequest("GET", "/commute/admin/tenants?token="+token, nil)
+		r.RemoteAddr = remote
+		resp := httptest.NewRecorder()
+		TenantStatsHandler(resp, r)
+		var out []tenantStats
+		json.Unmarshal(resp.Body.Bytes(), &out)
+		return out
+	}
+	all := stats("127.0.0.1:5555", "")
+	if len(all) != 3 || all[0].Tenant != DEFAULT_TENANT || all[1].Tenant != "goa" || all[1].Online != 1 {
+		t.Fatalf("wrong stats:%+v", all)
+	}
+	own := stats("1.2.3.4:5555", token)
+	if len(own) != 1 || own[0].Tenant != "pune" || own[0].Online != 2 || own[0].Drivers != 1 ||
+		own[0].Events["heartbeat"] != 1 || len(own[0].Events) != 1 {
+		t.Errorf("wrong tenant stats:%+v", own)
+	}
+
+	//Tenant staff are not staff of the platform, nor of another tenant
+	if _, ok := isStaffRequest(httptest.NewRequest("GET", "/commute/admin/roles?token="+token, nil), ROLE_ADMIN); ok {
+		t.Errorf("tenant admin passed as platform staff")
+	}
+	r := httptest.NewRequest("GET", "/commute/admin/roles?action=list&target=goa/rider1&token="+token, nil)
+	resp := httptest.NewRecorder()
+	RolesHandler(resp, r)
+	if !strings.HasPrefix(resp.Body.String(), "ERROR!") {
+		t.Errorf("tenant admin saw another tenant's user:%s", resp.Body.String())
+	}
+}
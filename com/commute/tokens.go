@@ -0,0 +1,251 @@
+package commute
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Access tokens are signed (JWT, HS256) and carry the user, role and expiry, so any instance can check them
+//without looking anything up. They are short lived. Refresh tokens are kept in the store so that they can be
+//revoked, and are traded in for a new pair.
+const ACCESS_TOKEN_TTL = 15 * time.Minute
+const OPEN_LOGIN_TOKEN_TTL = 24 * time.Hour //Old apps have no refresh. They log in again when the app starts.
+const REFRESH_TOKEN_TTL = 30 * 24 * time.Hour
+const SIGNING_KEY_MIN_BYTES = 32
+
+//Store buckets used by tokens
+const bucketRefreshTokens = "refreshtokens" //sha256 of the token -> refreshRecord
+
+//accessClaims is the payload of an access token.
+type accessClaims struct {
+	Sub  string `json:"sub"`
+	Role int    `json:"role"` //DRIVER_STATE or RIDER_STATE. 0 when not picked yet.
+	Iat  int64  `json:"iat"`
+	Exp  int64  `json:"exp"`
+	Jti  string `json:"jti"`
+	Sid  string `json:"sid"` //Session, see sessions.go
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+type refreshRecord struct {
+	User    string `json:"user"`
+	Session string `json:"session"`
+	Created int64  `json:"created"`
+	Expires int64  `json:"expires"`
+}
+
+//signingKeyFile is the key file. Tokens are signed with current and checked with any of keys, so that
+//tokens signed with the old key keep working for a while after a rotation.
+//eg: {"current":"2026-10","keys":{"2026-10":"<base64>","2026-09":"<base64>"}}
+type signingKeyFile struct {
+	Current string            `json:"current"`
+	Keys    map[string]string `json:"keys"`
+}
+
+var gSigningKeys map[string][]byte //By key id
+var gCurrentKeyId string
+var gSigningKeyFile string
+var gTokensLock = sync.RWMutex{}
+
+//Every process makes up its own key unless given a file. Fine for one instance; more need the same file.
+func resetTokens() {
+	key := make([]byte, SIGNING_KEY_MIN_BYTES)
+	crand.Read(key)
+	gTokensLock.Lock()
+	defer gTokensLock.Unlock()
+	gSigningKeys = map[string][]byte{"local": key}
+	gCurrentKeyId = "local"
+	gSigningKeyFile = ""
+}
+
+//LoadSigningKeys reads the key file and swaps the keys in. Empty path keeps the current keys. On error too.
+func LoadSigningKeys(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var f signingKeyFile
+	if err = json.Unmarshal(data, &f); err != nil {
+		return errors.New(fmt.Sprintf("Invalid key file %s : %s", path, err.Error()))
+	}
+	keys := make(map[string][]byte)
+	for kid, s := range f.Keys {
+		key, err := base64.StdEncoding.DecodeString(s)
+		if err != nil || len(key) < SIGNING_KEY_MIN_BYTES {
+			return errors.New(fmt.Sprintf("Invalid key %s in %s. Need %d bytes, base64", kid, path, SIGNING_KEY_MIN_BYTES))
+		}
+		keys[kid] = key
+	}
+	if _, ok := keys[f.Current]; !ok {
+		return errors.New(fmt.Sprintf("Current key %s not in %s", f.Current, path))
+	}
+	gTokensLock.Lock()
+	defer gTokensLock.Unlock()
+	gSigningKeys = keys
+	gCurrentKeyId = f.Current
+	gSigningKeyFile = path
+	return nil
+}
+
+//ReloadSigningKeys re-reads the file passed in the last LoadSigningKeys call.
+func ReloadSigningKeys() error {
+	gTokensLock.RLock()
+	path := gSigningKeyFile
+	gTokensLock.RUnlock()
+	return LoadSigningKeys(path)
+}
+
+func signToken(signingInput string, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signingInput))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+//signAccessToken makes an access token for the user's session valid for ttl.
+func signAccessToken(userName string, role int, sessionId string, ttl time.Duration) string {
+	now := clockNow()
+	gTokensLock.RLock()
+	kid := gCurrentKeyId
+	key := gSigningKeys[kid]
+	gTokensLock.RUnlock()
+
+	header, _ := json.Marshal(tokenHeader{Alg: "HS256", Typ: "JWT", Kid: kid})
+	claims, _ := json.Marshal(accessClaims{Sub: userName, Role: role, Iat: now.Unix(), Exp: now.Add(ttl).Unix(),
+		Jti: randSecret(), Sid: sessionId})
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	return signingInput + "." + signToken(signingInput, key)
+}
+
+//parseAccessToken checks the signature and expiry and returns what the token says.
+func parseAccessToken(token string) (*accessClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header tokenHeader
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(data, &header) != nil {
+		return nil, errors.New("malformed token header")
+	}
+	//Only what we sign with. Anything else, "none" included, is somebody trying their luck.
+	if header.Alg != "HS256" {
+		return nil, errors.New(fmt.Sprintf("unexpected token alg:%s", header.Alg))
+	}
+	gTokensLock.RLock()
+	key, ok := gSigningKeys[header.Kid]
+	gTokensLock.RUnlock()
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("unknown signing key:%s", header.Kid))
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(signToken(parts[0]+"."+parts[1], key))) {
+		return nil, errors.New("bad token signature")
+	}
+	claims := &accessClaims{}
+	data, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(data, claims) != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	if clockNow().Unix() >= claims.Exp {
+		return nil, errors.New("token expired")
+	}
+	return claims, nil
+}
+
+func refreshKey(refresh string) string {
+	h := sha256.Sum256([]byte(refresh))
+	return hex.EncodeToString(h[:])
+}
+
+//issueRefreshToken saves a new refresh token for the session, in place of the one it had. Only its hash
+//goes in the store.
+func issueRefreshToken(s *session) (string, error) {
+	now := clockNow()
+	refresh := randSecret()
+	rec := refreshRecord{User: s.User, Session: s.Id, Created: now.Unix(), Expires: now.Add(REFRESH_TOKEN_TTL).Unix()}
+	if err := storePutJSON(bucketRefreshTokens, refreshKey(refresh), rec); err != nil {
+		return "", err
+	}
+	if s.Refresh != "" {
+		getStore().Delete(bucketRefreshTokens, s.Refresh)
+	}
+	s.Refresh = refreshKey(refresh)
+	s.Expires = rec.Expires
+	if err := saveSession(s); err != nil {
+		return "", err
+	}
+	return refresh, nil
+}
+
+//refreshSession trades a refresh token in for a new access token and a new refresh token. The old one is
+//revoked, so a stolen one works only till either side uses it.
+func refreshSession(refresh string) (string, string, error) {
+	gSessionsLock.Lock()
+	defer gSessionsLock.Unlock()
+
+	var rec refreshRecord
+	if err := storeGetJSON(bucketRefreshTokens, refreshKey(refresh), &rec); err != nil {
+		return "", "", errors.New("Invalid refresh token. Log in again")
+	}
+	if err := getStore().Delete(bucketRefreshTokens, refreshKey(refresh)); err != nil {
+		return "", "", err
+	}
+	if clockNow().Unix() >= rec.Expires {
+		return "", "", errors.New("Refresh token expired. Log in again")
+	}
+	s, err := getSession(rec.User, rec.Session)
+	if err != nil || s.Refresh != refreshKey(refresh) {
+		return "", "", errors.New("Logged out. Log in again")
+	}
+	newRefresh, err := issueRefreshToken(s)
+	if err != nil {
+		return "", "", err
+	}
+	return sessionToken(s), newRefresh, nil
+}
+
+//revokeRefreshToken throws the refresh token away. Access tokens already out run till they expire.
+func revokeRefreshToken(refresh string) error {
+	if err := storeGetJSON(bucketRefreshTokens, refreshKey(refresh), &refreshRecord{}); err != nil {
+		return errors.New("Invalid refresh token")
+	}
+	return getStore().Delete(bucketRefreshTokens, refreshKey(refresh))
+}
+
+//Response with a token pair. Apps keep the refresh token and use the access token as the token param.
+func tokensPayload(access string, refresh string) string {
+	return fmt.Sprintf("tokens,%s,%s,%d", access, refresh, int(ACCESS_TOKEN_TTL.Seconds()))
+}
+
+//Function SigningKeysReloadHandler re-reads the key file, to rotate keys without a restart. Admins only.
+func SigningKeysReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := isStaffRequest(r, ROLE_ADMIN); !ok {
+		rejectStaffRequest(w, ROLE_ADMIN)
+		return
+	}
+	err := ReloadSigningKeys()
+	if err != nil {
+		fmt.Fprint(w, "ERROR! : ", err)
+	} else {
+		fmt.Fprint(w, "Signing keys reloaded")
+	}
+	fmt.Println(clockNow(), "\t", "signing keys reload", "\t", r.RemoteAddr, "\t", err)
+}
@@ -0,0 +1,179 @@
+package commute
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+//Writes a key file with the given key ids, current first. Keys are made from the id, so the same id is the
+//same key across files.
+func writeKeyFile(t *testing.T, path string, kids ...string) {
+	keys := make([]string, 0, len(kids))
+	for _, kid := range kids {
+		key := base64.StdEncoding.EncodeToString([]byte(strings.Repeat(kid, SIGNING_KEY_MIN_BYTES)[:SIGNING_KEY_MIN_BYTES]))
+		keys = append(keys, fmt.Sprintf(`"%s":"%s"`, kid, key))
+	}
+	data := fmt.Sprintf(`{"current":"%s","keys":{%s}}`, kids[0], strings.Join(keys, ","))
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("could not write key file:%s", err.Error())
+	}
+}
+
+func TestAccessToken(t *testing.T) {
+	Initialize()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+
+	s, _ := startSession("driver1", DRIVER_STATE, "", "", REFRESH_TOKEN_TTL)
+	token := signAccessToken("driver1", DRIVER_STATE, s.Id, ACCESS_TOKEN_TTL)
+	claims, err := parseAccessToken(token)
+	if err != nil || claims.Sub != "driver1" || claims.Role != DRIVER_STATE ||
+		claims.Exp != clock.Now().Add(ACCESS_TOKEN_TTL).Unix() {
+		t.Fatalf("claims wrong:%+v err:%v", claims, err)
+	}
+
+	parts := strings.Split(token, ".")
+	forged := []byte(`{"sub":"driver2","role":1,"exp":9999999999}`)
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT","kid":"local"}`))
+	cases := []struct {
+		token    string
+		user     string
+		expected bool
+	}{
+		{token, "driver1", true},
+		{token, "driver2", false}, //Someone else's token
+		{parts[0] + "." + base64.RawURLEncoding.EncodeToString(forged) + "." + parts[2], "driver2", false},
+		{none + "." + parts[1] + ".", "driver1", false},
+		{parts[0] + "." + parts[1], "driver1", false},
+		{"", "driver1", false},
+		{"SomeString:1234", "driver1", false},
+	}
+	for idx, c := range cases {
+		if ok, _ := isUserValid(c.user, c.token); ok != c.expected {
+			t.Errorf("test case #%d: isUserValid = %t, expected %t", idx, ok, c.expected)
+		}
+	}
+
+	clock.Advance(ACCESS_TOKEN_TTL)
+	if _, err = parseAccessToken(token); err == nil {
+		t.Errorf("expired token accepted")
+	}
+}
+
+//Tokens signed with a key keep working for as long as the key is in the file.
+func TestSigningKeyRotation(t *testing.T) {
+	Initialize()
+	f, _ := ioutil.TempFile("", "keys")
+	f.Close()
+	defer os.Remove(f.Name())
+
+	local := signAccessToken("rider1", RIDER_STATE, "", ACCESS_TOKEN_TTL)
+	writeKeyFile(t, f.Name(), "k1")
+	if err := LoadSigningKeys(f.Name()); err != nil {
+		t.Fatalf("LoadSigningKeys failed:%s", err.Error())
+	}
+	if _, err := parseAccessToken(local); err == nil {
+		t.Errorf("token from the dropped key accepted")
+	}
+	old := signAccessToken("rider1", RIDER_STATE, "", ACCESS_TOKEN_TTL)
+
+	writeKeyFile(t, f.Name(), "k2", "k1")
+	if err := ReloadSigningKeys(); err != nil {
+		t.Fatalf("ReloadSigningKeys failed:%s", err.Error())
+	}
+	current := signAccessToken("rider1", RIDER_STATE, "", ACCESS_TOKEN_TTL)
+	if _, err := parseAccessToken(old); err != nil {
+		t.Errorf("token from the old key rejected:%s", err.Error())
+	}
+	if !strings.HasPrefix(current, base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT","kid":"k2"}`))) {
+		t.Errorf("not signed with the current key:%s", current)
+	}
+
+	writeKeyFile(t, f.Name(), "k2")
+	ReloadSigningKeys()
+	if _, err := parseAccessToken(old); err == nil {
+		t.Errorf("token from the retired key accepted")
+	}
+	if _, err := parseAccessToken(current); err != nil {
+		t.Errorf("token from the current key rejected:%s", err.Error())
+	}
+
+	//Bad files leave the keys alone
+	badFiles := []string{
+		`not json`,
+		`{"current":"k3","keys":{"k2":"` + base64.StdEncoding.EncodeToString(make([]byte, 32)) + `"}}`,
+		`{"current":"k3","keys":{"k3":"c2hvcnQ="}}`,
+		`{"current":"k3","keys":{"k3":"not base64"}}`,
+	}
+	for idx, content := range badFiles {
+		ioutil.WriteFile(f.Name(), []byte(content), 0644)
+		if err := ReloadSigningKeys(); err == nil {
+			t.Errorf("test case #%d: bad key file loaded", idx)
+		}
+	}
+	if _, err := parseAccessToken(current); err != nil {
+		t.Errorf("keys changed by a bad file:%s", err.Error())
+	}
+
+	//Reload endpoint
+	resp := httptest.NewRecorder()
+	SigningKeysReloadHandler(resp, httptest.NewRequest("GET", "/commute/admin/keys/reload", nil))
+	if resp.Code != 403 {
+		t.Errorf("reload allowed from outside:%d", resp.Code)
+	}
+}
+
+func TestRefreshSession(t *testing.T) {
+	Initialize()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+
+	newRefresh := func(device string) (string, error) {
+		s, _ := startSession("driver1", DRIVER_STATE, device, "", REFRESH_TOKEN_TTL)
+		return issueRefreshToken(s)
+	}
+	refresh, err := newRefresh("phone1")
+	if err != nil {
+		t.Fatalf("issueRefreshToken failed:%s", err.Error())
+	}
+	clock.Advance(time.Hour)
+	access, refresh2, err := refreshSession(refresh)
+	if err != nil {
+		t.Fatalf("refresh failed:%s", err.Error())
+	}
+	if claims, err := parseAccessToken(access); err != nil || claims.Sub != "driver1" || claims.Role != DRIVER_STATE {
+		t.Errorf("wrong access token:%+v err:%v", claims, err)
+	}
+	//Used once
+	if _, _, err = refreshSession(refresh); err == nil {
+		t.Errorf("refresh token used twice")
+	}
+
+	//Revoked
+	if err = revokeRefreshToken(refresh2); err != nil {
+		t.Errorf("revoke failed:%s", err.Error())
+	}
+	if _, _, err = refreshSession(refresh2); err == nil {
+		t.Errorf("revoked refresh token worked")
+	}
+
+	//Expired
+	refresh3, _ := newRefresh("phone3")
+	clock.Advance(REFRESH_TOKEN_TTL)
+	if _, _, err = refreshSession(refresh3); err == nil {
+		t.Errorf("expired refresh token worked")
+	}
+
+	//Through the endpoint
+	refresh4, _ := newRefresh("phone4")
+	retStr, err := processAuthRequest("driver1", "refresh", "", "", "", refresh4, "", "")
+	if fields := strings.Split(retStr, ","); err != nil || len(fields) != 4 || fields[0] != "tokens" {
+		t.Errorf("refresh via endpoint failed. ret:%s err:%v", retStr, err)
+	}
+}
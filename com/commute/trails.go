@@ -0,0 +1,278 @@
+package commute
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//Trails are the routes actually taken on a trip. While it is active every location update of the rider and
+//of the driver goes in, each side on its own since the two only share the car after the pickup. When it
+//completes the trail is simplified and kept with the trip. Both of them can see it, during and after.
+const TRAIL_MAX_POINTS = 1000     //Per side, in memory. Past this the trail is simplified to make room.
+const TRAIL_TOLERANCE = 5.0       //Metres. What the trail is simplified to when shown, unless asked otherwise
+const TRAIL_MAX_TOLERANCE = 500.0 //Metres. The most that can be asked for
+const TRAIL_STORE_TOLERANCE = 2.0 //Metres. What is kept once the trip completes
+
+const bucketTrails = "trails" //tripId -> tripTrail
+
+type trailPoint struct {
+	Lat  float64 `json:"lat"`
+	Lng  float64 `json:"lng"`
+	Time int64   `json:"time"`
+}
+
+type tripTrail struct {
+	TripId string       `json:"tripid"`
+	Rider  []trailPoint `json:"rider"`
+	Driver []trailPoint `json:"driver"`
+}
+
+//Trails of the active trips by trip id.
+var gTrails map[string]*tripTrail
+var gTrailsLock = sync.Mutex{}
+
+func resetTrails() {
+	gTrailsLock.Lock()
+	defer gTrailsLock.Unlock()
+	gTrails = make(map[string]*tripTrail, 1000)
+}
+
+//recordTrailPoint adds the user's new position to the trails of the trips they are on. Only for locations
+//the app sent. Callers hold gStateLock.
+func recordTrailPoint(userName string, s *CommState, lat float64, lng float64) {
+	if len(s.arrConnectedWith) == 0 {
+		return
+	}
+	p := trailPoint{lat, lng, clockNow().Unix()}
+	for _, other := range s.arrConnectedWith {
+		rider, driver := userName, other
+		if s.driverOrRider == DRIVER_STATE {
+			rider, driver = other, userName
+		}
+		gActiveTripsLock.RLock()
+		tripId, ok := gActiveTrips[tripPairKey(rider, driver)]
+		gActiveTripsLock.RUnlock()
+		if !ok {
+			continue
+		}
+		gTrailsLock.Lock()
+		t, ok := gTrails[tripId]
+		if !ok {
+			t = &tripTrail{TripId: tripId, Rider: make([]trailPoint, 0), Driver: make([]trailPoint, 0)}
+			gTrails[tripId] = t
+		}
+		if userName == rider {
+			t.Rider = appendTrailPoint(t.Rider, p)
+		} else {
+			t.Driver = appendTrailPoint(t.Driver, p)
+		}
+		gTrailsLock.Unlock()
+	}
+}
+
+//Past the cap, simplifies harder and harder till the trail is down to half of it, so that it is not done on
+//every update.
+func appendTrailPoint(arr []trailPoint, p trailPoint) []trailPoint {
+	arr = append(arr, p)
+	if len(arr) <= TRAIL_MAX_POINTS {
+		return arr
+	}
+	for tolerance := TRAIL_TOLERANCE; len(arr) > TRAIL_MAX_POINTS/2; tolerance *= 2 {
+		if tolerance > TRAIL_MAX_TOLERANCE {
+			return arr[len(arr)-TRAIL_MAX_POINTS/2:] //Wanders all over. Better the recent part than none.
+		}
+		arr = simplifyTrail(arr, tolerance)
+	}
+	return arr
+}
+
+//persistTrail keeps the trail with the completed trip and lets go of it in memory.
+func persistTrail(tripId string) error {
+	gTrailsLock.Lock()
+	t, ok := gTrails[tripId]
+	delete(gTrails, tripId)
+	gTrailsLock.Unlock()
+	if !ok {
+		return nil
+	}
+	t.Rider = simplifyTrail(t.Rider, TRAIL_STORE_TOLERANCE)
+	t.Driver = simplifyTrail(t.Driver, TRAIL_STORE_TOLERANCE)
+	return storePutJSON(bucketTrails, tripId, t)
+}
+
+//getTrail returns a copy of the trip's trail, from memory while it is active.
+func getTrail(trip *Trip) *tripTrail {
+	out := &tripTrail{TripId: trip.TripId, Rider: make([]trailPoint, 0), Driver: make([]trailPoint, 0)}
+	if trip.State == TRIP_ACTIVE {
+		gTrailsLock.Lock()
+		defer gTrailsLock.Unlock()
+		if t, ok := gTrails[trip.TripId]; ok {
+			out.Rider = append(out.Rider, t.Rider...)
+			out.Driver = append(out.Driver, t.Driver...)
+		}
+		return out
+	}
+	storeGetJSON(bucketTrails, trip.TripId, out)
+	return out
+}
+
+//Metres from p to the segment a-b. Flat earth around a, which is plenty over a trail's few hundred metres.
+func distToSegment(p trailPoint, a trailPoint, b trailPoint) float64 {
+	cos := math.Cos(a.Lat * math.Pi / 180)
+	toXY := func(q trailPoint) (float64, float64) {
+		return (q.Lng - a.Lng) * cos * math.Pi / 180 * earthRadiusMetres, (q.Lat - a.Lat) * math.Pi / 180 * earthRadiusMetres
+	}
+	px, py := toXY(p)
+	bx, by := toXY(b)
+	l2 := bx*bx + by*by
+	if l2 == 0 {
+		return math.Hypot(px, py)
+	}
+	f := math.Max(0, math.Min(1, (px*bx+py*by)/l2))
+	return math.Hypot(px-f*bx, py-f*by)
+}
+
+//simplifyTrail is Douglas-Peucker: keeps the ends and, between them, only the points more than tolerance
+//metres off the line the kept ones make.
+func simplifyTrail(arr []trailPoint, tolerance float64) []trailPoint {
+	if len(arr) < 3 {
+		return append(make([]trailPoint, 0, len(arr)), arr...)
+	}
+	keep := make([]bool, len(arr))
+	keep[0], keep[len(arr)-1] = true, true
+	stack := [][2]int{{0, len(arr) - 1}}
+	for len(stack) > 0 {
+		first, last := stack[len(stack)-1][0], stack[len(stack)-1][1]
+		stack = stack[:len(stack)-1]
+		idx, max := 0, 0.0
+		for i := first + 1; i < last; i++ {
+			if d := distToSegment(arr[i], arr[first], arr[last]); d > max {
+				idx, max = i, d
+			}
+		}
+		if max > tolerance {
+			keep[idx] = true
+			stack = append(stack, [2]int{first, idx}, [2]int{idx, last})
+		}
+	}
+	out := make([]trailPoint, 0)
+	for i, p := range arr {
+		if keep[i] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+//encodePolyline is the Google encoded polyline format, 5 decimals.
+func encodePolyline(arr []trailPoint) string {
+	var sb strings.Builder
+	encode := func(v int64) {
+		v <<= 1
+		if v < 0 {
+			v = ^v
+		}
+		for v >= 0x20 {
+			sb.WriteByte(byte((0x20 | (v & 0x1f)) + 63))
+			v >>= 5
+		}
+		sb.WriteByte(byte(v + 63))
+	}
+	var prevLat, prevLng int64
+	for _, p := range arr {
+		lat, lng := int64(math.Round(p.Lat*1e5)), int64(math.Round(p.Lng*1e5))
+		encode(lat - prevLat)
+		encode(lng - prevLng)
+		prevLat, prevLng = lat, lng
+	}
+	return sb.String()
+}
+
+type geoJSONLineString struct {
+	Type        string       `json:"type"`
+	Coordinates [][2]float64 `json:"coordinates"` //lng, lat as GeoJSON has it
+}
+
+func toLineString(arr []trailPoint) geoJSONLineString {
+	coords := make([][2]float64, 0, len(arr))
+	for _, p := range arr {
+		coords = append(coords, [2]float64{p.Lng, p.Lat})
+	}
+	return geoJSONLineString{"LineString", coords}
+}
+
+//trailSide is one side's trail as sent back.
+type trailSide struct {
+	User     string            `json:"user"`
+	Points   int               `json:"points"` //Kept, before simplifying to the tolerance
+	Start    int64             `json:"start,omitempty"`
+	End      int64             `json:"end,omitempty"`
+	Polyline string            `json:"polyline"`
+	GeoJSON  geoJSONLineString `json:"geojson"`
+}
+
+type trailView struct {
+	TripId    string    `json:"tripid"`
+	State     int       `json:"state"`
+	Tolerance float64   `json:"tolerance"`
+	Rider     trailSide `json:"rider"`
+	Driver    trailSide `json:"driver"`
+}
+
+func newTrailSide(userName string, arr []trailPoint, tolerance float64) trailSide {
+	s := trailSide{User: userName, Points: len(arr)}
+	if len(arr) > 0 {
+		s.Start, s.End = arr[0].Time, arr[len(arr)-1].Time
+	}
+	arr = simplifyTrail(arr, tolerance)
+	s.Polyline = encodePolyline(arr)
+	s.GeoJSON = toLineString(arr)
+	return s
+}
+
+//processTrailRequest returns the trail of the trip as json. Only the two on the trip get to see it.
+func processTrailRequest(userName string, token string, tripId string, toleranceStr string) (string, error) {
+	if _, err := isUserValid(userName, token); err != nil {
+		return "", err
+	}
+	tolerance := TRAIL_TOLERANCE
+	if toleranceStr != "" {
+		var err error
+		tolerance, err = strconv.ParseFloat(toleranceStr, 64)
+		if err != nil || tolerance < 0 || tolerance > TRAIL_MAX_TOLERANCE {
+			return "", errors.New(fmt.Sprintf("ERROR in tolerance parameter:%s", toleranceStr))
+		}
+	}
+	trip, err := getTrip(tripId)
+	if err != nil || (trip.Rider != userName && trip.Driver != userName) {
+		return "", errors.New(fmt.Sprintf("No such trip:%s", tripId))
+	}
+	t := getTrail(trip)
+	out, err := json.Marshal(trailView{trip.TripId, trip.State, tolerance,
+		newTrailSide(trip.Rider, t.Rider, tolerance), newTrailSide(trip.Driver, t.Driver, tolerance)})
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+//Function TrailHandler returns the route taken on a trip, while it goes on and after, as an encoded
+//polyline and a GeoJSON LineString for each of the rider and the driver. Params are user, token, trip and
+//tolerance (metres, to simplify to).
+func TrailHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	user := q.Get("user")
+	retValue, err := processTrailRequest(user, q.Get("token"), q.Get("trip"), q.Get("tolerance"))
+	if err != nil {
+		fmt.Fprint(w, "ERROR! :", err)
+	} else {
+		fmt.Fprint(w, retValue)
+	}
+	fmt.Println(clockNow(), "\t", user, "\t", r.RemoteAddr, "\t", "trail", "\t", q.Get("trip"), "\t", err)
+}
@@ -0,0 +1,147 @@
+package commute
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSimplifyTrail(t *testing.T) {
+	start := Point{Lat: 12.884800, Lon: 77.551600}
+	trail := func(steps ...[2]float64) []trailPoint {
+		arr := make([]trailPoint, 0)
+		for i, s := range steps { //Heading and metres from start
+			p := movePoint(start, s[0], s[1])
+			arr = append(arr, trailPoint{p.Lat, p.Lon, int64(i)})
+		}
+		return arr
+	}
+	cases := []struct {
+		arr       []trailPoint
+		tolerance float64
+		expected  int
+	}{
+		{trail([2]float64{0, 0}), 5, 1},
+		{trail([2]float64{0, 0}, [2]float64{0, 100}), 5, 2},
+		{trail([2]float64{0, 0}, [2]float64{0, 50}, [2]float64{0, 100}, [2]float64{0, 150}), 5, 2}, //Straight
+		{trail([2]float64{0, 0}, [2]float64{0, 100}, [2]float64{45, 141}), 5, 3},                   //Turns right
+		{trail([2]float64{0, 0}, [2]float64{3, 100}, [2]float64{0, 200}), 10, 2},                   //5m off, noise
+		{trail([2]float64{0, 0}, [2]float64{3, 100}, [2]float64{0, 200}), 2, 3},
+		{trail([2]float64{0, 0}, [2]float64{0, 100}, [2]float64{45, 141}, [2]float64{90, 100}, [2]float64{0, 1}), 5, 5},
+	}
+	for idx, c := range cases {
+		got := simplifyTrail(c.arr, c.tolerance)
+		if len(got) != c.expected || got[0] != c.arr[0] || got[len(got)-1] != c.arr[len(c.arr)-1] {
+			t.Errorf("test case #%d: got %d points, expected %d", idx, len(got), c.expected)
+		}
+	}
+
+	//Capped in memory
+	arr := make([]trailPoint, 0)
+	for i := 0; i < 3*TRAIL_MAX_POINTS; i++ {
+		p := movePoint(start, float64(i*97%360), float64(i%50)*10)
+		arr = appendTrailPoint(arr, trailPoint{p.Lat, p.Lon, int64(i)})
+		if len(arr) > TRAIL_MAX_POINTS {
+			t.Fatalf("trail grew to %d", len(arr))
+		}
+	}
+	if arr[len(arr)-1].Time != int64(3*TRAIL_MAX_POINTS-1) {
+		t.Errorf("lost the latest point")
+	}
+}
+
+func TestEncodePolyline(t *testing.T) {
+	cases := []struct {
+		arr      []trailPoint
+		expected string
+	}{
+		{[]trailPoint{}, ""},
+		//The example in Google's docs
+		{[]trailPoint{{38.5, -120.2, 0}, {40.7, -120.95, 0}, {43.252, -126.453, 0}}, "_p~iF~ps|U_ulLnnqC_mqNvxq`@"},
+		{[]trailPoint{{-179.9832104, -179.9832104, 0}}, "`~oia@`~oia@"}, //Also from the docs, one value
+	}
+	for idx, c := range cases {
+		if got := encodePolyline(c.arr); got != c.expected {
+			t.Errorf("test case #%d: got %s, expected %s", idx, got, c.expected)
+		}
+	}
+}
+
+func TestTripTrail(t *testing.T) {
+	Initialize()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+	start := Point{Lat: 12.884800, Lon: 77.551600}
+	riderToken := newUser("rider1", start.Lat, start.Lon, RIDER_STATE)
+	driverToken := newUser("driver1", start.Lat, start.Lon, DRIVER_STATE)
+	otherToken := newUser("rider2", start.Lat, start.Lon, RIDER_STATE)
+	updateState("rider1", start.Lat, start.Lon, riderToken, RIDER_STATE, "driver1", EVENT_JOINREQ)
+	updateState("driver1", start.Lat, start.Lon, driverToken, DRIVER_STATE, "rider1", EVENT_JOINACCEPT)
+	trip, _ := getActiveTrip("rider1", "driver1")
+
+	//North 300m, a stop, then east 200m, both of them in the car
+	corner := movePoint(start, 0, 300)
+	route := []Point{movePoint(start, 0, 100), movePoint(start, 0, 200), corner, corner,
+		movePoint(corner, 90, 100), movePoint(corner, 90, 200)}
+	var at Point
+	for _, at = range route {
+		clock.Advance(20 * time.Second)
+		updateState("driver1", at.Lat, at.Lon, driverToken, DRIVER_STATE, "", EVENT_HEARTBEAT)
+		updateState("rider1", at.Lat, at.Lon, riderToken, RIDER_STATE, "", EVENT_HEARTBEAT)
+	}
+	updateState("rider2", at.Lat, at.Lon, otherToken, RIDER_STATE, "", EVENT_HEARTBEAT)
+	//Nothing goes in for events without a location
+	clock.Advance(20 * time.Second)
+	q, _ := url.ParseQuery("user=driver1&mode=1&eventtype=blocklist&token=" + driverToken)
+	processQuery(q, "okhttp")
+
+	get := func(user string, token string, tolerance string) (*trailView, error) {
+		ret, err := processTrailRequest(user, token, trip.TripId, tolerance)
+		if err != nil {
+			return nil, err
+		}
+		v := &trailView{}
+		return v, json.Unmarshal([]byte(ret), v)
+	}
+	v, err := get("rider1", riderToken, "")
+	if err != nil {
+		t.Fatalf("trail failed:%s", err.Error())
+	}
+	if v.State != TRIP_ACTIVE || v.Driver.Points != 6 || v.Rider.Points != 6 || len(v.Driver.GeoJSON.Coordinates) != 3 ||
+		v.Driver.GeoJSON.Type != "LineString" || v.Driver.GeoJSON.Coordinates[2][0] != at.Lon || v.Driver.Polyline == "" {
+		t.Errorf("wrong trail:%+v", v)
+	}
+
+	cases := []struct {
+		user      string
+		token     string
+		tolerance string
+		expected  bool
+	}{
+		{"driver1", driverToken, "0", true},
+		{"rider2", otherToken, "", false}, //Not on the trip
+		{"rider1", "badtoken", "", false},
+		{"rider1", riderToken, "-1", false},
+		{"rider1", riderToken, "far", false},
+		{"rider1", riderToken, "501", false},
+	}
+	for idx, c := range cases {
+		if _, err = get(c.user, c.token, c.tolerance); (err == nil) != c.expected {
+			t.Errorf("test case #%d: err = %v", idx, err)
+		}
+	}
+
+	//Kept after the trip, simplified, and nothing more goes in
+	updateState("driver1", at.Lat, at.Lon, driverToken, DRIVER_STATE, "rider1", EVENT_TRIPEND)
+	clock.Advance(20 * time.Second)
+	updateState("driver1", start.Lat, start.Lon, driverToken, DRIVER_STATE, "", EVENT_HEARTBEAT)
+	gTrailsLock.Lock()
+	inMemory := len(gTrails)
+	gTrailsLock.Unlock()
+	v, err = get("driver1", driverToken, "")
+	if err != nil || inMemory != 0 || v.State != TRIP_COMPLETED || v.Driver.Points != 3 || v.Driver.End != clockNow().Unix()-20 ||
+		v.Rider.Polyline != v.Driver.Polyline {
+		t.Errorf("wrong trail after the trip:%+v %v", v, err)
+	}
+}
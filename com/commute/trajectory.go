@@ -0,0 +1,139 @@
+package commute
+
+import (
+	"math"
+	"sort"
+)
+
+//Each user keeps their last few positions, so that we know where they are headed and how fast. Search uses
+//it to guess where everyone is by now, not at their last heartbeat, and to put the drivers coming towards a
+//rider ahead of the ones driving away.
+const TRACK_POINTS = 6          //Positions kept per user
+const TRACK_WINDOW_MS = 120000  //Only the positions this recent tell the motion
+const TRACK_MIN_MOVE = 15       //Metres. Less than this is GPS noise, not moving
+const TRACK_MAX_SPEED = 45      //Metres a second. Faster is a GPS jump, not driving
+const PROJECT_MAX_SECS = 60     //Never guess further ahead than this
+const RECEDING_PENALTY = 300    //Metres added, when ranking, for a driver heading away from the rider
+const APPROACH_MAX_ANGLE = 60.0 //Degrees off the bearing to the rider that still counts as coming towards them
+
+type trackPoint struct {
+	lat  float64
+	lng  float64
+	time int64 //Unix ms
+}
+
+//Only for locations the app sent. An event without one is no sign of standing still. Callers hold gStateLock.
+func recordPosition(s *CommState, lat float64, lng float64) {
+	s.track = append(s.track, trackPoint{lat, lng, clockNow().UnixNano() / 1e6})
+	if len(s.track) > TRACK_POINTS {
+		s.track = s.track[len(s.track)-TRACK_POINTS:]
+	}
+}
+
+//motion works out the heading, in degrees from north, and speed, in metres a second, from the oldest
+//position within the window to the latest. Not moving if they have not gone far enough.
+//Callers hold gStateLock.
+func motion(s *CommState) (heading float64, speed float64, moving bool) {
+	n := len(s.track)
+	if n < 2 {
+		return 0, 0, false
+	}
+	last := s.track[n-1]
+	first := last
+	for i := n - 2; i >= 0 && last.time-s.track[i].time <= TRACK_WINDOW_MS; i-- {
+		first = s.track[i]
+	}
+	secs := float64(last.time-first.time) / 1000
+	if secs <= 0 {
+		return 0, 0, false
+	}
+	from, to := Point{Lat: first.lat, Lon: first.lng}, Point{Lat: last.lat, Lon: last.lng}
+	dist := DistanceBetwnPts(from, to)
+	if dist < TRACK_MIN_MOVE || dist/secs > TRACK_MAX_SPEED {
+		return 0, 0, false
+	}
+	return bearing(from, to), dist / secs, true
+}
+
+//bearing is the initial heading from one point to the other, in degrees from north, 0 to 360.
+func bearing(from Point, to Point) float64 {
+	a, b := from.toRadians(), to.toRadians()
+	y := math.Sin(b.Lon-a.Lon) * math.Cos(b.Lat)
+	x := math.Cos(a.Lat)*math.Sin(b.Lat) - math.Sin(a.Lat)*math.Cos(b.Lat)*math.Cos(b.Lon-a.Lon)
+	return math.Mod(math.Atan2(y, x)*180/math.Pi+360, 360)
+}
+
+//movePoint is where going dist metres from p at the heading ends up.
+func movePoint(p Point, heading float64, dist float64) Point {
+	r := p.toRadians()
+	h := heading * math.Pi / 180
+	d := dist / earthRadiusMetres
+	lat := math.Asin(math.Sin(r.Lat)*math.Cos(d) + math.Cos(r.Lat)*math.Sin(d)*math.Cos(h))
+	lng := r.Lon + math.Atan2(math.Sin(h)*math.Sin(d)*math.Cos(r.Lat), math.Cos(d)-math.Sin(r.Lat)*math.Sin(lat))
+	return Point{Lat: lat * 180 / math.Pi, Lon: lng * 180 / math.Pi}
+}
+
+//projectedPosition is where the user probably is now, going on as they were since their last update.
+//Callers hold gStateLock.
+func projectedPosition(s *CommState, nowMs int64) Point {
+	p := Point{Lat: s.lat, Lon: s.lng}
+	heading, speed, moving := motion(s)
+	if !moving {
+		return p
+	}
+	secs := float64(nowMs-s.track[len(s.track)-1].time) / 1000
+	if secs <= 0 {
+		return p
+	}
+	if secs > PROJECT_MAX_SECS {
+		secs = PROJECT_MAX_SECS
+	}
+	return movePoint(p, heading, speed*secs)
+}
+
+//headingOff is how many degrees the driver's heading is off the way to the point, 0 to 180. Not moving has
+//no heading. Callers hold gStateLock.
+func headingOff(driverState *CommState, to Point) (float64, bool) {
+	heading, _, moving := motion(driverState)
+	if !moving {
+		return 0, false
+	}
+	off := math.Abs(heading - bearing(Point{Lat: driverState.lat, Lon: driverState.lng}, to))
+	if off > 180 {
+		off = 360 - off
+	}
+	return off, true
+}
+
+//isApproaching says if the driver is moving and headed for the point. Callers hold gStateLock.
+func isApproaching(driverState *CommState, to Point) bool {
+	off, moving := headingOff(driverState, to)
+	return moving && off <= APPROACH_MAX_ANGLE
+}
+
+//isReceding says if the driver is moving and not headed for the point. Standing still is neither.
+//Callers hold gStateLock.
+func isReceding(driverState *CommState, to Point) bool {
+	off, moving := headingOff(driverState, to)
+	return moving && off > APPROACH_MAX_ANGLE
+}
+
+//motionWeight is how far the driver counts as, for ranking: the projected distance, plus RECEDING_PENALTY
+//when heading away from the rider. Callers hold gStateLock.
+func motionWeight(driverState *CommState, dist float64, riderPos Point) float64 {
+	if isReceding(driverState, riderPos) {
+		return dist + RECEDING_PENALTY
+	}
+	return dist
+}
+
+//rankByWeight puts the lightest first. Nearest first among equals.
+func rankByWeight(arr []matchUserDetails) []matchUserDetails {
+	sort.SliceStable(arr, func(i, j int) bool {
+		if arr[i].weight != arr[j].weight {
+			return arr[i].weight < arr[j].weight
+		}
+		return arr[i].dist < arr[j].dist
+	})
+	return arr
+}
@@ -0,0 +1,160 @@
+package commute
+
+import (
+	"math"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestBearing(t *testing.T) {
+	from := Point{Lat: 12.884800, Lon: 77.551600}
+	cases := []struct {
+		heading float64
+		dist    float64
+	}{
+		{0, 100},
+		{90, 250},
+		{180, 1000},
+		{270, 30},
+		{45, 500},
+	}
+	for idx, c := range cases {
+		to := movePoint(from, c.heading, c.dist)
+		if d := DistanceBetwnPts(from, to); math.Abs(d-c.dist) > 0.5 {
+			t.Errorf("test case #%d: moved %f, expected %f", idx, d, c.dist)
+		}
+		if b := bearing(from, to); math.Abs(b-c.heading) > 0.5 {
+			t.Errorf("test case #%d: bearing %f, expected %f", idx, b, c.heading)
+		}
+	}
+}
+
+func TestMotion(t *testing.T) {
+	Initialize()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+	start := Point{Lat: 12.884800, Lon: 77.551600}
+
+	cases := []struct {
+		steps    []float64 //Metres north of start, one every 10 secs
+		moving   bool
+		speed    float64
+		expected float64 //Metres from start, projected 20 secs after the last
+	}{
+		{[]float64{0}, false, 0, 0},
+		{[]float64{0, 5, 2}, false, 0, 2},                 //GPS noise
+		{[]float64{0, 50, 100}, true, 5, 200},             //5 m/s north
+		{[]float64{100, 50, 0}, true, 5, 100},             //South
+		{[]float64{0, 2000}, false, 0, 2000},              //GPS jump
+		{[]float64{0, 50, 100, 100, 100}, true, 2.5, 150}, //Slowing down, over the whole window
+	}
+	for idx, c := range cases {
+		s := &CommState{}
+		for _, north := range c.steps {
+			p := movePoint(start, 0, north)
+			s.lat, s.lng = p.Lat, p.Lon
+			recordPosition(s, s.lat, s.lng)
+			clock.Advance(10 * time.Second)
+		}
+		clock.Advance(10 * time.Second)
+		heading, speed, moving := motion(s)
+		if moving != c.moving || math.Abs(speed-c.speed) > 0.1 {
+			t.Errorf("test case #%d: got %f %f %v", idx, heading, speed, moving)
+		}
+		got := DistanceBetwnPts(start, projectedPosition(s, clock.Now().UnixNano()/1e6))
+		if math.Abs(got-c.expected) > 1 {
+			t.Errorf("test case #%d: projected %f, expected %f", idx, got, c.expected)
+		}
+	}
+
+	//Positions older than the window do not count, and the guess never goes too far ahead
+	s := &CommState{}
+	recordPosition(s, start.Lat, start.Lon)
+	clock.Advance(10 * time.Minute)
+	p := movePoint(start, 90, 100)
+	s.lat, s.lng = p.Lat, p.Lon
+	recordPosition(s, s.lat, s.lng)
+	if _, _, moving := motion(s); moving {
+		t.Errorf("moving from a position 10 mins old")
+	}
+	clock.Advance(10 * time.Second)
+	p = movePoint(start, 90, 200)
+	s.lat, s.lng = p.Lat, p.Lon
+	recordPosition(s, s.lat, s.lng)
+	clock.Advance(10 * time.Minute)
+	if got := DistanceBetwnPts(start, projectedPosition(s, clock.Now().UnixNano()/1e6)); math.Abs(got-(200+10*PROJECT_MAX_SECS)) > 1 {
+		t.Errorf("projected too far:%f", got)
+	}
+}
+
+//Only the locations the app sends are kept. Events without one say nothing about where the user is.
+func TestTrackNoParam(t *testing.T) {
+	Initialize()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+	start := Point{Lat: 12.884800, Lon: 77.551600}
+	token := newUser("driver1", start.Lat, start.Lon, DRIVER_STATE)
+	for _, north := range []float64{50, 100} {
+		clock.Advance(10 * time.Second)
+		p := movePoint(start, 0, north)
+		updateState("driver1", p.Lat, p.Lon, token, DRIVER_STATE, "", EVENT_HEARTBEAT)
+	}
+	for _, event := range []string{"blocklist", "sessions", ""} {
+		clock.Advance(10 * time.Second)
+		q, _ := url.ParseQuery("user=driver1&mode=1&eventtype=" + event + "&token=" + token)
+		if _, err := processQuery(q, "okhttp"); err != nil {
+			t.Errorf("%s failed:%s", event, err.Error())
+		}
+	}
+	gStateLock.RLock()
+	defer gStateLock.RUnlock()
+	s := gStateDS["driver1"]
+	if _, speed, moving := motion(s); len(s.track) != 3 || !moving || math.Abs(speed-5) > 0.1 {
+		t.Errorf("wrong track:%+v", s.track)
+	}
+}
+
+func TestApproachingDrivers(t *testing.T) {
+	Initialize()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+	rider := Point{Lat: 12.884800, Lon: 77.551600}
+	at := func(heading float64, dist float64) Point { return movePoint(rider, heading, dist) }
+
+	//driver1 is nearer but driving away, driver2 is coming, driver3 is parked
+	p1, p2, p3 := at(0, 200), at(180, 320), at(90, 280)
+	newUser("rider1", rider.Lat, rider.Lon, RIDER_STATE)
+	token1 := newUser("driver1", p1.Lat, p1.Lon, DRIVER_STATE)
+	token2 := newUser("driver2", p2.Lat, p2.Lon, DRIVER_STATE)
+	token3 := newUser("driver3", p3.Lat, p3.Lon, DRIVER_STATE)
+	clock.Advance(10 * time.Second)
+	p1, p2 = at(0, 250), at(180, 270)
+	updateState("driver1", p1.Lat, p1.Lon, token1, DRIVER_STATE, "", EVENT_HEARTBEAT)
+	updateState("driver2", p2.Lat, p2.Lon, token2, DRIVER_STATE, "", EVENT_HEARTBEAT)
+	updateState("driver3", p3.Lat, p3.Lon, token3, DRIVER_STATE, "", EVENT_HEARTBEAT)
+
+	gStateLock.RLock()
+	if !isApproaching(gStateDS["driver2"], rider) || !isReceding(gStateDS["driver1"], rider) ||
+		isApproaching(gStateDS["driver3"], rider) || isReceding(gStateDS["driver3"], rider) {
+		t.Errorf("wrong headings")
+	}
+	gStateLock.RUnlock()
+
+	clock.Advance(10 * time.Second)
+	matches, _ := searchMatches("rider1", RIDER_STATE)
+	if got := matchNames(matches); got != "driver2,driver3,driver1" {
+		t.Errorf("got %s, expected driver2,driver3,driver1", got)
+	}
+	//Where they are by now
+	if len(matches) == 3 && (math.Abs(matches[0].dist-220) > 1 || math.Abs(matches[2].dist-300) > 1) {
+		t.Errorf("not projected:%+v", matches)
+	}
+
+	//Too far by now
+	clock.Advance(50 * time.Second)
+	matches, _ = searchMatches("rider1", RIDER_STATE)
+	if got := matchNames(matches); got != "driver2,driver3" {
+		t.Errorf("got %s, expected driver2,driver3", got)
+	}
+}
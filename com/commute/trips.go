@@ -0,0 +1,276 @@
+package commute
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//Lifecycle of a trip
+const TRIP_ACTIVE = 1
+const TRIP_COMPLETED = 2
+
+const TRIP_PAGE_SIZE = 20      //Default number of trips returned per page of history
+const TRIP_MAX_PAGE_SIZE = 100 //Callers cannot ask for more than this in one go
+
+//Store buckets used by trips.
+const bucketTrips = "trips"         //tripId -> Trip
+const bucketUserTrips = "usertrips" //user/starttime/tripId -> tripId. Index for history lookups.
+
+//Trip is the record of a single ride between a rider and a driver. Created when the driver accepts
+//and completed when either of them ends it.
+type Trip struct {
+	TripId         string      `json:"tripid"`
+	Rider          string      `json:"rider"`
+	Driver         string      `json:"driver"`
+	State          int         `json:"state"`
+	PickupLat      float64     `json:"pickuplat"`
+	PickupLng      float64     `json:"pickuplng"`
+	StartTime      int64       `json:"starttime"`
+	DropLat        float64     `json:"droplat"`
+	DropLng        float64     `json:"droplng"`
+	EndTime        int64       `json:"endtime"`
+	DistanceMetres float64     `json:"distance"`
+	Fare           *Settlement `json:"fare,omitempty"` //Filled in when the trip completes
+	SOS            []string    `json:"sos,omitempty"`  //Alerts raised on this trip. See safety.go
+}
+
+//Active trips by rider/driver pair. The trip records themselves live in the store.
+var gActiveTrips map[string]string
+var gActiveTripsLock = sync.RWMutex{}
+
+func resetTrips() {
+	gActiveTripsLock.Lock()
+	defer gActiveTripsLock.Unlock()
+	gActiveTrips = make(map[string]string, 1000)
+}
+
+func tripPairKey(rider string, driver string) string {
+	return rider + "|" + driver
+}
+
+//Keys are zero padded so that the store's key ordering is the time ordering.
+func userTripKey(userName string, startTime int64, tripId string) string {
+	return fmt.Sprintf("%s/%020d/%s", userName, startTime, tripId)
+}
+
+//Numbered from the store, so a restart does not hand out an id again. A fresh store, as on replay, starts over.
+func newTripId() (string, error) {
+	seq, err := nextSequence("trip")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("T%d-%d", clockNow().Unix(), seq), nil
+}
+
+func saveTrip(trip *Trip) error {
+	return storePutJSON(bucketTrips, trip.TripId, trip)
+}
+
+func getTrip(tripId string) (*Trip, error) {
+	trip := &Trip{}
+	if err := storeGetJSON(bucketTrips, tripId, trip); err != nil {
+		return nil, err
+	}
+	return trip, nil
+}
+
+//startTrip creates a trip record when a driver accepts a rider. The pickup is where the driver is right now.
+func startTrip(rider string, driver string, lat float64, lng float64) (*Trip, error) {
+	tripId, err := newTripId()
+	if err != nil {
+		return nil, err
+	}
+	trip := &Trip{
+		TripId:    tripId,
+		Rider:     rider,
+		Driver:    driver,
+		State:     TRIP_ACTIVE,
+		PickupLat: lat,
+		PickupLng: lng,
+		StartTime: clockNow().Unix(),
+	}
+	if err = saveTrip(trip); err != nil {
+		return nil, err
+	}
+	//Index for both of them
+	for _, u := range []string{rider, driver} {
+		if err = getStore().Put(bucketUserTrips, userTripKey(u, trip.StartTime, trip.TripId), []byte(trip.TripId)); err != nil {
+			return nil, err
+		}
+	}
+
+	gActiveTripsLock.Lock()
+	defer gActiveTripsLock.Unlock()
+	gActiveTrips[tripPairKey(rider, driver)] = trip.TripId
+	return trip, nil
+}
+
+//Returns the active trip between the two, if any.
+func getActiveTrip(rider string, driver string) (*Trip, error) {
+	gActiveTripsLock.RLock()
+	tripId, ok := gActiveTrips[tripPairKey(rider, driver)]
+	gActiveTripsLock.RUnlock()
+
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("No active trip between %s and %s", rider, driver))
+	}
+	return getTrip(tripId)
+}
+
+//completeTrip marks the trip as done at the given drop-off point and settles the fare. riders is how many
+//are sharing the driver's vehicle, this one included.
+func completeTrip(rider string, driver string, lat float64, lng float64, vehicleType int, riders int) (*Trip, error) {
+	trip, err := getActiveTrip(rider, driver)
+	if err != nil {
+		return nil, err
+	}
+	trip.State = TRIP_COMPLETED
+	trip.DropLat = lat
+	trip.DropLng = lng
+	trip.EndTime = clockNow().Unix()
+	trip.DistanceMetres = DistanceBetwnPts(Point{Lat: trip.PickupLat, Lon: trip.PickupLng}, Point{Lat: lat, Lon: lng})
+	trip.Fare = newSettlement(tenantOf(driver), trip.DistanceMetres, vehicleType, riders)
+	if err = saveTrip(trip); err != nil {
+		return nil, err
+	}
+	//The trip is done either way. Only the map is lost.
+	if err = persistTrail(trip.TripId); err != nil {
+		fmt.Println("ERROR in completeTrip: could not save trail for trip:", trip.TripId, " err:", err)
+	}
+
+	gActiveTripsLock.Lock()
+	defer gActiveTripsLock.Unlock()
+	delete(gActiveTrips, tripPairKey(rider, driver))
+	return trip, nil
+}
+
+//getTripHistory returns the user's trips which started within [from, to], newest first, along with the total
+//count before paging. to = 0 means no upper limit.
+func getTripHistory(userName string, from int64, to int64, page int, pageSize int) ([]Trip, int, error) {
+	if page < 0 || pageSize <= 0 {
+		return nil, 0, errors.New(fmt.Sprintf("Invalid page:%d pagesize:%d", page, pageSize))
+	}
+	if pageSize > TRIP_MAX_PAGE_SIZE {
+		pageSize = TRIP_MAX_PAGE_SIZE
+	}
+
+	tripIds, err := getStore().List(bucketUserTrips, userName+"/")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	trips := make([]Trip, 0)
+	for _, id := range tripIds {
+		trip, err := getTrip(string(id))
+		if err != nil {
+			return nil, 0, err
+		}
+		//Someone else whose name starts with ours and a slash
+		if trip.Rider != userName && trip.Driver != userName {
+			continue
+		}
+		if trip.StartTime < from || (to > 0 && trip.StartTime > to) {
+			continue
+		}
+		trips = append(trips, *trip)
+	}
+	sort.SliceStable(trips, func(i, j int) bool { return trips[i].StartTime > trips[j].StartTime })
+
+	total := len(trips)
+	start := page * pageSize
+	if start >= total {
+		return make([]Trip, 0), total, nil
+	}
+	end := start + pageSize
+	if end > total {
+		end = total
+	}
+	return trips[start:end], total, nil
+}
+
+//Accepts either unix seconds or a yyyy-mm-dd date. Empty is 0.
+func parseTimeParam(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return secs, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("ERROR in time parameter:%s", s))
+	}
+	return t.Unix(), nil
+}
+
+//Integer query param with a default for when it is missing.
+func parseIntParam(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	return strconv.Atoi(s)
+}
+
+//processTripHistoryRequest parses the params given in the URL and returns the json to be sent back.
+func processTripHistoryRequest(userName string, token string, fromStr string, toStr string,
+	pageStr string, pageSizeStr string) (string, error) {
+	if _, err := isUserValid(userName, token); err != nil {
+		return "", err
+	}
+	from, err := parseTimeParam(fromStr)
+	if err != nil {
+		return "", err
+	}
+	to, err := parseTimeParam(toStr)
+	if err != nil {
+		return "", err
+	}
+	//A plain date as the upper limit should include the whole day.
+	if _, perr := strconv.ParseInt(toStr, 10, 64); perr != nil && toStr != "" {
+		to += 24*60*60 - 1
+	}
+	page, err := parseIntParam(pageStr, 0)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("ERROR in page parameter:%s", pageStr))
+	}
+	pageSize, err := parseIntParam(pageSizeStr, TRIP_PAGE_SIZE)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("ERROR in pagesize parameter:%s", pageSizeStr))
+	}
+
+	trips, total, err := getTripHistory(userName, from, to, page, pageSize)
+	if err != nil {
+		return "", err
+	}
+	out, err := json.Marshal(struct {
+		Trips []Trip `json:"trips"`
+		Page  int    `json:"page"`
+		Total int    `json:"total"`
+	}{trips, page, total})
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+//Function TripHistoryHandler returns the trips of the logged in user. Params are user, token,
+//from/to (unix secs or yyyy-mm-dd), page and pagesize.
+func TripHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	user := q.Get("user")
+	retValue, err := processTripHistoryRequest(user, q.Get("token"), q.Get("from"), q.Get("to"),
+		q.Get("page"), q.Get("pagesize"))
+	if err != nil {
+		fmt.Fprint(w, "ERROR! :", err)
+	} else {
+		fmt.Fprint(w, retValue)
+	}
+
+	fmt.Println(clockNow(), "\t", user, "\t", r.RemoteAddr, "\t", r.URL.RawQuery, "\t", err)
+}
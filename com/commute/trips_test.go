@@ -0,0 +1,138 @@
+package commute
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTripLifecycle(t *testing.T) {
+	Initialize()
+	SetStore(NewMemStore())
+
+	tokenDriver, _ := updateState("driver1", 12.884733, 77.551541, "", DRIVER_STATE, "", EVENT_LOGIN)
+	tokenRider, _ := updateState("rider1", 12.884800, 77.551600, "", RIDER_STATE, "", EVENT_LOGIN)
+	updateState("rider1", 12.884800, 77.551600, tokenRider, RIDER_STATE, "driver1", EVENT_JOINREQ)
+
+	//Ending before a join is an error
+	_, err := updateState("rider1", 12.884800, 77.551600, tokenRider, RIDER_STATE, "driver1", EVENT_TRIPEND)
+	if err == nil {
+		t.Errorf("trip ended without being started")
+	}
+
+	_, err = updateState("driver1", 12.884733, 77.551541, tokenDriver, DRIVER_STATE, "rider1", EVENT_JOINACCEPT)
+	if err != nil {
+		t.Fatalf("join accept failed:%s", err.Error())
+	}
+	trip, err := getActiveTrip("rider1", "driver1")
+	if err != nil || trip.State != TRIP_ACTIVE || trip.PickupLat != 12.884733 || trip.PickupLng != 77.551541 {
+		t.Errorf("active trip not recorded correctly. trip:%v err:%v", trip, err)
+	}
+
+	//Accepting again while on the trip should not create another one
+	_, err = updateState("driver1", 12.884733, 77.551541, tokenDriver, DRIVER_STATE, "rider1", EVENT_JOINACCEPT)
+	if err == nil {
+		t.Errorf("second join accept during a trip did not fail")
+	}
+
+	//Driver drops the rider ~4.4km away
+	retStr, err := updateState("driver1", 12.918230, 77.573472, tokenDriver, DRIVER_STATE, "rider1", EVENT_TRIPEND)
+	if err != nil || !strings.Contains(retStr, "Success") {
+		t.Fatalf("trip end failed. ret:%s err:%v", retStr, err)
+	}
+	done, _ := getTrip(trip.TripId)
+	if done.State != TRIP_COMPLETED || done.DropLat != 12.918230 || done.EndTime < done.StartTime ||
+		done.DistanceMetres < 4400 || done.DistanceMetres > 4440 {
+		t.Errorf("completed trip not recorded correctly. trip:%v", done)
+	}
+	if len(getCurrentState("driver1").arrConnectedWith) != 0 || len(getCurrentState("rider1").arrConnectedWith) != 0 {
+		t.Errorf("users still connected after the trip ended")
+	}
+	if _, err = getActiveTrip("rider1", "driver1"); err == nil {
+		t.Errorf("trip still active after it ended")
+	}
+
+	//Both of them see it in their history
+	for _, u := range []string{"rider1", "driver1"} {
+		trips, total, _ := getTripHistory(u, 0, 0, 0, 10)
+		if total != 1 || trips[0].TripId != trip.TripId {
+			t.Errorf("history of %s is wrong. total:%d trips:%v", u, total, trips)
+		}
+	}
+}
+
+func TestTripHistoryPaging(t *testing.T) {
+	Initialize()
+	SetStore(NewMemStore())
+
+	//Put in trips a day apart directly, newest last.
+	base := time.Date(2018, 3, 1, 9, 0, 0, 0, time.UTC).Unix()
+	for i := 0; i < 25; i++ {
+		trip := &Trip{TripId: fmt.Sprintf("T%d", i), Rider: "rider1", Driver: "driver1", State: TRIP_COMPLETED,
+			StartTime: base + int64(i)*24*60*60}
+		saveTrip(trip)
+		getStore().Put(bucketUserTrips, userTripKey("rider1", trip.StartTime, trip.TripId), []byte(trip.TripId))
+	}
+	//Someone whose name starts with rider1 and a slash. Not one of ours.
+	saveTrip(&Trip{TripId: "T99", Rider: "rider1/x", Driver: "driver1", State: TRIP_COMPLETED, StartTime: base})
+	getStore().Put(bucketUserTrips, userTripKey("rider1/x", base, "T99"), []byte("T99"))
+
+	cases := []struct {
+		from, to       int64
+		page, pageSize int
+		total, count   int
+		first          string
+	}{
+		{0, 0, 0, 10, 25, 10, "T24"},
+		{0, 0, 2, 10, 25, 5, "T4"},
+		{0, 0, 3, 10, 25, 0, ""},
+		{base + 10*24*60*60, base + 14*24*60*60, 0, 10, 5, 5, "T14"},
+		{0, 0, 0, 1000, 25, 25, "T24"}, //pagesize gets capped, but there are only 25
+	}
+	for idx, c := range cases {
+		trips, total, err := getTripHistory("rider1", c.from, c.to, c.page, c.pageSize)
+		if err != nil || total != c.total || len(trips) != c.count {
+			t.Errorf("test case #%d: total:%d count:%d err:%v", idx, total, len(trips), err)
+			continue
+		}
+		if c.first != "" && trips[0].TripId != c.first {
+			t.Errorf("test case #%d: first trip %s want %s", idx, trips[0].TripId, c.first)
+		}
+	}
+	if _, _, err := getTripHistory("rider1", 0, 0, -1, 10); err == nil {
+		t.Errorf("negative page did not fail")
+	}
+
+	//Through the request parser, with dates and auth.
+	token := newToken("rider1", RIDER_STATE)
+	if _, err := processTripHistoryRequest("rider1", "wrongtoken", "", "", "", ""); err == nil {
+		t.Errorf("history returned with a wrong token")
+	}
+	out, err := processTripHistoryRequest("rider1", token, "2018-03-05", "2018-03-06", "0", "")
+	var resp struct {
+		Trips []Trip
+		Total int
+	}
+	json.Unmarshal([]byte(out), &resp)
+	if err != nil || resp.Total != 2 || resp.Trips[0].TripId != "T5" {
+		t.Errorf("date filtered history is wrong. out:%s err:%v", out, err)
+	}
+	if _, err = processTripHistoryRequest("rider1", token, "yesterday", "", "", ""); err == nil {
+		t.Errorf("bad from param did not fail")
+	}
+}
+
+//A restart keeps the store, and must not hand out a trip id that is in it already.
+func TestTripIdAfterRestart(t *testing.T) {
+	Initialize()
+	clock := NewFakeClock(time.Date(2026, 10, 19, 8, 0, 0, 0, time.UTC))
+	defer SetClock(SetClock(clock))
+	first, _ := startTrip("rider1", "driver1", 12.884800, 77.551600)
+	resetTrips()
+	second, err := startTrip("rider2", "driver2", 12.884800, 77.551600)
+	if err != nil || second.TripId == first.TripId {
+		t.Errorf("trip id handed out again:%s err:%v", first.TripId, err)
+	}
+}